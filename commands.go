@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+
+	"github.com/johnmarkli/dime/pkg/server"
+	"github.com/johnmarkli/dime/pkg/store"
+)
+
+// command is a subcommand of dime
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"backup": {
+		usage: "snapshot a data directory in to a backup directory, or verify a snapshot against its manifest",
+		run:   backup,
+	},
+	"fsck": {
+		usage: "check the files of a data directory for interrupted writes and corruption",
+		run:   fsck,
+	},
+	"migrate": {
+		usage: "move the files of a data directory in the flat layout in to the sharded layout",
+		run:   migrate,
+	},
+	"restore": {
+		usage: "restore a snapshot from a backup directory in to an empty data directory",
+		run:   restore,
+	},
+	"rewrap": {
+		usage: "wrap the data keys of encrypted DICOMs with the primary key after a key rotation",
+		run:   rewrap,
+	},
+}
+
+// runCommand runs a subcommand with its arguments, returning the exit code
+func runCommand(name string, args []string) int {
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\nCommands:\n", name)
+		names := []string{}
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %s\n    \t%s\n", name, commands[name].usage)
+		}
+		return 2
+	}
+	err := cmd.run(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		slog.Error(err.Error())
+		return 1
+	}
+	return 0
+}
+
+// migrate moves a data directory in the flat layout in to the sharded layout
+func migrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dir := flags.String("data-dir", server.DataDir(), "data directory to migrate")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	moved, err := store.Migrate(*dir)
+	slog.Info("Migrated data directory", slog.String("dir", *dir), slog.Int("moved", moved))
+	return err
+}
+
+// fsck checks a data directory, exiting with an error if problems remain
+func fsck(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	dir := flags.String("data-dir", server.DataDir(), "data directory to check")
+	repair := flags.Bool("repair", false, "remove temp files, render missing images and quarantine corrupt files")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	report, err := store.Fsck(*dir, *repair)
+	if err != nil {
+		return err
+	}
+	for _, p := range report.Problems {
+		attrs := []any{slog.String("path", p.Path), slog.String("kind", p.Kind)}
+		if p.Error != "" {
+			attrs = append(attrs, slog.String("error", p.Error))
+		}
+		if p.Action != "" {
+			attrs = append(attrs, slog.String("action", p.Action))
+		}
+		slog.Warn("Found problem", attrs...)
+	}
+	slog.Info("Checked data directory", slog.String("dir", *dir),
+		slog.Int("checked", report.Checked), slog.Int("problems", len(report.Problems)))
+	if n := report.Unrepaired(); n > 0 {
+		return fmt.Errorf("%d problems were not repaired", n)
+	}
+	return nil
+}
+
+// rewrap wraps the data keys of encrypted DICOMs with the primary key
+func rewrap(args []string) error {
+	flags := flag.NewFlagSet("rewrap", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	st, err := server.OpenStore()
+	if err != nil {
+		return err
+	}
+	es, ok := st.(*store.EncryptedStore)
+	if !ok {
+		return errors.New("DIME_ENCRYPTION_KEY_FILE is not set")
+	}
+	rewrapped, err := es.Rewrap()
+	slog.Info("Rewrapped data keys", slog.Int("rewrapped", rewrapped))
+	return err
+}
+
+// backup snapshots a data directory, or verifies a snapshot with -verify,
+// exiting with an error if the snapshot has problems
+func backup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	dir := flags.String("data-dir", server.DataDir(), "data directory to back up")
+	dest := flags.String("to", os.Getenv("DIME_BACKUP_DIR"), "backup directory")
+	verify := flags.Bool("verify", false, "verify a snapshot against its manifest instead of backing up")
+	snapshot := flags.String("snapshot", "", "snapshot to verify, defaults to the latest")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *dest == "" {
+		return errors.New("backup directory is not set")
+	}
+
+	if !*verify {
+		m, err := store.Backup(*dir, *dest)
+		if err != nil {
+			return err
+		}
+		slog.Info("Backed up data directory", slog.String("dir", *dir), slog.String("snapshot", m.ID),
+			slog.Int("count", m.Count), slog.Int64("size", m.Size),
+			slog.Int("copied", m.Copied), slog.Int64("copiedSize", m.CopiedSize))
+		return nil
+	}
+	report, err := store.VerifyBackup(*dest, *snapshot)
+	if err != nil {
+		return err
+	}
+	for _, p := range report.Problems {
+		attrs := []any{slog.String("path", p.Path), slog.String("kind", p.Kind)}
+		if p.Error != "" {
+			attrs = append(attrs, slog.String("error", p.Error))
+		}
+		slog.Warn("Found problem", attrs...)
+	}
+	slog.Info("Verified snapshot", slog.String("snapshot", report.Snapshot),
+		slog.Int("checked", report.Checked), slog.Int("problems", len(report.Problems)))
+	if n := len(report.Problems); n > 0 {
+		return fmt.Errorf("%d files of the snapshot are missing or corrupt", n)
+	}
+	return nil
+}
+
+// restore restores a snapshot in to an empty data directory
+func restore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	dir := flags.String("data-dir", server.DataDir(), "empty data directory to restore in to")
+	dest := flags.String("from", os.Getenv("DIME_BACKUP_DIR"), "backup directory")
+	snapshot := flags.String("snapshot", "", "snapshot to restore, defaults to the latest")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *dest == "" {
+		return errors.New("backup directory is not set")
+	}
+
+	m, err := store.Restore(*dest, *snapshot, *dir)
+	if err != nil {
+		return err
+	}
+	slog.Info("Restored data directory", slog.String("dir", *dir), slog.String("snapshot", m.ID),
+		slog.Int("count", m.Count), slog.Int64("size", m.Size))
+	return nil
+}
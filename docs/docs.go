@@ -19,24 +19,21 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
-        "/dicoms": {
+        "/admin/backup": {
             "get": {
-                "description": "List DICOMs on the server",
+                "description": "Report whether a backup of the data directory is running, the latest snapshot in the backup directory and the error of the last backup if it failed",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "dicoms"
+                    "admin"
                 ],
-                "summary": "List DICOMs",
+                "summary": "Report backup",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/store.DICOM"
-                            }
+                            "$ref": "#/definitions/store.BackupStatus"
                         }
                     },
                     "500": {
@@ -48,22 +45,54 @@ const docTemplate = `{
                 }
             },
             "post": {
-                "description": "Uploads a DICOM image to the server",
-                "consumes": [
-                    "multipart/form-data"
+                "description": "Start an incremental snapshot of the data directory in to the backup directory in the background without blocking ingest",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "admin"
                 ],
+                "summary": "Start backup",
+                "responses": {
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "$ref": "#/definitions/store.BackupStatus"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/compression": {
+            "get": {
+                "description": "Report the progress of compressing the DICOMs stored uncompressed in each compressed file store, such as those stored before compression was enabled, and the bytes saved",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "dicoms"
+                    "admin"
                 ],
-                "summary": "Upload a DICOM image",
+                "summary": "Report recompression",
                 "responses": {
-                    "201": {
-                        "description": "Created",
+                    "200": {
+                        "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/store.DICOM"
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/store.RecompressStatus"
+                            }
                         }
                     },
                     "500": {
@@ -75,37 +104,100 @@ const docTemplate = `{
                 }
             }
         },
-        "/dicoms/{id}": {
+        "/admin/replication": {
             "get": {
-                "description": "Read a DICOM image from the server by SOP Instance UID",
+                "description": "Report the sequence number of the last change of the primary applied, the number of changes not yet applied, and the error of the last pull if it failed",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "dicoms"
+                    "admin"
                 ],
-                "summary": "Read a DICOM image",
-                "parameters": [
-                    {
-                        "type": "string",
-                        "description": "DICOM SOP Instance UID",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
+                "summary": "Report replication",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/replica.Status"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/scrub": {
+            "get": {
+                "description": "Report the progress of the background scrubber and DICOMs whose checksum doesn't match the checksum recorded when they were stored",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "admin"
+                ],
+                "summary": "Report integrity scrubbing",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/store.ScrubStatus"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
                     }
+                }
+            }
+        },
+        "/admin/tiers": {
+            "get": {
+                "description": "Report the number of DICOMs in the hot and cold tiers, how many were recalled, and the result of the last migration of idle studies to the cold tier",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "admin"
                 ],
+                "summary": "Report storage tiers",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/store.DICOM"
+                            "$ref": "#/definitions/store.TierStatus"
                         }
                     },
-                    "404": {
-                        "description": "Not Found",
+                    "500": {
+                        "description": "Internal Server Error",
                         "schema": {
                             "type": "string"
                         }
+                    }
+                }
+            }
+        },
+        "/admin/usage": {
+            "get": {
+                "description": "Report the storage used against the global quota and the quota of each tenant, the space of the disk of the data directory, and the bytes of images evicted to free it",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "admin"
+                ],
+                "summary": "Report storage usage",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/quota.Report"
+                        }
                     },
                     "500": {
                         "description": "Internal Server Error",
@@ -116,37 +208,45 @@ const docTemplate = `{
                 }
             }
         },
-        "/dicoms/{id}/attributes": {
+        "/changes": {
             "get": {
-                "description": "Get attributes from a DICOM image by tag",
+                "description": "List the DICOMs created, updated and deleted after a sequence number in the order they changed, along with the sequence number of the last change. With wait, a request with no changes to list waits up to that long, at most 1m, for the next change.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "dicoms"
+                    "changes"
                 ],
-                "summary": "Get attributes from DICOM image",
+                "summary": "List changes",
                 "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Sequence number to list changes after",
+                        "name": "since",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Maximum number of changes, at most 1000",
+                        "name": "limit",
+                        "in": "query"
+                    },
                     {
                         "type": "string",
-                        "description": "DICOM SOP Instance UID",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
+                        "description": "How long to wait for a change, such as 30s",
+                        "name": "wait",
+                        "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/dicom.Element"
-                            }
+                            "$ref": "#/definitions/changes.Page"
                         }
                     },
-                    "404": {
-                        "description": "Not Found",
+                    "400": {
+                        "description": "Bad Request",
                         "schema": {
                             "type": "string"
                         }
@@ -160,28 +260,39 @@ const docTemplate = `{
                 }
             }
         },
-        "/dicoms/{id}/image": {
+        "/changes/stream": {
             "get": {
-                "description": "Get DICOM imange as a PNG",
+                "description": "Stream the DICOMs created, updated and deleted after a sequence number as Server-Sent Events as they change. Each event has the sequence number of the change as its id and the type of change as its event. A reconnecting client resumes after the change in its Last-Event-ID header.",
                 "produces": [
-                    "image/png"
+                    "text/event-stream"
                 ],
                 "tags": [
-                    "dicoms"
+                    "changes"
                 ],
-                "summary": "Get DICOM image as a PNG",
+                "summary": "Stream changes",
                 "parameters": [
                     {
-                        "type": "string",
-                        "description": "DICOM SOP Instance UID",
-                        "name": "id",
-                        "in": "path",
-                        "required": true
+                        "type": "integer",
+                        "description": "Sequence number to stream changes after",
+                        "name": "since",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Sequence number to resume streaming changes after",
+                        "name": "Last-Event-ID",
+                        "in": "header"
                     }
                 ],
                 "responses": {
-                    "404": {
-                        "description": "Not Found",
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/changes.Event"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
                         "schema": {
                             "type": "string"
                         }
@@ -195,46 +306,1801 @@ const docTemplate = `{
                 }
             }
         },
-        "/health": {
+        "/dicoms": {
             "get": {
-                "description": "Check the health of the server",
+                "description": "List DICOMs on the server that the request may read",
                 "produces": [
-                    "text/plain"
+                    "application/json"
                 ],
                 "tags": [
-                    "health"
+                    "dicoms"
                 ],
-                "summary": "Check server health",
+                "summary": "List DICOMs",
                 "responses": {
                     "200": {
-                        "description": "OK"
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/store.DICOM"
+                            }
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/auth.Error"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
                     }
                 }
-            }
-        }
-    },
-    "definitions": {
-        "dicom.Element": {
-            "type": "object",
-            "properties": {
-                "VR": {
-                    "$ref": "#/definitions/tag.VRKind"
-                },
-                "rawVR": {
-                    "type": "string"
-                },
-                "tag": {
-                    "$ref": "#/definitions/tag.Tag"
-                },
-                "value": {},
-                "valueLength": {
-                    "type": "integer"
+            },
+            "post": {
+                "description": "Uploads a DICOM image to the server as multipart/form-data or as an application/dicom body.\nZIP and tar(.gz) archives of DICOMs are ingested file by file and return a report for each file.\nIf the server ingests asynchronously, the upload is queued and the ingest job is returned.\nUploads are stored for the tenant in the X-Dime-Tenant header, and are rejected if they would exceed its quota or fill the disk.",
+                "consumes": [
+                    "multipart/form-data",
+                    "application/dicom",
+                    "application/zip",
+                    "application/x-tar",
+                    "application/gzip"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "dicoms"
+                ],
+                "summary": "Upload a DICOM image",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Tenant that owns the upload",
+                        "name": "X-Dime-Tenant",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/ingest.Result"
+                            }
+                        }
+                    },
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/store.DICOM"
+                        }
+                    },
+                    "202": {
+                        "description": "Accepted",
+                        "schema": {
+                            "$ref": "#/definitions/jobs.Job"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/auth.Error"
+                        }
+                    },
+                    "413": {
+                        "description": "Request Entity Too Large",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "507": {
+                        "description": "Insufficient Storage",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/dicoms/import": {
+            "post": {
+                "description": "Import DICOMs from a directory under the server's import directory.\nIf the directory contains a DICOMDIR, the files referenced by its directory records are imported.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "dicoms"
+                ],
+                "summary": "Import DICOMs from a directory on the server",
+                "parameters": [
+                    {
+                        "description": "Directory to import relative to the import directory",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/server.ImportRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Tenant that owns the imported DICOMs",
+                        "name": "X-Dime-Tenant",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/ingest.Result"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/auth.Error"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/dicoms/{id}": {
+            "get": {
+                "description": "Read a DICOM image from the server by SOP Instance UID",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "dicoms"
+                ],
+                "summary": "Read a DICOM image",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "DICOM SOP Instance UID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "ETag of a cached DICOM",
+                        "name": "If-None-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/store.DICOM"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "SHA-256 checksum of the DICOM"
+                            }
+                        }
+                    },
+                    "304": {
+                        "description": "Not Modified"
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/auth.Error"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/dicoms/{id}/attributes": {
+            "get": {
+                "description": "Get attributes from a DICOM image by tag",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "dicoms"
+                ],
+                "summary": "Get attributes from DICOM image",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "DICOM SOP Instance UID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/dicom.Element"
+                            }
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/auth.Error"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/dicoms/{id}/coercion": {
+            "get": {
+                "description": "Show the changes the coercion rules would make to a DICOM if it was ingested from a source",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "dicoms"
+                ],
+                "summary": "Dry run coercion rules on a DICOM",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "DICOM SOP Instance UID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Source the DICOM is ingested from",
+                        "name": "source",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/coerce.Change"
+                            }
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/auth.Error"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/dicoms/{id}/file": {
+            "get": {
+                "description": "Get a DICOM as a Part 10 file, decompressed and decrypted if it is stored compressed or encrypted",
+                "produces": [
+                    "application/dicom"
+                ],
+                "tags": [
+                    "dicoms"
+                ],
+                "summary": "Get DICOM file",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "DICOM SOP Instance UID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/auth.Error"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/dicoms/{id}/image": {
+            "get": {
+                "description": "Get DICOM imange as a PNG",
+                "produces": [
+                    "image/png"
+                ],
+                "tags": [
+                    "dicoms"
+                ],
+                "summary": "Get DICOM image as a PNG",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "DICOM SOP Instance UID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/auth.Error"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/dicoms/{id}/validation": {
+            "get": {
+                "description": "Validate a DICOM against the IOD of its SOP Class, checking required attributes, VR and VM conformance and UID syntax",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "dicoms"
+                ],
+                "summary": "Validate a DICOM",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "DICOM SOP Instance UID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/validate.Report"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/auth.Error"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/health": {
+            "get": {
+                "description": "Check the health of the server",
+                "produces": [
+                    "text/plain"
+                ],
+                "tags": [
+                    "health"
+                ],
+                "summary": "Check server health",
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    }
+                }
+            }
+        },
+        "/jobs/{id}": {
+            "get": {
+                "description": "Read the progress of an ingest job and the result of each file ingested",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "jobs"
+                ],
+                "summary": "Read an ingest job",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Job ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/jobs.Job"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/retention/report": {
+            "get": {
+                "description": "Dry run the retention rules, reporting the studies that have expired and would be deleted or archived",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "retention"
+                ],
+                "summary": "Report expired studies",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/retention.Report"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/retention/studies/{uid}": {
+            "get": {
+                "description": "Read when a study was ingested, its labels and its legal hold",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "retention"
+                ],
+                "summary": "Read the retention record of a study",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Study Instance UID",
+                        "name": "uid",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/retention.Study"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/retention/studies/{uid}/hold": {
+            "put": {
+                "description": "Place a legal hold on a study that blocks it from being deleted or archived until it is released",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "retention"
+                ],
+                "summary": "Hold a study",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Study Instance UID",
+                        "name": "uid",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Reason for the hold",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/server.HoldRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/retention.Study"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "Release the legal hold on a study",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "retention"
+                ],
+                "summary": "Release a study",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Study Instance UID",
+                        "name": "uid",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/retention.Study"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/retention/studies/{uid}/labels": {
+            "put": {
+                "description": "Replace the labels of a study that retention rules match",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "retention"
+                ],
+                "summary": "Label a study",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Study Instance UID",
+                        "name": "uid",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Labels of the study",
+                        "name": "labels",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "type": "string"
+                            }
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/retention.Study"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/routing/transfers": {
+            "get": {
+                "description": "List the transfers of DICOMs to downstream destinations that are pending or failed",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "routing"
+                ],
+                "summary": "List transfers",
+                "parameters": [
+                    {
+                        "enum": [
+                            "pending",
+                            "failed"
+                        ],
+                        "type": "string",
+                        "description": "Only list transfers in a state",
+                        "name": "state",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/route.Transfer"
+                            }
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/routing/transfers/{id}": {
+            "get": {
+                "description": "Read a pending or failed transfer of a DICOM to a downstream destination",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "routing"
+                ],
+                "summary": "Read a transfer",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Transfer ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/route.Transfer"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/routing/transfers/{id}/retry": {
+            "post": {
+                "description": "Retry a transfer now. A failed transfer is given a fresh set of attempts.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "routing"
+                ],
+                "summary": "Retry a transfer",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Transfer ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/route.Transfer"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/stability/series/{uid}": {
+            "get": {
+                "description": "Read the instances received of a series and whether it is stable",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "stability"
+                ],
+                "summary": "Read series stability",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Series Instance UID",
+                        "name": "uid",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/stability.Series"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/stability/studies": {
+            "get": {
+                "description": "List the studies in the order they last received an instance with whether each is stable, having received no instances for the quiet period or its expected Number of Study Related Instances",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "stability"
+                ],
+                "summary": "List study stability",
+                "parameters": [
+                    {
+                        "type": "boolean",
+                        "description": "Only list studies that are stable or not",
+                        "name": "stable",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/stability.Study"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/stability/studies/{uid}": {
+            "get": {
+                "description": "Read the instances received of a study and whether it is stable",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "stability"
+                ],
+                "summary": "Read study stability",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Study Instance UID",
+                        "name": "uid",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/stability.Study"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/stability/studies/{uid}/series": {
+            "get": {
+                "description": "List the series of a study in the order they last received an instance with whether each is stable, having received no instances for the quiet period or its expected Number of Series Related Instances",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "stability"
+                ],
+                "summary": "List series stability",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Study Instance UID",
+                        "name": "uid",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/stability.Series"
+                            }
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/webhooks/deliveries": {
+            "get": {
+                "description": "List the deliveries of events to webhook subscriptions that are pending, failed or among the last 1000 delivered",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "webhooks"
+                ],
+                "summary": "List deliveries",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Only list deliveries to a subscription",
+                        "name": "subscription",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "pending",
+                            "delivered",
+                            "failed"
+                        ],
+                        "type": "string",
+                        "description": "Only list deliveries in a state",
+                        "name": "state",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "array",
+                            "items": {
+                                "$ref": "#/definitions/webhook.Delivery"
+                            }
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/webhooks/deliveries/{id}": {
+            "get": {
+                "description": "Read a delivery of an event to a webhook subscription",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "webhooks"
+                ],
+                "summary": "Read a delivery",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Delivery ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/webhook.Delivery"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/webhooks/deliveries/{id}/retry": {
+            "post": {
+                "description": "Deliver an event to a webhook subscription again now. A failed or delivered delivery is given a fresh set of attempts.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "webhooks"
+                ],
+                "summary": "Retry a delivery",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Delivery ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/webhook.Delivery"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "auth.Error": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string",
+                    "example": "Unauthorized"
+                },
+                "message": {
+                    "type": "string",
+                    "example": "no credentials"
+                },
+                "status": {
+                    "type": "integer",
+                    "example": 401
+                }
+            }
+        },
+        "changes.Event": {
+            "type": "object",
+            "properties": {
+                "id": {
+                    "type": "string",
+                    "example": "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000436"
+                },
+                "modality": {
+                    "type": "string",
+                    "example": "MR"
+                },
+                "seq": {
+                    "type": "integer",
+                    "example": 42
+                },
+                "seriesInstanceUID": {
+                    "type": "string",
+                    "example": "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000394"
+                },
+                "seriesInstances": {
+                    "type": "integer",
+                    "example": 24
+                },
+                "sha256": {
+                    "type": "string",
+                    "example": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+                },
+                "sopClassUID": {
+                    "type": "string",
+                    "example": "1.2.840.10008.5.1.4.1.1.4"
+                },
+                "studyInstanceUID": {
+                    "type": "string",
+                    "example": "1.2.840.114202.4.833393677.4209323108.691055951.3610221745"
+                },
+                "studyInstances": {
+                    "type": "integer",
+                    "example": 96
+                },
+                "time": {
+                    "type": "string"
+                },
+                "type": {
+                    "type": "string",
+                    "example": "created"
+                }
+            }
+        },
+        "changes.Page": {
+            "type": "object",
+            "properties": {
+                "changes": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/changes.Event"
+                    }
+                },
+                "compacted": {
+                    "type": "integer",
+                    "example": 12
+                },
+                "last": {
+                    "type": "integer",
+                    "example": 42
+                }
+            }
+        },
+        "coerce.Change": {
+            "type": "object",
+            "properties": {
+                "name": {
+                    "type": "string",
+                    "example": "InstitutionName"
+                },
+                "new": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "old": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "op": {
+                    "type": "string",
+                    "example": "set"
+                },
+                "rule": {
+                    "type": "string",
+                    "example": "site-a"
+                },
+                "tag": {
+                    "type": "string",
+                    "example": "(0008,0080)"
+                }
+            }
+        },
+        "dicom.Element": {
+            "type": "object",
+            "properties": {
+                "VR": {
+                    "$ref": "#/definitions/tag.VRKind"
+                },
+                "rawVR": {
+                    "type": "string"
+                },
+                "tag": {
+                    "$ref": "#/definitions/tag.Tag"
+                },
+                "value": {},
+                "valueLength": {
+                    "type": "integer"
+                }
+            }
+        },
+        "ingest.Result": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                },
+                "file": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                }
+            }
+        },
+        "jobs.Job": {
+            "type": "object",
+            "properties": {
+                "created": {
+                    "type": "string"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "failed": {
+                    "type": "integer",
+                    "example": 0
+                },
+                "filename": {
+                    "type": "string",
+                    "example": "IM000001"
+                },
+                "id": {
+                    "type": "string",
+                    "example": "5f0c6b1e3a2d4c8e9b7a6f5e4d3c2b1a"
+                },
+                "kind": {
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/jobs.Kind"
+                        }
+                    ],
+                    "example": "dicom"
+                },
+                "processed": {
+                    "type": "integer",
+                    "example": 1
+                },
+                "results": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/ingest.Result"
+                    }
+                },
+                "source": {
+                    "type": "string",
+                    "example": "10.0.1.5"
+                },
+                "state": {
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/jobs.State"
+                        }
+                    ],
+                    "example": "done"
+                },
+                "tenant": {
+                    "type": "string",
+                    "example": "radiology"
+                },
+                "updated": {
+                    "type": "string"
+                },
+                "user": {
+                    "type": "string",
+                    "example": "modality-gateway"
+                }
+            }
+        },
+        "jobs.Kind": {
+            "type": "string",
+            "enum": [
+                "dicom",
+                "zip",
+                "tar"
+            ],
+            "x-enum-varnames": [
+                "KindDICOM",
+                "KindZip",
+                "KindTar"
+            ]
+        },
+        "jobs.State": {
+            "type": "string",
+            "enum": [
+                "pending",
+                "running",
+                "done",
+                "failed"
+            ],
+            "x-enum-varnames": [
+                "StatePending",
+                "StateRunning",
+                "StateDone",
+                "StateFailed"
+            ]
+        },
+        "quota.Disk": {
+            "type": "object",
+            "properties": {
+                "free": {
+                    "type": "integer",
+                    "example": 85899345920
+                },
+                "minFree": {
+                    "type": "integer",
+                    "example": 268435456
+                },
+                "total": {
+                    "type": "integer",
+                    "example": 274877906944
+                }
+            }
+        },
+        "quota.Report": {
+            "type": "object",
+            "properties": {
+                "disk": {
+                    "$ref": "#/definitions/quota.Disk"
+                },
+                "evicted": {
+                    "type": "integer",
+                    "example": 1048576
+                },
+                "global": {
+                    "$ref": "#/definitions/quota.Usage"
+                },
+                "tenants": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "$ref": "#/definitions/quota.Usage"
+                    }
+                }
+            }
+        },
+        "quota.Usage": {
+            "type": "object",
+            "properties": {
+                "count": {
+                    "type": "integer",
+                    "example": 100
+                },
+                "limit": {
+                    "type": "integer",
+                    "example": 107374182400
+                },
+                "used": {
+                    "type": "integer",
+                    "example": 52428800
+                }
+            }
+        },
+        "replica.Status": {
+            "type": "object",
+            "properties": {
+                "applied": {
+                    "type": "integer",
+                    "example": 40
+                },
+                "checkpoint": {
+                    "type": "integer",
+                    "example": 40
+                },
+                "lag": {
+                    "type": "integer",
+                    "example": 2
+                },
+                "lastError": {
+                    "type": "string"
+                },
+                "lastSync": {
+                    "type": "string"
+                },
+                "primary": {
+                    "type": "string",
+                    "example": "https://dime-primary:8080"
+                },
+                "primarySeq": {
+                    "type": "integer",
+                    "example": 42
+                }
+            }
+        },
+        "retention.Expiry": {
+            "type": "object",
+            "properties": {
+                "action": {
+                    "type": "string",
+                    "example": "delete"
+                },
+                "done": {
+                    "type": "boolean"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "expired": {
+                    "type": "string"
+                },
+                "held": {
+                    "type": "boolean"
+                },
+                "instances": {
+                    "type": "integer",
+                    "example": 12
+                },
+                "rule": {
+                    "type": "string",
+                    "example": "research-mr"
+                },
+                "studyInstanceUID": {
+                    "type": "string",
+                    "example": "1.2.840.114202.4.833393677.4209323108.691055951.3610221745"
+                }
+            }
+        },
+        "retention.Hold": {
+            "type": "object",
+            "properties": {
+                "created": {
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string",
+                    "example": "litigation 2024-117"
+                }
+            }
+        },
+        "retention.Report": {
+            "type": "object",
+            "properties": {
+                "dryRun": {
+                    "type": "boolean"
+                },
+                "evaluated": {
+                    "type": "string"
+                },
+                "expired": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/retention.Expiry"
+                    }
+                },
+                "studies": {
+                    "type": "integer",
+                    "example": 40
+                }
+            }
+        },
+        "retention.Study": {
+            "type": "object",
+            "properties": {
+                "hold": {
+                    "$ref": "#/definitions/retention.Hold"
+                },
+                "ingested": {
+                    "type": "string"
+                },
+                "labels": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "modalities": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    },
+                    "example": [
+                        "MR"
+                    ]
+                },
+                "studyDate": {
+                    "type": "string",
+                    "example": "20131217"
+                },
+                "studyInstanceUID": {
+                    "type": "string",
+                    "example": "1.2.840.114202.4.833393677.4209323108.691055951.3610221745"
+                }
+            }
+        },
+        "route.State": {
+            "type": "string",
+            "enum": [
+                "pending",
+                "failed"
+            ],
+            "x-enum-varnames": [
+                "StatePending",
+                "StateFailed"
+            ]
+        },
+        "route.Transfer": {
+            "type": "object",
+            "properties": {
+                "attempts": {
+                    "type": "integer",
+                    "example": 1
+                },
+                "created": {
+                    "type": "string"
+                },
+                "destination": {
+                    "type": "string",
+                    "example": "pacs"
+                },
+                "dicomID": {
+                    "type": "string",
+                    "example": "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000436"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string",
+                    "example": "5f0c6b1e3a2d4c8e9b7a6f5e4d3c2b1a"
+                },
+                "nextAttempt": {
+                    "type": "string"
+                },
+                "rule": {
+                    "type": "string",
+                    "example": "ct-to-pacs"
+                },
+                "state": {
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/route.State"
+                        }
+                    ],
+                    "example": "pending"
+                },
+                "updated": {
+                    "type": "string"
+                }
+            }
+        },
+        "server.HoldRequest": {
+            "type": "object",
+            "properties": {
+                "reason": {
+                    "type": "string",
+                    "example": "litigation 2024-117"
+                }
+            }
+        },
+        "server.ImportRequest": {
+            "type": "object",
+            "properties": {
+                "path": {
+                    "type": "string",
+                    "example": "study1"
+                }
+            }
+        },
+        "stability.Series": {
+            "type": "object",
+            "properties": {
+                "expected": {
+                    "type": "integer",
+                    "example": 24
+                },
+                "instances": {
+                    "type": "integer",
+                    "example": 24
+                },
+                "lastReceived": {
+                    "type": "string"
+                },
+                "modality": {
+                    "type": "string",
+                    "example": "MR"
+                },
+                "seriesInstanceUID": {
+                    "type": "string",
+                    "example": "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000394"
+                },
+                "stable": {
+                    "type": "boolean",
+                    "example": true
+                },
+                "stableSince": {
+                    "type": "string"
+                },
+                "studyInstanceUID": {
+                    "type": "string",
+                    "example": "1.2.840.114202.4.833393677.4209323108.691055951.3610221745"
+                }
+            }
+        },
+        "stability.Study": {
+            "type": "object",
+            "properties": {
+                "expected": {
+                    "type": "integer",
+                    "example": 96
+                },
+                "instances": {
+                    "type": "integer",
+                    "example": 96
+                },
+                "lastReceived": {
+                    "type": "string"
+                },
+                "series": {
+                    "type": "integer",
+                    "example": 4
+                },
+                "stable": {
+                    "type": "boolean",
+                    "example": true
+                },
+                "stableSince": {
+                    "type": "string"
+                },
+                "studyInstanceUID": {
+                    "type": "string",
+                    "example": "1.2.840.114202.4.833393677.4209323108.691055951.3610221745"
+                }
+            }
+        },
+        "store.BackupStatus": {
+            "type": "object",
+            "properties": {
+                "dir": {
+                    "type": "string",
+                    "example": "/backups/dime"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "last": {
+                    "$ref": "#/definitions/store.Snapshot"
+                },
+                "running": {
+                    "type": "boolean"
+                },
+                "started": {
+                    "type": "string"
+                }
+            }
+        },
+        "store.Compression": {
+            "type": "object",
+            "properties": {
+                "method": {
+                    "type": "string",
+                    "example": "deflate"
+                },
+                "ratio": {
+                    "type": "number",
+                    "example": 2.24
+                },
+                "size": {
+                    "type": "integer",
+                    "example": 586394
+                },
+                "storedSize": {
+                    "type": "integer",
+                    "example": 261537
                 }
             }
         },
         "store.DICOM": {
             "type": "object",
             "properties": {
+                "compression": {
+                    "$ref": "#/definitions/store.Compression"
+                },
                 "id": {
                     "type": "string",
                     "example": "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000436"
@@ -243,12 +2109,213 @@ const docTemplate = `{
                     "type": "string",
                     "example": "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000394"
                 },
+                "sha256": {
+                    "type": "string",
+                    "example": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+                },
                 "studyInstanceUID": {
                     "type": "string",
                     "example": "1.2.840.114202.4.833393677.4209323108.691055951.3610221745"
                 }
             }
         },
+        "store.Mismatch": {
+            "type": "object",
+            "properties": {
+                "actual": {
+                    "type": "string"
+                },
+                "detected": {
+                    "type": "string"
+                },
+                "expected": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "path": {
+                    "type": "string"
+                }
+            }
+        },
+        "store.RecompressStatus": {
+            "type": "object",
+            "properties": {
+                "bytesAfter": {
+                    "type": "integer",
+                    "example": 209229600
+                },
+                "bytesBefore": {
+                    "type": "integer",
+                    "example": 469115200
+                },
+                "checked": {
+                    "type": "integer",
+                    "example": 1200
+                },
+                "dir": {
+                    "type": "string",
+                    "example": "data"
+                },
+                "errors": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "finished": {
+                    "type": "string"
+                },
+                "method": {
+                    "type": "string",
+                    "example": "deflate"
+                },
+                "rate": {
+                    "type": "integer",
+                    "example": 10
+                },
+                "recompressed": {
+                    "type": "integer",
+                    "example": 800
+                },
+                "running": {
+                    "type": "boolean"
+                },
+                "started": {
+                    "type": "string"
+                }
+            }
+        },
+        "store.ScrubStatus": {
+            "type": "object",
+            "properties": {
+                "checked": {
+                    "type": "integer"
+                },
+                "interval": {
+                    "type": "string"
+                },
+                "lastFinished": {
+                    "type": "string"
+                },
+                "lastPassErrors": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "lastStarted": {
+                    "type": "string"
+                },
+                "mismatches": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/store.Mismatch"
+                    }
+                },
+                "passes": {
+                    "type": "integer"
+                },
+                "rate": {
+                    "type": "integer"
+                },
+                "recorded": {
+                    "type": "integer"
+                },
+                "running": {
+                    "type": "boolean"
+                }
+            }
+        },
+        "store.Snapshot": {
+            "type": "object",
+            "properties": {
+                "copied": {
+                    "type": "integer",
+                    "example": 12
+                },
+                "copiedSize": {
+                    "type": "integer",
+                    "example": 5242880
+                },
+                "count": {
+                    "type": "integer",
+                    "example": 2400
+                },
+                "finished": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string",
+                    "example": "20240601T020000.000Z"
+                },
+                "size": {
+                    "type": "integer",
+                    "example": 1073741824
+                },
+                "source": {
+                    "type": "string",
+                    "example": "data"
+                },
+                "started": {
+                    "type": "string"
+                }
+            }
+        },
+        "store.TierMigration": {
+            "type": "object",
+            "properties": {
+                "errors": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "finished": {
+                    "type": "string"
+                },
+                "instances": {
+                    "type": "integer",
+                    "example": 60
+                },
+                "started": {
+                    "type": "string"
+                },
+                "studies": {
+                    "type": "integer",
+                    "example": 2
+                }
+            }
+        },
+        "store.TierStatus": {
+            "type": "object",
+            "properties": {
+                "cold": {
+                    "type": "integer",
+                    "example": 3600
+                },
+                "hot": {
+                    "type": "integer",
+                    "example": 120
+                },
+                "lastMigration": {
+                    "$ref": "#/definitions/store.TierMigration"
+                },
+                "maxIdle": {
+                    "type": "string",
+                    "example": "2160h0m0s"
+                },
+                "recalled": {
+                    "type": "integer",
+                    "example": 12
+                },
+                "studies": {
+                    "type": "integer",
+                    "example": 40
+                }
+            }
+        },
         "tag.Tag": {
             "type": "object",
             "properties": {
@@ -295,6 +2362,163 @@ const docTemplate = `{
                 "VRDate",
                 "VRPixelData"
             ]
+        },
+        "validate.Finding": {
+            "type": "object",
+            "properties": {
+                "message": {
+                    "type": "string",
+                    "example": "missing type 2 attribute"
+                },
+                "module": {
+                    "type": "string",
+                    "example": "Patient"
+                },
+                "name": {
+                    "type": "string",
+                    "example": "PatientName"
+                },
+                "tag": {
+                    "type": "string",
+                    "example": "(0010,0010)"
+                },
+                "type": {
+                    "type": "string",
+                    "example": "2"
+                }
+            }
+        },
+        "validate.Report": {
+            "type": "object",
+            "properties": {
+                "errors": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/validate.Finding"
+                    }
+                },
+                "iod": {
+                    "type": "string",
+                    "example": "MR Image"
+                },
+                "sopClassUID": {
+                    "type": "string",
+                    "example": "1.2.840.10008.5.1.4.1.1.4"
+                },
+                "valid": {
+                    "type": "boolean"
+                },
+                "warnings": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/validate.Finding"
+                    }
+                }
+            }
+        },
+        "webhook.Delivery": {
+            "type": "object",
+            "properties": {
+                "attempts": {
+                    "type": "integer",
+                    "example": 1
+                },
+                "created": {
+                    "type": "string"
+                },
+                "delivered": {
+                    "type": "string"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "event": {
+                    "$ref": "#/definitions/webhook.Event"
+                },
+                "id": {
+                    "type": "string",
+                    "example": "5f0c6b1e3a2d4c8e9b7a6f5e4d3c2b1a"
+                },
+                "nextAttempt": {
+                    "type": "string"
+                },
+                "state": {
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/webhook.State"
+                        }
+                    ],
+                    "example": "pending"
+                },
+                "statusCode": {
+                    "type": "integer",
+                    "example": 503
+                },
+                "subscription": {
+                    "type": "string",
+                    "example": "ai"
+                },
+                "updated": {
+                    "type": "string"
+                }
+            }
+        },
+        "webhook.Event": {
+            "type": "object",
+            "properties": {
+                "id": {
+                    "type": "string",
+                    "example": "instance.stored-42"
+                },
+                "instances": {
+                    "type": "integer",
+                    "example": 24
+                },
+                "modality": {
+                    "type": "string",
+                    "example": "MR"
+                },
+                "seriesInstanceUID": {
+                    "type": "string",
+                    "example": "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000394"
+                },
+                "sha256": {
+                    "type": "string",
+                    "example": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+                },
+                "sopClassUID": {
+                    "type": "string",
+                    "example": "1.2.840.10008.5.1.4.1.1.4"
+                },
+                "sopInstanceUID": {
+                    "type": "string",
+                    "example": "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000436"
+                },
+                "studyInstanceUID": {
+                    "type": "string",
+                    "example": "1.2.840.114202.4.833393677.4209323108.691055951.3610221745"
+                },
+                "time": {
+                    "type": "string"
+                },
+                "type": {
+                    "type": "string",
+                    "example": "instance.stored"
+                }
+            }
+        },
+        "webhook.State": {
+            "type": "string",
+            "enum": [
+                "pending",
+                "delivered",
+                "failed"
+            ],
+            "x-enum-varnames": [
+                "StatePending",
+                "StateDelivered",
+                "StateFailed"
+            ]
         }
     }
 }`
@@ -10,12 +10,159 @@ import (
 	"github.com/johnmarkli/dime/pkg/server"
 )
 
+// Usage:
+//
+//	dime [command]
+//
+// Without a command, dime runs the server.
+//
+// Commands:
+//
+//	backup [-data-dir dir] [-to dir] [-verify] [-snapshot id]
+//	    snapshot a data directory in to a backup directory, or verify a snapshot against its manifest
+//	fsck [-data-dir dir] [-repair]
+//	    check the files of a data directory for interrupted writes and corruption
+//	migrate [-data-dir dir]
+//	    move the files of a data directory in the flat layout in to the sharded layout
+//	restore [-data-dir dir] [-from dir] [-snapshot id]
+//	    restore a snapshot from a backup directory in to an empty data directory
+//	rewrap
+//	    wrap the data keys of encrypted DICOMs with the primary key of DIME_ENCRYPTION_KEY_FILE
+//
 // Environment:
 //
 //	DIME_PORT
 //	    int - port for server to listen on
 //	DIME_DATA_DIR
 //	    string - directory to save data to the file system
+//	DIME_STORE
+//	    string - file or s3 storage of DICOMs and images
+//	DIME_S3_ENDPOINT
+//	    string - URL of the S3-compatible object storage service
+//	DIME_S3_REGION
+//	    string - region of the S3 bucket
+//	DIME_S3_BUCKET
+//	    string - S3 bucket to store DICOMs and images in
+//	DIME_S3_PREFIX
+//	    string - prefix of the S3 object keys
+//	DIME_S3_ACCESS_KEY_ID
+//	    string - S3 access key ID, defaults to AWS_ACCESS_KEY_ID
+//	DIME_S3_SECRET_ACCESS_KEY
+//	    string - S3 secret access key, defaults to AWS_SECRET_ACCESS_KEY
+//	DIME_S3_SESSION_TOKEN
+//	    string - S3 session token, defaults to AWS_SESSION_TOKEN
+//	DIME_S3_PATH_STYLE
+//	    bool - address the S3 bucket in the path instead of the host name
+//	DIME_S3_PART_SIZE
+//	    int - size in bytes of each part of a multipart upload to S3
+//	DIME_COMPRESSION
+//	    string - none or deflate to losslessly compress DICOM files in the data directory
+//	DIME_RECOMPRESS_RATE
+//	    int - DICOM files per second checked to compress those stored uncompressed, 0 to disable
+//	DIME_TIER_COLD_DIR
+//	    string - directory of the cold tier that idle studies are migrated to
+//	DIME_TIER_COLD_COMPRESSION
+//	    string - none or deflate to losslessly compress DICOM files in the cold tier, defaults to DIME_COMPRESSION
+//	DIME_TIER_MAX_IDLE
+//	    duration - how long a study is not accessed before it is migrated to the cold tier
+//	DIME_TIER_INTERVAL
+//	    duration - how often to migrate idle studies to the cold tier
+//	DIME_BACKUP_DIR
+//	    string - directory of snapshots of the data directory taken with dime backup or POST /admin/backup
+//	DIME_REPLICATE_FROM
+//	    string - URL of a primary dime server to replicate DICOMs from
+//	DIME_REPLICATION_INTERVAL
+//	    duration - how often to pull the change feed of the primary once caught up
+//	DIME_WEBHOOKS
+//	    string - JSON file of webhook subscriptions that events are delivered to
+//	DIME_WEBHOOK_MAX_ATTEMPTS
+//	    int - number of attempts to deliver an event before giving up
+//	DIME_WEBHOOK_BACKOFF
+//	    duration - delay before retrying a failed delivery, doubling each attempt
+//	DIME_STABLE_AFTER
+//	    duration - how long a series or study receives no instances before it is stable
+//	DIME_ENCRYPTION_KEY_FILE
+//	    string - JSON file of keys that DICOMs and images are encrypted at rest with
+//	DIME_MAX_UPLOAD_SIZE
+//	    int - maximum size in bytes of an uploaded DICOM
+//	DIME_MAX_ARCHIVE_SIZE
+//	    int - maximum size in bytes of an uploaded archive
+//	DIME_MAX_ARCHIVE_UNCOMPRESSED_SIZE
+//	    int - maximum total size in bytes of the files in an archive once decompressed
+//	DIME_MAX_ARCHIVE_ENTRIES
+//	    int - maximum number of entries in an archive
+//	DIME_IMPORT_DIR
+//	    string - directory that DICOMs can be imported from on the server
+//	DIME_VALIDATION_POLICY
+//	    string - accept, warn or reject DICOMs that fail IOD validation on ingest
+//	DIME_COERCION_RULES
+//	    string - JSON file of rules that coerce attributes on ingest
+//	DIME_TRUSTED_PROXIES
+//	    string - comma separated addresses or CIDRs of proxies trusted to set the X-Dime-Source and X-Dime-Tenant headers
+//	DIME_INGEST_WORKERS
+//	    int - number of workers ingesting queued uploads
+//	DIME_INGEST_QUEUE_SIZE
+//	    int - maximum number of queued uploads
+//	DIME_INBOX_DIR
+//	    string - directory to watch for DICOMs to ingest
+//	DIME_INBOX_ARCHIVE_DIR
+//	    string - directory to move ingested inbox files to
+//	DIME_INBOX_ERROR_DIR
+//	    string - directory to move inbox files that failed to ingest to
+//	DIME_INBOX_INTERVAL
+//	    duration - how often to poll the inbox directory
+//	DIME_ROUTING_RULES
+//	    string - JSON file of destinations and rules that forward DICOMs
+//	DIME_ROUTING_MAX_ATTEMPTS
+//	    int - number of attempts to forward a DICOM before giving up
+//	DIME_ROUTING_BACKOFF
+//	    duration - delay before retrying a failed forward, doubling each attempt
+//	DIME_SCRUB_RATE
+//	    int - DICOM files per second the scrubber verifies, 0 to disable scrubbing
+//	DIME_SCRUB_INTERVAL
+//	    duration - delay between scrubbing passes over the file store
+//	DIME_RETENTION_RULES
+//	    string - JSON file of rules that expire studies
+//	DIME_RETENTION_INTERVAL
+//	    duration - how often to evaluate the retention rules
+//	DIME_RETENTION_ARCHIVE_DIR
+//	    string - directory to archive expired studies to
+//	DIME_QUOTAS
+//	    string - JSON file of the global and per-tenant storage quotas in bytes
+//	DIME_MIN_FREE_BYTES
+//	    int - bytes to keep free on the disk of the data directory, 0 to disable the check
+//	DIME_EVICT_IMAGES
+//	    bool - evict the least recently used PNG images before rejecting uploads for lack of disk
+//	DIME_API_KEYS
+//	    string - JSON file of API keys that authenticate requests in the X-API-Key header
+//	DIME_JWKS_FILE
+//	    string - JWKS file of keys that verify JWT bearer tokens
+//	DIME_JWT_ISSUER
+//	    string - issuer that JWT bearer tokens must have
+//	DIME_JWT_AUDIENCE
+//	    string - audience that JWT bearer tokens must have
+//	DIME_AUTH_PUBLIC_HEALTH
+//	    bool - serve /health without authentication, defaults to true
+//	DIME_REPLICATE_API_KEY
+//	    string - API key of requests to the primary dime server
+//	DIME_RBAC
+//	    string - JSON file of the roles granted to subjects and groups within scopes of DICOMs
+//	DIME_AUDIT_LOG
+//	    string - file that audit messages of access to DICOMs are appended to
+//	DIME_AUDIT_SYSLOG
+//	    string - udp:// or tcp:// URL of a syslog collector that audit messages are sent to
+//	DIME_AUDIT_SOURCE_ID
+//	    string - audit source ID of audit messages, defaults to the host name
+//	DIME_TLS_CERT_FILE
+//	    string - PEM certificate chain that the server serves HTTPS with
+//	DIME_TLS_KEY_FILE
+//	    string - PEM private key of DIME_TLS_CERT_FILE
+//	DIME_TLS_CLIENT_CA_FILE
+//	    string - PEM CAs that verify client certificates, which then authenticate requests
+//	DIME_TLS_CLIENT_AUTH
+//	    string - none, request or require client certificates, defaults to request with DIME_TLS_CLIENT_CA_FILE
+//	DIME_TLS_RELOAD_INTERVAL
+//	    duration - how often to check the TLS files for changes and reload them
 
 //	@title			dime API
 //	@version		1.0
@@ -33,6 +180,12 @@ func main() {
 		os.Exit(exitCode)
 	}()
 
+	// Run command
+	if len(os.Args) > 1 {
+		exitCode = runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
 	// Start dime server
 	s, err := server.New()
 	if err != nil {
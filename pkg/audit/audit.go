@@ -0,0 +1,253 @@
+// Package audit records access to DICOMs as DICOM PS3.15 audit messages
+// (RFC 3881, IHE ATNA) in an append-only log and optionally sends them to a
+// syslog collector
+package audit
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// Action is an action on a DICOM that is audited
+type Action string
+
+// Actions
+const (
+	// ActionCreate stores a DICOM
+	ActionCreate Action = "create"
+	// ActionRead reads a DICOM
+	ActionRead Action = "read"
+	// ActionQuery queries attributes of a DICOM
+	ActionQuery Action = "query"
+	// ActionRender renders the image of a DICOM
+	ActionRender Action = "render"
+	// ActionExport exports a DICOM as a file
+	ActionExport Action = "export"
+	// ActionDelete deletes a DICOM
+	ActionDelete Action = "delete"
+)
+
+// Outcome is the outcome of an audited action, as the event outcome
+// indicator of an audit message
+type Outcome int
+
+// Outcomes
+const (
+	// OutcomeSuccess is an action that succeeded
+	OutcomeSuccess Outcome = 0
+	// OutcomeMinorFailure is an action that failed, such as one that was
+	// forbidden
+	OutcomeMinorFailure Outcome = 4
+	// OutcomeSeriousFailure is an action that failed and was not retried
+	OutcomeSeriousFailure Outcome = 8
+)
+
+// Event is an audited action of a user from a source, the address or name
+// of the requesting system, on a DICOM. A DICOM the server exports on its
+// own, such as one it routes, has the name and address of the destination
+// instead of a user and source. A query of many DICOMs has the request URI as
+// its query.
+type Event struct {
+	Action             Action
+	Outcome            Outcome
+	Time               time.Time
+	User               string
+	Source             string
+	Destination        string
+	DestinationAddress string
+	PatientID          string
+	StudyInstanceUID   string
+	SOPClassUID        string
+	SOPInstanceUID     string
+	Query              string
+}
+
+// NewEvent returns an event of an action by a user from a source on a DICOM
+func NewEvent(action Action, dcm *store.DICOM, user, source string) Event {
+	return Event{
+		Action:           action,
+		Time:             time.Now().UTC(),
+		User:             user,
+		Source:           source,
+		PatientID:        stringValue(dcm, tag.PatientID),
+		StudyInstanceUID: dcm.StudyInstanceUID,
+		SOPClassUID:      stringValue(dcm, tag.SOPClassUID),
+		SOPInstanceUID:   dcm.ID,
+	}
+}
+
+// Logger writes audit messages to an append-only log and optionally sends
+// them to a syslog collector
+type Logger struct {
+	mu       sync.Mutex
+	file     *os.File
+	sourceID string
+	host     string
+	syslog   *syslogSender
+}
+
+// Option is an option of a Logger
+type Option func(*Logger)
+
+// WithSourceID sets the audit source ID of the messages, which defaults to
+// the host name
+func WithSourceID(id string) Option {
+	return func(l *Logger) {
+		l.sourceID = id
+	}
+}
+
+// WithSyslog sends the messages to a syslog collector at an address over udp
+// or tcp
+func WithSyslog(network, addr string) Option {
+	return func(l *Logger) {
+		l.syslog = newSyslogSender(network, addr)
+	}
+}
+
+// New returns a Logger that appends audit messages to a file, one per line
+func New(file string, opts ...Option) (*Logger, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	l := &Logger{
+		file:     f,
+		sourceID: host,
+		host:     host,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.syslog != nil {
+		if l.syslog.network != "udp" && l.syslog.network != "tcp" {
+			f.Close()
+			return nil, fmt.Errorf("unsupported syslog network %q", l.syslog.network)
+		}
+		l.syslog.host = host
+		l.syslog.start()
+	}
+	return l, nil
+}
+
+// Record an event, logging rather than returning any error so the action
+// that is audited isn't failed by it
+func (l *Logger) Record(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	b, err := xml.Marshal(newMessage(ev, l.sourceID, l.host))
+	if err != nil {
+		slog.Error("Failed to marshal audit message", slog.String("error", err.Error()))
+		return
+	}
+
+	// Append and sync the message so it survives a crash
+	l.mu.Lock()
+	_, err = l.file.Write(append(b, '\n'))
+	if err == nil {
+		err = l.file.Sync()
+	}
+	l.mu.Unlock()
+	if err != nil {
+		slog.Error("Failed to write audit message", slog.String("error", err.Error()))
+	}
+	if l.syslog != nil {
+		l.syslog.send(ev.Time, b)
+	}
+}
+
+// Created records a DICOM created by a user from a source. It has the
+// signature of an ingest.Auditor.
+func (l *Logger) Created(dcm *store.DICOM, source, user string) {
+	l.Record(NewEvent(ActionCreate, dcm, user, source))
+}
+
+// Exported records a DICOM the server sent to a destination with a network
+// address or URL. It has the signature of a route.Auditor.
+func (l *Logger) Exported(dcm *store.DICOM, destination, address string) {
+	ev := NewEvent(ActionExport, dcm, "", "")
+	ev.Destination = destination
+	ev.DestinationAddress = address
+	l.Record(ev)
+}
+
+// Close the log, sending the messages waiting to be sent to syslog first
+func (l *Logger) Close() error {
+	if l.syslog != nil {
+		l.syslog.stop()
+	}
+	return l.file.Close()
+}
+
+// Wrap a store so the DICOMs created in and deleted from it are audited as
+// actions of a user from a source, such as the replication of a primary
+func (l *Logger) Wrap(st store.Store, user, source string) store.Store {
+	return &auditedStore{Store: st, log: l, user: user, source: source}
+}
+
+// auditedStore records the DICOMs created in and deleted from a store
+type auditedStore struct {
+	store.Store
+	log    *Logger
+	user   string
+	source string
+}
+
+// Create a DICOM and record it
+func (s *auditedStore) Create(dcm *store.DICOM) error {
+	err := s.Store.Create(dcm)
+	if err != nil {
+		return err
+	}
+	s.log.Record(NewEvent(ActionCreate, dcm, s.user, s.source))
+	return nil
+}
+
+// Delete a DICOM and record it
+func (s *auditedStore) Delete(id string) error {
+	dcm, err := s.Store.Read(id)
+	if err != nil {
+		return err
+	}
+	err = s.Store.Delete(id)
+	if err != nil {
+		return err
+	}
+	s.log.Record(NewEvent(ActionDelete, dcm, s.user, s.source))
+	return nil
+}
+
+// Walk calls fn with each DICOM of the store in turn
+func (s *auditedStore) Walk(fn func(dcm *store.DICOM) error) error {
+	return store.Walk(s.Store, fn)
+}
+
+// stringValue returns the first string value of an element of a DICOM, or
+// an empty string if it has none
+func stringValue(dcm *store.DICOM, t tag.Tag) string {
+	if dcm.Dataset() == nil {
+		return ""
+	}
+	element, err := dcm.Dataset().FindElementByTag(t)
+	if err != nil {
+		return ""
+	}
+	values, ok := element.Value.GetValue().([]string)
+	if !ok || len(values) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(values[0])
+}
@@ -0,0 +1,296 @@
+package audit_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/audit"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+)
+
+const (
+	testDataPath = "../../testdata/IM000001-mri"
+	testID       = "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000395"
+)
+
+// auditMessage is the part of an audit message the tests check
+type auditMessage struct {
+	EventIdentification struct {
+		EventActionCode       string `xml:"EventActionCode,attr"`
+		EventOutcomeIndicator int    `xml:"EventOutcomeIndicator,attr"`
+		EventID               struct {
+			Code string `xml:"csd-code,attr"`
+		} `xml:"EventID"`
+		EventTypeCode struct {
+			Code string `xml:"csd-code,attr"`
+		} `xml:"EventTypeCode"`
+	} `xml:"EventIdentification"`
+	ActiveParticipant []struct {
+		UserID               string `xml:"UserID,attr"`
+		UserIsRequestor      bool   `xml:"UserIsRequestor,attr"`
+		NetworkAccessPointID string `xml:"NetworkAccessPointID,attr"`
+		RoleIDCode           struct {
+			Code string `xml:"csd-code,attr"`
+		} `xml:"RoleIDCode"`
+	} `xml:"ActiveParticipant"`
+	AuditSourceIdentification struct {
+		AuditSourceID string `xml:"AuditSourceID,attr"`
+	} `xml:"AuditSourceIdentification"`
+	ParticipantObjectIdentification []struct {
+		ParticipantObjectID           string `xml:"ParticipantObjectID,attr"`
+		ParticipantObjectTypeCodeRole int    `xml:"ParticipantObjectTypeCodeRole,attr"`
+		ParticipantObjectQuery        string `xml:"ParticipantObjectQuery"`
+		ParticipantObjectDescription  struct {
+			SOPClass struct {
+				UID      string `xml:"UID,attr"`
+				Instance struct {
+					UID string `xml:"UID,attr"`
+				} `xml:"Instance"`
+			} `xml:"SOPClass"`
+		} `xml:"ParticipantObjectDescription"`
+	} `xml:"ParticipantObjectIdentification"`
+}
+
+func newDICOM(t *testing.T) *store.DICOM {
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	return dcm
+}
+
+// readLog reads the messages of an audit log
+func readLog(t *testing.T, file string) []auditMessage {
+	b, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	var msgs []auditMessage
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var msg auditMessage
+		assert.NoError(t, xml.Unmarshal([]byte(line), &msg))
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestLogger(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	l, err := audit.New(file, audit.WithSourceID("dime-test"))
+	assert.NoError(t, err)
+	dcm := newDICOM(t)
+
+	ev := audit.NewEvent(audit.ActionQuery, dcm, "reporting", "10.0.0.5")
+	ev.Query = "tag=(0010,0010)"
+	l.Record(ev)
+	l.Created(dcm, "10.0.0.6", "")
+	l.Record(audit.Event{Action: audit.ActionRead, Outcome: audit.OutcomeMinorFailure, User: "stranger"})
+	assert.NoError(t, l.Close())
+
+	msgs := readLog(t, file)
+	if !assert.Len(t, msgs, 3) {
+		return
+	}
+
+	// Attribute query by a user
+	msg := msgs[0]
+	assert.Equal(t, "E", msg.EventIdentification.EventActionCode)
+	assert.Equal(t, "110112", msg.EventIdentification.EventID.Code)
+	assert.Equal(t, "query", msg.EventIdentification.EventTypeCode.Code)
+	assert.Equal(t, 0, msg.EventIdentification.EventOutcomeIndicator)
+	assert.Equal(t, "dime-test", msg.AuditSourceIdentification.AuditSourceID)
+	if assert.Len(t, msg.ActiveParticipant, 2) {
+		assert.Equal(t, "reporting", msg.ActiveParticipant[0].UserID)
+		assert.True(t, msg.ActiveParticipant[0].UserIsRequestor)
+		assert.Equal(t, "10.0.0.5", msg.ActiveParticipant[0].NetworkAccessPointID)
+		assert.Equal(t, "dime-test", msg.ActiveParticipant[1].UserID)
+		assert.False(t, msg.ActiveParticipant[1].UserIsRequestor)
+	}
+	if assert.Len(t, msg.ParticipantObjectIdentification, 2) {
+		patient := msg.ParticipantObjectIdentification[0]
+		assert.NotEmpty(t, patient.ParticipantObjectID)
+		assert.Equal(t, 1, patient.ParticipantObjectTypeCodeRole)
+		study := msg.ParticipantObjectIdentification[1]
+		assert.Equal(t, dcm.StudyInstanceUID, study.ParticipantObjectID)
+		assert.Equal(t, testID, study.ParticipantObjectDescription.SOPClass.Instance.UID)
+		assert.NotEmpty(t, study.ParticipantObjectDescription.SOPClass.UID)
+		query, err := base64.StdEncoding.DecodeString(study.ParticipantObjectQuery)
+		assert.NoError(t, err)
+		assert.Equal(t, "tag=(0010,0010)", string(query))
+	}
+
+	// DICOM transferred from a source without a user
+	msg = msgs[1]
+	assert.Equal(t, "C", msg.EventIdentification.EventActionCode)
+	assert.Equal(t, "110104", msg.EventIdentification.EventID.Code)
+	if assert.Len(t, msg.ActiveParticipant, 2) {
+		assert.Equal(t, "10.0.0.6", msg.ActiveParticipant[0].UserID)
+		assert.Equal(t, "110153", msg.ActiveParticipant[0].RoleIDCode.Code)
+		assert.Equal(t, "110152", msg.ActiveParticipant[1].RoleIDCode.Code)
+	}
+
+	// Forbidden read
+	msg = msgs[2]
+	assert.Equal(t, 4, msg.EventIdentification.EventOutcomeIndicator)
+	assert.Empty(t, msg.ParticipantObjectIdentification)
+
+	// Messages are appended to the log
+	l, err = audit.New(file)
+	assert.NoError(t, err)
+	l.Record(audit.NewEvent(audit.ActionExport, dcm, "reporting", "10.0.0.5"))
+	assert.NoError(t, l.Close())
+	msgs = readLog(t, file)
+	if assert.Len(t, msgs, 4) {
+		assert.Equal(t, "110106", msgs[3].EventIdentification.EventID.Code)
+		host, _ := os.Hostname()
+		assert.Equal(t, host, msgs[3].AuditSourceIdentification.AuditSourceID)
+	}
+
+	_, err = audit.New(filepath.Join(t.TempDir(), "missing", "audit.log"))
+	assert.Error(t, err)
+	_, err = audit.New(filepath.Join(t.TempDir(), "audit.log"), audit.WithSyslog("unix", "/dev/log"))
+	assert.Error(t, err)
+}
+
+func TestLoggerExported(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	l, err := audit.New(file, audit.WithSourceID("dime-test"))
+	assert.NoError(t, err)
+	l.Exported(newDICOM(t), "pacs", "pacs.example.com:104")
+	l.Record(audit.Event{Action: audit.ActionQuery, User: "reporting", Query: "/dicoms"})
+	assert.NoError(t, l.Close())
+
+	msgs := readLog(t, file)
+	if !assert.Len(t, msgs, 2) {
+		return
+	}
+
+	// DICOM routed to a destination by the server
+	msg := msgs[0]
+	assert.Equal(t, "110106", msg.EventIdentification.EventID.Code)
+	if assert.Len(t, msg.ActiveParticipant, 2) {
+		assert.Equal(t, "dime-test", msg.ActiveParticipant[0].UserID)
+		assert.True(t, msg.ActiveParticipant[0].UserIsRequestor)
+		assert.Equal(t, "110153", msg.ActiveParticipant[0].RoleIDCode.Code)
+		assert.Equal(t, "pacs", msg.ActiveParticipant[1].UserID)
+		assert.False(t, msg.ActiveParticipant[1].UserIsRequestor)
+		assert.Equal(t, "pacs.example.com", msg.ActiveParticipant[1].NetworkAccessPointID)
+		assert.Equal(t, "110152", msg.ActiveParticipant[1].RoleIDCode.Code)
+	}
+	assert.Len(t, msg.ParticipantObjectIdentification, 2)
+
+	// Query of many DICOMs
+	msg = msgs[1]
+	if assert.Len(t, msg.ParticipantObjectIdentification, 1) {
+		query := msg.ParticipantObjectIdentification[0]
+		assert.Equal(t, "/dicoms", query.ParticipantObjectID)
+		assert.Equal(t, 24, query.ParticipantObjectTypeCodeRole)
+	}
+}
+
+func TestLoggerWrap(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	l, err := audit.New(file)
+	assert.NoError(t, err)
+	mem, err := store.NewMemStore()
+	assert.NoError(t, err)
+	st := l.Wrap(mem, "retention", "")
+	dcm := newDICOM(t)
+
+	assert.NoError(t, st.Create(dcm))
+	assert.NoError(t, st.Delete(dcm.ID))
+	assert.Error(t, st.Delete(dcm.ID))
+	assert.NoError(t, l.Close())
+
+	msgs := readLog(t, file)
+	if assert.Len(t, msgs, 2) {
+		assert.Equal(t, "C", msgs[0].EventIdentification.EventActionCode)
+		assert.Equal(t, "D", msgs[1].EventIdentification.EventActionCode)
+		assert.Equal(t, "110103", msgs[1].EventIdentification.EventID.Code)
+		assert.Equal(t, "retention", msgs[1].ActiveParticipant[0].UserID)
+	}
+}
+
+func TestLoggerSyslog(t *testing.T) {
+	dcm := newDICOM(t)
+
+	// UDP sends a message per datagram
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+	l, err := audit.New(filepath.Join(t.TempDir(), "audit.log"), audit.WithSyslog("udp", conn.LocalAddr().String()))
+	assert.NoError(t, err)
+	l.Record(audit.NewEvent(audit.ActionRender, dcm, "reporting", "10.0.0.5"))
+	assert.NoError(t, l.Close())
+	buf := make([]byte, 64*1024)
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err := conn.ReadFrom(buf)
+	assert.NoError(t, err)
+	checkSyslog(t, buf[:n])
+
+	// TCP octet counts messages
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	received := make(chan []byte, 2)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		for {
+			length, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(length))
+			b := make([]byte, n)
+			_, err = io.ReadFull(r, b)
+			if err != nil {
+				return
+			}
+			received <- b
+		}
+	}()
+	l, err = audit.New(filepath.Join(t.TempDir(), "audit.log"), audit.WithSyslog("tcp", ln.Addr().String()))
+	assert.NoError(t, err)
+	l.Record(audit.NewEvent(audit.ActionRender, dcm, "reporting", "10.0.0.5"))
+	l.Record(audit.NewEvent(audit.ActionExport, dcm, "reporting", "10.0.0.5"))
+	assert.NoError(t, l.Close())
+	for i := 0; i < 2; i++ {
+		select {
+		case b := <-received:
+			checkSyslog(t, b)
+		case <-time.After(5 * time.Second):
+			t.Fatal("syslog message not received")
+		}
+	}
+}
+
+// checkSyslog checks an RFC 5424 syslog message holds an audit message
+func checkSyslog(t *testing.T, b []byte) {
+	assert.True(t, bytes.HasPrefix(b, []byte("<85>1 ")), string(b))
+	fields := strings.SplitN(string(b), " ", 8)
+	if !assert.Len(t, fields, 8) {
+		return
+	}
+	assert.Equal(t, "dime", fields[3])
+	assert.Equal(t, "IHE+RFC-3881", fields[5])
+	assert.Equal(t, "-", fields[6])
+	msg := strings.TrimPrefix(fields[7], "\xef\xbb\xbf")
+	var m auditMessage
+	assert.NoError(t, xml.Unmarshal([]byte(msg), &m))
+	assert.Equal(t, "reporting", m.ActiveParticipant[0].UserID)
+}
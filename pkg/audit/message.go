@@ -0,0 +1,224 @@
+package audit
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Codes of the DICOM (DCM) and RFC 3881 code systems used in audit messages
+var (
+	eventInstancesAccessed    = code{"110103", "DCM", "DICOM Instances Accessed"}
+	eventInstancesTransferred = code{"110104", "DCM", "DICOM Instances Transferred"}
+	eventExport               = code{"110106", "DCM", "Export"}
+	eventQuery                = code{"110112", "DCM", "Query"}
+	roleDestination           = code{"110152", "DCM", "Destination Role ID"}
+	roleSource                = code{"110153", "DCM", "Source Role ID"}
+	idStudyInstanceUID        = code{"110180", "DCM", "Study Instance UID"}
+	idPatientNumber           = code{"2", "RFC-3881", "Patient Number"}
+	idURI                     = code{"12", "RFC-3881", "URI"}
+)
+
+// Participant object type codes and roles of RFC 3881
+const (
+	objectPerson       = 1
+	objectSystemObject = 2
+	objectRolePatient  = 1
+	objectRoleReport   = 3
+	objectRoleQuery    = 24
+)
+
+// Network access point type codes of RFC 3881
+const (
+	accessPointMachineName = "1"
+	accessPointIPAddress   = "2"
+)
+
+// message is a DICOM PS3.15 audit message
+type message struct {
+	XMLName                   xml.Name            `xml:"AuditMessage"`
+	EventIdentification       eventIdentification `xml:"EventIdentification"`
+	ActiveParticipants        []activeParticipant `xml:"ActiveParticipant"`
+	AuditSourceIdentification auditSource         `xml:"AuditSourceIdentification"`
+	ParticipantObjects        []participantObject `xml:"ParticipantObjectIdentification"`
+}
+
+type eventIdentification struct {
+	EventActionCode       string `xml:"EventActionCode,attr"`
+	EventDateTime         string `xml:"EventDateTime,attr"`
+	EventOutcomeIndicator int    `xml:"EventOutcomeIndicator,attr"`
+	EventID               code   `xml:"EventID"`
+	EventTypeCode         *code  `xml:"EventTypeCode,omitempty"`
+}
+
+type code struct {
+	Code           string `xml:"csd-code,attr"`
+	CodeSystemName string `xml:"codeSystemName,attr"`
+	OriginalText   string `xml:"originalText,attr"`
+}
+
+type activeParticipant struct {
+	UserID                     string `xml:"UserID,attr"`
+	UserIsRequestor            bool   `xml:"UserIsRequestor,attr"`
+	NetworkAccessPointID       string `xml:"NetworkAccessPointID,attr,omitempty"`
+	NetworkAccessPointTypeCode string `xml:"NetworkAccessPointTypeCode,attr,omitempty"`
+	RoleIDCode                 *code  `xml:"RoleIDCode,omitempty"`
+}
+
+type auditSource struct {
+	AuditSourceID string `xml:"AuditSourceID,attr"`
+}
+
+type participantObject struct {
+	ParticipantObjectID           string       `xml:"ParticipantObjectID,attr"`
+	ParticipantObjectTypeCode     int          `xml:"ParticipantObjectTypeCode,attr"`
+	ParticipantObjectTypeCodeRole int          `xml:"ParticipantObjectTypeCodeRole,attr"`
+	ParticipantObjectIDTypeCode   code         `xml:"ParticipantObjectIDTypeCode"`
+	ParticipantObjectQuery        string       `xml:"ParticipantObjectQuery,omitempty"`
+	ParticipantObjectDescription  *description `xml:"ParticipantObjectDescription,omitempty"`
+}
+
+type description struct {
+	SOPClass []sopClass `xml:"SOPClass"`
+}
+
+type sopClass struct {
+	UID               string     `xml:"UID,attr"`
+	NumberOfInstances int        `xml:"NumberOfInstances,attr"`
+	Instances         []instance `xml:"Instance"`
+}
+
+type instance struct {
+	UID string `xml:"UID,attr"`
+}
+
+// eventCodes are the event ID, action code and event type of each action.
+// Reads and image renders are both DICOM Instances Accessed, told apart by
+// their event type.
+var eventCodes = map[Action]struct {
+	id     code
+	action string
+	typ    string
+}{
+	ActionCreate: {eventInstancesTransferred, "C", "Create"},
+	ActionRead:   {eventInstancesAccessed, "R", "Read"},
+	ActionQuery:  {eventQuery, "E", "Attribute Query"},
+	ActionRender: {eventInstancesAccessed, "R", "Image Render"},
+	ActionExport: {eventExport, "R", "Export"},
+	ActionDelete: {eventInstancesAccessed, "D", "Delete"},
+}
+
+// newMessage returns the audit message of an event recorded by an audit
+// source on a host
+func newMessage(ev Event, sourceID, host string) message {
+	codes := eventCodes[ev.Action]
+	msg := message{
+		EventIdentification: eventIdentification{
+			EventActionCode:       codes.action,
+			EventDateTime:         ev.Time.UTC().Format(time.RFC3339Nano),
+			EventOutcomeIndicator: int(ev.Outcome),
+			EventID:               codes.id,
+			EventTypeCode:         &code{string(ev.Action), "dime", codes.typ},
+		},
+		AuditSourceIdentification: auditSource{AuditSourceID: sourceID},
+	}
+
+	// The user or system that requested the event and this server. DICOMs
+	// are transferred from the requestor when they are created and to it
+	// when they are exported.
+	requestor := activeParticipant{UserID: ev.User, UserIsRequestor: true}
+	if requestor.UserID == "" {
+		requestor.UserID = ev.Source
+	}
+	if ev.Source != "" {
+		requestor.NetworkAccessPointID = ev.Source
+		requestor.NetworkAccessPointTypeCode = accessPointType(ev.Source)
+	}
+	server := activeParticipant{
+		UserID:                     sourceID,
+		NetworkAccessPointID:       host,
+		NetworkAccessPointTypeCode: accessPointType(host),
+	}
+	switch {
+	case ev.Action == ActionCreate:
+		requestor.RoleIDCode = &roleSource
+		server.RoleIDCode = &roleDestination
+	case ev.Action == ActionExport && ev.Destination != "":
+		// Exported by the server on its own, so it is the requestor and the
+		// destination takes the place of the user
+		server.UserIsRequestor = true
+		server.RoleIDCode = &roleSource
+		destination := activeParticipant{UserID: ev.Destination, RoleIDCode: &roleDestination}
+		if host := addressHost(ev.DestinationAddress); host != "" {
+			destination.NetworkAccessPointID = host
+			destination.NetworkAccessPointTypeCode = accessPointType(host)
+		}
+		msg.ActiveParticipants = []activeParticipant{server, destination}
+	case ev.Action == ActionExport:
+		requestor.RoleIDCode = &roleDestination
+		server.RoleIDCode = &roleSource
+	}
+	if msg.ActiveParticipants == nil {
+		msg.ActiveParticipants = []activeParticipant{requestor, server}
+	}
+
+	// The patient and study of the DICOM
+	if ev.PatientID != "" {
+		msg.ParticipantObjects = append(msg.ParticipantObjects, participantObject{
+			ParticipantObjectID:           ev.PatientID,
+			ParticipantObjectTypeCode:     objectPerson,
+			ParticipantObjectTypeCodeRole: objectRolePatient,
+			ParticipantObjectIDTypeCode:   idPatientNumber,
+		})
+	}
+	if ev.StudyInstanceUID != "" {
+		study := participantObject{
+			ParticipantObjectID:           ev.StudyInstanceUID,
+			ParticipantObjectTypeCode:     objectSystemObject,
+			ParticipantObjectTypeCodeRole: objectRoleReport,
+			ParticipantObjectIDTypeCode:   idStudyInstanceUID,
+		}
+		if ev.Query != "" {
+			study.ParticipantObjectQuery = base64.StdEncoding.EncodeToString([]byte(ev.Query))
+		}
+		if ev.SOPInstanceUID != "" {
+			study.ParticipantObjectDescription = &description{SOPClass: []sopClass{{
+				UID:               ev.SOPClassUID,
+				NumberOfInstances: 1,
+				Instances:         []instance{{UID: ev.SOPInstanceUID}},
+			}}}
+		}
+		msg.ParticipantObjects = append(msg.ParticipantObjects, study)
+	} else if ev.Query != "" {
+		// A query of many DICOMs, identified by its request URI
+		msg.ParticipantObjects = append(msg.ParticipantObjects, participantObject{
+			ParticipantObjectID:           ev.Query,
+			ParticipantObjectTypeCode:     objectSystemObject,
+			ParticipantObjectTypeCodeRole: objectRoleQuery,
+			ParticipantObjectIDTypeCode:   idURI,
+			ParticipantObjectQuery:        base64.StdEncoding.EncodeToString([]byte(ev.Query)),
+		})
+	}
+	return msg
+}
+
+// addressHost returns the host of a network address or URL
+func addressHost(addr string) string {
+	if u, err := url.Parse(addr); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// accessPointType returns the network access point type of an address
+func accessPointType(addr string) string {
+	if net.ParseIP(addr) != nil {
+		return accessPointIPAddress
+	}
+	return accessPointMachineName
+}
@@ -0,0 +1,104 @@
+package audit
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// syslogPriority is the priority of audit messages, the authpriv (10)
+	// facility with notice (5) severity
+	syslogPriority = 10*8 + 5
+	// syslogMsgID is the MSGID of audit messages that IHE ATNA requires
+	syslogMsgID = "IHE+RFC-3881"
+	// syslogQueueSize is the number of messages waiting to be sent before
+	// more are dropped
+	syslogQueueSize = 1000
+	// syslogTimeout is how long to wait to connect or send a message
+	syslogTimeout = 5 * time.Second
+)
+
+// bom is the byte order mark that starts a UTF-8 syslog MSG
+const bom = "\xef\xbb\xbf"
+
+// syslogSender sends audit messages to a syslog collector in RFC 5424 format
+// in the background, one message per datagram over udp (RFC 5426) or octet
+// counted over tcp (RFC 6587)
+type syslogSender struct {
+	network string
+	addr    string
+	host    string
+	queue   chan []byte
+	done    chan struct{}
+	conn    net.Conn
+}
+
+// newSyslogSender returns a syslogSender to a collector
+func newSyslogSender(network, addr string) *syslogSender {
+	return &syslogSender{
+		network: network,
+		addr:    addr,
+		queue:   make(chan []byte, syslogQueueSize),
+		done:    make(chan struct{}),
+	}
+}
+
+// start sending messages
+func (s *syslogSender) start() {
+	go func() {
+		defer close(s.done)
+		for line := range s.queue {
+			err := s.write(line)
+			if err != nil {
+				slog.Error("Failed to send audit message to syslog",
+					slog.String("addr", s.addr),
+					slog.String("error", err.Error()))
+			}
+		}
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	}()
+}
+
+// stop sending messages once those waiting are sent
+func (s *syslogSender) stop() {
+	close(s.queue)
+	<-s.done
+}
+
+// send a message recorded at a time, dropping it if too many are waiting
+func (s *syslogSender) send(ts time.Time, msg []byte) {
+	line := fmt.Sprintf("<%d>1 %s %s dime %d %s - %s%s",
+		syslogPriority, ts.UTC().Format(time.RFC3339Nano), s.host, os.Getpid(), syslogMsgID, bom, msg)
+	select {
+	case s.queue <- []byte(line):
+	default:
+		slog.Warn("Dropped audit message for syslog", slog.String("addr", s.addr))
+	}
+}
+
+// write a line to the collector, connecting if needed
+func (s *syslogSender) write(line []byte) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.addr, syslogTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if s.network == "tcp" {
+		line = append([]byte(fmt.Sprintf("%d ", len(line))), line...)
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	_, err := s.conn.Write(line)
+	if err != nil {
+		// reconnect for the next message
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// APIKeyHeader is the header of a request's API key
+const APIKeyHeader = "X-API-Key"
+
+// APIKeysConfig is the API keys that authenticate requests
+type APIKeysConfig struct {
+	Keys []APIKey `json:"keys"`
+}
+
+// APIKey is a static API key of a client, given either as the key or as the
+// hex SHA-256 digest of the key so the file doesn't hold it
+type APIKey struct {
+	Name   string `json:"name" example:"reporting"`
+	Key    string `json:"key,omitempty"`
+	SHA256 string `json:"sha256,omitempty" example:"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"`
+}
+
+// APIKeys authenticates requests by the API key in their X-API-Key header
+type APIKeys struct {
+	keys []apiKey
+}
+
+// apiKey is an APIKey with its digest decoded
+type apiKey struct {
+	name   string
+	digest []byte
+}
+
+// LoadAPIKeys loads APIKeys from a JSON file
+func LoadAPIKeys(file string) (*APIKeys, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read api keys: %w", err)
+	}
+	var cfg APIKeysConfig
+	err = json.Unmarshal(b, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse api keys: %w", err)
+	}
+	return NewAPIKeys(&cfg)
+}
+
+// NewAPIKeys returns APIKeys of a config
+func NewAPIKeys(cfg *APIKeysConfig) (*APIKeys, error) {
+	a := &APIKeys{}
+	names := map[string]bool{}
+	for i, k := range cfg.Keys {
+		if k.Name == "" {
+			return nil, fmt.Errorf("api key %d: name is required", i+1)
+		}
+		if names[k.Name] {
+			return nil, fmt.Errorf("%s: duplicate api key", k.Name)
+		}
+		names[k.Name] = true
+		var digest []byte
+		switch {
+		case k.Key != "" && k.SHA256 != "":
+			return nil, fmt.Errorf("%s: only one of key and sha256 can be set", k.Name)
+		case k.Key != "":
+			sum := sha256.Sum256([]byte(k.Key))
+			digest = sum[:]
+		case k.SHA256 != "":
+			var err error
+			digest, err = hex.DecodeString(strings.ToLower(k.SHA256))
+			if err != nil || len(digest) != sha256.Size {
+				return nil, fmt.Errorf("%s: invalid sha256", k.Name)
+			}
+		default:
+			return nil, fmt.Errorf("%s: key or sha256 is required", k.Name)
+		}
+		a.keys = append(a.keys, apiKey{name: k.Name, digest: digest})
+	}
+	return a, nil
+}
+
+// Authenticate a request by its API key
+func (a *APIKeys) Authenticate(r *http.Request) (*Identity, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	sum := sha256.Sum256([]byte(key))
+	var match *apiKey
+	for i := range a.keys {
+		// compare every key so the time taken doesn't reveal which matched
+		if subtle.ConstantTimeCompare(sum[:], a.keys[i].digest) == 1 {
+			match = &a.keys[i]
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("%w: unknown api key", ErrInvalidCredentials)
+	}
+	return &Identity{Subject: match.name, Method: MethodAPIKey}, nil
+}
@@ -0,0 +1,92 @@
+// Package auth authenticates requests with API keys, JWT bearer tokens and
+// TLS client certificates
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Authentication methods
+const (
+	// MethodAPIKey is a static API key
+	MethodAPIKey = "apikey"
+	// MethodJWT is a JWT bearer token
+	MethodJWT = "jwt"
+	// MethodCertificate is a TLS client certificate
+	MethodCertificate = "certificate"
+)
+
+var (
+	// ErrNoCredentials is an error for a request without credentials an
+	// Authenticator accepts
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials is an error for credentials that are not valid
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Identity is who made a request. Claims are those of a JWT or of a client
+// certificate.
+type Identity struct {
+	Subject string         `json:"subject" example:"reporting"`
+	Method  string         `json:"method" example:"apikey"`
+	Claims  map[string]any `json:"claims,omitempty"`
+}
+
+// Authenticator authenticates requests with one kind of credentials. It
+// returns ErrNoCredentials if a request has none of its kind.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Error is the body of a 401 or 403 response
+type Error struct {
+	Status  int    `json:"status" example:"401"`
+	Error   string `json:"error" example:"Unauthorized"`
+	Message string `json:"message" example:"no credentials"`
+}
+
+type identityKey struct{}
+
+// Authenticate a request with the first of a list of authenticators that
+// finds credentials in it
+func Authenticate(r *http.Request, authenticators []Authenticator) (*Identity, error) {
+	for _, a := range authenticators {
+		id, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return id, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// WithIdentity returns a context with the identity of a request
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the identity of a request, or nil if it is
+// unauthenticated
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+// WriteError writes a 401 or 403 response with a message. 401 responses ask
+// for a bearer token or API key.
+func WriteError(w http.ResponseWriter, status int, message string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="dime"`)
+		w.Header().Add("WWW-Authenticate", `ApiKey realm="dime", header="X-API-Key"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(Error{
+		Status:  status,
+		Error:   http.StatusText(status),
+		Message: message,
+	})
+}
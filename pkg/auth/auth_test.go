@@ -0,0 +1,333 @@
+package auth_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeys(t *testing.T) {
+	sum := sha256.Sum256([]byte("hashed"))
+	file := filepath.Join(t.TempDir(), "keys.json")
+	assert.NoError(t, os.WriteFile(file, []byte(`{"keys":[
+		{"name":"reporting","key":"s3cret"},
+		{"name":"replica","sha256":"`+hex.EncodeToString(sum[:])+`"}
+	]}`), 0600))
+	keys, err := auth.LoadAPIKeys(file)
+	assert.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/dicoms", nil)
+	_, err = keys.Authenticate(r)
+	assert.ErrorIs(t, err, auth.ErrNoCredentials)
+
+	r.Header.Set(auth.APIKeyHeader, "s3cret")
+	id, err := keys.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, &auth.Identity{Subject: "reporting", Method: auth.MethodAPIKey}, id)
+
+	r.Header.Set(auth.APIKeyHeader, "hashed")
+	id, err = keys.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "replica", id.Subject)
+
+	r.Header.Set(auth.APIKeyHeader, "wrong")
+	_, err = keys.Authenticate(r)
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+
+	for _, cfg := range []auth.APIKeysConfig{
+		{Keys: []auth.APIKey{{Key: "s3cret"}}},
+		{Keys: []auth.APIKey{{Name: "a"}}},
+		{Keys: []auth.APIKey{{Name: "a", Key: "s3cret", SHA256: hex.EncodeToString(sum[:])}}},
+		{Keys: []auth.APIKey{{Name: "a", SHA256: "abc"}}},
+		{Keys: []auth.APIKey{{Name: "a", Key: "1"}, {Name: "a", Key: "2"}}},
+	} {
+		_, err := auth.NewAPIKeys(&cfg)
+		assert.Error(t, err)
+	}
+
+	_, err = auth.LoadAPIKeys(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	jwks := auth.JWKS{Keys: []auth.JWK{
+		{
+			Kty: "RSA",
+			Kid: "rsa",
+			Use: "sig",
+			N:   b64(rsaKey.N.Bytes()),
+			E:   b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+		},
+		{
+			Kty: "EC",
+			Kid: "ec",
+			Crv: "P-256",
+			X:   b64(ecKey.X.FillBytes(make([]byte, 32))),
+			Y:   b64(ecKey.Y.FillBytes(make([]byte, 32))),
+		},
+	}}
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	b, err := json.Marshal(jwks)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(file, b, 0600))
+	now := time.Unix(1700000000, 0)
+	verifier, err := auth.LoadJWKS(file,
+		auth.WithIssuer("https://idp.example.com"),
+		auth.WithAudience("dime"),
+		auth.WithClock(func() time.Time { return now }))
+	assert.NoError(t, err)
+
+	claims := map[string]any{
+		"sub": "radiologist",
+		"iss": "https://idp.example.com",
+		"aud": []string{"pacs", "dime"},
+		"exp": now.Add(time.Hour).Unix(),
+	}
+
+	// RS256, PS256 and ES256 tokens are valid
+	for _, token := range []string{
+		signRSA(t, rsaKey, "RS256", "rsa", claims),
+		signRSA(t, rsaKey, "PS256", "rsa", claims),
+		signEC(t, ecKey, "ES256", "ec", claims),
+		signEC(t, ecKey, "ES256", "", claims),
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/dicoms", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		id, err := verifier.Authenticate(r)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "radiologist", id.Subject)
+			assert.Equal(t, auth.MethodJWT, id.Method)
+			assert.Equal(t, "https://idp.example.com", id.Claims["iss"])
+		}
+	}
+
+	// A request without a bearer token has no credentials
+	r := httptest.NewRequest(http.MethodGet, "/dicoms", nil)
+	_, err = verifier.Authenticate(r)
+	assert.ErrorIs(t, err, auth.ErrNoCredentials)
+	r.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	_, err = verifier.Authenticate(r)
+	assert.ErrorIs(t, err, auth.ErrNoCredentials)
+
+	// Invalid tokens
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	with := func(k string, v any) map[string]any {
+		c := map[string]any{}
+		for name, claim := range claims {
+			c[name] = claim
+		}
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+	for name, token := range map[string]string{
+		"malformed":       "abc.def",
+		"wrong key":       signRSA(t, other, "RS256", "rsa", claims),
+		"wrong kid":       signRSA(t, rsaKey, "RS256", "ec", claims),
+		"wrong kty":       signRSA(t, rsaKey, "ES256", "rsa", claims),
+		"none":            b64([]byte(`{"alg":"none"}`)) + "." + b64(mustJSON(t, claims)) + ".",
+		"HS256":           signHMACHeader(t, claims),
+		"expired":         signRSA(t, rsaKey, "RS256", "rsa", with("exp", now.Add(-time.Hour).Unix())),
+		"no exp":          signRSA(t, rsaKey, "RS256", "rsa", with("exp", nil)),
+		"not valid yet":   signRSA(t, rsaKey, "RS256", "rsa", with("nbf", now.Add(time.Hour).Unix())),
+		"wrong issuer":    signRSA(t, rsaKey, "RS256", "rsa", with("iss", "https://other.example.com")),
+		"wrong audience":  signRSA(t, rsaKey, "RS256", "rsa", with("aud", "pacs")),
+		"tampered claims": tamper(signRSA(t, rsaKey, "RS256", "rsa", claims), with("sub", "admin")),
+	} {
+		_, err := verifier.Verify(token)
+		assert.ErrorIs(t, err, auth.ErrInvalidCredentials, name)
+	}
+
+	// Tokens within the leeway of exp are valid
+	_, err = verifier.Verify(signRSA(t, rsaKey, "RS256", "rsa", with("exp", now.Add(-30*time.Second).Unix())))
+	assert.NoError(t, err)
+
+	// JWKS without signing keys or with unsupported keys fail
+	for _, jwks := range []auth.JWKS{
+		{},
+		{Keys: []auth.JWK{{Kty: "RSA", Use: "enc", N: b64(rsaKey.N.Bytes()), E: "AQAB"}}},
+		{Keys: []auth.JWK{{Kty: "oct"}}},
+		{Keys: []auth.JWK{{Kty: "EC", Crv: "P-224"}}},
+		{Keys: []auth.JWK{{Kty: "EC", Crv: "P-256", X: b64([]byte{1}), Y: b64([]byte{2})}}},
+		{Keys: []auth.JWK{{Kty: "RSA", Alg: "HS256", N: b64(rsaKey.N.Bytes()), E: "AQAB"}}},
+	} {
+		_, err := auth.NewJWT(&jwks)
+		assert.Error(t, err)
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	certs := auth.NewClientCertificates()
+	r := httptest.NewRequest(http.MethodGet, "/dicoms", nil)
+	_, err := certs.Authenticate(r)
+	assert.ErrorIs(t, err, auth.ErrNoCredentials)
+	r.TLS = &tls.ConnectionState{}
+	_, err = certs.Authenticate(r)
+	assert.ErrorIs(t, err, auth.ErrNoCredentials)
+
+	// The common name is the subject and organizational units are groups
+	r.TLS.PeerCertificates = []*x509.Certificate{{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "modality", OrganizationalUnit: []string{"radiology", "ct"}},
+	}}
+	id, err := certs.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, &auth.Identity{
+		Subject: "modality",
+		Method:  auth.MethodCertificate,
+		Claims: map[string]any{
+			"sub":    "modality",
+			"dn":     "CN=modality,OU=radiology+OU=ct",
+			"serial": "42",
+			"groups": []any{"radiology", "ct"},
+		},
+	}, id)
+
+	// Certificates without a common name fall back to their email or DNS name
+	r.TLS.PeerCertificates = []*x509.Certificate{{SerialNumber: big.NewInt(43), DNSNames: []string{"gateway.example.com"}}}
+	id, err = certs.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "gateway.example.com", id.Subject)
+	r.TLS.PeerCertificates = []*x509.Certificate{{SerialNumber: big.NewInt(44), EmailAddresses: []string{"ops@example.com"}, DNSNames: []string{"gateway.example.com"}}}
+	id, err = certs.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "ops@example.com", id.Subject)
+	r.TLS.PeerCertificates = []*x509.Certificate{{SerialNumber: big.NewInt(45)}}
+	_, err = certs.Authenticate(r)
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+}
+
+func TestAuthenticate(t *testing.T) {
+	keys, err := auth.NewAPIKeys(&auth.APIKeysConfig{Keys: []auth.APIKey{{Name: "reporting", Key: "s3cret"}}})
+	assert.NoError(t, err)
+	authenticators := []auth.Authenticator{keys, failing{}}
+
+	r := httptest.NewRequest(http.MethodGet, "/dicoms", nil)
+	r.Header.Set(auth.APIKeyHeader, "s3cret")
+	id, err := auth.Authenticate(r, authenticators)
+	assert.NoError(t, err)
+	assert.Equal(t, "reporting", id.Subject)
+
+	// The first authenticator that finds credentials decides
+	r.Header.Set(auth.APIKeyHeader, "wrong")
+	_, err = auth.Authenticate(r, authenticators)
+	assert.ErrorIs(t, err, auth.ErrInvalidCredentials)
+
+	r.Header.Del(auth.APIKeyHeader)
+	_, err = auth.Authenticate(r, authenticators)
+	assert.EqualError(t, err, "failing")
+
+	_, err = auth.Authenticate(r, nil)
+	assert.ErrorIs(t, err, auth.ErrNoCredentials)
+
+	ctx := auth.WithIdentity(context.Background(), &auth.Identity{Subject: "reporting"})
+	assert.Equal(t, "reporting", auth.FromContext(ctx).Subject)
+	assert.Nil(t, auth.FromContext(context.Background()))
+}
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	auth.WriteError(w, http.StatusUnauthorized, "no credentials")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Len(t, w.Header().Values("WWW-Authenticate"), 2)
+	var e auth.Error
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&e))
+	assert.Equal(t, auth.Error{Status: 401, Error: "Unauthorized", Message: "no credentials"}, e)
+
+	w = httptest.NewRecorder()
+	auth.WriteError(w, http.StatusForbidden, "forbidden")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Values("WWW-Authenticate"))
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&e))
+	assert.Equal(t, auth.Error{Status: 403, Error: "Forbidden", Message: "forbidden"}, e)
+}
+
+// failing is an authenticator that fails every request
+type failing struct{}
+
+func (failing) Authenticate(*http.Request) (*auth.Identity, error) {
+	return nil, errors.New("failing")
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func mustJSON(t *testing.T, v any) []byte {
+	b, err := json.Marshal(v)
+	assert.NoError(t, err)
+	return b
+}
+
+func signingInput(t *testing.T, alg, kid string, claims map[string]any) string {
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	return b64(mustJSON(t, header)) + "." + b64(mustJSON(t, claims))
+}
+
+func signRSA(t *testing.T, key *rsa.PrivateKey, alg, kid string, claims map[string]any) string {
+	input := signingInput(t, alg, kid, claims)
+	digest := sha256.Sum256([]byte(input))
+	var sig []byte
+	var err error
+	if alg == "PS256" {
+		sig, err = rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], nil)
+	} else {
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	}
+	assert.NoError(t, err)
+	return input + "." + b64(sig)
+}
+
+func signEC(t *testing.T, key *ecdsa.PrivateKey, alg, kid string, claims map[string]any) string {
+	input := signingInput(t, alg, kid, claims)
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	assert.NoError(t, err)
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return input + "." + b64(sig)
+}
+
+func signHMACHeader(t *testing.T, claims map[string]any) string {
+	return signingInput(t, "HS256", "", claims) + "." + b64([]byte("signature"))
+}
+
+// tamper replaces the claims of a token, keeping its signature
+func tamper(token string, claims map[string]any) string {
+	b, _ := json.Marshal(claims)
+	parts := strings.Split(token, ".")
+	return parts[0] + "." + b64(b) + "." + parts[2]
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ClientCertificates authenticates requests by the client certificate of
+// their TLS connection. The certificate must have been verified in the
+// handshake, as a certs.Reloader with client CAs does. The subject is the
+// common name of the certificate, or its first email or DNS name if it has
+// none, and its organizational units are the groups claim. The identity has
+// the certificate method, so a certificate with the common name of an API key
+// or the subject of a JWT isn't granted the roles of that identity.
+type ClientCertificates struct{}
+
+// NewClientCertificates returns a ClientCertificates authenticator
+func NewClientCertificates() *ClientCertificates {
+	return &ClientCertificates{}
+}
+
+// Authenticate a request by its client certificate
+func (c *ClientCertificates) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, ErrNoCredentials
+	}
+	cert := r.TLS.PeerCertificates[0]
+	sub := cert.Subject.CommonName
+	if sub == "" && len(cert.EmailAddresses) > 0 {
+		sub = cert.EmailAddresses[0]
+	}
+	if sub == "" && len(cert.DNSNames) > 0 {
+		sub = cert.DNSNames[0]
+	}
+	if sub == "" {
+		return nil, fmt.Errorf("%w: client certificate has no subject", ErrInvalidCredentials)
+	}
+	claims := map[string]any{
+		"sub":    sub,
+		"dn":     cert.Subject.String(),
+		"serial": cert.SerialNumber.String(),
+	}
+	if len(cert.Subject.OrganizationalUnit) > 0 {
+		groups := make([]any, len(cert.Subject.OrganizationalUnit))
+		for i, ou := range cert.Subject.OrganizationalUnit {
+			groups[i] = ou
+		}
+		claims["groups"] = groups
+	}
+	return &Identity{Subject: sub, Method: MethodCertificate, Claims: claims}, nil
+}
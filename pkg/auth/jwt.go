@@ -0,0 +1,342 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // register hashes of JWT algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultLeeway is the clock skew allowed checking exp and nbf
+const defaultLeeway = time.Minute
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK is a JSON Web Key. RSA keys have n and e and EC keys have crv, x and y.
+type JWK struct {
+	Kty string `json:"kty" example:"RSA"`
+	Kid string `json:"kid,omitempty" example:"2024-01"`
+	Alg string `json:"alg,omitempty" example:"RS256"`
+	Use string `json:"use,omitempty" example:"sig"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWT authenticates requests by a JWT bearer token in their Authorization
+// header, signed by a key of a JWKS
+type JWT struct {
+	keys     []jwtKey
+	issuer   string
+	audience string
+	leeway   time.Duration
+	now      func() time.Time
+}
+
+// jwtKey is a JWK with its public key decoded
+type jwtKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+// jwtAlgorithm is a JWT signature algorithm
+type jwtAlgorithm struct {
+	hash crypto.Hash
+	kty  string
+	pss  bool
+}
+
+// jwtAlgorithms are the signature algorithms of tokens that are accepted.
+// Tokens with "none" or HMAC signatures are rejected.
+var jwtAlgorithms = map[string]jwtAlgorithm{
+	"RS256": {hash: crypto.SHA256, kty: "RSA"},
+	"RS384": {hash: crypto.SHA384, kty: "RSA"},
+	"RS512": {hash: crypto.SHA512, kty: "RSA"},
+	"PS256": {hash: crypto.SHA256, kty: "RSA", pss: true},
+	"PS384": {hash: crypto.SHA384, kty: "RSA", pss: true},
+	"PS512": {hash: crypto.SHA512, kty: "RSA", pss: true},
+	"ES256": {hash: crypto.SHA256, kty: "EC"},
+	"ES384": {hash: crypto.SHA384, kty: "EC"},
+	"ES512": {hash: crypto.SHA512, kty: "EC"},
+}
+
+// JWTOption is an option of a JWT
+type JWTOption func(*JWT)
+
+// WithIssuer requires tokens to have an iss claim of issuer
+func WithIssuer(issuer string) JWTOption {
+	return func(j *JWT) {
+		j.issuer = issuer
+	}
+}
+
+// WithAudience requires tokens to have an aud claim with audience
+func WithAudience(audience string) JWTOption {
+	return func(j *JWT) {
+		j.audience = audience
+	}
+}
+
+// WithLeeway sets the clock skew allowed checking exp and nbf
+func WithLeeway(leeway time.Duration) JWTOption {
+	return func(j *JWT) {
+		j.leeway = leeway
+	}
+}
+
+// WithClock sets the clock checking exp and nbf
+func WithClock(now func() time.Time) JWTOption {
+	return func(j *JWT) {
+		j.now = now
+	}
+}
+
+// LoadJWKS loads a JWT authenticator with the keys of a JWKS file
+func LoadJWKS(file string, opts ...JWTOption) (*JWT, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwks: %w", err)
+	}
+	var jwks JWKS
+	err = json.Unmarshal(b, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse jwks: %w", err)
+	}
+	return NewJWT(&jwks, opts...)
+}
+
+// NewJWT returns a JWT authenticator with the keys of a JWKS. Keys that are
+// not for signatures are skipped.
+func NewJWT(jwks *JWKS, opts ...JWTOption) (*JWT, error) {
+	j := &JWT{
+		leeway: defaultLeeway,
+		now:    time.Now,
+	}
+	for _, opt := range opts {
+		opt(j)
+	}
+	for i, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if k.Alg != "" {
+			if _, ok := jwtAlgorithms[k.Alg]; !ok {
+				return nil, fmt.Errorf("jwk %d: unsupported alg %q", i+1, k.Alg)
+			}
+		}
+		key, err := publicKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("jwk %d: %w", i+1, err)
+		}
+		j.keys = append(j.keys, jwtKey{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	if len(j.keys) == 0 {
+		return nil, fmt.Errorf("jwks has no signing keys")
+	}
+	return j, nil
+}
+
+// Authenticate a request by its bearer token
+func (j *JWT) Authenticate(r *http.Request) (*Identity, error) {
+	header := r.Header.Get("Authorization")
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return nil, ErrNoCredentials
+	}
+	claims, err := j.Verify(strings.TrimSpace(token))
+	if err != nil {
+		return nil, err
+	}
+	sub, _ := claims["sub"].(string)
+	return &Identity{Subject: sub, Method: MethodJWT, Claims: claims}, nil
+}
+
+// Verify the signature and claims of a token and return its claims
+func (j *JWT) Verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidCredentials)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed header", ErrInvalidCredentials)
+	}
+	alg, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported alg %q", ErrInvalidCredentials, header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidCredentials)
+	}
+	h := alg.hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+	verified := false
+	for _, k := range j.keys {
+		if header.Kid != "" && k.kid != "" && header.Kid != k.kid {
+			continue
+		}
+		if k.alg != "" && k.alg != header.Alg {
+			continue
+		}
+		if verify(alg, k.key, digest, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: invalid signature", ErrInvalidCredentials)
+	}
+	var claims map[string]any
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed claims", ErrInvalidCredentials)
+	}
+	err = j.validate(claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	return claims, nil
+}
+
+// validate the registered claims of a token
+func (j *JWT) validate(claims map[string]any) error {
+	now := j.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("token has no exp")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(j.leeway)) {
+		return fmt.Errorf("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(j.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("token is not valid yet")
+	}
+	if j.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != j.issuer {
+			return fmt.Errorf("token has wrong issuer")
+		}
+	}
+	if j.audience != "" && !hasAudience(claims["aud"], j.audience) {
+		return fmt.Errorf("token has wrong audience")
+	}
+	return nil
+}
+
+// hasAudience returns whether an aud claim, a string or list of strings,
+// has an audience
+func hasAudience(aud any, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verify a signature of a digest
+func verify(alg jwtAlgorithm, key crypto.PublicKey, digest, sig []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg.kty != "RSA" {
+			return false
+		}
+		if alg.pss {
+			return rsa.VerifyPSS(key, alg.hash, digest, sig, nil) == nil
+		}
+		return rsa.VerifyPKCS1v15(key, alg.hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg.kty != "EC" || len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// publicKey decodes the public key of a JWK
+func publicKey(k JWK) (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil || len(n) == 0 {
+			return nil, fmt.Errorf("invalid n")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid e")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported crv %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x")
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y")
+		}
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("point is not on curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported kty %q", k.Kty)
+}
+
+// decodeSegment decodes a base64url JSON segment of a token
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
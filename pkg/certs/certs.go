@@ -0,0 +1,282 @@
+// Package certs provides TLS configurations whose certificate and client CAs
+// are loaded from files and reloaded when the files change, so certificates
+// are renewed without restarting dime or dropping connections
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultInterval = 30 * time.Second
+
+// ClientAuth is whether clients are asked for a certificate
+type ClientAuth string
+
+// Client authentication modes
+const (
+	// ClientAuthNone doesn't ask clients for a certificate
+	ClientAuthNone ClientAuth = "none"
+	// ClientAuthRequest asks clients for a certificate and verifies it if
+	// they send one
+	ClientAuthRequest ClientAuth = "request"
+	// ClientAuthRequire requires clients to send a certificate that verifies
+	ClientAuthRequire ClientAuth = "require"
+)
+
+// Config is the files of a TLS configuration. ClientAuth defaults to request
+// if ClientCAFile is set and none if it isn't.
+type Config struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	ClientAuth   ClientAuth
+}
+
+// Reloader holds the certificate and client CAs of a Config, polling their
+// files and reloading them when they change. Handshakes after a reload use
+// the new certificate while open connections carry on. A reload that fails,
+// such as when the certificate has been written but its key not yet, is
+// logged and retried at the next poll.
+type Reloader struct {
+	cfg      Config
+	interval time.Duration
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	seen      map[string]fileState
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// fileState is the state of a file when it was last loaded
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// Option configures a Reloader
+type Option func(*Reloader)
+
+// WithInterval sets how often the files are polled for changes
+func WithInterval(d time.Duration) Option {
+	return func(r *Reloader) {
+		r.interval = d
+	}
+}
+
+// New returns a Reloader of a Config, loading its files
+func New(cfg Config, opts ...Option) (*Reloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("tls requires a certificate and key file")
+	}
+	switch cfg.ClientAuth {
+	case "":
+		cfg.ClientAuth = ClientAuthNone
+		if cfg.ClientCAFile != "" {
+			cfg.ClientAuth = ClientAuthRequest
+		}
+	case ClientAuthNone:
+	case ClientAuthRequest, ClientAuthRequire:
+		if cfg.ClientCAFile == "" {
+			return nil, fmt.Errorf("client auth %q requires a client CA file", cfg.ClientAuth)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported client auth %q", cfg.ClientAuth)
+	}
+	r := &Reloader{
+		cfg:      cfg,
+		interval: defaultInterval,
+		quit:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ClientAuth returns whether clients are asked for a certificate
+func (r *Reloader) ClientAuth() ClientAuth {
+	return r.cfg.ClientAuth
+}
+
+// Config returns a TLS configuration that serves the current certificate and
+// verifies client certificates against the current client CAs
+func (r *Reloader) Config() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.getCertificate,
+	}
+	// Client certificates are verified by verifyClient rather than by
+	// ClientCAs so that reloaded client CAs apply to new handshakes. It is
+	// called by VerifyConnection, which unlike VerifyPeerCertificate is also
+	// called when a session is resumed, so a resumed session whose client
+	// certificate no longer verifies fails too.
+	switch r.cfg.ClientAuth {
+	case ClientAuthRequest:
+		cfg.ClientAuth = tls.RequestClientCert
+		cfg.VerifyConnection = r.verifyClient
+	case ClientAuthRequire:
+		cfg.ClientAuth = tls.RequireAnyClientCert
+		cfg.VerifyConnection = r.verifyClient
+	}
+	return cfg
+}
+
+// ClientConfig returns a TLS configuration for connecting to servers, which
+// presents the current certificate if a server asks for one and verifies
+// servers against the system roots
+func (r *Reloader) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.getCertificate(nil)
+		},
+	}
+}
+
+// Listen returns a listener that accepts TLS connections on a listener, such
+// as that of a dimse.Server
+func (r *Reloader) Listen(ln net.Listener) net.Listener {
+	return tls.NewListener(ln, r.Config())
+}
+
+// Start polling the files for changes
+func (r *Reloader) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.quit:
+				return
+			case <-ticker.C:
+				r.poll()
+			}
+		}
+	}()
+}
+
+// Stop polling the files
+func (r *Reloader) Stop() {
+	close(r.quit)
+	r.wg.Wait()
+}
+
+// poll the files and reload them if any has changed
+func (r *Reloader) poll() {
+	if !r.changed() {
+		return
+	}
+	err := r.load()
+	if err != nil {
+		slog.Error("Failed to reload TLS certificate", slog.String("error", err.Error()))
+		return
+	}
+	slog.Info("Reloaded TLS certificate", slog.String("file", r.cfg.CertFile))
+}
+
+// files returns the files of the configuration
+func (r *Reloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+	return files
+}
+
+// changed returns whether any file has changed since it was loaded
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, file := range r.files() {
+		fi, err := os.Stat(file)
+		if err != nil || r.seen[file] != (fileState{size: fi.Size(), modTime: fi.ModTime()}) {
+			return true
+		}
+	}
+	return false
+}
+
+// load the files, keeping those loaded before if any fails to load
+func (r *Reloader) load() error {
+	// Files are stat'ed before they are read so a file that changes while it
+	// is read is loaded again at the next poll
+	seen := map[string]fileState{}
+	for _, file := range r.files() {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to read tls file: %w", err)
+		}
+		seen[file] = fileState{size: fi.Size(), modTime: fi.ModTime()}
+	}
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+	var clientCAs *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		b, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CAs: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates in client CA file %s", r.cfg.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.seen = seen
+	r.mu.Unlock()
+	return nil
+}
+
+// getCertificate returns the current certificate for a handshake
+func (r *Reloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// verifyClient verifies the certificate a client sent on a connection, if
+// any, against the current client CAs
+func (r *Reloader) verifyClient(cs tls.ConnectionState) error {
+	certs := cs.PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	r.mu.RLock()
+	roots := r.clientCAs
+	r.mu.RUnlock()
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	if err != nil {
+		return fmt.Errorf("failed to verify client certificate: %w", err)
+	}
+	return nil
+}
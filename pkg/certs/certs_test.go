@@ -0,0 +1,313 @@
+package certs_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/certs"
+	"github.com/johnmarkli/dime/pkg/dimse"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+)
+
+// authority is a CA that issues test certificates
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	file string
+}
+
+var serial int64
+
+// newAuthority returns a CA with its certificate written to a file
+func newAuthority(t *testing.T) *authority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "dime test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	ca := &authority{cert: cert, key: key, pool: x509.NewCertPool()}
+	ca.pool.AddCert(cert)
+	ca.file = filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(ca.file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	return ca
+}
+
+// issue a certificate for a name, writing it and its key to files in dir
+func (ca *authority) issue(t *testing.T, dir, name string, usage x509.ExtKeyUsage) (certFile, keyFile string, cert tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name, OrganizationalUnit: []string{"radiology"}},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	assert.NoError(t, os.WriteFile(certFile, certPEM, 0600))
+	assert.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	assert.NoError(t, err)
+	cert.Leaf, err = x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return certFile, keyFile, cert
+}
+
+// serve HTTPS with a TLS configuration, returning the address
+func serve(t *testing.T, cfg *tls.Config) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(r.TLS.PeerCertificates) > 0 {
+				w.Header().Set("X-Client", r.TLS.PeerCertificates[0].Subject.CommonName)
+			}
+		}),
+		TLSConfig: cfg,
+	}
+	go s.ServeTLS(ln, "", "")
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String()
+}
+
+// newClient returns an HTTP client that trusts a CA and has client
+// certificates
+func newClient(ca *authority, certs ...tls.Certificate) *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      ca.pool,
+			Certificates: certs,
+		}},
+	}
+}
+
+// serverSerial returns the serial number of the certificate a connection
+// was served with
+func serverSerial(t *testing.T, rsp *http.Response) int64 {
+	if !assert.NotNil(t, rsp.TLS) {
+		return 0
+	}
+	return rsp.TLS.PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestReloader(t *testing.T) {
+	ca := newAuthority(t)
+	dir := t.TempDir()
+	certFile, keyFile, first := ca.issue(t, dir, "localhost", x509.ExtKeyUsageServerAuth)
+	r, err := certs.New(certs.Config{CertFile: certFile, KeyFile: keyFile}, certs.WithInterval(10*time.Millisecond))
+	assert.NoError(t, err)
+	assert.Equal(t, certs.ClientAuthNone, r.ClientAuth())
+	r.Start()
+	defer r.Stop()
+	addr := serve(t, r.Config())
+
+	// The first certificate is served
+	open := newClient(ca)
+	rsp, err := open.Get("https://" + addr)
+	assert.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, first.Leaf.SerialNumber.Int64(), serverSerial(t, rsp))
+
+	// A renewed certificate is served from the next handshake on
+	_, _, second := ca.issue(t, dir, "localhost", x509.ExtKeyUsageServerAuth)
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, later, later))
+	assert.NoError(t, os.Chtimes(keyFile, later, later))
+	assert.Eventually(t, func() bool {
+		rsp, err := newClient(ca).Get("https://" + addr)
+		if err != nil {
+			return false
+		}
+		rsp.Body.Close()
+		return rsp.TLS.PeerCertificates[0].SerialNumber.Int64() == second.Leaf.SerialNumber.Int64()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The open connection is kept
+	rsp, err = open.Get("https://" + addr)
+	assert.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, first.Leaf.SerialNumber.Int64(), serverSerial(t, rsp))
+
+	// A certificate that fails to load keeps the last one
+	assert.NoError(t, os.WriteFile(keyFile, []byte("not a key"), 0600))
+	time.Sleep(50 * time.Millisecond)
+	rsp, err = newClient(ca).Get("https://" + addr)
+	assert.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, second.Leaf.SerialNumber.Int64(), serverSerial(t, rsp))
+}
+
+func TestReloaderClientAuth(t *testing.T) {
+	ca := newAuthority(t)
+	certFile, keyFile, _ := ca.issue(t, t.TempDir(), "localhost", x509.ExtKeyUsageServerAuth)
+	_, _, client := ca.issue(t, t.TempDir(), "modality", x509.ExtKeyUsageClientAuth)
+	_, _, server := ca.issue(t, t.TempDir(), "server", x509.ExtKeyUsageServerAuth)
+	_, _, stranger := newAuthority(t).issue(t, t.TempDir(), "stranger", x509.ExtKeyUsageClientAuth)
+
+	// Requested client certificates are optional
+	r, err := certs.New(certs.Config{CertFile: certFile, KeyFile: keyFile, ClientCAFile: ca.file})
+	assert.NoError(t, err)
+	assert.Equal(t, certs.ClientAuthRequest, r.ClientAuth())
+	addr := serve(t, r.Config())
+	rsp, err := newClient(ca).Get("https://" + addr)
+	assert.NoError(t, err)
+	rsp.Body.Close()
+	assert.Empty(t, rsp.Header.Get("X-Client"))
+	rsp, err = newClient(ca, client).Get("https://" + addr)
+	assert.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, "modality", rsp.Header.Get("X-Client"))
+
+	// Certificates of other CAs or not for client auth fail
+	_, err = newClient(ca, stranger).Get("https://" + addr)
+	assert.Error(t, err)
+	_, err = newClient(ca, server).Get("https://" + addr)
+	assert.Error(t, err)
+
+	// Required client certificates are not optional
+	r, err = certs.New(certs.Config{CertFile: certFile, KeyFile: keyFile, ClientCAFile: ca.file, ClientAuth: certs.ClientAuthRequire})
+	assert.NoError(t, err)
+	addr = serve(t, r.Config())
+	_, err = newClient(ca).Get("https://" + addr)
+	assert.Error(t, err)
+	rsp, err = newClient(ca, client).Get("https://" + addr)
+	assert.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, "modality", rsp.Header.Get("X-Client"))
+}
+
+func TestReloaderClientAuthResumed(t *testing.T) {
+	ca := newAuthority(t)
+	certFile, keyFile, _ := ca.issue(t, t.TempDir(), "localhost", x509.ExtKeyUsageServerAuth)
+	_, _, client := ca.issue(t, t.TempDir(), "modality", x509.ExtKeyUsageClientAuth)
+	caFile := filepath.Join(t.TempDir(), "clients.pem")
+	b, err := os.ReadFile(ca.file)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(caFile, b, 0600))
+	r, err := certs.New(certs.Config{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuth: certs.ClientAuthRequire},
+		certs.WithInterval(10*time.Millisecond))
+	assert.NoError(t, err)
+	r.Start()
+	defer r.Stop()
+	addr := serve(t, r.Config())
+
+	// Each request is a new connection that resumes the session of the first
+	c := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig: &tls.Config{
+				RootCAs:            ca.pool,
+				Certificates:       []tls.Certificate{client},
+				ClientSessionCache: tls.NewLRUClientSessionCache(1),
+			},
+		},
+	}
+	for _, resumed := range []bool{false, true} {
+		rsp, err := c.Get("https://" + addr)
+		if assert.NoError(t, err) {
+			rsp.Body.Close()
+			assert.Equal(t, resumed, rsp.TLS.DidResume)
+			assert.Equal(t, "modality", rsp.Header.Get("X-Client"))
+		}
+	}
+
+	// Once the client CAs are rotated, the session's client certificate no
+	// longer verifies and resuming it fails
+	other := newAuthority(t)
+	b, err = os.ReadFile(other.file)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(caFile, b, 0600))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(caFile, later, later))
+	assert.Eventually(t, func() bool {
+		rsp, err := c.Get("https://" + addr)
+		if err != nil {
+			return true
+		}
+		rsp.Body.Close()
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReloaderDIMSE(t *testing.T) {
+	ca := newAuthority(t)
+	certFile, keyFile, _ := ca.issue(t, t.TempDir(), "localhost", x509.ExtKeyUsageServerAuth)
+	_, _, client := ca.issue(t, t.TempDir(), "modality", x509.ExtKeyUsageClientAuth)
+	r, err := certs.New(certs.Config{CertFile: certFile, KeyFile: keyFile, ClientCAFile: ca.file, ClientAuth: certs.ClientAuthRequire})
+	assert.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := dimse.NewServer("STORESCP", func(string, *dicom.Dataset) error { return nil })
+	go s.Serve(r.Listen(ln))
+	defer s.Close()
+	addr := ln.Addr().String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cfg := &tls.Config{RootCAs: ca.pool, ServerName: "localhost", Certificates: []tls.Certificate{client}}
+	assert.NoError(t, dimse.NewClient(addr, "DIME", "STORESCP", dimse.WithTLS(cfg)).Echo(ctx))
+
+	// Associations without TLS or a client certificate fail
+	assert.Error(t, dimse.NewClient(addr, "DIME", "STORESCP").Echo(ctx))
+	cfg = &tls.Config{RootCAs: ca.pool, ServerName: "localhost"}
+	assert.Error(t, dimse.NewClient(addr, "DIME", "STORESCP", dimse.WithTLS(cfg)).Echo(ctx))
+}
+
+func TestNew(t *testing.T) {
+	ca := newAuthority(t)
+	certFile, keyFile, _ := ca.issue(t, t.TempDir(), "localhost", x509.ExtKeyUsageServerAuth)
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	for _, cfg := range []certs.Config{
+		{},
+		{CertFile: certFile},
+		{CertFile: missing, KeyFile: keyFile},
+		{CertFile: certFile, KeyFile: certFile},
+		{CertFile: certFile, KeyFile: keyFile, ClientCAFile: missing},
+		{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile},
+		{CertFile: certFile, KeyFile: keyFile, ClientAuth: certs.ClientAuthRequire},
+		{CertFile: certFile, KeyFile: keyFile, ClientCAFile: ca.file, ClientAuth: "verify"},
+	} {
+		_, err := certs.New(cfg)
+		assert.Error(t, err, cfg)
+	}
+}
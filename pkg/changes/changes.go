@@ -0,0 +1,510 @@
+// Package changes records an ordered log of the DICOMs created, updated and
+// deleted in a store
+package changes
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// Types of change
+const (
+	// Created is a DICOM stored for the first time
+	Created = "created"
+	// Updated is a DICOM stored again
+	Updated = "updated"
+	// Deleted is a DICOM deleted from the store
+	Deleted = "deleted"
+)
+
+const (
+	logFile                = "changes.jsonl"
+	compactedFile          = "compacted.json"
+	defaultPageLimit       = 100
+	maxPageLimit           = 1000
+	lockStripes            = 64
+	defaultDeleteRetention = 30 * 24 * time.Hour
+	minCompact             = 1000
+)
+
+// Event is a change to a DICOM in the store. Seq increases by one with each
+// event, though compaction leaves gaps where events were dropped.
+// SeriesInstances and StudyInstances are the Number of Series and Study
+// Related Instances of a DICOM, if it has them.
+type Event struct {
+	Seq               uint64    `json:"seq" example:"42"`
+	Type              string    `json:"type" example:"created"`
+	ID                string    `json:"id" example:"1.3.12.2.1107.5.2.6.24119.30000013121716094326500000436"`
+	StudyInstanceUID  string    `json:"studyInstanceUID,omitempty" example:"1.2.840.114202.4.833393677.4209323108.691055951.3610221745"`
+	SeriesInstanceUID string    `json:"seriesInstanceUID,omitempty" example:"1.3.12.2.1107.5.2.6.24119.30000013121716094326500000394"`
+	Modality          string    `json:"modality,omitempty" example:"MR"`
+	SOPClassUID       string    `json:"sopClassUID,omitempty" example:"1.2.840.10008.5.1.4.1.1.4"`
+	SeriesInstances   int       `json:"seriesInstances,omitempty" example:"24"`
+	StudyInstances    int       `json:"studyInstances,omitempty" example:"96"`
+	SHA256            string    `json:"sha256,omitempty" example:"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"`
+	Time              time.Time `json:"time"`
+}
+
+// Page is the events after a sequence number and the sequence number of the
+// last event in the log. Compacted is the sequence number of the last deleted
+// event dropped by compaction, so a consumer that has applied fewer events
+// may have missed deletes.
+type Page struct {
+	Changes   []Event `json:"changes"`
+	Last      uint64  `json:"last" example:"42"`
+	Compacted uint64  `json:"compacted,omitempty" example:"12"`
+}
+
+// compacted is the state of compaction kept alongside the journal
+type compacted struct {
+	Seq uint64 `json:"seq"`
+}
+
+// Log is an ordered log of the changes to a store. Events are appended to a
+// journal in a directory and synced before the change is acknowledged, so the
+// log survives a restart. Changes to the same DICOM are recorded in the order
+// they were made.
+//
+// The log is compacted each time it doubles in length, keeping only the last
+// event of each DICOM and dropping deleted events older than the delete
+// retention, so it grows with the DICOMs in the store rather than with every
+// change made to them.
+type Log struct {
+	dir             string
+	deleteRetention time.Duration
+
+	mu        sync.Mutex
+	events    []Event
+	instances map[string]Event
+	compacted uint64
+	kept      int
+	file      *os.File
+	notify    chan struct{}
+	locks     [lockStripes]sync.Mutex
+}
+
+// Option configures a Log
+type Option func(*Log)
+
+// WithDeleteRetention sets how long deleted events are kept once compaction
+// would drop them, which is how far behind a consumer can fall without
+// missing deletes
+func WithDeleteRetention(d time.Duration) Option {
+	return func(l *Log) {
+		l.deleteRetention = d
+	}
+}
+
+// New creates a Log with its journal in dir, loading the journal of a
+// previous run
+func New(dir string, opts ...Option) (*Log, error) {
+	l := &Log{
+		dir:             dir,
+		deleteRetention: defaultDeleteRetention,
+		instances:       map[string]Event{},
+		notify:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	err = l.load()
+	if err != nil {
+		return nil, err
+	}
+	l.file, err = os.OpenFile(filepath.Join(dir, logFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open change log: %w", err)
+	}
+	l.mu.Lock()
+	l.maybeCompact()
+	l.mu.Unlock()
+	return l, nil
+}
+
+// Close the journal
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Last returns the sequence number of the last event, or 0 if there are none
+func (l *Log) Last() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.last()
+}
+
+// Since returns up to limit events after a sequence number, 100 if limit is
+// 0 and at most 1000
+func (l *Log) Since(seq uint64, limit int) Page {
+	if limit <= 0 {
+		limit = defaultPageLimit
+	}
+	limit = min(limit, maxPageLimit)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := sort.Search(len(l.events), func(i int) bool {
+		return l.events[i].Seq > seq
+	})
+	end := min(i+limit, len(l.events))
+	return Page{
+		Changes:   append([]Event{}, l.events[i:end]...),
+		Last:      l.last(),
+		Compacted: l.compacted,
+	}
+}
+
+// Wait until there are events after a sequence number, returning false if
+// the context is done first
+func (l *Log) Wait(ctx context.Context, seq uint64) bool {
+	for {
+		l.mu.Lock()
+		if l.last() > seq {
+			l.mu.Unlock()
+			return true
+		}
+		notify := l.notify
+		l.mu.Unlock()
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Backfill records a created event for each DICOM in a store that isn't in
+// the log, such as those stored before the log was kept, returning how many
+// were recorded
+func (l *Log) Backfill(st store.Store) (int, error) {
+	n := 0
+	err := store.Walk(st, func(dcm *store.DICOM) error {
+		l.mu.Lock()
+		_, ok := l.instances[dcm.ID]
+		l.mu.Unlock()
+		if ok {
+			return nil
+		}
+		err := l.record(Created, dcm)
+		if err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// Wrap a store so that the DICOMs created and deleted in it are recorded in
+// the log
+func (l *Log) Wrap(st store.Store) store.Store {
+	return &loggedStore{Store: st, l: l}
+}
+
+// record an event for a DICOM, appending it to the journal
+func (l *Log) record(typ string, dcm *store.DICOM) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if typ == Created {
+		if _, ok := l.instances[dcm.ID]; ok {
+			typ = Updated
+		}
+	}
+	e := Event{
+		Seq:               l.last() + 1,
+		Type:              typ,
+		ID:                dcm.ID,
+		StudyInstanceUID:  dcm.StudyInstanceUID,
+		SeriesInstanceUID: dcm.SeriesInstanceUID,
+		Modality:          stringValue(dcm, tag.Modality),
+		SOPClassUID:       stringValue(dcm, tag.SOPClassUID),
+		SeriesInstances:   intValue(dcm, tag.NumberOfSeriesRelatedInstances),
+		StudyInstances:    intValue(dcm, tag.NumberOfStudyRelatedInstances),
+		SHA256:            dcm.SHA256,
+		Time:              time.Now().UTC(),
+	}
+	if typ == Deleted {
+		e.SHA256 = ""
+		e.SeriesInstances, e.StudyInstances = 0, 0
+		if prev, ok := l.instances[dcm.ID]; ok {
+			e.Modality, e.SOPClassUID = prev.Modality, prev.SOPClassUID
+		}
+	}
+	b, err := json.Marshal(e)
+	if err == nil {
+		_, err = l.file.Write(append(b, '\n'))
+	}
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write change log: %w", err)
+	}
+	l.apply(e)
+	l.maybeCompact()
+	return nil
+}
+
+// maybeCompact compacts the log if it has doubled in length since it was
+// last compacted, logging a compaction that fails as the events it would
+// have dropped are still in the journal. The caller must hold the lock.
+func (l *Log) maybeCompact() {
+	if len(l.events) < max(minCompact, 2*l.kept) {
+		return
+	}
+	before := len(l.events)
+	err := l.compact()
+	l.kept = len(l.events)
+	if err != nil {
+		slog.Error("Failed to compact change log", slog.String("error", err.Error()))
+		return
+	}
+	slog.Info("Compacted change log", slog.Int("before", before), slog.Int("after", len(l.events)))
+}
+
+// compact the log, keeping the last event of each DICOM and deleted events
+// within the delete retention. The last event of the log is always kept so
+// its sequence number survives a restart. The journal is rewritten to a temp
+// file and renamed in to place. The caller must hold the lock.
+func (l *Log) compact() error {
+	latest := make(map[string]uint64, len(l.instances))
+	for _, e := range l.events {
+		latest[e.ID] = e.Seq
+	}
+	cutoff := time.Now().Add(-l.deleteRetention)
+	seq := l.compacted
+	var kept []Event
+	for i, e := range l.events {
+		if i < len(l.events)-1 {
+			if latest[e.ID] != e.Seq {
+				continue
+			}
+			if e.Type == Deleted && e.Time.Before(cutoff) {
+				seq = max(seq, e.Seq)
+				continue
+			}
+		}
+		kept = append(kept, e)
+	}
+
+	// The compacted sequence number is written first so a crash before the
+	// journal is replaced only overstates it
+	if seq != l.compacted {
+		b, err := json.Marshal(compacted{Seq: seq})
+		if err != nil {
+			return err
+		}
+		err = writeFile(filepath.Join(l.dir, compactedFile), b)
+		if err != nil {
+			return err
+		}
+		l.compacted = seq
+	}
+	var b []byte
+	for _, e := range kept {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		b = append(append(b, line...), '\n')
+	}
+	path := filepath.Join(l.dir, logFile)
+	err := writeFile(path, b)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open change log: %w", err)
+	}
+	l.file.Close()
+	l.file = file
+	l.events = kept
+	return nil
+}
+
+// writeFile writes a file to a temp file, syncs it and renames it in to place
+func writeFile(path string, b []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// apply an event to the log, waking those waiting for it. The caller must
+// hold the lock.
+func (l *Log) apply(e Event) {
+	l.events = append(l.events, e)
+	close(l.notify)
+	l.notify = make(chan struct{})
+	if e.Type == Deleted {
+		delete(l.instances, e.ID)
+	} else {
+		l.instances[e.ID] = e
+	}
+}
+
+// last returns the sequence number of the last event. The caller must hold
+// the lock.
+func (l *Log) last() uint64 {
+	if len(l.events) == 0 {
+		return 0
+	}
+	return l.events[len(l.events)-1].Seq
+}
+
+// load the events of the journal, skipping a partial event left by a crash
+func (l *Log) load() error {
+	b, err := os.ReadFile(filepath.Join(l.dir, compactedFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read change log compaction: %w", err)
+	}
+	if err == nil {
+		var c compacted
+		err = json.Unmarshal(b, &c)
+		if err != nil {
+			return fmt.Errorf("failed to parse change log compaction: %w", err)
+		}
+		l.compacted = c.Seq
+	}
+
+	f, err := os.Open(filepath.Join(l.dir, logFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open change log: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil || e.Seq <= l.last() {
+			slog.Error("Skipping unreadable change log event", slog.String("event", scanner.Text()))
+			continue
+		}
+		l.apply(e)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("failed to read change log: %w", err)
+	}
+	return nil
+}
+
+// lock returns the lock of a DICOM, which orders its changes
+func (l *Log) lock(id string) *sync.Mutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return &l.locks[h.Sum32()%lockStripes]
+}
+
+// loggedStore records the DICOMs created and deleted in a store
+type loggedStore struct {
+	store.Store
+	l *Log
+}
+
+// Create a DICOM in the store and record it as created or updated
+func (s *loggedStore) Create(dcm *store.DICOM) error {
+	mu := s.l.lock(dcm.ID)
+	mu.Lock()
+	defer mu.Unlock()
+	err := s.Store.Create(dcm)
+	if err != nil {
+		return err
+	}
+	return s.l.record(Created, dcm)
+}
+
+// Delete a DICOM from the store and record it as deleted
+func (s *loggedStore) Delete(id string) error {
+	mu := s.l.lock(id)
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Find the study and series of the DICOM before it is gone
+	s.l.mu.Lock()
+	e, ok := s.l.instances[id]
+	s.l.mu.Unlock()
+	dcm := &store.DICOM{ID: id, StudyInstanceUID: e.StudyInstanceUID, SeriesInstanceUID: e.SeriesInstanceUID}
+	if !ok {
+		if read, err := s.Store.Read(id); err == nil {
+			dcm = read
+		}
+	}
+	err := s.Store.Delete(id)
+	if err != nil {
+		return err
+	}
+	return s.l.record(Deleted, dcm)
+}
+
+// Walk calls fn with each DICOM of the store in turn
+func (s *loggedStore) Walk(fn func(dcm *store.DICOM) error) error {
+	return store.Walk(s.Store, fn)
+}
+
+// stringValue returns the first string value of an element of a DICOM, or ""
+// if it has no dataset
+func stringValue(dcm *store.DICOM, t tag.Tag) string {
+	if dcm.Dataset() == nil {
+		return ""
+	}
+	element, err := dcm.Dataset().FindElementByTag(t)
+	if err != nil {
+		return ""
+	}
+	values, ok := element.Value.GetValue().([]string)
+	if !ok || len(values) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(values[0])
+}
+
+// intValue returns the first integer string value of an element of a DICOM,
+// or 0 if it has none
+func intValue(dcm *store.DICOM, t tag.Tag) int {
+	n, err := strconv.Atoi(stringValue(dcm, t))
+	if err != nil {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,189 @@
+package changes_test
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/changes"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+)
+
+const (
+	testDataPath = "../../testdata/IM000001-mri"
+	testID       = "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000395"
+)
+
+func TestLog(t *testing.T) {
+	dir := t.TempDir()
+	l, err := changes.New(dir)
+	assert.NoError(t, err)
+	mem, err := store.NewMemStore()
+	assert.NoError(t, err)
+	st := l.Wrap(mem)
+
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+
+	// Creating, storing again and deleting a DICOM are recorded in order
+	assert.NoError(t, st.Create(dcm))
+	assert.NoError(t, st.Create(dcm))
+	assert.NoError(t, st.Delete(testID))
+	assert.ErrorIs(t, st.Delete(testID), store.ErrNotFound)
+	page := l.Since(0, 0)
+	assert.Equal(t, uint64(3), page.Last)
+	if assert.Len(t, page.Changes, 3) {
+		assert.Equal(t, changes.Created, page.Changes[0].Type)
+		assert.Equal(t, changes.Updated, page.Changes[1].Type)
+		assert.Equal(t, changes.Deleted, page.Changes[2].Type)
+		assert.Equal(t, uint64(3), page.Changes[2].Seq)
+		assert.Equal(t, testID, page.Changes[2].ID)
+		assert.Equal(t, dcm.StudyInstanceUID, page.Changes[2].StudyInstanceUID)
+		assert.Equal(t, dcm.SeriesInstanceUID, page.Changes[2].SeriesInstanceUID)
+		assert.Equal(t, "MR", page.Changes[0].Modality)
+		assert.Equal(t, "MR", page.Changes[2].Modality)
+		assert.Empty(t, page.Changes[2].SHA256)
+	}
+	page = l.Since(1, 1)
+	if assert.Len(t, page.Changes, 1) {
+		assert.Equal(t, uint64(2), page.Changes[0].Seq)
+	}
+	assert.Empty(t, l.Since(3, 0).Changes)
+
+	// The log survives a restart
+	assert.NoError(t, l.Close())
+	l, err = changes.New(dir)
+	assert.NoError(t, err)
+	defer l.Close()
+	assert.Equal(t, uint64(3), l.Last())
+	st = l.Wrap(mem)
+	assert.NoError(t, st.Create(dcm))
+	page = l.Since(3, 0)
+	if assert.Len(t, page.Changes, 1) {
+		assert.Equal(t, uint64(4), page.Changes[0].Seq)
+		assert.Equal(t, changes.Created, page.Changes[0].Type)
+	}
+}
+
+// nopStore is a store that creates and deletes nothing
+type nopStore struct {
+	store.Store
+}
+
+func (nopStore) Create(*store.DICOM) error { return nil }
+func (nopStore) Delete(string) error       { return nil }
+
+func TestLogCompact(t *testing.T) {
+	// A DICOM is deleted and another stored again until the log is long
+	// enough to compact
+	record := func(l *changes.Log) {
+		st := l.Wrap(nopStore{})
+		assert.NoError(t, st.Create(&store.DICOM{ID: "1.2.3"}))
+		assert.NoError(t, st.Create(&store.DICOM{ID: "4.5.6"}))
+		assert.NoError(t, st.Delete("4.5.6"))
+		for range 997 {
+			assert.NoError(t, st.Create(&store.DICOM{ID: "1.2.3"}))
+		}
+	}
+
+	// Only the last event of each DICOM is kept, along with recent deletes
+	l, err := changes.New(t.TempDir())
+	assert.NoError(t, err)
+	defer l.Close()
+	record(l)
+	page := l.Since(0, 0)
+	assert.Equal(t, uint64(1000), page.Last)
+	assert.Zero(t, page.Compacted)
+	if assert.Len(t, page.Changes, 2) {
+		assert.Equal(t, changes.Event{Seq: 3, Type: changes.Deleted, ID: "4.5.6", Time: page.Changes[0].Time}, page.Changes[0])
+		assert.Equal(t, uint64(1000), page.Changes[1].Seq)
+		assert.Equal(t, changes.Updated, page.Changes[1].Type)
+	}
+
+	// Deletes older than the delete retention are dropped too
+	dir := t.TempDir()
+	l, err = changes.New(dir, changes.WithDeleteRetention(0))
+	assert.NoError(t, err)
+	record(l)
+	page = l.Since(0, 0)
+	assert.Equal(t, uint64(1000), page.Last)
+	assert.Equal(t, uint64(3), page.Compacted)
+	if assert.Len(t, page.Changes, 1) {
+		assert.Equal(t, uint64(1000), page.Changes[0].Seq)
+	}
+
+	// The compacted log survives a restart and carries on from its last event
+	assert.NoError(t, l.Close())
+	f, err := os.Open(filepath.Join(dir, "changes.jsonl"))
+	assert.NoError(t, err)
+	lines := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		lines++
+	}
+	f.Close()
+	assert.Equal(t, 1, lines)
+	l, err = changes.New(dir)
+	assert.NoError(t, err)
+	defer l.Close()
+	page = l.Since(0, 0)
+	assert.Equal(t, uint64(1000), page.Last)
+	assert.Equal(t, uint64(3), page.Compacted)
+	assert.NoError(t, l.Wrap(nopStore{}).Create(&store.DICOM{ID: "4.5.6"}))
+	assert.Equal(t, uint64(1001), l.Last())
+}
+
+func TestLogBackfill(t *testing.T) {
+	mem, err := store.NewMemStore()
+	assert.NoError(t, err)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, mem.Create(dcm))
+
+	// DICOMs stored before the log was kept are recorded once
+	l, err := changes.New(t.TempDir())
+	assert.NoError(t, err)
+	defer l.Close()
+	n, err := l.Backfill(mem)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = l.Backfill(mem)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, uint64(1), l.Last())
+}
+
+func TestLogWait(t *testing.T) {
+	l, err := changes.New(t.TempDir())
+	assert.NoError(t, err)
+	defer l.Close()
+	mem, err := store.NewMemStore()
+	assert.NoError(t, err)
+	st := l.Wrap(mem)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+
+	// Waiting returns false when the context is done before a change
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.False(t, l.Wait(ctx, 0))
+
+	// Waiting returns true once a change is made
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, st.Create(dcm))
+	}()
+	assert.True(t, l.Wait(context.Background(), 0))
+	assert.True(t, l.Wait(context.Background(), 0))
+	assert.Equal(t, uint64(1), l.Last())
+}
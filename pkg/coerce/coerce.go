@@ -0,0 +1,292 @@
+// Package coerce provides a rules engine that coerces the attributes of
+// DICOMs as they are ingested
+package coerce
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// Operations that can be performed on an attribute
+const (
+	// OpSet sets the value of an attribute, adding it if it is missing
+	OpSet = "set"
+	// OpPrefix prefixes each value of an attribute
+	OpPrefix = "prefix"
+	// OpMap replaces each value of an attribute found in a map
+	OpMap = "map"
+	// OpRemove removes an attribute
+	OpRemove = "remove"
+)
+
+// Rule coerces attributes of DICOMs that match it
+type Rule struct {
+	Name    string   `json:"name" example:"site-a"`
+	Match   Match    `json:"match"`
+	Actions []Action `json:"actions"`
+}
+
+// Match selects the DICOMs a rule applies to. A DICOM matches if its source
+// matches the Source glob pattern and each attribute has a value matching
+// its regular expression. An empty Match matches every DICOM.
+type Match struct {
+	Source     string            `json:"source,omitempty" example:"10.0.1.*"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Action is an operation on an attribute. Attributes are given by tag, e.g.
+// (0008,0080), or keyword, e.g. InstitutionName.
+type Action struct {
+	Op    string            `json:"op" example:"set"`
+	Tag   string            `json:"tag" example:"InstitutionName"`
+	Value string            `json:"value,omitempty" example:"General Hospital"`
+	Map   map[string]string `json:"map,omitempty"`
+}
+
+// Change is a change made to an attribute by a rule
+type Change struct {
+	Rule string   `json:"rule" example:"site-a"`
+	Op   string   `json:"op" example:"set"`
+	Tag  string   `json:"tag" example:"(0008,0080)"`
+	Name string   `json:"name" example:"InstitutionName"`
+	Old  []string `json:"old"`
+	New  []string `json:"new"`
+}
+
+// Engine evaluates rules in order against DICOMs
+type Engine struct {
+	rules []rule
+}
+
+// rule is a compiled Rule
+type rule struct {
+	Rule
+	attributes map[tag.Tag]*regexp.Regexp
+	tags       []tag.Tag
+}
+
+// Load an Engine from a JSON file containing a list of rules
+func Load(file string) (*Engine, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read coercion rules: %w", err)
+	}
+	var rules []Rule
+	err = json.Unmarshal(b, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse coercion rules: %w", err)
+	}
+	return New(rules)
+}
+
+// New creates an Engine from a list of rules
+func New(rules []Rule) (*Engine, error) {
+	e := &Engine{}
+	for i, r := range rules {
+		compiled := rule{Rule: r, attributes: map[tag.Tag]*regexp.Regexp{}}
+		if r.Name == "" {
+			compiled.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if _, err := path.Match(r.Match.Source, ""); err != nil {
+			return nil, fmt.Errorf("%s: invalid source pattern: %w", compiled.Name, err)
+		}
+		for t, expr := range r.Match.Attributes {
+			parsed, err := ParseTag(t)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", compiled.Name, err)
+			}
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid pattern for %s: %w", compiled.Name, t, err)
+			}
+			compiled.attributes[parsed] = re
+		}
+		for _, a := range r.Actions {
+			switch a.Op {
+			case OpSet, OpPrefix, OpMap, OpRemove:
+			default:
+				return nil, fmt.Errorf("%s: unknown operation %q", compiled.Name, a.Op)
+			}
+			parsed, err := ParseTag(a.Tag)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", compiled.Name, err)
+			}
+			if a.Op != OpRemove && !isString(parsed) {
+				return nil, fmt.Errorf("%s: %s is not a string attribute", compiled.Name, a.Tag)
+			}
+			compiled.tags = append(compiled.tags, parsed)
+		}
+		e.rules = append(e.rules, compiled)
+	}
+	return e, nil
+}
+
+// Apply the rules to a dataset from a source, returning the changes made.
+// Each matching rule sees the changes made by the rules before it.
+func (e *Engine) Apply(ds *dicom.Dataset, source string) ([]Change, error) {
+	changes := []Change{}
+	for _, r := range e.rules {
+		if !r.matches(ds, source) {
+			continue
+		}
+		for i, a := range r.Actions {
+			change, err := apply(ds, r.tags[i], a)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", r.Name, err)
+			}
+			if change != nil {
+				change.Rule = r.Name
+				changes = append(changes, *change)
+			}
+		}
+	}
+	return changes, nil
+}
+
+// DryRun returns the changes the rules would make to a dataset from a source
+// without changing it
+func (e *Engine) DryRun(ds *dicom.Dataset, source string) ([]Change, error) {
+	c := dicom.Dataset{Elements: slices.Clone(ds.Elements)}
+	return e.Apply(&c, source)
+}
+
+// matches returns whether the rule applies to a dataset from a source
+func (r *rule) matches(ds *dicom.Dataset, source string) bool {
+	if r.Match.Source != "" {
+		if ok, _ := path.Match(r.Match.Source, source); !ok {
+			return false
+		}
+	}
+	for t, re := range r.attributes {
+		values, _ := stringValues(ds, t)
+		if !slices.ContainsFunc(values, re.MatchString) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply an action to the attribute with the tag, returning the change or nil
+// if the attribute is unchanged. Elements are replaced rather than modified so
+// that a shallow copy of the dataset can be changed safely.
+func apply(ds *dicom.Dataset, t tag.Tag, a Action) (*Change, error) {
+	old, found := stringValues(ds, t)
+	var values []string
+	switch a.Op {
+	case OpRemove:
+		if !found {
+			return nil, nil
+		}
+		ds.Elements = slices.DeleteFunc(ds.Elements, func(el *dicom.Element) bool {
+			return el.Tag == t
+		})
+		return newChange(a.Op, t, old, []string{}), nil
+	case OpSet:
+		values = []string{a.Value}
+	case OpPrefix:
+		if !found {
+			return nil, nil
+		}
+		for _, v := range old {
+			values = append(values, a.Value+v)
+		}
+	case OpMap:
+		if !found {
+			return nil, nil
+		}
+		for _, v := range old {
+			if mapped, ok := a.Map[v]; ok {
+				v = mapped
+			}
+			values = append(values, v)
+		}
+	}
+	if found && slices.Equal(old, values) {
+		return nil, nil
+	}
+
+	el, err := dicom.NewElement(t, values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create element %s: %w", t, err)
+	}
+	i, exists := slices.BinarySearchFunc(ds.Elements, t, func(el *dicom.Element, t tag.Tag) int {
+		return el.Tag.Compare(t)
+	})
+	if exists {
+		el.RawValueRepresentation = ds.Elements[i].RawValueRepresentation
+		ds.Elements[i] = el
+	} else {
+		ds.Elements = slices.Insert(ds.Elements, i, el)
+	}
+	if old == nil {
+		old = []string{}
+	}
+	return newChange(a.Op, t, old, values), nil
+}
+
+// stringValues returns the string values of the attribute with the tag and
+// whether it was found
+func stringValues(ds *dicom.Dataset, t tag.Tag) ([]string, bool) {
+	el, err := ds.FindElementByTag(t)
+	if err != nil {
+		return nil, false
+	}
+	values, _ := el.Value.GetValue().([]string)
+	return values, true
+}
+
+func newChange(op string, t tag.Tag, old, values []string) *Change {
+	c := &Change{
+		Op:  op,
+		Tag: fmt.Sprintf("(%04X,%04X)", t.Group, t.Element),
+		Old: old,
+		New: values,
+	}
+	if info, err := tag.Find(t); err == nil {
+		c.Name = info.Name
+	}
+	return c
+}
+
+// isString returns whether the attribute with the tag has a string value
+func isString(t tag.Tag) bool {
+	info, err := tag.Find(t)
+	if err != nil {
+		return false
+	}
+	switch tag.GetVRKind(t, info.VR) {
+	case tag.VRString, tag.VRStringList, tag.VRDate:
+		return true
+	}
+	return false
+}
+
+// ParseTag parses a tag given as (gggg,eeee) or as a keyword
+func ParseTag(s string) (tag.Tag, error) {
+	trimmed := strings.Trim(s, "()")
+	if group, element, ok := strings.Cut(trimmed, ","); ok {
+		g, err := strconv.ParseUint(strings.TrimSpace(group), 16, 16)
+		if err != nil {
+			return tag.Tag{}, fmt.Errorf("tag %s could not be parsed: %w", s, err)
+		}
+		e, err := strconv.ParseUint(strings.TrimSpace(element), 16, 16)
+		if err != nil {
+			return tag.Tag{}, fmt.Errorf("tag %s could not be parsed: %w", s, err)
+		}
+		return tag.Tag{Group: uint16(g), Element: uint16(e)}, nil
+	}
+	info, err := tag.FindByName(s)
+	if err != nil {
+		return tag.Tag{}, fmt.Errorf("unknown tag %s: %w", s, err)
+	}
+	return info.Tag, nil
+}
@@ -0,0 +1,126 @@
+package coerce_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/johnmarkli/dime/pkg/coerce"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+const (
+	testDataPath = "../../testdata/IM000001-mri"
+)
+
+var (
+	testRules = []coerce.Rule{
+		{
+			Name: "sunnyvale",
+			Match: coerce.Match{
+				Source:     "10.0.1.*",
+				Attributes: map[string]string{"InstitutionName": "^Sunnyvale"},
+			},
+			Actions: []coerce.Action{
+				{Op: coerce.OpSet, Tag: "InstitutionName", Value: "Sunnyvale Imaging"},
+				{Op: coerce.OpPrefix, Tag: "(0008,0050)", Value: "SIC-"},
+				{Op: coerce.OpSet, Tag: "IssuerOfPatientID", Value: "SIC"},
+				{Op: coerce.OpRemove, Tag: "StationName"},
+			},
+		},
+		{
+			Name: "issuers",
+			Actions: []coerce.Action{
+				{Op: coerce.OpMap, Tag: "IssuerOfPatientID", Map: map[string]string{"SIC": "urn:oid:1.2.3"}},
+			},
+		},
+	}
+)
+
+func TestEngineApply(t *testing.T) {
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	e, err := coerce.New(testRules)
+	assert.NoError(t, err)
+
+	changes, err := e.Apply(&ds, "10.0.1.5")
+	assert.NoError(t, err)
+	assert.Equal(t, []coerce.Change{
+		{Rule: "sunnyvale", Op: "set", Tag: "(0008,0080)", Name: "InstitutionName",
+			Old: []string{"Sunnyvale Imaging Center"}, New: []string{"Sunnyvale Imaging"}},
+		{Rule: "sunnyvale", Op: "prefix", Tag: "(0008,0050)", Name: "AccessionNumber",
+			Old: []string{"135656-1"}, New: []string{"SIC-135656-1"}},
+		{Rule: "sunnyvale", Op: "set", Tag: "(0010,0021)", Name: "IssuerOfPatientID",
+			Old: []string{}, New: []string{"SIC"}},
+		{Rule: "sunnyvale", Op: "remove", Tag: "(0008,1010)", Name: "StationName",
+			Old: []string{"MRC24119"}, New: []string{}},
+		{Rule: "issuers", Op: "map", Tag: "(0010,0021)", Name: "IssuerOfPatientID",
+			Old: []string{"SIC"}, New: []string{"urn:oid:1.2.3"}},
+	}, changes)
+
+	assertValue(t, &ds, tag.InstitutionName, "Sunnyvale Imaging")
+	assertValue(t, &ds, tag.IssuerOfPatientID, "urn:oid:1.2.3")
+	_, err = ds.FindElementByTag(tag.StationName)
+	assert.Error(t, err)
+
+	// Attributes stay in order for writing
+	for i := 1; i < len(ds.Elements); i++ {
+		assert.Negative(t, ds.Elements[i-1].Tag.Compare(ds.Elements[i].Tag))
+	}
+	assert.NoError(t, dicom.Write(io.Discard, ds))
+}
+
+func TestEngineApplyNoMatch(t *testing.T) {
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	e, err := coerce.New(testRules)
+	assert.NoError(t, err)
+
+	changes, err := e.Apply(&ds, "192.168.0.1")
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+}
+
+func TestEngineDryRun(t *testing.T) {
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	e, err := coerce.New(testRules)
+	assert.NoError(t, err)
+
+	changes, err := e.DryRun(&ds, "10.0.1.5")
+	assert.NoError(t, err)
+	assert.Len(t, changes, 5)
+
+	assertValue(t, &ds, tag.InstitutionName, "Sunnyvale Imaging Center")
+	assertValue(t, &ds, tag.StationName, "MRC24119")
+}
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rules.json")
+	err := os.WriteFile(file, []byte(`[
+  {"name": "site", "actions": [{"op": "set", "tag": "(0008,0080)", "value": "General"}]}
+]`), 0600)
+	assert.NoError(t, err)
+	_, err = coerce.Load(file)
+	assert.NoError(t, err)
+
+	for _, rules := range []string{
+		`[{"actions": [{"op": "rename", "tag": "InstitutionName"}]}]`,
+		`[{"actions": [{"op": "set", "tag": "NotATag"}]}]`,
+		`[{"actions": [{"op": "set", "tag": "Rows", "value": "1"}]}]`,
+		`[{"match": {"attributes": {"Modality": "("}}}]`,
+	} {
+		assert.NoError(t, os.WriteFile(file, []byte(rules), 0600))
+		_, err = coerce.Load(file)
+		assert.Error(t, err, rules)
+	}
+}
+
+func assertValue(t *testing.T, ds *dicom.Dataset, tg tag.Tag, value string) {
+	el, err := ds.FindElementByTag(tg)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{value}, el.Value.GetValue())
+}
@@ -0,0 +1,198 @@
+package dimse
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+	"github.com/suyashkumar/dicom/pkg/uid"
+)
+
+const (
+	verificationSOPClass = "1.2.840.10008.1.1"
+)
+
+// Client is a C-STORE and C-ECHO SCU for a remote AE
+type Client struct {
+	addr      string
+	callingAE string
+	calledAE  string
+	tls       *tls.Config
+}
+
+// ClientOption configures a Client
+type ClientOption func(*Client)
+
+// WithTLS connects to the remote AE over TLS with a configuration
+func WithTLS(cfg *tls.Config) ClientOption {
+	return func(c *Client) {
+		c.tls = cfg
+	}
+}
+
+// NewClient returns a Client that connects to the AE with the called AE title
+// at addr, identifying itself with the calling AE title
+func NewClient(addr, callingAE, calledAE string, opts ...ClientOption) *Client {
+	c := &Client{
+		addr:      addr,
+		callingAE: callingAE,
+		calledAE:  calledAE,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Echo verifies the connection to the remote AE with a C-ECHO
+func (c *Client) Echo(ctx context.Context) error {
+	pc := &presentationContext{
+		id:             1,
+		abstractSyntax: verificationSOPClass,
+		transferSyntax: []string{uid.ImplicitVRLittleEndian},
+	}
+	a, err := c.associate(ctx, pc)
+	if err != nil {
+		return err
+	}
+	cmd := &command{
+		Field:       commandCEchoRQ,
+		MessageID:   1,
+		SOPClassUID: verificationSOPClass,
+	}
+	return c.request(a, pc, cmd, nil)
+}
+
+// Store sends a DICOM to the remote AE with a C-STORE. DICOMs with an
+// uncompressed transfer syntax are sent in whichever of explicit or implicit
+// VR little endian the remote AE accepts; compressed DICOMs are sent as is.
+func (c *Client) Store(ctx context.Context, ds *dicom.Dataset) error {
+	sopClass, err := stringValue(ds, tag.SOPClassUID)
+	if err != nil {
+		return err
+	}
+	sopInstance, err := stringValue(ds, tag.SOPInstanceUID)
+	if err != nil {
+		return err
+	}
+	ts, err := stringValue(ds, tag.TransferSyntaxUID)
+	if err != nil {
+		ts = uid.ImplicitVRLittleEndian
+	}
+	pc := &presentationContext{
+		id:             1,
+		abstractSyntax: sopClass,
+		transferSyntax: []string{ts},
+	}
+	if _, _, err := uid.ParseTransferSyntaxUID(ts); err == nil {
+		pc.transferSyntax = []string{uid.ExplicitVRLittleEndian, uid.ImplicitVRLittleEndian}
+	}
+
+	a, err := c.associate(ctx, pc)
+	if err != nil {
+		return err
+	}
+	data, err := encodeDataset(ds, pc.transferSyntax[0])
+	if err != nil {
+		a.abort()
+		return err
+	}
+	cmd := &command{
+		Field:          commandCStoreRQ,
+		MessageID:      1,
+		SOPClassUID:    sopClass,
+		SOPInstanceUID: sopInstance,
+		HasDataset:     true,
+	}
+	return c.request(a, pc, cmd, data)
+}
+
+// associate with the remote AE, proposing a single presentation context
+func (c *Client) associate(ctx context.Context, pc *presentationContext) (*association, error) {
+	a, err := associate(ctx, c.addr, c.tls, &request{
+		calledAE:  c.calledAE,
+		callingAE: c.callingAE,
+		contexts:  []*presentationContext{pc},
+		maxPDU:    maxPDULength,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !pc.accepted {
+		a.abort()
+		return nil, fmt.Errorf("%w: presentation context for %s not accepted",
+			ErrRejected, pc.abstractSyntax)
+	}
+	return a, nil
+}
+
+// request sends a request and waits for its response before releasing the
+// association
+func (c *Client) request(a *association, pc *presentationContext, cmd *command, data []byte) error {
+	err := a.send(pc.id, cmd.encode(), data)
+	if err != nil {
+		a.abort()
+		return err
+	}
+	_, rsp, _, err := a.receive()
+	if err != nil {
+		a.abort()
+		return err
+	}
+	if !rsp.isResponse() || rsp.RespondedTo != cmd.MessageID {
+		a.abort()
+		return errors.New("unexpected dimse response")
+	}
+	err = a.release()
+	if !isSuccess(rsp.Status) {
+		return &StatusError{Status: rsp.Status}
+	}
+	return err
+}
+
+// encodeDataset encodes a dataset without its file meta information in a
+// transfer syntax
+func encodeDataset(ds *dicom.Dataset, ts string) ([]byte, error) {
+	bo, implicit := transferSyntax(ts)
+	var b bytes.Buffer
+	w := dicom.NewWriter(&b, dicom.SkipVRVerification())
+	w.SetTransferSyntax(bo, implicit)
+	for _, el := range ds.Elements {
+		if el.Tag.Group == tag.MetadataGroup {
+			continue
+		}
+		err := w.WriteElement(el)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode element %s: %w", el.Tag, err)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// transferSyntax returns the byte order and VR encoding of a transfer syntax.
+// Compressed transfer syntaxes are explicit VR little endian.
+func transferSyntax(ts string) (binary.ByteOrder, bool) {
+	bo, implicit, err := uid.ParseTransferSyntaxUID(ts)
+	if err != nil {
+		return binary.LittleEndian, false
+	}
+	return bo, implicit
+}
+
+// stringValue returns the first value of a string attribute
+func stringValue(ds *dicom.Dataset, t tag.Tag) (string, error) {
+	el, err := ds.FindElementByTag(t)
+	if err != nil {
+		return "", fmt.Errorf("failed to find %s: %w", t, err)
+	}
+	values, _ := el.Value.GetValue().([]string)
+	if len(values) == 0 {
+		return "", fmt.Errorf("%s is empty", t)
+	}
+	return values[0], nil
+}
@@ -0,0 +1,161 @@
+package dimse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Command fields
+const (
+	commandCStoreRQ  = 0x0001
+	commandCStoreRSP = 0x8001
+	commandCEchoRQ   = 0x0030
+	commandCEchoRSP  = 0x8030
+)
+
+// Status codes
+const (
+	// StatusSuccess is the status of a successful operation
+	StatusSuccess = 0x0000
+	// StatusProcessingFailure is the status of an operation that failed
+	StatusProcessingFailure = 0x0110
+	// StatusSOPClassNotSupported is the status of an operation on an
+	// unsupported SOP class
+	StatusSOPClassNotSupported = 0x0122
+)
+
+const (
+	dataSetNone    = 0x0101
+	dataSetPresent = 0x0000
+	priorityMedium = 0x0000
+)
+
+// StatusError is an error for a DIMSE response with a failure status
+type StatusError struct {
+	Status uint16
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("dimse operation failed with status 0x%04X", e.Status)
+}
+
+// command is a DIMSE command set
+type command struct {
+	Field          uint16
+	MessageID      uint16
+	RespondedTo    uint16
+	SOPClassUID    string
+	SOPInstanceUID string
+	HasDataset     bool
+	Status         uint16
+}
+
+// isResponse returns whether the command is a response
+func (c *command) isResponse() bool {
+	return c.Field&0x8000 != 0
+}
+
+// encode the command set in implicit VR little endian, as command sets
+// always are
+func (c *command) encode() []byte {
+	var b bytes.Buffer
+	writeString(&b, 0x0002, c.SOPClassUID)
+	writeUint16(&b, 0x0100, c.Field)
+	if c.isResponse() {
+		writeUint16(&b, 0x0120, c.RespondedTo)
+	} else {
+		writeUint16(&b, 0x0110, c.MessageID)
+		if c.Field == commandCStoreRQ {
+			writeUint16(&b, 0x0700, priorityMedium)
+		}
+	}
+	if c.HasDataset {
+		writeUint16(&b, 0x0800, dataSetPresent)
+	} else {
+		writeUint16(&b, 0x0800, dataSetNone)
+	}
+	if c.isResponse() {
+		writeUint16(&b, 0x0900, c.Status)
+	}
+	if c.SOPInstanceUID != "" {
+		writeString(&b, 0x1000, c.SOPInstanceUID)
+	}
+
+	var out bytes.Buffer
+	writeHeader(&out, 0x0000, 4)
+	binary.Write(&out, binary.LittleEndian, uint32(b.Len()))
+	out.Write(b.Bytes())
+	return out.Bytes()
+}
+
+// decodeCommand decodes a command set
+func decodeCommand(b []byte) (*command, error) {
+	c := &command{}
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return nil, errors.New("short command element")
+		}
+		group := binary.LittleEndian.Uint16(b)
+		element := binary.LittleEndian.Uint16(b[2:])
+		n := int(binary.LittleEndian.Uint32(b[4:]))
+		if 8+n > len(b) {
+			return nil, errors.New("invalid command element length")
+		}
+		value := b[8 : 8+n]
+		b = b[8+n:]
+		if group != 0x0000 {
+			continue
+		}
+		var u uint16
+		if n == 2 {
+			u = binary.LittleEndian.Uint16(value)
+		}
+		switch element {
+		case 0x0002:
+			c.SOPClassUID = trimUID(value)
+		case 0x0100:
+			c.Field = u
+		case 0x0110:
+			c.MessageID = u
+		case 0x0120:
+			c.RespondedTo = u
+		case 0x0800:
+			c.HasDataset = u != dataSetNone
+		case 0x0900:
+			c.Status = u
+		case 0x1000:
+			c.SOPInstanceUID = trimUID(value)
+		}
+	}
+	if c.Field == 0 {
+		return nil, errors.New("command field missing")
+	}
+	return c, nil
+}
+
+func writeHeader(b *bytes.Buffer, element uint16, n int) {
+	binary.Write(b, binary.LittleEndian, uint16(0x0000))
+	binary.Write(b, binary.LittleEndian, element)
+	binary.Write(b, binary.LittleEndian, uint32(n))
+}
+
+func writeUint16(b *bytes.Buffer, element uint16, v uint16) {
+	writeHeader(b, element, 2)
+	binary.Write(b, binary.LittleEndian, v)
+}
+
+// writeString writes a UID, padded with a null byte to an even length
+func writeString(b *bytes.Buffer, element uint16, s string) {
+	if len(s)%2 != 0 {
+		s += "\x00"
+	}
+	writeHeader(b, element, len(s))
+	b.WriteString(s)
+}
+
+// isSuccess returns whether a status is success or a warning
+func isSuccess(status uint16) bool {
+	return status == StatusSuccess || status&0xF000 == 0xB000 || status == 0x0107 || status == 0x0116
+}
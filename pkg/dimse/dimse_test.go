@@ -0,0 +1,90 @@
+package dimse_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/dimse"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+const (
+	testDataPath = "../../testdata/IM000001-mri"
+)
+
+// startServer starts a Server on a local port, returning its address
+func startServer(t *testing.T, handler dimse.Handler) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := dimse.NewServer("STORESCP", handler)
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String()
+}
+
+func TestClientStore(t *testing.T) {
+	var mu sync.Mutex
+	received := []*dicom.Dataset{}
+	callingAEs := []string{}
+	addr := startServer(t, func(callingAE string, ds *dicom.Dataset) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, ds)
+		callingAEs = append(callingAEs, callingAE)
+		return nil
+	})
+
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := dimse.NewClient(addr, "DIME", "STORESCP")
+	assert.NoError(t, c.Echo(ctx))
+	assert.NoError(t, c.Store(ctx, &ds))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, received, 1)
+	assert.Equal(t, []string{"DIME"}, callingAEs)
+	for _, tg := range []tag.Tag{tag.SOPInstanceUID, tag.StudyInstanceUID, tag.PatientName, tag.Rows} {
+		want, err := ds.FindElementByTag(tg)
+		assert.NoError(t, err)
+		got, err := received[0].FindElementByTag(tg)
+		assert.NoError(t, err)
+		assert.Equal(t, want.Value.String(), got.Value.String())
+	}
+	pixels, err := received[0].FindElementByTag(tag.PixelData)
+	assert.NoError(t, err)
+	assert.Len(t, dicom.MustGetPixelDataInfo(pixels.Value).Frames, 1)
+
+	// Received DICOMs can be written as files
+	var b bytes.Buffer
+	assert.NoError(t, dicom.Write(&b, *received[0]))
+}
+
+func TestClientStoreFailure(t *testing.T) {
+	addr := startServer(t, func(string, *dicom.Dataset) error {
+		return errors.New("disk full")
+	})
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+
+	err = dimse.NewClient(addr, "DIME", "STORESCP").Store(context.Background(), &ds)
+	var statusErr *dimse.StatusError
+	assert.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, uint16(dimse.StatusProcessingFailure), statusErr.Status)
+}
+
+func TestClientRejected(t *testing.T) {
+	addr := startServer(t, func(string, *dicom.Dataset) error { return nil })
+
+	err := dimse.NewClient(addr, "DIME", "OTHER").Echo(context.Background())
+	assert.ErrorIs(t, err, dimse.ErrRejected)
+}
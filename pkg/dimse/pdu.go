@@ -0,0 +1,494 @@
+// Package dimse provides a minimal DICOM upper layer and DIMSE implementation
+// for sending DICOMs to a C-STORE SCP and receiving them as one
+package dimse
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// PDU types
+const (
+	pduAssociateRQ = 0x01
+	pduAssociateAC = 0x02
+	pduAssociateRJ = 0x03
+	pduData        = 0x04
+	pduReleaseRQ   = 0x05
+	pduReleaseRP   = 0x06
+	pduAbort       = 0x07
+)
+
+// Item types
+const (
+	itemApplicationContext = 0x10
+	itemPresentationRQ     = 0x20
+	itemPresentationAC     = 0x21
+	itemAbstractSyntax     = 0x30
+	itemTransferSyntax     = 0x40
+	itemUserInfo           = 0x50
+	itemMaxLength          = 0x51
+	itemImplementationUID  = 0x52
+	itemImplementationName = 0x55
+)
+
+const (
+	applicationContext = "1.2.840.10008.3.1.1.1"
+	implementationUID  = "1.2.826.0.1.3680043.10.1138"
+	implementationName = "DIME"
+	protocolVersion    = 1
+	maxPDULength       = 1 << 16
+	pduHeaderLength    = 6
+	pdvHeaderLength    = 6
+	aeTitleLength      = 16
+	releaseTimeout     = 10 * time.Second
+)
+
+var (
+	// ErrRejected is an error for an association rejected by the peer
+	ErrRejected = errors.New("association rejected")
+	// ErrAborted is an error for an association aborted by the peer
+	ErrAborted = errors.New("association aborted")
+	// errReleased is returned when the peer releases the association
+	errReleased = errors.New("association released")
+)
+
+// presentationContext is a proposed or accepted abstract syntax and its
+// transfer syntaxes
+type presentationContext struct {
+	id             byte
+	abstractSyntax string
+	transferSyntax []string
+	accepted       bool
+}
+
+// association is an established association between two AEs
+type association struct {
+	conn     net.Conn
+	maxPDU   uint32
+	contexts []*presentationContext
+	stop     func() bool
+}
+
+// request is an A-ASSOCIATE-RQ
+type request struct {
+	calledAE  string
+	callingAE string
+	contexts  []*presentationContext
+	maxPDU    uint32
+}
+
+// associate requests an association with the AE at addr, over TLS if cfg is
+// set
+func associate(ctx context.Context, addr string, cfg *tls.Config, req *request) (*association, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	if cfg != nil {
+		tlsConn := tls.Client(conn, cfg)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+		}
+		conn = tlsConn
+	}
+	a := &association{conn: conn, contexts: req.contexts}
+	a.stop = context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+
+	err = writePDU(conn, pduAssociateRQ, req.encode())
+	if err != nil {
+		a.close()
+		return nil, err
+	}
+	typ, body, err := readPDU(conn)
+	if err != nil {
+		a.close()
+		return nil, err
+	}
+	switch typ {
+	case pduAssociateAC:
+		err = a.accept(body)
+		if err != nil {
+			a.abort()
+			return nil, err
+		}
+		return a, nil
+	case pduAssociateRJ:
+		a.close()
+		if len(body) >= 4 {
+			return nil, fmt.Errorf("%w: result %d, source %d, reason %d",
+				ErrRejected, body[1], body[2], body[3])
+		}
+		return nil, ErrRejected
+	case pduAbort:
+		a.close()
+		return nil, ErrAborted
+	default:
+		a.abort()
+		return nil, fmt.Errorf("unexpected pdu type 0x%02x", typ)
+	}
+}
+
+// accept records the presentation contexts accepted in an A-ASSOCIATE-AC
+func (a *association) accept(body []byte) error {
+	if len(body) < 68 {
+		return errors.New("short a-associate-ac pdu")
+	}
+	a.maxPDU = maxPDULength
+	return eachItem(body[68:], func(typ byte, data []byte) error {
+		switch typ {
+		case itemPresentationAC:
+			if len(data) < 4 {
+				return errors.New("short presentation context item")
+			}
+			pc := a.context(data[0])
+			if pc == nil || data[2] != 0 {
+				return nil
+			}
+			return eachItem(data[4:], func(typ byte, data []byte) error {
+				if typ == itemTransferSyntax {
+					pc.transferSyntax = []string{trimUID(data)}
+					pc.accepted = true
+				}
+				return nil
+			})
+		case itemUserInfo:
+			return eachItem(data, func(typ byte, data []byte) error {
+				if typ == itemMaxLength && len(data) == 4 {
+					if n := binary.BigEndian.Uint32(data); n != 0 && n < a.maxPDU {
+						a.maxPDU = n
+					}
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+// context returns the presentation context with the id
+func (a *association) context(id byte) *presentationContext {
+	for _, pc := range a.contexts {
+		if pc.id == id {
+			return pc
+		}
+	}
+	return nil
+}
+
+// send a message as P-DATA-TF PDUs, fragmented to the peer's maximum PDU
+// length
+func (a *association) send(pcid byte, cmd []byte, data []byte) error {
+	err := a.sendFragments(pcid, cmd, 0x01)
+	if err != nil || data == nil {
+		return err
+	}
+	return a.sendFragments(pcid, data, 0x00)
+}
+
+func (a *association) sendFragments(pcid byte, b []byte, control byte) error {
+	size := int(a.maxPDU) - pdvHeaderLength
+	for {
+		n := min(len(b), size)
+		last := n == len(b)
+		header := control
+		if last {
+			header |= 0x02
+		}
+		pdv := make([]byte, pdvHeaderLength, pdvHeaderLength+n)
+		binary.BigEndian.PutUint32(pdv, uint32(n+2))
+		pdv[4] = pcid
+		pdv[5] = header
+		pdv = append(pdv, b[:n]...)
+		err := writePDU(a.conn, pduData, pdv)
+		if err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		b = b[n:]
+	}
+}
+
+// receive a message, returning its presentation context, command and data
+// set. The data set is nil if the command has none.
+func (a *association) receive() (byte, *command, []byte, error) {
+	var cmdBuf, dataBuf bytes.Buffer
+	var cmd *command
+	var pcid byte
+	for {
+		typ, body, err := readPDU(a.conn)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		switch typ {
+		case pduData:
+		case pduReleaseRQ:
+			return 0, nil, nil, errReleased
+		case pduAbort:
+			return 0, nil, nil, ErrAborted
+		default:
+			return 0, nil, nil, fmt.Errorf("unexpected pdu type 0x%02x", typ)
+		}
+		for len(body) > 0 {
+			if len(body) < pdvHeaderLength {
+				return 0, nil, nil, errors.New("short presentation data value")
+			}
+			n := int(binary.BigEndian.Uint32(body))
+			if n < 2 || n+4 > len(body) {
+				return 0, nil, nil, errors.New("invalid presentation data value length")
+			}
+			pcid = body[4]
+			header := body[5]
+			value := body[pdvHeaderLength : n+4]
+			body = body[n+4:]
+
+			if header&0x01 != 0 {
+				cmdBuf.Write(value)
+				if header&0x02 == 0 {
+					continue
+				}
+				cmd, err = decodeCommand(cmdBuf.Bytes())
+				if err != nil {
+					return 0, nil, nil, err
+				}
+				if !cmd.HasDataset {
+					return pcid, cmd, nil, nil
+				}
+				continue
+			}
+			if cmd == nil {
+				return 0, nil, nil, errors.New("data set received before command")
+			}
+			dataBuf.Write(value)
+			if header&0x02 != 0 {
+				return pcid, cmd, dataBuf.Bytes(), nil
+			}
+		}
+	}
+}
+
+// release the association gracefully
+func (a *association) release() error {
+	defer a.close()
+	a.conn.SetDeadline(time.Now().Add(releaseTimeout))
+	err := writePDU(a.conn, pduReleaseRQ, make([]byte, 4))
+	if err != nil {
+		return err
+	}
+	for {
+		typ, _, err := readPDU(a.conn)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case pduReleaseRP:
+			return nil
+		case pduAbort:
+			return ErrAborted
+		}
+	}
+}
+
+// abort the association
+func (a *association) abort() {
+	writePDU(a.conn, pduAbort, make([]byte, 4))
+	a.close()
+}
+
+func (a *association) close() {
+	if a.stop != nil {
+		a.stop()
+	}
+	a.conn.Close()
+}
+
+// encode an A-ASSOCIATE-RQ
+func (r *request) encode() []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint16(protocolVersion))
+	b.Write([]byte{0, 0})
+	b.WriteString(padAETitle(r.calledAE))
+	b.WriteString(padAETitle(r.callingAE))
+	b.Write(make([]byte, 32))
+	writeItem(&b, itemApplicationContext, []byte(applicationContext))
+	for _, pc := range r.contexts {
+		var item bytes.Buffer
+		item.Write([]byte{pc.id, 0, 0, 0})
+		writeItem(&item, itemAbstractSyntax, []byte(pc.abstractSyntax))
+		for _, ts := range pc.transferSyntax {
+			writeItem(&item, itemTransferSyntax, []byte(ts))
+		}
+		writeItem(&b, itemPresentationRQ, item.Bytes())
+	}
+	writeItem(&b, itemUserInfo, userInfo(r.maxPDU))
+	return b.Bytes()
+}
+
+// decodeRequest decodes an A-ASSOCIATE-RQ
+func decodeRequest(body []byte) (*request, error) {
+	if len(body) < 68 {
+		return nil, errors.New("short a-associate-rq pdu")
+	}
+	r := &request{
+		calledAE:  strings.TrimSpace(string(body[4:20])),
+		callingAE: strings.TrimSpace(string(body[20:36])),
+		maxPDU:    maxPDULength,
+	}
+	err := eachItem(body[68:], func(typ byte, data []byte) error {
+		switch typ {
+		case itemPresentationRQ:
+			if len(data) < 4 {
+				return errors.New("short presentation context item")
+			}
+			pc := &presentationContext{id: data[0]}
+			err := eachItem(data[4:], func(typ byte, data []byte) error {
+				switch typ {
+				case itemAbstractSyntax:
+					pc.abstractSyntax = trimUID(data)
+				case itemTransferSyntax:
+					pc.transferSyntax = append(pc.transferSyntax, trimUID(data))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			r.contexts = append(r.contexts, pc)
+		case itemUserInfo:
+			return eachItem(data, func(typ byte, data []byte) error {
+				if typ == itemMaxLength && len(data) == 4 {
+					if n := binary.BigEndian.Uint32(data); n != 0 && n < r.maxPDU {
+						r.maxPDU = n
+					}
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// encodeAccept encodes an A-ASSOCIATE-AC for a request, with the transfer
+// syntax of each accepted presentation context
+func encodeAccept(r *request) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint16(protocolVersion))
+	b.Write([]byte{0, 0})
+	b.WriteString(padAETitle(r.calledAE))
+	b.WriteString(padAETitle(r.callingAE))
+	b.Write(make([]byte, 32))
+	writeItem(&b, itemApplicationContext, []byte(applicationContext))
+	for _, pc := range r.contexts {
+		var item bytes.Buffer
+		if pc.accepted {
+			item.Write([]byte{pc.id, 0, 0, 0})
+			writeItem(&item, itemTransferSyntax, []byte(pc.transferSyntax[0]))
+		} else {
+			// transfer syntaxes not supported (provider rejection)
+			item.Write([]byte{pc.id, 0, 4, 0})
+			writeItem(&item, itemTransferSyntax, nil)
+		}
+		writeItem(&b, itemPresentationAC, item.Bytes())
+	}
+	writeItem(&b, itemUserInfo, userInfo(maxPDULength))
+	return b.Bytes()
+}
+
+// userInfo encodes the user information sub-items
+func userInfo(maxPDU uint32) []byte {
+	var b bytes.Buffer
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, maxPDU)
+	writeItem(&b, itemMaxLength, length)
+	writeItem(&b, itemImplementationUID, []byte(implementationUID))
+	writeItem(&b, itemImplementationName, []byte(implementationName))
+	return b.Bytes()
+}
+
+// writePDU writes a PDU with its header
+func writePDU(w io.Writer, typ byte, body []byte) error {
+	header := make([]byte, pduHeaderLength)
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[2:], uint32(len(body)))
+	_, err := w.Write(append(header, body...))
+	if err != nil {
+		return fmt.Errorf("failed to write pdu: %w", err)
+	}
+	return nil
+}
+
+// readPDU reads a PDU, returning its type and body
+func readPDU(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, pduHeaderLength)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read pdu: %w", err)
+	}
+	n := binary.BigEndian.Uint32(header[2:])
+	if n > 4*maxPDULength {
+		return 0, nil, fmt.Errorf("pdu length %d exceeds maximum", n)
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read pdu: %w", err)
+	}
+	return header[0], body, nil
+}
+
+// writeItem writes a variable item with its header
+func writeItem(b *bytes.Buffer, typ byte, data []byte) {
+	b.Write([]byte{typ, 0})
+	binary.Write(b, binary.BigEndian, uint16(len(data)))
+	b.Write(data)
+}
+
+// eachItem calls fn with the type and data of each variable item in b
+func eachItem(b []byte, fn func(typ byte, data []byte) error) error {
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return errors.New("short item")
+		}
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		if 4+n > len(b) {
+			return errors.New("invalid item length")
+		}
+		err := fn(b[0], b[4:4+n])
+		if err != nil {
+			return err
+		}
+		b = b[4+n:]
+	}
+	return nil
+}
+
+// padAETitle pads or truncates an AE title to 16 characters
+func padAETitle(ae string) string {
+	if len(ae) > aeTitleLength {
+		return ae[:aeTitleLength]
+	}
+	return ae + strings.Repeat(" ", aeTitleLength-len(ae))
+}
+
+// trimUID trims the padding from a UID
+func trimUID(b []byte) string {
+	return strings.TrimRight(string(b), "\x00 ")
+}
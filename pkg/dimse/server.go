@@ -0,0 +1,222 @@
+package dimse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+	"github.com/suyashkumar/dicom/pkg/uid"
+)
+
+// Handler handles a DICOM received with a C-STORE from the calling AE
+type Handler func(callingAE string, ds *dicom.Dataset) error
+
+// Server is a C-STORE and C-ECHO SCP
+type Server struct {
+	aeTitle string
+	handler Handler
+
+	mu    sync.Mutex
+	ln    net.Listener
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// NewServer returns a Server with the AE title that passes each DICOM it
+// receives to handler. An empty AE title accepts any called AE title.
+func NewServer(aeTitle string, handler Handler) *Server {
+	return &Server{
+		aeTitle: aeTitle,
+		handler: handler,
+		conns:   map[net.Conn]struct{}{},
+	}
+}
+
+// Serve accepts associations on the listener until it is closed. Associations
+// are over TLS if it is a TLS listener, such as one of a certs.Reloader.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serve(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close the listener and any open associations
+func (s *Server) Close() error {
+	s.mu.Lock()
+	var err error
+	if s.ln != nil {
+		err = s.ln.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// serve an association
+func (s *Server) serve(conn net.Conn) {
+	a := &association{conn: conn}
+	defer a.close()
+
+	typ, body, err := readPDU(conn)
+	if err != nil || typ != pduAssociateRQ {
+		return
+	}
+	req, err := decodeRequest(body)
+	if err != nil {
+		a.abort()
+		return
+	}
+	if s.aeTitle != "" && req.calledAE != s.aeTitle {
+		// rejected permanent, service user, called AE title not recognized
+		writePDU(conn, pduAssociateRJ, []byte{0, 1, 1, 7})
+		return
+	}
+	for _, pc := range req.contexts {
+		negotiate(pc)
+	}
+	a.contexts = req.contexts
+	a.maxPDU = req.maxPDU
+	err = writePDU(conn, pduAssociateAC, encodeAccept(req))
+	if err != nil {
+		return
+	}
+
+	for {
+		pcid, cmd, data, err := a.receive()
+		if errors.Is(err, errReleased) {
+			writePDU(conn, pduReleaseRP, make([]byte, 4))
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, ErrAborted) && !errors.Is(err, io.EOF) {
+				slog.Error("Failed to receive dimse message", slog.String("error", err.Error()))
+				a.abort()
+			}
+			return
+		}
+		rsp := &command{
+			RespondedTo:    cmd.MessageID,
+			SOPClassUID:    cmd.SOPClassUID,
+			SOPInstanceUID: cmd.SOPInstanceUID,
+			Status:         StatusSuccess,
+		}
+		switch cmd.Field {
+		case commandCEchoRQ:
+			rsp.Field = commandCEchoRSP
+		case commandCStoreRQ:
+			rsp.Field = commandCStoreRSP
+			rsp.Status = s.store(req.callingAE, a.context(pcid), cmd, data)
+		default:
+			a.abort()
+			return
+		}
+		err = a.send(pcid, rsp.encode(), nil)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// store passes a DICOM received with a C-STORE to the handler and returns
+// the status of the response
+func (s *Server) store(callingAE string, pc *presentationContext, cmd *command, data []byte) uint16 {
+	if pc == nil || !pc.accepted {
+		return StatusSOPClassNotSupported
+	}
+	ds, err := decodeDataset(data, pc.transferSyntax[0], cmd.SOPClassUID, cmd.SOPInstanceUID)
+	if err == nil {
+		err = s.handler(callingAE, ds)
+	}
+	if err != nil {
+		slog.Error("Failed to store dicom",
+			slog.String("callingAE", callingAE),
+			slog.String("sopInstanceUID", cmd.SOPInstanceUID),
+			slog.String("error", err.Error()))
+		return StatusProcessingFailure
+	}
+	return StatusSuccess
+}
+
+// negotiate accepts a presentation context with explicit or implicit VR
+// little endian if proposed, otherwise the first transfer syntax proposed
+func negotiate(pc *presentationContext) {
+	for _, ts := range []string{uid.ExplicitVRLittleEndian, uid.ImplicitVRLittleEndian} {
+		if slices.Contains(pc.transferSyntax, ts) {
+			pc.transferSyntax = []string{ts}
+			pc.accepted = true
+			return
+		}
+	}
+	if pc.abstractSyntax != verificationSOPClass && len(pc.transferSyntax) > 0 {
+		pc.transferSyntax = pc.transferSyntax[:1]
+		pc.accepted = true
+	}
+}
+
+// decodeDataset decodes a dataset received in a transfer syntax, adding
+// file meta information so that it can be written as a file
+func decodeDataset(data []byte, ts, sopClass, sopInstance string) (*dicom.Dataset, error) {
+	p, err := dicom.NewParser(bytes.NewReader(data), int64(len(data)), nil,
+		dicom.SkipMetadataReadOnNewParserInit())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse dicom: %w", err)
+	}
+	p.SetTransferSyntax(transferSyntax(ts))
+
+	ds := &dicom.Dataset{}
+	for _, meta := range []struct {
+		t     tag.Tag
+		value string
+	}{
+		{tag.MediaStorageSOPClassUID, sopClass},
+		{tag.MediaStorageSOPInstanceUID, sopInstance},
+		{tag.TransferSyntaxUID, ts},
+	} {
+		el, err := dicom.NewElement(meta.t, []string{meta.value})
+		if err != nil {
+			return nil, err
+		}
+		ds.Elements = append(ds.Elements, el)
+	}
+	for {
+		el, err := p.Next()
+		if errors.Is(err, dicom.ErrorEndOfDICOM) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse dicom: %w", err)
+		}
+		ds.Elements = append(ds.Elements, el)
+	}
+	return ds, nil
+}
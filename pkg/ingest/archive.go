@@ -0,0 +1,138 @@
+package ingest
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	dicomDirName = "DICOMDIR"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+// IngestZip ingests every DICOM in a ZIP archive read from r. The archive is
+// spooled to a temporary file since ZIP requires random access. An archive
+// that exceeds the archive limits fails with ErrTooLarge, leaving the DICOMs
+// ingested before the limit was reached in the store.
+func (i *Ingester) IngestZip(r io.Reader) ([]Result, error) {
+	tmp, err := os.CreateTemp("", "dime-*.zip")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	lr := &limitReader{r: r, n: i.archive.Size}
+	size, err := io.Copy(tmp, lr)
+	if lr.exceeded {
+		return nil, i.errSize()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zip archive: %w", err)
+	}
+
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zip archive: %w", err)
+	}
+	if len(zr.File) > i.archive.Entries {
+		return nil, fmt.Errorf("%w: archive has more than %d entries", ErrTooLarge, i.archive.Entries)
+	}
+	uncompressed := &limitReader{n: i.archive.UncompressedSize}
+	results := []Result{}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || isDICOMDIR(f.Name) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			res := Result{File: f.Name, Error: err.Error()}
+			i.report(res)
+			results = append(results, res)
+			continue
+		}
+		uncompressed.r = rc
+		results = append(results, i.ingestFile(f.Name, uncompressed))
+		rc.Close()
+		if uncompressed.exceeded {
+			return results, i.errUncompressedSize()
+		}
+	}
+	return results, nil
+}
+
+// IngestTar ingests every DICOM in a tar archive read from r, which may be
+// gzip compressed. An archive that exceeds the archive limits fails with
+// ErrTooLarge, leaving the DICOMs ingested before the limit was reached in
+// the store.
+func (i *Ingester) IngestTar(r io.Reader) ([]Result, error) {
+	lr := &limitReader{r: r, n: i.archive.Size}
+	br := bufio.NewReader(lr)
+	magic, _ := br.Peek(len(gzipMagic))
+	var tr *tar.Reader
+	if bytes.Equal(magic, gzipMagic) {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip archive: %w", err)
+		}
+		defer gr.Close()
+		tr = tar.NewReader(gr)
+	} else {
+		tr = tar.NewReader(br)
+	}
+
+	uncompressed := &limitReader{r: tr, n: i.archive.UncompressedSize}
+	results := []Result{}
+	for entries := 1; ; entries++ {
+		hdr, err := tr.Next()
+		if lr.exceeded {
+			return results, i.errSize()
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return results, fmt.Errorf("failed to read tar archive: %w", err)
+		}
+		if entries > i.archive.Entries {
+			return results, fmt.Errorf("%w: archive has more than %d entries", ErrTooLarge, i.archive.Entries)
+		}
+		if hdr.Typeflag != tar.TypeReg || isDICOMDIR(hdr.Name) {
+			continue
+		}
+		results = append(results, i.ingestFile(hdr.Name, uncompressed))
+		if lr.exceeded {
+			return results, i.errSize()
+		}
+		if uncompressed.exceeded {
+			return results, i.errUncompressedSize()
+		}
+	}
+	return results, nil
+}
+
+// errSize returns the error for an archive that is larger than the size limit
+func (i *Ingester) errSize() error {
+	return fmt.Errorf("%w: archive is larger than %d bytes", ErrTooLarge, i.archive.Size)
+}
+
+// errUncompressedSize returns the error for an archive whose files are larger
+// than the uncompressed size limit
+func (i *Ingester) errUncompressedSize() error {
+	return fmt.Errorf("%w: archive is larger than %d bytes uncompressed", ErrTooLarge, i.archive.UncompressedSize)
+}
+
+func isDICOMDIR(name string) bool {
+	return strings.EqualFold(path.Base(name), dicomDirName)
+}
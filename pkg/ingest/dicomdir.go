@@ -0,0 +1,161 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+var (
+	// ErrInvalidFileID is an error for a Referenced File ID in a DICOMDIR that
+	// doesn't refer to a file within its directory
+	ErrInvalidFileID = errors.New("invalid referenced file id")
+)
+
+// IngestDir ingests the DICOMs in a directory. If the directory contains a
+// DICOMDIR, only the files referenced by its directory records are ingested,
+// otherwise every file in the directory tree is.
+func (i *Ingester) IngestDir(dir string) ([]Result, error) {
+	fileIDs, err := dicomDirFileIDs(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		fileIDs, err = walkFiles(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	results := []Result{}
+	for _, fileID := range fileIDs {
+		name := filepath.Join(fileID...)
+		file, err := resolveFileID(dir, fileID)
+		if err != nil {
+			res := Result{File: name, Error: err.Error()}
+			i.report(res)
+			results = append(results, res)
+			continue
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			res := Result{File: name, Error: err.Error()}
+			i.report(res)
+			results = append(results, res)
+			continue
+		}
+		results = append(results, i.ingestFile(name, f))
+		f.Close()
+	}
+	return results, nil
+}
+
+// dicomDirFileIDs returns the Referenced File IDs of the directory records in
+// the DICOMDIR in dir
+func dicomDirFileIDs(dir string) ([][]string, error) {
+	dicomDirPath, err := findFold(dir, dicomDirName)
+	if err != nil {
+		return nil, err
+	}
+	dataset, err := dicom.ParseFile(dicomDirPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DICOMDIR: %w", err)
+	}
+	element, err := dataset.FindElementByTag(tag.DirectoryRecordSequence)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find directory record sequence: %w", err)
+	}
+
+	fileIDs := [][]string{}
+	items, _ := element.Value.GetValue().([]*dicom.SequenceItemValue)
+	for _, item := range items {
+		elements, _ := item.GetValue().([]*dicom.Element)
+		for _, el := range elements {
+			if el.Tag != tag.ReferencedFileID {
+				continue
+			}
+			components, _ := el.Value.GetValue().([]string)
+			if len(components) > 0 {
+				fileIDs = append(fileIDs, components)
+			}
+		}
+	}
+	return fileIDs, nil
+}
+
+// resolveFileID resolves the components of a Referenced File ID relative to
+// dir. Media is often written in upper case and copied to case sensitive file
+// systems, so each component is matched without regard to case. The DICOMDIR
+// is untrusted, so components that could leave dir are rejected, as is a file
+// that resolves outside of dir through a symlink.
+func resolveFileID(dir string, components []string) (string, error) {
+	p := dir
+	for _, c := range components {
+		c = strings.TrimSpace(c)
+		if c == "" || c == "." || c == ".." || strings.ContainsAny(c, `/\`) {
+			return "", fmt.Errorf("%w: %q", ErrInvalidFileID, strings.Join(components, `\`))
+		}
+		next, err := findFold(p, c)
+		if err != nil {
+			return "", fmt.Errorf("failed to find referenced file: %w", err)
+		}
+		p = next
+	}
+
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve directory: %w", err)
+	}
+	file, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve referenced file: %w", err)
+	}
+	rel, err := filepath.Rel(root, file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %q is outside of the directory", ErrInvalidFileID, strings.Join(components, `\`))
+	}
+	return file, nil
+}
+
+// findFold finds the entry in dir with the name, ignoring case
+func findFold(dir, name string) (string, error) {
+	if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+		return filepath.Join(dir, name), nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if strings.EqualFold(e.Name(), name) {
+			return filepath.Join(dir, e.Name()), nil
+		}
+	}
+	return "", fs.ErrNotExist
+}
+
+// walkFiles returns the path components relative to dir of every regular
+// file in the directory tree
+func walkFiles(dir string) ([][]string, error) {
+	fileIDs := [][]string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && !isDICOMDIR(p) {
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			fileIDs = append(fileIDs, strings.Split(rel, string(filepath.Separator)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk directory: %w", err)
+	}
+	return fileIDs, nil
+}
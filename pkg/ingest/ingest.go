@@ -0,0 +1,348 @@
+// Package ingest provides a way to ingest DICOM files into a store
+package ingest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/johnmarkli/dime/pkg/coerce"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/johnmarkli/dime/pkg/validate"
+	"github.com/suyashkumar/dicom"
+)
+
+const (
+	defaultMaxSize                = 1 << 30  // 1GB
+	defaultMaxArchiveSize         = 10 << 30 // 10GB
+	defaultMaxArchiveUncompressed = 50 << 30 // 50GB
+	defaultMaxArchiveEntries      = 100000
+)
+
+var (
+	// ErrTooLarge is an error for a DICOM that exceeds the maximum size
+	ErrTooLarge = errors.New("request entity too large")
+)
+
+// Ingester parses DICOM files and saves them to a store
+type Ingester struct {
+	store     store.Store
+	maxSize   int64
+	archive   ArchiveLimits
+	policy    validate.Policy
+	rules     *coerce.Engine
+	hooks     []Hook
+	auditor   Auditor
+	source    string
+	tenant    string
+	user      string
+	authorize func(*store.DICOM) error
+	progress  func(Result)
+}
+
+// Hook is called with each DICOM after it is saved to the store and the
+// source it was ingested from
+type Hook func(dcm *store.DICOM, source string)
+
+// Auditor records each DICOM after it is saved to the store along with the
+// source it was ingested from and the user that sent it
+type Auditor interface {
+	Created(dcm *store.DICOM, source, user string)
+}
+
+// Option configures an Ingester
+type Option func(*Ingester)
+
+// WithMaxSize sets the maximum size in bytes of a single DICOM
+func WithMaxSize(size int64) Option {
+	return func(i *Ingester) {
+		i.maxSize = size
+	}
+}
+
+// ArchiveLimits limit the archives that are ingested so that an upload can't
+// fill the disk it is spooled to or expand in to more than can be stored, as a
+// ZIP bomb would. Limits that are zero are the defaults.
+type ArchiveLimits struct {
+	// Size is the maximum size in bytes of an archive
+	Size int64
+	// UncompressedSize is the maximum total size in bytes of the files in an
+	// archive once they are decompressed
+	UncompressedSize int64
+	// Entries is the maximum number of entries in an archive
+	Entries int
+}
+
+// WithArchiveLimits sets the limits of the archives that are ingested
+func WithArchiveLimits(limits ArchiveLimits) Option {
+	return func(i *Ingester) {
+		if limits.Size > 0 {
+			i.archive.Size = limits.Size
+		}
+		if limits.UncompressedSize > 0 {
+			i.archive.UncompressedSize = limits.UncompressedSize
+		}
+		if limits.Entries > 0 {
+			i.archive.Entries = limits.Entries
+		}
+	}
+}
+
+// WithValidation sets the policy for DICOMs that fail validation
+func WithValidation(policy validate.Policy) Option {
+	return func(i *Ingester) {
+		i.policy = policy
+	}
+}
+
+// WithRules sets the rules that coerce the attributes of DICOMs before they
+// are stored
+func WithRules(rules *coerce.Engine) Option {
+	return func(i *Ingester) {
+		i.rules = rules
+	}
+}
+
+// WithHook adds a hook that is called after each DICOM is saved to the store
+func WithHook(hook Hook) Option {
+	return func(i *Ingester) {
+		i.hooks = append(i.hooks, hook)
+	}
+}
+
+// WithAuditor sets the auditor that records each DICOM saved to the store
+func WithAuditor(auditor Auditor) Option {
+	return func(i *Ingester) {
+		i.auditor = auditor
+	}
+}
+
+// Result is the outcome of ingesting a single file
+type Result struct {
+	File  string `json:"file"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// New returns a new Ingester
+func New(st store.Store, opts ...Option) *Ingester {
+	i := &Ingester{
+		store:   st,
+		maxSize: defaultMaxSize,
+		archive: ArchiveLimits{
+			Size:             defaultMaxArchiveSize,
+			UncompressedSize: defaultMaxArchiveUncompressed,
+			Entries:          defaultMaxArchiveEntries,
+		},
+		policy: validate.PolicyAccept,
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	return i
+}
+
+// ArchiveLimits returns the limits of the archives that are ingested
+func (i *Ingester) ArchiveLimits() ArchiveLimits {
+	return i.archive
+}
+
+// WithSource returns a copy of the Ingester for DICOMs from a source, such as
+// the address of the client that sent them, which coercion rules can match
+func (i *Ingester) WithSource(source string) *Ingester {
+	c := *i
+	c.source = source
+	return &c
+}
+
+// WithTenant returns a copy of the Ingester for DICOMs owned by a tenant,
+// whose quota they are admitted to and accounted against by the store
+func (i *Ingester) WithTenant(tenant string) *Ingester {
+	c := *i
+	c.tenant = tenant
+	return &c
+}
+
+// WithUser returns a copy of the Ingester for DICOMs sent by an
+// authenticated user, which the auditor records
+func (i *Ingester) WithUser(user string) *Ingester {
+	c := *i
+	c.user = user
+	return &c
+}
+
+// WithAuthorize returns a copy of the Ingester that checks each DICOM with fn
+// before it is saved to the store, failing the DICOM with the error fn returns
+func (i *Ingester) WithAuthorize(fn func(dcm *store.DICOM) error) *Ingester {
+	c := *i
+	c.authorize = fn
+	return &c
+}
+
+// WithProgress returns a copy of the Ingester that calls fn with the result of
+// each file as it is ingested from an archive or directory
+func (i *Ingester) WithProgress(fn func(Result)) *Ingester {
+	c := *i
+	c.progress = fn
+	return &c
+}
+
+// Ingest saves a DICOM read from r to the store. The DICOM is spooled to a
+// temporary file as it is read, failing with ErrTooLarge once it exceeds the
+// maximum size, and parsed from there so the upload is never held in memory.
+func (i *Ingester) Ingest(r io.Reader) (*store.DICOM, error) {
+	tmp, size, err := i.spool(r)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	dataset, err := dicom.Parse(bufio.NewReader(tmp), size, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse dicom: %w", err)
+	}
+	err = i.coerce(&dataset)
+	if err != nil {
+		return nil, err
+	}
+
+	dcm, err := store.NewDICOM(&dataset)
+	if err != nil {
+		return nil, err
+	}
+	err = i.validate(dcm)
+	if err != nil {
+		return nil, err
+	}
+	if i.authorize != nil {
+		err = i.authorize(dcm)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dcm.Tenant = i.tenant
+	err = i.store.Create(dcm)
+	if err != nil {
+		return nil, err
+	}
+	if i.auditor != nil {
+		i.auditor.Created(dcm, i.source, i.user)
+	}
+	for _, hook := range i.hooks {
+		hook(dcm, i.source)
+	}
+	return dcm, nil
+}
+
+// spool a DICOM read from r to a temporary file up to the maximum size and
+// return the file, rewound, along with its size
+func (i *Ingester) spool(r io.Reader) (*os.File, int64, error) {
+	tmp, err := os.CreateTemp("", "dime-*.dcm")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	lr := &limitReader{r: r, n: i.maxSize}
+	size, err := io.Copy(tmp, lr)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil || lr.exceeded {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		if lr.exceeded {
+			return nil, 0, ErrTooLarge
+		}
+		return nil, 0, fmt.Errorf("failed to read dicom: %w", err)
+	}
+	return tmp, size, nil
+}
+
+// coerce the attributes of a dataset with the rules
+func (i *Ingester) coerce(dataset *dicom.Dataset) error {
+	if i.rules == nil {
+		return nil
+	}
+	changes, err := i.rules.Apply(dataset, i.source)
+	if err != nil {
+		return fmt.Errorf("failed to coerce dicom: %w", err)
+	}
+	for _, c := range changes {
+		slog.Info("Coerced attribute",
+			slog.String("rule", c.Rule),
+			slog.String("op", c.Op),
+			slog.String("tag", c.Tag),
+			slog.String("source", i.source))
+	}
+	return nil
+}
+
+// validate a DICOM according to the validation policy
+func (i *Ingester) validate(dcm *store.DICOM) error {
+	if i.policy == validate.PolicyAccept {
+		return nil
+	}
+	report := validate.Validate(dcm.Dataset())
+	err := report.Err()
+	if err != nil && i.policy == validate.PolicyWarn {
+		slog.Warn("Ingesting invalid DICOM",
+			slog.String("id", dcm.ID),
+			slog.String("error", err.Error()))
+		return nil
+	}
+	return err
+}
+
+// ingestFile ingests a single file and reports the result
+func (i *Ingester) ingestFile(name string, r io.Reader) Result {
+	res := Result{File: name}
+	dcm, err := i.Ingest(r)
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.ID = dcm.ID
+	}
+	i.report(res)
+	return res
+}
+
+// report a result to the progress function
+func (i *Ingester) report(res Result) {
+	if i.progress != nil {
+		i.progress(res)
+	}
+}
+
+// NewLimitReader returns a reader that reads up to n bytes from r and then
+// fails with ErrTooLarge if there is more to read
+func NewLimitReader(r io.Reader, n int64) io.Reader {
+	return &limitReader{r: r, n: n}
+}
+
+// limitReader reads up to n bytes and then fails with ErrTooLarge
+type limitReader struct {
+	r        io.Reader
+	n        int64
+	read     int64
+	exceeded bool
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.read >= l.n {
+		// probe for data past the limit
+		var b [1]byte
+		if n, _ := l.r.Read(b[:]); n > 0 {
+			l.exceeded = true
+			return 0, ErrTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.n-l.read {
+		p = p[:l.n-l.read]
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	return n, err
+}
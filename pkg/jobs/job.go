@@ -0,0 +1,94 @@
+package jobs
+
+import (
+	"strings"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/auth"
+	"github.com/johnmarkli/dime/pkg/ingest"
+)
+
+// State is the state of a job
+type State string
+
+const (
+	// StatePending is a job waiting for a worker
+	StatePending State = "pending"
+	// StateRunning is a job being ingested by a worker
+	StateRunning State = "running"
+	// StateDone is a job that has been ingested, possibly with errors for
+	// some of its files
+	StateDone State = "done"
+	// StateFailed is a job that could not be ingested
+	StateFailed State = "failed"
+)
+
+// Kind is the kind of upload a job ingests
+type Kind string
+
+const (
+	// KindDICOM is a single DICOM
+	KindDICOM Kind = "dicom"
+	// KindZip is a ZIP archive of DICOMs
+	KindZip Kind = "zip"
+	// KindTar is a tar(.gz) archive of DICOMs
+	KindTar Kind = "tar"
+)
+
+// KindOf determines whether an upload is a DICOM or an archive from its media
+// type, falling back to the file extension for generic media types
+func KindOf(mediaType, filename string) Kind {
+	switch mediaType {
+	case "application/zip", "application/x-zip-compressed":
+		return KindZip
+	case "application/x-tar", "application/gzip", "application/x-gzip", "application/x-gtar":
+		return KindTar
+	}
+	name := strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return KindZip
+	case strings.HasSuffix(name, ".tar"), strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return KindTar
+	}
+	return KindDICOM
+}
+
+// Job is an upload queued for ingest. The identity that submitted it is
+// journaled with it so its DICOMs are authorized after a restart, but isn't
+// returned by the queue.
+type Job struct {
+	ID        string          `json:"id" example:"5f0c6b1e3a2d4c8e9b7a6f5e4d3c2b1a"`
+	Kind      Kind            `json:"kind" example:"dicom"`
+	Filename  string          `json:"filename,omitempty" example:"IM000001"`
+	Source    string          `json:"source,omitempty" example:"10.0.1.5"`
+	Tenant    string          `json:"tenant,omitempty" example:"radiology"`
+	User      string          `json:"user,omitempty" example:"modality-gateway"`
+	Identity  *auth.Identity  `json:"identity,omitempty" swaggerignore:"true"`
+	State     State           `json:"state" example:"done"`
+	Processed int             `json:"processed" example:"1"`
+	Failed    int             `json:"failed" example:"0"`
+	Results   []ingest.Result `json:"results"`
+	Error     string          `json:"error,omitempty"`
+	Created   time.Time       `json:"created"`
+	Updated   time.Time       `json:"updated"`
+}
+
+// finished returns whether the job is done or failed
+func (j *Job) finished() bool {
+	return j.State == StateDone || j.State == StateFailed
+}
+
+// public returns a deep copy of the job without its identity
+func (j *Job) public() *Job {
+	c := j.copy()
+	c.Identity = nil
+	return c
+}
+
+// copy returns a deep copy of the job
+func (j *Job) copy() *Job {
+	c := *j
+	c.Results = append([]ingest.Result{}, j.Results...)
+	return &c
+}
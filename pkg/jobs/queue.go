@@ -0,0 +1,428 @@
+// Package jobs provides an asynchronous queue for ingesting DICOMs
+package jobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/auth"
+	"github.com/johnmarkli/dime/pkg/ingest"
+	"github.com/johnmarkli/dime/pkg/store"
+)
+
+const (
+	defaultWorkers   = 4
+	defaultQueueSize = 100
+	jobExt           = ".json"
+	uploadExt        = ".upload"
+	defaultRetention = 7 * 24 * time.Hour
+	pruneInterval    = time.Hour
+)
+
+var (
+	// ErrNotFound is an error for a job that is not found
+	ErrNotFound = errors.New("not found")
+	// ErrQueueFull is an error for a job submitted to a full queue
+	ErrQueueFull = errors.New("ingest queue is full")
+)
+
+// Queue ingests uploads with a bounded pool of workers. Jobs and their
+// uploads are journaled to a directory so pending jobs survive a restart.
+// Finished jobs are kept until they are older than the retention period.
+type Queue struct {
+	dir       string
+	ingester  *ingest.Ingester
+	workers   int
+	size      int
+	retention time.Duration
+	authorize func(id *auth.Identity) func(*store.DICOM) error
+
+	mu      sync.RWMutex
+	jobs    map[string]*Job
+	pruned  time.Time
+	pending chan string
+	wg      sync.WaitGroup
+	quit    chan struct{}
+}
+
+// Option configures a Queue
+type Option func(*Queue)
+
+// WithWorkers sets the number of workers ingesting jobs
+func WithWorkers(n int) Option {
+	return func(q *Queue) {
+		q.workers = n
+	}
+}
+
+// WithSize sets the maximum number of pending jobs
+func WithSize(n int) Option {
+	return func(q *Queue) {
+		q.size = n
+	}
+}
+
+// WithRetention sets how long finished jobs are kept
+func WithRetention(d time.Duration) Option {
+	return func(q *Queue) {
+		q.retention = d
+	}
+}
+
+// WithAuthorize sets the function that returns the check of each DICOM of a
+// job against the identity that submitted it
+func WithAuthorize(fn func(id *auth.Identity) func(*store.DICOM) error) Option {
+	return func(q *Queue) {
+		q.authorize = fn
+	}
+}
+
+// New creates a Queue journaled in dir, recovering any jobs from a previous
+// run
+func New(dir string, ingester *ingest.Ingester, opts ...Option) (*Queue, error) {
+	q := &Queue{
+		dir:       dir,
+		ingester:  ingester,
+		workers:   defaultWorkers,
+		size:      defaultQueueSize,
+		retention: defaultRetention,
+		jobs:      map[string]*Job{},
+		pruned:    time.Now(),
+		quit:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// Recover jobs from the journal
+	recovered, err := q.load()
+	if err != nil {
+		return nil, err
+	}
+	q.pending = make(chan string, max(q.size, len(recovered)))
+	for _, id := range recovered {
+		q.pending <- id
+	}
+	return q, nil
+}
+
+// Start the workers
+func (q *Queue) Start() {
+	for range q.workers {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+// Stop the workers, waiting for running jobs to finish. Pending jobs remain
+// in the journal.
+func (q *Queue) Stop() {
+	close(q.quit)
+	q.wg.Wait()
+}
+
+// Submit an upload read from r to the queue for a tenant and the identity
+// that sent it. The upload is spooled to the journal before the job is
+// returned.
+func (q *Queue) Submit(r io.Reader, kind Kind, filename, source, tenant string, identity *auth.Identity) (*Job, error) {
+	if len(q.pending) >= cap(q.pending) {
+		return nil, ErrQueueFull
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	// Spool upload
+	f, err := os.Create(q.uploadPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload file: %w", err)
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(q.uploadPath(id))
+		return nil, fmt.Errorf("failed to write upload file: %w", err)
+	}
+
+	user := ""
+	if identity != nil {
+		user = identity.Subject
+	}
+	now := time.Now().UTC()
+	job := &Job{
+		ID:       id,
+		Kind:     kind,
+		Filename: filename,
+		Source:   source,
+		Tenant:   tenant,
+		User:     user,
+		Identity: identity,
+		State:    StatePending,
+		Results:  []ingest.Result{},
+		Created:  now,
+		Updated:  now,
+	}
+	err = q.save(job)
+	if err != nil {
+		os.Remove(q.uploadPath(id))
+		return nil, err
+	}
+
+	q.mu.Lock()
+	q.jobs[id] = job
+	submitted := job.public()
+	q.mu.Unlock()
+	select {
+	case q.pending <- id:
+	default:
+		q.fail(id, ErrQueueFull)
+		return nil, ErrQueueFull
+	}
+	return submitted, nil
+}
+
+// Get a job by ID
+func (q *Queue) Get(id string) (*Job, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return job.public(), nil
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	ticker := time.NewTicker(min(pruneInterval, q.retention))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.quit:
+			return
+		case id := <-q.pending:
+			q.run(id)
+			q.prune()
+		case <-ticker.C:
+			q.prune()
+		}
+	}
+}
+
+// run ingests a job's upload and records the results
+func (q *Queue) run(id string) {
+	q.update(id, func(j *Job) {
+		j.State = StateRunning
+		j.Processed = 0
+		j.Failed = 0
+		j.Results = []ingest.Result{}
+	})
+	q.mu.RLock()
+	job := q.jobs[id].copy()
+	q.mu.RUnlock()
+
+	f, err := os.Open(q.uploadPath(id))
+	if err != nil {
+		q.fail(id, fmt.Errorf("failed to open upload file: %w", err))
+		return
+	}
+	defer os.Remove(q.uploadPath(id))
+	defer f.Close()
+
+	ingester := q.ingester.WithSource(job.Source).WithTenant(job.Tenant).WithUser(job.User).WithProgress(func(res ingest.Result) {
+		q.update(id, func(j *Job) { j.addResult(res) })
+	})
+	if q.authorize != nil {
+		ingester = ingester.WithAuthorize(q.authorize(job.Identity))
+	}
+	switch job.Kind {
+	case KindZip:
+		_, err = ingester.IngestZip(f)
+	case KindTar:
+		_, err = ingester.IngestTar(f)
+	default:
+		res := ingest.Result{File: job.Filename}
+		dcm, ingestErr := ingester.Ingest(f)
+		if ingestErr != nil {
+			res.Error = ingestErr.Error()
+		} else {
+			res.ID = dcm.ID
+		}
+		q.update(id, func(j *Job) { j.addResult(res) })
+	}
+	if err != nil {
+		q.fail(id, err)
+		return
+	}
+	q.update(id, func(j *Job) { j.State = StateDone })
+	job, _ = q.Get(id)
+	slog.Info("Finished ingest job",
+		slog.String("job", id),
+		slog.Int("processed", job.Processed),
+		slog.Int("failed", job.Failed))
+}
+
+// prune removes the finished jobs older than the retention period from the
+// queue and its journal, at most once every prune interval
+func (q *Queue) prune() {
+	q.mu.Lock()
+	if time.Since(q.pruned) < min(pruneInterval, q.retention) {
+		q.mu.Unlock()
+		return
+	}
+	q.pruned = time.Now()
+	expired := []string{}
+	for id, job := range q.jobs {
+		if job.finished() && time.Since(job.Updated) > q.retention {
+			delete(q.jobs, id)
+			expired = append(expired, id)
+		}
+	}
+	q.mu.Unlock()
+
+	for _, id := range expired {
+		os.Remove(q.jobPath(id))
+	}
+	if len(expired) > 0 {
+		slog.Info("Pruned ingest jobs", slog.Int("jobs", len(expired)))
+	}
+}
+
+// addResult records the result of ingesting a file
+func (j *Job) addResult(res ingest.Result) {
+	j.Processed++
+	if res.Error != "" {
+		j.Failed++
+	}
+	j.Results = append(j.Results, res)
+}
+
+// fail marks a job as failed
+func (q *Queue) fail(id string, err error) {
+	slog.Error("Failed ingest job", slog.String("job", id), slog.String("error", err.Error()))
+	q.update(id, func(j *Job) {
+		j.State = StateFailed
+		j.Error = err.Error()
+	})
+	os.Remove(q.uploadPath(id))
+}
+
+// update a job and journal it
+func (q *Queue) update(id string, fn func(*Job)) {
+	q.mu.Lock()
+	job, ok := q.jobs[id]
+	if !ok {
+		q.mu.Unlock()
+		return
+	}
+	fn(job)
+	job.Updated = time.Now().UTC()
+	c := job.copy()
+	q.mu.Unlock()
+
+	err := q.save(c)
+	if err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+// save a job to the journal, replacing the previous entry atomically
+func (q *Queue) save(job *Job) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job: %w", err)
+	}
+	tmp := q.jobPath(job.ID) + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write job: %w", err)
+	}
+	err = os.Rename(tmp, q.jobPath(job.ID))
+	if err != nil {
+		return fmt.Errorf("failed to write job: %w", err)
+	}
+	return nil
+}
+
+// load jobs from the journal, returning the IDs of unfinished jobs in the
+// order they were created
+func (q *Queue) load() ([]string, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job directory: %w", err)
+	}
+	unfinished := []*Job{}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), jobExt) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(q.dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read job: %w", err)
+		}
+		var job Job
+		err = json.Unmarshal(b, &job)
+		if err != nil {
+			slog.Error("Skipping unreadable job", slog.String("file", e.Name()))
+			continue
+		}
+		if job.finished() {
+			if time.Since(job.Updated) > q.retention {
+				os.Remove(q.jobPath(job.ID))
+				continue
+			}
+		} else {
+			job.State = StatePending
+			unfinished = append(unfinished, &job)
+		}
+		q.jobs[job.ID] = &job
+	}
+
+	sort.Slice(unfinished, func(i, j int) bool {
+		return unfinished[i].Created.Before(unfinished[j].Created)
+	})
+	ids := []string{}
+	for _, job := range unfinished {
+		ids = append(ids, job.ID)
+	}
+	if len(ids) > 0 {
+		slog.Info("Recovered ingest jobs", slog.Int("pending", len(ids)))
+	}
+	return ids, nil
+}
+
+func (q *Queue) jobPath(id string) string {
+	return filepath.Join(q.dir, id+jobExt)
+}
+
+func (q *Queue) uploadPath(id string) string {
+	return filepath.Join(q.dir, id+uploadExt)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
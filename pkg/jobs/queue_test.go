@@ -0,0 +1,163 @@
+package jobs_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/auth"
+	"github.com/johnmarkli/dime/pkg/ingest"
+	"github.com/johnmarkli/dime/pkg/jobs"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testID       = "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000395"
+	testDataPath = "../../testdata/IM000001-mri"
+)
+
+func TestQueue(t *testing.T) {
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	q, err := jobs.New(t.TempDir(), ingest.New(st))
+	assert.NoError(t, err)
+	q.Start()
+	defer q.Stop()
+
+	file, err := os.Open(testDataPath)
+	assert.NoError(t, err)
+	defer file.Close()
+	job, err := q.Submit(file, jobs.KindDICOM, "IM000001-mri", "", "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, jobs.StatePending, job.State)
+
+	job = waitForJob(t, q, job.ID)
+	assert.Equal(t, 1, job.Processed)
+	assert.Equal(t, 0, job.Failed)
+	assert.Equal(t, []ingest.Result{{File: "IM000001-mri", ID: testID}}, job.Results)
+
+	_, err = st.Read(testID)
+	assert.NoError(t, err)
+
+	_, err = q.Get("badid")
+	assert.ErrorIs(t, err, jobs.ErrNotFound)
+}
+
+func TestQueueRecover(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+
+	// Submit a job without any workers running
+	q, err := jobs.New(dir, ingest.New(st))
+	assert.NoError(t, err)
+	file, err := os.Open(testDataPath)
+	assert.NoError(t, err)
+	defer file.Close()
+	job, err := q.Submit(file, jobs.KindDICOM, "IM000001-mri", "", "", nil)
+	assert.NoError(t, err)
+
+	// Restart the queue from its journal
+	q, err = jobs.New(dir, ingest.New(st))
+	assert.NoError(t, err)
+	q.Start()
+	defer q.Stop()
+
+	job = waitForJob(t, q, job.ID)
+	assert.Equal(t, []ingest.Result{{File: "IM000001-mri", ID: testID}}, job.Results)
+}
+
+func TestQueueAuthorize(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	errDenied := errors.New("denied")
+	authorize := jobs.WithAuthorize(func(id *auth.Identity) func(*store.DICOM) error {
+		return func(dcm *store.DICOM) error {
+			if id == nil || id.Subject != "gateway" {
+				return errDenied
+			}
+			return nil
+		}
+	})
+
+	// Submit a job without any workers running
+	q, err := jobs.New(dir, ingest.New(st), authorize)
+	assert.NoError(t, err)
+	file, err := os.Open(testDataPath)
+	assert.NoError(t, err)
+	defer file.Close()
+	job, err := q.Submit(file, jobs.KindDICOM, "IM000001-mri", "", "", &auth.Identity{Subject: "clinic", Method: auth.MethodAPIKey})
+	assert.NoError(t, err)
+	assert.Equal(t, "clinic", job.User)
+	assert.Nil(t, job.Identity)
+
+	// The identity the job was submitted with is authorized after a restart
+	q, err = jobs.New(dir, ingest.New(st), authorize)
+	assert.NoError(t, err)
+	q.Start()
+	defer q.Stop()
+
+	job = waitForJob(t, q, job.ID)
+	assert.Equal(t, 1, job.Failed)
+	assert.Equal(t, []ingest.Result{{File: "IM000001-mri", Error: errDenied.Error()}}, job.Results)
+	_, err = st.Read(testID)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+}
+
+func TestQueueFull(t *testing.T) {
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	q, err := jobs.New(t.TempDir(), ingest.New(st), jobs.WithSize(1))
+	assert.NoError(t, err)
+
+	file, err := os.Open(testDataPath)
+	assert.NoError(t, err)
+	defer file.Close()
+	_, err = q.Submit(file, jobs.KindDICOM, "IM000001-mri", "", "", nil)
+	assert.NoError(t, err)
+	_, err = q.Submit(file, jobs.KindDICOM, "IM000001-mri", "", "", nil)
+	assert.ErrorIs(t, err, jobs.ErrQueueFull)
+}
+
+func TestQueuePrune(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	q, err := jobs.New(dir, ingest.New(st), jobs.WithRetention(50*time.Millisecond))
+	assert.NoError(t, err)
+	q.Start()
+	defer q.Stop()
+
+	file, err := os.Open(testDataPath)
+	assert.NoError(t, err)
+	defer file.Close()
+	job, err := q.Submit(file, jobs.KindDICOM, "IM000001-mri", "", "", nil)
+	assert.NoError(t, err)
+	waitForJob(t, q, job.ID)
+
+	// The finished job is pruned from the queue and its journal once it is
+	// older than the retention period
+	assert.Eventually(t, func() bool {
+		_, err := q.Get(job.ID)
+		return errors.Is(err, jobs.ErrNotFound)
+	}, 5*time.Second, 10*time.Millisecond)
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+// waitForJob waits for a job to finish
+func waitForJob(t *testing.T, q *jobs.Queue, id string) *jobs.Job {
+	var job *jobs.Job
+	assert.Eventually(t, func() bool {
+		var err error
+		job, err = q.Get(id)
+		assert.NoError(t, err)
+		return job.State == jobs.StateDone || job.State == jobs.StateFailed
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, jobs.StateDone, job.State)
+	return job
+}
@@ -0,0 +1,47 @@
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Config is the storage quotas in bytes. A quota of 0 is unlimited.
+type Config struct {
+	// Global is the quota of all tenants together
+	Global int64 `json:"global" example:"1099511627776"`
+	// Default is the quota of each tenant that has no quota of its own
+	Default int64 `json:"default" example:"107374182400"`
+	// Tenants is the quota of each tenant by name
+	Tenants map[string]int64 `json:"tenants"`
+}
+
+// Load a Config from a JSON file
+func Load(file string) (*Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quotas: %w", err)
+	}
+	var cfg Config
+	err = json.Unmarshal(b, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse quotas: %w", err)
+	}
+	if cfg.Global < 0 || cfg.Default < 0 {
+		return nil, fmt.Errorf("invalid quotas: quotas must not be negative")
+	}
+	for tenant, limit := range cfg.Tenants {
+		if limit < 0 {
+			return nil, fmt.Errorf("invalid quotas: %s: quota must not be negative", tenant)
+		}
+	}
+	return &cfg, nil
+}
+
+// limit returns the quota of a tenant
+func (c *Config) limit(tenant string) int64 {
+	if limit, ok := c.Tenants[tenant]; ok {
+		return limit
+	}
+	return c.Default
+}
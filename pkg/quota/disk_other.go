@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+
+package quota
+
+// diskSpace is not supported on this platform, so the free space watermark
+// is not enforced
+func diskSpace(dir string) (total, free int64, err error) {
+	return 0, 0, errUnsupported
+}
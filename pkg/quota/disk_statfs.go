@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd
+
+package quota
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// diskSpace returns the total and available bytes of the file system that
+// holds dir
+func diskSpace(dir string) (total, free int64, err error) {
+	var st syscall.Statfs_t
+	err = syscall.Statfs(dir, &st)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to stat file system: %w", err)
+	}
+	return int64(st.Blocks) * int64(st.Bsize), int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,506 @@
+// Package quota enforces storage quotas per tenant and keeps uploads from
+// filling the disk of the data directory
+package quota
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/suyashkumar/dicom"
+)
+
+const (
+	// DefaultTenant owns the DICOMs stored without a tenant
+	DefaultTenant = "default"
+	ledgerFile    = "ledger.jsonl"
+)
+
+var (
+	// ErrQuotaExceeded is an error for a DICOM that would exceed a quota
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+	// ErrInsufficientStorage is an error for a DICOM that would leave less
+	// than the minimum free space on disk
+	ErrInsufficientStorage = errors.New("insufficient storage")
+	// ErrInvalidTenant is an error for a tenant name that is not valid
+	ErrInvalidTenant = errors.New("invalid tenant")
+
+	errUnsupported = errors.New("unsupported")
+	tenantPattern  = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+)
+
+// Usage is the storage used against a quota. A Limit of 0 is unlimited.
+type Usage struct {
+	Used  int64 `json:"used" example:"52428800"`
+	Count int   `json:"count" example:"100"`
+	Limit int64 `json:"limit" example:"107374182400"`
+}
+
+// Disk is the space of the disk of the data directory
+type Disk struct {
+	Total   int64 `json:"total" example:"274877906944"`
+	Free    int64 `json:"free" example:"85899345920"`
+	MinFree int64 `json:"minFree" example:"268435456"`
+}
+
+// Report is the storage used by all tenants and by each tenant
+type Report struct {
+	Global  Usage            `json:"global"`
+	Tenants map[string]Usage `json:"tenants"`
+	Disk    *Disk            `json:"disk,omitempty"`
+	Evicted int64            `json:"evicted" example:"1048576"`
+}
+
+// entry is a DICOM accounted to a tenant in the ledger
+type entry struct {
+	ID      string `json:"id"`
+	Tenant  string `json:"tenant,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// Manager admits DICOMs to the store if they fit within the quotas of their
+// tenant and leave the minimum free space on disk, evicting cached images to
+// make room if it can. DICOMs are admitted and accounted as they are created
+// in a store wrapped by Wrap, whatever creates them. The size of each stored
+// DICOM is appended to a ledger so usage survives a restart, and the ledger
+// is compacted when it is loaded. DICOMs admitted at the same time are all
+// accounted once they are stored, so concurrent uploads can overshoot a quota
+// by their size.
+type Manager struct {
+	dir     string
+	cfg     *Config
+	minFree int64
+	evict   func(need int64) (int64, error)
+
+	mu      sync.Mutex
+	entries map[string]entry
+	tenants map[string]*Usage
+	evicted int64
+	ledger  *os.File
+}
+
+// Option configures a Manager
+type Option func(*Manager)
+
+// WithConfig sets the quotas that DICOMs are admitted within
+func WithConfig(cfg *Config) Option {
+	return func(m *Manager) {
+		m.cfg = cfg
+	}
+}
+
+// WithMinFree sets the bytes that must be left free on the disk of the data
+// directory, 0 to not check the disk
+func WithMinFree(bytes int64) Option {
+	return func(m *Manager) {
+		m.minFree = bytes
+	}
+}
+
+// WithEvictor sets a function that evicts cached images to free at least need
+// bytes on disk before DICOMs are rejected, returning the bytes it freed
+func WithEvictor(evict func(need int64) (int64, error)) Option {
+	return func(m *Manager) {
+		m.evict = evict
+	}
+}
+
+// New creates a Manager with its ledger in dir, which is also the directory
+// whose disk is kept from filling, loading the ledger of a previous run
+func New(dir string, opts ...Option) (*Manager, error) {
+	m := &Manager{
+		dir:     dir,
+		cfg:     &Config{},
+		entries: map[string]entry{},
+		tenants: map[string]*Usage{},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	err = m.load()
+	if err != nil {
+		return nil, err
+	}
+	err = m.compact()
+	if err != nil {
+		return nil, err
+	}
+	m.ledger, err = os.OpenFile(m.ledgerPath(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ledger: %w", err)
+	}
+	return m, nil
+}
+
+// Close the ledger
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ledger.Close()
+}
+
+// ParseTenant returns the tenant with a name, which is the default tenant if
+// the name is empty
+func ParseTenant(name string) (string, error) {
+	if name == "" {
+		return DefaultTenant, nil
+	}
+	if !tenantPattern.MatchString(name) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidTenant, name)
+	}
+	return name, nil
+}
+
+// Admit returns an error if storing size bytes for a tenant would exceed the
+// global quota or the tenant's quota, or would leave less than the minimum
+// free space on disk once cached images are evicted
+func (m *Manager) Admit(tenant string, size int64) error {
+	tenant, err := ParseTenant(tenant)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	var used int64
+	for _, u := range m.tenants {
+		used += u.Used
+	}
+	var tenantUsed int64
+	if u, ok := m.tenants[tenant]; ok {
+		tenantUsed = u.Used
+	}
+	limit := m.cfg.limit(tenant)
+	m.mu.Unlock()
+	if m.cfg.Global > 0 && used+size > m.cfg.Global {
+		return fmt.Errorf("%w: %d of %d bytes are used", ErrQuotaExceeded, used, m.cfg.Global)
+	}
+	if limit > 0 && tenantUsed+size > limit {
+		return fmt.Errorf("%w: tenant %s uses %d of %d bytes", ErrQuotaExceeded, tenant, tenantUsed, limit)
+	}
+	return m.reserve(size)
+}
+
+// Add accounts for a DICOM of size bytes stored for a tenant, replacing the
+// DICOM's previous size
+func (m *Manager) Add(tenant, id string, size int64) {
+	tenant, err := ParseTenant(tenant)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apply(entry{ID: id, Tenant: tenant, Size: size})
+	m.append(entry{ID: id, Tenant: tenant, Size: size})
+}
+
+// Empty returns whether no DICOMs are accounted, such as before quotas were
+// first enabled
+func (m *Manager) Empty() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries) == 0
+}
+
+// Backfill accounts each DICOM in a store that isn't in the ledger, such as
+// those stored before quotas were enabled, to the default tenant, returning
+// how many were accounted
+func (m *Manager) Backfill(st store.Store) (int, error) {
+	n := 0
+	err := store.Walk(st, func(dcm *store.DICOM) error {
+		m.mu.Lock()
+		_, ok := m.entries[dcm.ID]
+		m.mu.Unlock()
+		if ok {
+			return nil
+		}
+		size, err := encodedSize(dcm)
+		if err != nil {
+			return err
+		}
+		m.Add(DefaultTenant, dcm.ID, size)
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// Remove the DICOM with an ID from the usage of its tenant
+func (m *Manager) Remove(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.entries[id]; !ok {
+		return
+	}
+	m.apply(entry{ID: id, Deleted: true})
+	m.append(entry{ID: id, Deleted: true})
+}
+
+// Report the storage used by all tenants and by each tenant, and the space of
+// the disk
+func (m *Manager) Report() (*Report, error) {
+	m.mu.Lock()
+	report := &Report{
+		Global:  Usage{Limit: m.cfg.Global},
+		Tenants: map[string]Usage{},
+		Evicted: m.evicted,
+	}
+	for tenant, u := range m.tenants {
+		report.Global.Used += u.Used
+		report.Global.Count += u.Count
+		report.Tenants[tenant] = Usage{Used: u.Used, Count: u.Count, Limit: m.cfg.limit(tenant)}
+	}
+	for tenant, limit := range m.cfg.Tenants {
+		if _, ok := report.Tenants[tenant]; !ok {
+			report.Tenants[tenant] = Usage{Limit: limit}
+		}
+	}
+	m.mu.Unlock()
+
+	total, free, err := diskSpace(m.dir)
+	if errors.Is(err, errUnsupported) {
+		return report, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	report.Disk = &Disk{Total: total, Free: free, MinFree: m.minFree}
+	return report, nil
+}
+
+// Wrap a store so that the DICOMs created in it are admitted and accounted to
+// their tenant, and those deleted from it are removed from their tenant's
+// usage
+func (m *Manager) Wrap(st store.Store) store.Store {
+	return &accountedStore{Store: st, m: m}
+}
+
+// reserve returns an error if writing size bytes would leave less than the
+// minimum free space on disk, evicting cached images first if it can
+func (m *Manager) reserve(size int64) error {
+	if m.minFree <= 0 {
+		return nil
+	}
+	_, free, err := diskSpace(m.dir)
+	if errors.Is(err, errUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	short := m.minFree + size - free
+	if short <= 0 {
+		return nil
+	}
+	if m.evict != nil {
+		freed, err := m.evict(short)
+		if err != nil {
+			slog.Error("Failed to evict images", slog.String("error", err.Error()))
+		}
+		if freed > 0 {
+			slog.Info("Evicted images", slog.Int64("bytes", freed))
+			m.mu.Lock()
+			m.evicted += freed
+			m.mu.Unlock()
+		}
+		_, free, err = diskSpace(m.dir)
+		if err != nil {
+			return err
+		}
+		if m.minFree+size <= free {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %d bytes are free and %d must be kept free", ErrInsufficientStorage, free, m.minFree)
+}
+
+// apply an entry to the usage of its tenant. The caller must hold the lock.
+func (m *Manager) apply(e entry) {
+	if old, ok := m.entries[e.ID]; ok {
+		u := m.tenants[old.Tenant]
+		u.Used -= old.Size
+		u.Count--
+		if u.Count == 0 {
+			delete(m.tenants, old.Tenant)
+		}
+		delete(m.entries, e.ID)
+	}
+	if e.Deleted {
+		return
+	}
+	u, ok := m.tenants[e.Tenant]
+	if !ok {
+		u = &Usage{}
+		m.tenants[e.Tenant] = u
+	}
+	u.Used += e.Size
+	u.Count++
+	m.entries[e.ID] = e
+}
+
+// append an entry to the ledger. The caller must hold the lock.
+func (m *Manager) append(e entry) {
+	b, err := json.Marshal(e)
+	if err == nil {
+		_, err = m.ledger.Write(append(b, '\n'))
+	}
+	if err != nil {
+		slog.Error("Failed to write ledger",
+			slog.String("id", e.ID),
+			slog.String("error", err.Error()))
+	}
+}
+
+// load the entries of the ledger
+func (m *Manager) load() error {
+	f, err := os.Open(m.ledgerPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open ledger: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e entry
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil || e.ID == "" {
+			slog.Error("Skipping unreadable ledger entry", slog.String("entry", scanner.Text()))
+			continue
+		}
+		m.apply(e)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("failed to read ledger: %w", err)
+	}
+	return nil
+}
+
+// compact the ledger to one entry per stored DICOM, replacing it atomically
+func (m *Manager) compact() error {
+	tmp := m.ledgerPath() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to write ledger: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range m.entries {
+		err = enc.Encode(e)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, m.ledgerPath())
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write ledger: %w", err)
+	}
+	return nil
+}
+
+func (m *Manager) ledgerPath() string {
+	return filepath.Join(m.dir, ledgerFile)
+}
+
+// tenant returns the tenant of a DICOM, which is the tenant it is created
+// for, the tenant of the DICOM it replaces or the default tenant
+func (m *Manager) tenant(dcm *store.DICOM) (string, error) {
+	if dcm.Tenant != "" {
+		return ParseTenant(dcm.Tenant)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.entries[dcm.ID]; ok {
+		return e.Tenant, nil
+	}
+	return DefaultTenant, nil
+}
+
+// encodedSize returns the size in bytes of a DICOM once it is written
+func encodedSize(dcm *store.DICOM) (int64, error) {
+	if dcm.Dataset() == nil {
+		return 0, nil
+	}
+	var w countingWriter
+	err := dicom.Write(&w, *dcm.Dataset())
+	if err != nil {
+		return 0, fmt.Errorf("failed to size dicom: %w", err)
+	}
+	return int64(w), nil
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// accountedStore admits the DICOMs created in a store and accounts them to
+// their tenant, and removes those deleted from it from their tenant's usage
+type accountedStore struct {
+	store.Store
+	m *Manager
+}
+
+// Create a DICOM in the store if it is admitted for its tenant and account
+// for it
+func (s *accountedStore) Create(dcm *store.DICOM) error {
+	tenant, err := s.m.tenant(dcm)
+	if err != nil {
+		return err
+	}
+	size, err := encodedSize(dcm)
+	if err != nil {
+		return err
+	}
+	err = s.m.Admit(tenant, size)
+	if err != nil {
+		return err
+	}
+	err = s.Store.Create(dcm)
+	if err != nil {
+		return err
+	}
+	s.m.Add(tenant, dcm.ID, size)
+	return nil
+}
+
+// Delete a DICOM from the store and from its tenant's usage
+func (s *accountedStore) Delete(id string) error {
+	err := s.Store.Delete(id)
+	if err != nil {
+		return err
+	}
+	s.m.Remove(id)
+	return nil
+}
+
+// Walk calls fn with each DICOM of the store in turn
+func (s *accountedStore) Walk(fn func(dcm *store.DICOM) error) error {
+	return store.Walk(s.Store, fn)
+}
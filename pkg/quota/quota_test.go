@@ -0,0 +1,170 @@
+package quota_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/johnmarkli/dime/pkg/quota"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+)
+
+const (
+	testDataPath = "../../testdata/IM000001-mri"
+	testID       = "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000395"
+)
+
+func TestManager(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &quota.Config{Global: 1000, Default: 500, Tenants: map[string]int64{"research": 800}}
+	m, err := quota.New(dir, quota.WithConfig(cfg))
+	assert.NoError(t, err)
+
+	// The default tenant is limited by the default quota
+	assert.NoError(t, m.Admit("", 500))
+	assert.ErrorIs(t, m.Admit("", 501), quota.ErrQuotaExceeded)
+	m.Add("", "a", 400)
+	assert.ErrorIs(t, m.Admit("", 101), quota.ErrQuotaExceeded)
+
+	// A tenant with its own quota is limited by it and the global quota
+	assert.NoError(t, m.Admit("research", 600))
+	assert.ErrorIs(t, m.Admit("research", 601), quota.ErrQuotaExceeded)
+	m.Add("research", "b", 300)
+
+	// Replacing a DICOM replaces its size
+	m.Add("research", "b", 200)
+	report, err := m.Report()
+	assert.NoError(t, err)
+	assert.Equal(t, quota.Usage{Used: 600, Count: 2, Limit: 1000}, report.Global)
+	assert.Equal(t, quota.Usage{Used: 400, Count: 1, Limit: 500}, report.Tenants[quota.DefaultTenant])
+	assert.Equal(t, quota.Usage{Used: 200, Count: 1, Limit: 800}, report.Tenants["research"])
+
+	// Usage survives a restart
+	m.Remove("a")
+	assert.NoError(t, m.Close())
+	m, err = quota.New(dir, quota.WithConfig(cfg))
+	assert.NoError(t, err)
+	report, err = m.Report()
+	assert.NoError(t, err)
+	assert.Equal(t, quota.Usage{Used: 200, Count: 1, Limit: 1000}, report.Global)
+	assert.NotContains(t, report.Tenants, quota.DefaultTenant)
+	assert.Equal(t, quota.Usage{Used: 200, Count: 1, Limit: 800}, report.Tenants["research"])
+	assert.NoError(t, m.Close())
+
+	_, err = quota.ParseTenant("../etc")
+	assert.ErrorIs(t, err, quota.ErrInvalidTenant)
+	assert.ErrorIs(t, m.Admit("a b", 1), quota.ErrInvalidTenant)
+}
+
+func TestManagerMinFree(t *testing.T) {
+	dir := t.TempDir()
+	m, err := quota.New(dir, quota.WithMinFree(1<<62))
+	assert.NoError(t, err)
+	defer m.Close()
+	report, err := m.Report()
+	assert.NoError(t, err)
+	if report.Disk == nil {
+		t.Skip("disk space is not supported on this platform")
+	}
+	assert.ErrorIs(t, m.Admit("", 1), quota.ErrInsufficientStorage)
+
+	// Images are evicted before a DICOM is rejected
+	var need int64
+	m, err = quota.New(dir, quota.WithMinFree(1<<62), quota.WithEvictor(func(n int64) (int64, error) {
+		need = n
+		return 1024, nil
+	}))
+	assert.NoError(t, err)
+	defer m.Close()
+	assert.ErrorIs(t, m.Admit("", 1), quota.ErrInsufficientStorage)
+	assert.Positive(t, need)
+	report, err = m.Report()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1024), report.Evicted)
+
+	m, err = quota.New(dir, quota.WithMinFree(1))
+	assert.NoError(t, err)
+	defer m.Close()
+	assert.NoError(t, m.Admit("", 1))
+}
+
+func TestWrap(t *testing.T) {
+	m, err := quota.New(t.TempDir(), quota.WithConfig(&quota.Config{Tenants: map[string]int64{"small": 1 << 10}}))
+	assert.NoError(t, err)
+	defer m.Close()
+	mem, err := store.NewMemStore()
+	assert.NoError(t, err)
+	st := m.Wrap(mem)
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+
+	// A DICOM created over its tenant's quota is rejected before it is stored
+	dcm.Tenant = "small"
+	assert.ErrorIs(t, st.Create(dcm), quota.ErrQuotaExceeded)
+	_, err = mem.Read(testID)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	// A DICOM created without a tenant is accounted to the default tenant, and
+	// stays with it when it is replaced
+	dcm.Tenant = ""
+	assert.NoError(t, st.Create(dcm))
+	assert.NoError(t, st.Create(dcm))
+	report, err := m.Report()
+	assert.NoError(t, err)
+	assert.Equal(t, quota.Usage{Used: int64(len(b)), Count: 1}, report.Tenants[quota.DefaultTenant])
+
+	// Deleting a DICOM removes it from the usage of its tenant
+	assert.NoError(t, st.Delete(testID))
+	report, err = m.Report()
+	assert.NoError(t, err)
+	assert.Zero(t, report.Global.Used)
+	assert.NotContains(t, report.Tenants, quota.DefaultTenant)
+}
+
+func TestBackfill(t *testing.T) {
+	m, err := quota.New(t.TempDir())
+	assert.NoError(t, err)
+	defer m.Close()
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+
+	// DICOMs stored before quotas were enabled are accounted once to the
+	// default tenant
+	assert.True(t, m.Empty())
+	n, err := m.Backfill(st)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = m.Backfill(st)
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+	assert.False(t, m.Empty())
+	report, err := m.Report()
+	assert.NoError(t, err)
+	assert.Equal(t, quota.Usage{Used: int64(len(b)), Count: 1}, report.Tenants[quota.DefaultTenant])
+}
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "quotas.json")
+	assert.NoError(t, os.WriteFile(file, []byte(`{"global": 1000, "tenants": {"research": 500}}`), 0600))
+	cfg, err := quota.Load(file)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), cfg.Global)
+	assert.Equal(t, int64(500), cfg.Tenants["research"])
+
+	assert.NoError(t, os.WriteFile(file, []byte(`{"default": -1}`), 0600))
+	_, err = quota.Load(file)
+	assert.Error(t, err)
+}
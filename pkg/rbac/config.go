@@ -0,0 +1,99 @@
+package rbac
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/johnmarkli/dime/pkg/auth"
+)
+
+// defaultGroupsClaim is the JWT claim of the groups of a subject
+const defaultGroupsClaim = "groups"
+
+// methods are the authentication methods of the identities grants match
+var methods = []string{auth.MethodAPIKey, auth.MethodJWT, auth.MethodCertificate}
+
+// Config is the grants of roles to subjects and groups
+type Config struct {
+	Grants      []Grant `json:"grants"`
+	GroupsClaim string  `json:"groupsClaim,omitempty" example:"groups"`
+}
+
+// Grant gives roles to a subject, or to the members of a group listed in the
+// groups claim of a JWT, within scopes. A grant without scopes applies to
+// every DICOM. Method is the authentication method of the identities the
+// grant matches, since API keys, JWTs and client certificates each name their
+// own subjects and groups. Tenant is the tenant that owns the DICOMs uploaded
+// under the grant.
+type Grant struct {
+	Method  string  `json:"method" example:"apikey"`
+	Subject string  `json:"subject,omitempty" example:"reporting"`
+	Group   string  `json:"group,omitempty" example:"researchers"`
+	Roles   []Role  `json:"roles"`
+	Scopes  []Scope `json:"scopes,omitempty"`
+	Tenant  string  `json:"tenant,omitempty" example:"research"`
+}
+
+// Scope selects the DICOMs a grant applies to. IssuerOfPatientID and
+// Institution must equal the Issuer of Patient ID and Institution Name of a
+// DICOM and StudyLabel must be one of the labels of its study. An empty Scope
+// selects every DICOM.
+type Scope struct {
+	IssuerOfPatientID string `json:"issuerOfPatientID,omitempty" example:"HOSPITAL-A"`
+	Institution       string `json:"institution,omitempty" example:"General Hospital"`
+	StudyLabel        string `json:"studyLabel,omitempty" example:"covid-research"`
+}
+
+// StudyLabels returns whether a grant of the Config is scoped by study label
+func (c *Config) StudyLabels() bool {
+	for _, g := range c.Grants {
+		for _, s := range g.Scopes {
+			if s.StudyLabel != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Load a Config from a JSON file
+func Load(file string) (*Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rbac config: %w", err)
+	}
+	var cfg Config
+	err = json.Unmarshal(b, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rbac config: %w", err)
+	}
+	return &cfg, nil
+}
+
+// compile validates the grants of a Config and sets its defaults
+func compile(cfg *Config) (*Config, error) {
+	c := &Config{GroupsClaim: cfg.GroupsClaim}
+	if c.GroupsClaim == "" {
+		c.GroupsClaim = defaultGroupsClaim
+	}
+	for i, g := range cfg.Grants {
+		if (g.Subject == "") == (g.Group == "") {
+			return nil, fmt.Errorf("grant %d: one of subject and group is required", i+1)
+		}
+		if !slices.Contains(methods, g.Method) {
+			return nil, fmt.Errorf("grant %d: method must be one of %v", i+1, methods)
+		}
+		if len(g.Roles) == 0 {
+			return nil, fmt.Errorf("grant %d: roles are required", i+1)
+		}
+		for _, role := range g.Roles {
+			if _, ok := permissions[role]; !ok {
+				return nil, fmt.Errorf("grant %d: unknown role %q", i+1, role)
+			}
+		}
+		c.Grants = append(c.Grants, g)
+	}
+	return c, nil
+}
@@ -0,0 +1,240 @@
+// Package rbac authorizes requests by the roles granted to their identity
+// within scopes of DICOMs
+package rbac
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/johnmarkli/dime/pkg/auth"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// Role is a set of actions a subject may take
+type Role string
+
+// Roles
+const (
+	// RoleUploader may upload and import DICOMs
+	RoleUploader Role = "uploader"
+	// RoleReader may list and read DICOMs
+	RoleReader Role = "reader"
+	// RoleDeidentifiedReader may list and read DICOMs whose patient identity
+	// has been removed
+	RoleDeidentifiedReader Role = "de-identified-reader"
+	// RoleAdmin may take every action
+	RoleAdmin Role = "admin"
+)
+
+// Action is an action on DICOMs or the server
+type Action string
+
+// Actions
+const (
+	// ActionCreate uploads or imports DICOMs
+	ActionCreate Action = "create"
+	// ActionRead lists and reads DICOMs
+	ActionRead Action = "read"
+	// ActionAdmin manages the server
+	ActionAdmin Action = "admin"
+)
+
+// permissions are the actions of each role
+var permissions = map[Role][]Action{
+	RoleUploader:           {ActionCreate},
+	RoleReader:             {ActionRead},
+	RoleDeidentifiedReader: {ActionRead},
+	RoleAdmin:              {ActionCreate, ActionRead, ActionAdmin},
+}
+
+// ErrForbidden is an error for an action an identity may not take
+var ErrForbidden = errors.New("forbidden")
+
+// Authorizer authorizes the actions of identities by the roles granted to
+// them
+type Authorizer struct {
+	cfg    *Config
+	labels func(studyInstanceUID string) []string
+}
+
+// Option is an option of an Authorizer
+type Option func(*Authorizer)
+
+// WithLabels sets the labels of each study that scopes match
+func WithLabels(labels func(studyInstanceUID string) []string) Option {
+	return func(a *Authorizer) {
+		a.labels = labels
+	}
+}
+
+// New returns an Authorizer of the grants of a config
+func New(cfg *Config, opts ...Option) (*Authorizer, error) {
+	c, err := compile(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rbac config: %w", err)
+	}
+	a := &Authorizer{
+		cfg:    c,
+		labels: func(string) []string { return nil },
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a, nil
+}
+
+// Authorize an identity to take an action on some DICOMs. It returns
+// ErrForbidden unless one of the identity's roles permits the action.
+func (a *Authorizer) Authorize(id *auth.Identity, action Action) error {
+	for _, g := range a.grants(id) {
+		for _, role := range g.Roles {
+			if slices.Contains(permissions[role], action) {
+				return nil
+			}
+		}
+	}
+	return forbidden(id, action)
+}
+
+// Tenant returns the tenant of an identity, which is that of the first of its
+// grants with a tenant, or an empty string if none of them have one
+func (a *Authorizer) Tenant(id *auth.Identity) string {
+	for _, g := range a.grants(id) {
+		if g.Tenant != "" {
+			return g.Tenant
+		}
+	}
+	return ""
+}
+
+// AuthorizeDICOM authorizes an identity to take an action on a DICOM. It
+// returns ErrForbidden unless one of the identity's roles permits the action
+// within a scope of the DICOM.
+func (a *Authorizer) AuthorizeDICOM(id *auth.Identity, action Action, dcm *store.DICOM) error {
+	if a.allowed(a.grants(id), action, dcm) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s may not %s %s", ErrForbidden, subject(id), action, dcm.ID)
+}
+
+// Filter the DICOMs an identity may take an action on
+func (a *Authorizer) Filter(id *auth.Identity, action Action, dicoms []*store.DICOM) []*store.DICOM {
+	grants := a.grants(id)
+	filtered := []*store.DICOM{}
+	for _, dcm := range dicoms {
+		if a.allowed(grants, action, dcm) {
+			filtered = append(filtered, dcm)
+		}
+	}
+	return filtered
+}
+
+// allowed returns whether one of a list of grants permits an action on a
+// DICOM
+func (a *Authorizer) allowed(grants []Grant, action Action, dcm *store.DICOM) bool {
+	for _, g := range grants {
+		if !a.inScope(g.Scopes, dcm) {
+			continue
+		}
+		for _, role := range g.Roles {
+			if !slices.Contains(permissions[role], action) {
+				continue
+			}
+			if role == RoleDeidentifiedReader && !strings.EqualFold(stringValue(dcm, tag.PatientIdentityRemoved), "YES") {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// inScope returns whether a DICOM is in one of a list of scopes, or there are
+// no scopes
+func (a *Authorizer) inScope(scopes []Scope, dcm *store.DICOM) bool {
+	if len(scopes) == 0 {
+		return true
+	}
+	for _, s := range scopes {
+		if s.IssuerOfPatientID != "" && s.IssuerOfPatientID != stringValue(dcm, tag.IssuerOfPatientID) {
+			continue
+		}
+		if s.Institution != "" && s.Institution != stringValue(dcm, tag.InstitutionName) {
+			continue
+		}
+		if s.StudyLabel != "" && !slices.Contains(a.labels(dcm.StudyInstanceUID), s.StudyLabel) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// grants returns the grants to an identity by its authentication method and
+// its subject or groups
+func (a *Authorizer) grants(id *auth.Identity) []Grant {
+	if id == nil {
+		return nil
+	}
+	groups := groups(id.Claims[a.cfg.GroupsClaim])
+	var grants []Grant
+	for _, g := range a.cfg.Grants {
+		if g.Method != id.Method {
+			continue
+		}
+		if (g.Subject != "" && g.Subject == id.Subject) || (g.Group != "" && slices.Contains(groups, g.Group)) {
+			grants = append(grants, g)
+		}
+	}
+	return grants
+}
+
+// groups returns the groups of a claim, a string or list of strings
+func groups(claim any) []string {
+	switch claim := claim.(type) {
+	case string:
+		return []string{claim}
+	case []any:
+		var groups []string
+		for _, c := range claim {
+			if s, ok := c.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+// forbidden returns an ErrForbidden for an action of an identity
+func forbidden(id *auth.Identity, action Action) error {
+	return fmt.Errorf("%w: %s may not %s", ErrForbidden, subject(id), action)
+}
+
+// subject returns the subject of an identity to report in errors
+func subject(id *auth.Identity) string {
+	if id == nil || id.Subject == "" {
+		return "anonymous"
+	}
+	return id.Subject
+}
+
+// stringValue returns the first string value of an element of a DICOM, or
+// an empty string if it has none
+func stringValue(dcm *store.DICOM, t tag.Tag) string {
+	if dcm.Dataset() == nil {
+		return ""
+	}
+	element, err := dcm.Dataset().FindElementByTag(t)
+	if err != nil {
+		return ""
+	}
+	values, ok := element.Value.GetValue().([]string)
+	if !ok || len(values) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(values[0])
+}
@@ -0,0 +1,154 @@
+package rbac_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/johnmarkli/dime/pkg/auth"
+	"github.com/johnmarkli/dime/pkg/rbac"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+const (
+	testDataPath = "../../testdata/IM000001-mri"
+	testID       = "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000395"
+	institution  = "Sunnyvale Imaging Center"
+)
+
+// newDICOM returns the test DICOM with extra elements
+func newDICOM(t *testing.T, elements map[tag.Tag]string) *store.DICOM {
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	for tg, val := range elements {
+		el, err := dicom.NewElement(tg, []string{val})
+		assert.NoError(t, err)
+		ds.Elements = append(ds.Elements, el)
+	}
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	return dcm
+}
+
+func TestAuthorizer(t *testing.T) {
+	dcm := newDICOM(t, map[tag.Tag]string{tag.IssuerOfPatientID: "HOSPITAL-A"})
+	deidentified := newDICOM(t, map[tag.Tag]string{tag.PatientIdentityRemoved: "YES"})
+	labels := map[string][]string{}
+	a, err := rbac.New(&rbac.Config{Grants: []rbac.Grant{
+		{Method: auth.MethodAPIKey, Subject: "gateway", Roles: []rbac.Role{rbac.RoleUploader}},
+		{Method: auth.MethodAPIKey, Subject: "reporting", Roles: []rbac.Role{rbac.RoleReader}, Scopes: []rbac.Scope{{Institution: institution}}},
+		{Method: auth.MethodAPIKey, Subject: "other", Roles: []rbac.Role{rbac.RoleReader}, Scopes: []rbac.Scope{{Institution: "General Hospital"}}},
+		{Method: auth.MethodAPIKey, Subject: "issuer", Roles: []rbac.Role{rbac.RoleReader}, Scopes: []rbac.Scope{{IssuerOfPatientID: "HOSPITAL-A"}}},
+		{Method: auth.MethodAPIKey, Subject: "project", Roles: []rbac.Role{rbac.RoleReader}, Scopes: []rbac.Scope{{StudyLabel: "research"}}},
+		{Method: auth.MethodJWT, Group: "researchers", Roles: []rbac.Role{rbac.RoleDeidentifiedReader}},
+		{Method: auth.MethodJWT, Group: "admins", Roles: []rbac.Role{rbac.RoleAdmin}},
+	}}, rbac.WithLabels(func(uid string) []string { return labels[uid] }))
+	assert.NoError(t, err)
+
+	gateway := &auth.Identity{Subject: "gateway", Method: auth.MethodAPIKey}
+	reporting := &auth.Identity{Subject: "reporting", Method: auth.MethodAPIKey}
+	other := &auth.Identity{Subject: "other", Method: auth.MethodAPIKey}
+	issuer := &auth.Identity{Subject: "issuer", Method: auth.MethodAPIKey}
+	project := &auth.Identity{Subject: "project", Method: auth.MethodAPIKey}
+	researcher := &auth.Identity{Subject: "alice", Method: auth.MethodJWT, Claims: map[string]any{"groups": []any{"researchers"}}}
+	admin := &auth.Identity{Subject: "bob", Method: auth.MethodJWT, Claims: map[string]any{"groups": "admins"}}
+	stranger := &auth.Identity{Subject: "stranger", Method: auth.MethodAPIKey}
+
+	// Roles permit actions
+	assert.NoError(t, a.Authorize(gateway, rbac.ActionCreate))
+	assert.ErrorIs(t, a.Authorize(gateway, rbac.ActionRead), rbac.ErrForbidden)
+	assert.NoError(t, a.Authorize(reporting, rbac.ActionRead))
+	assert.ErrorIs(t, a.Authorize(reporting, rbac.ActionCreate), rbac.ErrForbidden)
+	assert.NoError(t, a.Authorize(researcher, rbac.ActionRead))
+	assert.ErrorIs(t, a.Authorize(researcher, rbac.ActionAdmin), rbac.ErrForbidden)
+	for _, action := range []rbac.Action{rbac.ActionCreate, rbac.ActionRead, rbac.ActionAdmin} {
+		assert.NoError(t, a.Authorize(admin, action))
+		assert.ErrorIs(t, a.Authorize(stranger, action), rbac.ErrForbidden)
+		assert.ErrorIs(t, a.Authorize(nil, action), rbac.ErrForbidden)
+	}
+	assert.EqualError(t, a.Authorize(stranger, rbac.ActionRead), "forbidden: stranger may not read")
+
+	// Grants only match identities of their authentication method
+	impostor := &auth.Identity{Subject: "reporting", Method: auth.MethodCertificate,
+		Claims: map[string]any{"groups": []any{"admins"}}}
+	for _, action := range []rbac.Action{rbac.ActionCreate, rbac.ActionRead, rbac.ActionAdmin} {
+		assert.ErrorIs(t, a.Authorize(impostor, action), rbac.ErrForbidden)
+	}
+
+	// Scopes select DICOMs
+	assert.NoError(t, a.AuthorizeDICOM(reporting, rbac.ActionRead, dcm))
+	assert.ErrorIs(t, a.AuthorizeDICOM(other, rbac.ActionRead, dcm), rbac.ErrForbidden)
+	assert.NoError(t, a.AuthorizeDICOM(issuer, rbac.ActionRead, dcm))
+	assert.ErrorIs(t, a.AuthorizeDICOM(issuer, rbac.ActionRead, deidentified), rbac.ErrForbidden)
+	assert.ErrorIs(t, a.AuthorizeDICOM(project, rbac.ActionRead, dcm), rbac.ErrForbidden)
+	labels[dcm.StudyInstanceUID] = []string{"research"}
+	assert.NoError(t, a.AuthorizeDICOM(project, rbac.ActionRead, dcm))
+	assert.NoError(t, a.AuthorizeDICOM(admin, rbac.ActionRead, dcm))
+	assert.ErrorIs(t, a.AuthorizeDICOM(gateway, rbac.ActionRead, dcm), rbac.ErrForbidden)
+
+	// De-identified readers only read de-identified DICOMs
+	assert.ErrorIs(t, a.AuthorizeDICOM(researcher, rbac.ActionRead, dcm), rbac.ErrForbidden)
+	assert.NoError(t, a.AuthorizeDICOM(researcher, rbac.ActionRead, deidentified))
+	assert.Equal(t, []*store.DICOM{deidentified}, a.Filter(researcher, rbac.ActionRead, []*store.DICOM{dcm, deidentified}))
+	assert.Equal(t, []*store.DICOM{dcm}, a.Filter(issuer, rbac.ActionRead, []*store.DICOM{dcm, deidentified}))
+	assert.Equal(t, []*store.DICOM{}, a.Filter(stranger, rbac.ActionRead, []*store.DICOM{dcm, deidentified}))
+}
+
+func TestAuthorizerTenant(t *testing.T) {
+	a, err := rbac.New(&rbac.Config{Grants: []rbac.Grant{
+		{Method: auth.MethodAPIKey, Subject: "gateway", Roles: []rbac.Role{rbac.RoleUploader}},
+		{Method: auth.MethodJWT, Group: "radiology", Roles: []rbac.Role{rbac.RoleUploader}, Tenant: "radiology"},
+		{Method: auth.MethodJWT, Group: "research", Roles: []rbac.Role{rbac.RoleUploader}, Tenant: "research"},
+	}})
+	assert.NoError(t, err)
+
+	// The tenant is that of the first grant with one
+	assert.Equal(t, "", a.Tenant(&auth.Identity{Subject: "gateway", Method: auth.MethodAPIKey}))
+	assert.Equal(t, "radiology", a.Tenant(&auth.Identity{Subject: "alice", Method: auth.MethodJWT,
+		Claims: map[string]any{"groups": []any{"research", "radiology"}}}))
+	assert.Equal(t, "", a.Tenant(nil))
+}
+
+func TestGroupsClaim(t *testing.T) {
+	dcm := newDICOM(t, nil)
+	a, err := rbac.New(&rbac.Config{
+		GroupsClaim: "roles",
+		Grants:      []rbac.Grant{{Method: auth.MethodJWT, Group: "radiology", Roles: []rbac.Role{rbac.RoleReader}}},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, a.AuthorizeDICOM(&auth.Identity{Method: auth.MethodJWT, Claims: map[string]any{"roles": []any{"radiology"}}}, rbac.ActionRead, dcm))
+	assert.ErrorIs(t, a.AuthorizeDICOM(&auth.Identity{Method: auth.MethodJWT, Claims: map[string]any{"groups": []any{"radiology"}}}, rbac.ActionRead, dcm), rbac.ErrForbidden)
+}
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rbac.json")
+	assert.NoError(t, os.WriteFile(file, []byte(`{"grants":[
+		{"method":"apikey","subject":"reporting","roles":["reader"],"scopes":[{"institution":"General Hospital"}]}
+	]}`), 0600))
+	cfg, err := rbac.Load(file)
+	assert.NoError(t, err)
+	assert.Equal(t, &rbac.Config{Grants: []rbac.Grant{{
+		Method:  auth.MethodAPIKey,
+		Subject: "reporting",
+		Roles:   []rbac.Role{rbac.RoleReader},
+		Scopes:  []rbac.Scope{{Institution: "General Hospital"}},
+	}}}, cfg)
+
+	_, err = rbac.Load(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+
+	for _, cfg := range []rbac.Config{
+		{Grants: []rbac.Grant{{Roles: []rbac.Role{rbac.RoleReader}}}},
+		{Grants: []rbac.Grant{{Subject: "a", Group: "b", Roles: []rbac.Role{rbac.RoleReader}}}},
+		{Grants: []rbac.Grant{{Subject: "a"}}},
+		{Grants: []rbac.Grant{{Method: auth.MethodAPIKey, Subject: "a", Roles: []rbac.Role{"superuser"}}}},
+		{Grants: []rbac.Grant{{Subject: "a", Roles: []rbac.Role{rbac.RoleReader}}}},
+		{Grants: []rbac.Grant{{Method: "password", Subject: "a", Roles: []rbac.Role{rbac.RoleReader}}}},
+	} {
+		_, err := rbac.New(&cfg)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,360 @@
+// Package replica mirrors the DICOMs of a primary dime server by pulling its
+// change feed
+package replica
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/changes"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/suyashkumar/dicom"
+)
+
+const (
+	defaultInterval  = 5 * time.Second
+	defaultBatchSize = 100
+	defaultTimeout   = 5 * time.Minute
+	checkpointFile   = "checkpoint.json"
+	maxErrorBody     = 512
+)
+
+// errGone is an error for a DICOM deleted from the primary before it was
+// fetched
+var errGone = errors.New("dicom is gone from the primary")
+
+// Status is how far a Replicator is behind its primary. Lag is how many
+// sequence numbers of the primary's events are not yet applied, an upper
+// bound on the events as compaction leaves gaps.
+type Status struct {
+	Primary    string     `json:"primary" example:"https://dime-primary:8080"`
+	Checkpoint uint64     `json:"checkpoint" example:"40"`
+	PrimarySeq uint64     `json:"primarySeq" example:"42"`
+	Lag        uint64     `json:"lag" example:"2"`
+	Applied    int        `json:"applied" example:"40"`
+	LastSync   *time.Time `json:"lastSync,omitempty"`
+	LastError  string     `json:"lastError,omitempty"`
+}
+
+// checkpoint is the sequence number of the last event applied
+type checkpoint struct {
+	Seq uint64 `json:"seq"`
+}
+
+// Replicator pulls the change feed of a primary dime server and applies it to
+// a store, fetching the DICOMs created or updated on the primary and deleting
+// those deleted from it. The sequence number of the last event applied is
+// checkpointed to a directory so replication resumes from it after a
+// restart. Events may be applied again after a crash, which is harmless as
+// storing a DICOM again replaces it. DICOMs are created in the store like any
+// other, so a store wrapped for quotas and retention accounts and records
+// them.
+type Replicator struct {
+	primary  string
+	store    store.Store
+	dir      string
+	interval time.Duration
+	batch    int
+	client   *http.Client
+	headers  map[string]string
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	mu     sync.Mutex
+	status Status
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// Option configures a Replicator
+type Option func(*Replicator)
+
+// WithInterval sets how often to pull the change feed once caught up
+func WithInterval(d time.Duration) Option {
+	return func(r *Replicator) {
+		r.interval = d
+	}
+}
+
+// WithBatchSize sets the number of events pulled at a time
+func WithBatchSize(n int) Option {
+	return func(r *Replicator) {
+		r.batch = n
+	}
+}
+
+// WithClient sets the HTTP client of requests to the primary, which should
+// have a timeout so a primary that hangs doesn't stall replication
+func WithClient(c *http.Client) Option {
+	return func(r *Replicator) {
+		r.client = c
+	}
+}
+
+// WithHeaders sets headers added to requests to the primary
+func WithHeaders(headers map[string]string) Option {
+	return func(r *Replicator) {
+		r.headers = headers
+	}
+}
+
+// New creates a Replicator of the primary at a URL in to a store with its
+// checkpoint in dir, loading the checkpoint of a previous run
+func New(primary string, st store.Store, dir string, opts ...Option) (*Replicator, error) {
+	u, err := url.Parse(primary)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid primary url %q", primary)
+	}
+	r := &Replicator{
+		primary:  strings.TrimSuffix(primary, "/"),
+		store:    st,
+		dir:      dir,
+		interval: defaultInterval,
+		batch:    defaultBatchSize,
+		client:   &http.Client{Timeout: defaultTimeout},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.status.Primary = r.primary
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, checkpointFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	if err == nil {
+		var cp checkpoint
+		err = json.Unmarshal(b, &cp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse checkpoint: %w", err)
+		}
+		r.status.Checkpoint = cp.Seq
+	}
+	return r, nil
+}
+
+// Start replicating in the background
+func (r *Replicator) Start() {
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go func() {
+		defer close(r.done)
+		for {
+			err := r.Sync()
+			if err != nil && r.ctx.Err() == nil {
+				slog.Error("Failed to replicate", slog.String("primary", r.primary), slog.String("error", err.Error()))
+			}
+			select {
+			case <-r.stop:
+				return
+			case <-time.After(r.interval):
+			}
+		}
+	}()
+}
+
+// Stop replicating, cancelling requests to the primary in flight and waiting
+// for events being applied
+func (r *Replicator) Stop() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	r.cancel()
+	<-r.done
+}
+
+// Status returns how far the Replicator is behind its primary
+func (r *Replicator) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// Sync pulls and applies the change feed of the primary until it is caught
+// up, checkpointing after each batch of events
+func (r *Replicator) Sync() error {
+	for {
+		r.mu.Lock()
+		since := r.status.Checkpoint
+		r.mu.Unlock()
+		page, err := r.changes(since)
+		if err == nil && since > 0 && since < page.Compacted {
+			slog.Warn("Replica may have missed deletes compacted from the change feed of the primary",
+				slog.String("primary", r.primary),
+				slog.Uint64("checkpoint", since),
+				slog.Uint64("compacted", page.Compacted))
+		}
+		if err == nil {
+			r.mu.Lock()
+			r.status.PrimarySeq = page.Last
+			r.mu.Unlock()
+			err = r.apply(page.Changes)
+		}
+
+		r.mu.Lock()
+		r.status.Lag = 0
+		if r.status.PrimarySeq > r.status.Checkpoint {
+			r.status.Lag = r.status.PrimarySeq - r.status.Checkpoint
+		}
+		if err != nil {
+			r.status.LastError = err.Error()
+			r.mu.Unlock()
+			return err
+		}
+		r.status.LastError = ""
+		caughtUp := len(page.Changes) < r.batch || r.status.Lag == 0
+		if caughtUp {
+			now := time.Now().UTC()
+			r.status.LastSync = &now
+		}
+		r.mu.Unlock()
+		if caughtUp {
+			return nil
+		}
+		select {
+		case <-r.stop:
+			return nil
+		default:
+		}
+	}
+}
+
+// apply events in order, checkpointing the last event applied
+func (r *Replicator) apply(events []changes.Event) error {
+	var err error
+	applied := 0
+	for _, e := range events {
+		switch e.Type {
+		case changes.Created, changes.Updated:
+			err = r.fetch(e.ID)
+			if errors.Is(err, errGone) {
+				// a later event deletes it
+				err = nil
+			}
+		case changes.Deleted:
+			err = r.store.Delete(e.ID)
+			if errors.Is(err, store.ErrNotFound) {
+				err = nil
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to apply event %d: %w", e.Seq, err)
+			break
+		}
+		applied++
+	}
+	if applied == 0 {
+		return err
+	}
+	seq := events[applied-1].Seq
+	cpErr := r.writeCheckpoint(seq)
+	r.mu.Lock()
+	r.status.Applied += applied
+	if cpErr == nil {
+		r.status.Checkpoint = seq
+	}
+	r.mu.Unlock()
+	if err == nil {
+		err = cpErr
+	}
+	return err
+}
+
+// changes gets the events of the primary after a sequence number
+func (r *Replicator) changes(since uint64) (*changes.Page, error) {
+	resp, err := r.get(fmt.Sprintf("%s/changes?since=%d&limit=%d", r.primary, since, r.batch))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	var page changes.Page
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse changes: %w", err)
+	}
+	return &page, nil
+}
+
+// fetch a DICOM from the primary and store it
+func (r *Replicator) fetch(id string) error {
+	resp, err := r.get(fmt.Sprintf("%s/dicoms/%s/file", r.primary, url.PathEscape(id)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errGone
+	}
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	ds, err := dicom.ParseUntilEOF(resp.Body, nil)
+	if err != nil {
+		return fmt.Errorf("failed to parse dicom: %w", err)
+	}
+	dcm, err := store.NewDICOM(&ds)
+	if err != nil {
+		return err
+	}
+	return r.store.Create(dcm)
+}
+
+func (r *Replicator) get(u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for k, v := range r.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach primary: %w", err)
+	}
+	return resp, nil
+}
+
+// writeCheckpoint writes the checkpoint to a temp file and renames it in to
+// place
+func (r *Replicator) writeCheckpoint(seq uint64) error {
+	b, err := json.Marshal(checkpoint{Seq: seq})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(r.dir, checkpointFile)
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return nil
+}
+
+// responseError returns an error for an unexpected response of the primary
+func responseError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return fmt.Errorf("primary responded %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
@@ -0,0 +1,135 @@
+package replica_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/changes"
+	"github.com/johnmarkli/dime/pkg/replica"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+)
+
+const (
+	testDataPath = "../../testdata/IM000001-mri"
+	testID       = "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000395"
+)
+
+// primary serves the change feed and DICOM files of a store
+func primary(t *testing.T, l *changes.Log, st store.Store) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/changes" {
+			since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+			assert.NoError(t, json.NewEncoder(w).Encode(l.Since(since, limit)))
+			return
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/dicoms/"), "/file")
+		dcm, err := st.Read(id)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var b bytes.Buffer
+		assert.NoError(t, dicom.Write(&b, *dcm.Dataset()))
+		_, _ = w.Write(b.Bytes())
+	}))
+}
+
+func TestReplicator(t *testing.T) {
+	l, err := changes.New(t.TempDir())
+	assert.NoError(t, err)
+	defer l.Close()
+	mem, err := store.NewMemStore()
+	assert.NoError(t, err)
+	st := l.Wrap(mem)
+	srv := primary(t, l, st)
+	defer srv.Close()
+
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+	assert.NoError(t, st.Create(dcm))
+
+	_, err = replica.New("ftp://primary", mem, t.TempDir())
+	assert.Error(t, err)
+
+	// A DICOM stored on the primary is replicated in batches
+	dir := t.TempDir()
+	secondary, err := store.NewMemStore()
+	assert.NoError(t, err)
+	r, err := replica.New(srv.URL, secondary, dir, replica.WithBatchSize(1))
+	assert.NoError(t, err)
+	assert.NoError(t, r.Sync())
+	read, err := secondary.Read(testID)
+	assert.NoError(t, err)
+	assert.Equal(t, dcm.StudyInstanceUID, read.StudyInstanceUID)
+	status := r.Status()
+	assert.Equal(t, uint64(2), status.Checkpoint)
+	assert.Equal(t, uint64(2), status.PrimarySeq)
+	assert.Equal(t, uint64(0), status.Lag)
+	assert.Equal(t, 2, status.Applied)
+	assert.NotNil(t, status.LastSync)
+
+	// Replication resumes from its checkpoint after a restart
+	assert.NoError(t, st.Delete(testID))
+	r, err = replica.New(srv.URL, secondary, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), r.Status().Checkpoint)
+	assert.Equal(t, uint64(0), r.Status().Lag)
+	assert.NoError(t, r.Sync())
+	_, err = secondary.Read(testID)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	status = r.Status()
+	assert.Equal(t, uint64(3), status.Checkpoint)
+	assert.Equal(t, 1, status.Applied)
+
+	// Failures are reported and retried
+	srv.Close()
+	assert.Error(t, r.Sync())
+	assert.NotEmpty(t, r.Status().LastError)
+}
+
+func TestReplicatorStop(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hang:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(hang)
+	secondary, err := store.NewMemStore()
+	assert.NoError(t, err)
+
+	// A request to a hung primary times out
+	r, err := replica.New(srv.URL, secondary, t.TempDir(), replica.WithClient(&http.Client{Timeout: 50 * time.Millisecond}))
+	assert.NoError(t, err)
+	assert.Error(t, r.Sync())
+
+	// Stopping cancels a request to a hung primary
+	r, err = replica.New(srv.URL, secondary, t.TempDir())
+	assert.NoError(t, err)
+	r.Start()
+	time.Sleep(50 * time.Millisecond)
+	stopped := make(chan struct{})
+	go func() {
+		r.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop blocked on a hung primary")
+	}
+}
@@ -0,0 +1,95 @@
+package retention
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Actions taken on an expired study
+const (
+	// ActionDelete deletes an expired study from the store
+	ActionDelete = "delete"
+	// ActionArchive copies an expired study to the archive store before
+	// deleting it from the store
+	ActionArchive = "archive"
+)
+
+// Times the age of a study is measured from
+const (
+	// SinceIngest measures age from when a study was first ingested
+	SinceIngest = "ingest"
+	// SinceStudyDate measures age from the Study Date of a study
+	SinceStudyDate = "studyDate"
+)
+
+// Config is the rules that expire studies
+type Config struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Rule expires the studies that match it once they are older than MaxAgeDays,
+// measured since they were ingested or since their study date. The first rule
+// that matches a study applies to it.
+type Rule struct {
+	Name       string `json:"name" example:"research-mr"`
+	Match      Match  `json:"match"`
+	Since      string `json:"since,omitempty" example:"ingest"`
+	MaxAgeDays int    `json:"maxAgeDays" example:"365"`
+	Action     string `json:"action,omitempty" example:"delete"`
+}
+
+// Match selects the studies a rule expires. Modality must equal the modality
+// of an instance of the study and Label must be one of the study's labels. An
+// empty Match matches every study.
+type Match struct {
+	Modality string `json:"modality,omitempty" example:"MR"`
+	Label    string `json:"label,omitempty" example:"research"`
+}
+
+// Load a Config from a JSON file
+func Load(file string) (*Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read retention rules: %w", err)
+	}
+	var cfg Config
+	err = json.Unmarshal(b, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse retention rules: %w", err)
+	}
+	return &cfg, nil
+}
+
+// compile validates the rules of a Config and sets their defaults
+func compile(cfg *Config, archive bool) ([]Rule, error) {
+	rules := []Rule{}
+	for i, r := range cfg.Rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("rule %d: name is required", i+1)
+		}
+		if r.MaxAgeDays <= 0 {
+			return nil, fmt.Errorf("%s: maxAgeDays must be positive", r.Name)
+		}
+		switch r.Since {
+		case "":
+			r.Since = SinceIngest
+		case SinceIngest, SinceStudyDate:
+		default:
+			return nil, fmt.Errorf("%s: unknown since %q", r.Name, r.Since)
+		}
+		switch r.Action {
+		case "":
+			r.Action = ActionDelete
+		case ActionDelete:
+		case ActionArchive:
+			if !archive {
+				return nil, fmt.Errorf("%s: no archive is configured", r.Name)
+			}
+		default:
+			return nil, fmt.Errorf("%s: unknown action %q", r.Name, r.Action)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
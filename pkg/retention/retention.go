@@ -0,0 +1,602 @@
+// Package retention expires stored studies that are older than their
+// approved retention period
+package retention
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+const (
+	defaultInterval = time.Hour
+	studyExt        = ".json"
+	instancesExt    = ".instances"
+	backfillFile    = "backfilled"
+	studyDateFormat = "20060102"
+	day             = 24 * time.Hour
+)
+
+var (
+	// ErrNotFound is an error for a study that is not found
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidUID is an error for a Study Instance UID that is not a valid
+	// UID
+	ErrInvalidUID = errors.New("invalid study instance uid")
+	// ErrHeld is an error for a study that was held while it was being
+	// expired
+	ErrHeld = errors.New("study is held")
+)
+
+// Study is the retention record of a study
+type Study struct {
+	StudyInstanceUID string    `json:"studyInstanceUID" example:"1.2.840.114202.4.833393677.4209323108.691055951.3610221745"`
+	Ingested         time.Time `json:"ingested"`
+	Labels           []string  `json:"labels"`
+	Modalities       []string  `json:"modalities,omitempty" example:"MR"`
+	StudyDate        string    `json:"studyDate,omitempty" example:"20131217"`
+	Hold             *Hold     `json:"hold,omitempty"`
+}
+
+// Hold is a legal hold that blocks a study from being expired
+type Hold struct {
+	Reason  string    `json:"reason" example:"litigation 2024-117"`
+	Created time.Time `json:"created"`
+}
+
+// Expiry is a study that has expired and what was done with it
+type Expiry struct {
+	StudyInstanceUID string    `json:"studyInstanceUID" example:"1.2.840.114202.4.833393677.4209323108.691055951.3610221745"`
+	Rule             string    `json:"rule" example:"research-mr"`
+	Action           string    `json:"action" example:"delete"`
+	Expired          time.Time `json:"expired"`
+	Instances        int       `json:"instances" example:"12"`
+	Held             bool      `json:"held"`
+	Done             bool      `json:"done"`
+	Error            string    `json:"error,omitempty"`
+}
+
+// Report is the result of evaluating the retention rules
+type Report struct {
+	Evaluated time.Time `json:"evaluated"`
+	DryRun    bool      `json:"dryRun"`
+	Studies   int       `json:"studies" example:"40"`
+	Expired   []Expiry  `json:"expired"`
+}
+
+// Manager records when studies were ingested along with their labels, legal
+// holds, modalities, study date and instances, and periodically deletes or
+// archives the studies that have expired under its rules. Records are
+// journaled to a directory so they survive a restart, and the rules are
+// evaluated against them so only the instances of expired studies are read
+// from the store.
+type Manager struct {
+	dir      string
+	store    store.Store
+	archive  store.Store
+	rules    []Rule
+	interval time.Duration
+
+	mu         sync.Mutex
+	studies    map[string]*Study
+	stored     map[string]bool
+	backfilled bool
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// Option configures a Manager
+type Option func(*Manager)
+
+// WithArchive sets the store that archived studies are copied to
+func WithArchive(st store.Store) Option {
+	return func(m *Manager) {
+		m.archive = st
+	}
+}
+
+// WithInterval sets how often the retention rules are evaluated
+func WithInterval(d time.Duration) Option {
+	return func(m *Manager) {
+		m.interval = d
+	}
+}
+
+// New creates a Manager journaled in dir that expires studies from a store,
+// loading the records of a previous run
+func New(dir string, st store.Store, cfg *Config, opts ...Option) (*Manager, error) {
+	m := &Manager{
+		dir:      dir,
+		store:    st,
+		interval: defaultInterval,
+		studies:  map[string]*Study{},
+		stored:   map[string]bool{},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	rules, err := compile(cfg, m.archive != nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retention rules: %w", err)
+	}
+	m.rules = rules
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	err = m.load()
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Start evaluating the retention rules in the background
+func (m *Manager) Start() {
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go func() {
+		defer close(m.done)
+		for {
+			_, err := m.Evaluate(false)
+			if err != nil {
+				slog.Error("Failed to evaluate retention rules", slog.String("error", err.Error()))
+			}
+			select {
+			case <-m.stop:
+				return
+			case <-time.After(m.interval):
+			}
+		}
+	}()
+}
+
+// Stop evaluating the retention rules, waiting for an evaluation in progress
+func (m *Manager) Stop() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	<-m.done
+}
+
+// Record when the study of a DICOM was first stored, along with the DICOM's
+// modality, study date and SOP Instance UID
+func (m *Manager) Record(dcm *store.DICOM) {
+	uid := dcm.StudyInstanceUID
+	if !store.ValidUID(uid) {
+		return
+	}
+	modality := stringValue(dcm, tag.Modality)
+	studyDate := stringValue(dcm, tag.StudyDate)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.record(uid, dcm.ID, modality, studyDate)
+	if err != nil {
+		slog.Error("Failed to record study",
+			slog.String("study", uid),
+			slog.String("error", err.Error()))
+	}
+}
+
+// record an instance of a study, saving the study record if it is new or its
+// modalities or study date changed. The caller must hold the lock.
+func (m *Manager) record(uid, id, modality, studyDate string) error {
+	s, ok := m.studies[uid]
+	if ok {
+		s = s.copy()
+	} else {
+		s = m.newStudy(uid)
+	}
+	changed := !ok
+	if modality != "" && !slices.Contains(s.Modalities, modality) {
+		s.Modalities = append(s.Modalities, modality)
+		changed = true
+	}
+	if s.StudyDate == "" && studyDate != "" {
+		s.StudyDate = studyDate
+		changed = true
+	}
+	if changed {
+		err := m.save(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(m.instancesPath(uid), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open instances: %w", err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(id + "\n")
+	if err != nil {
+		return fmt.Errorf("failed to write instances: %w", err)
+	}
+	m.stored[uid] = true
+	return nil
+}
+
+// Wrap a store so that the DICOMs created in it are recorded, however they
+// are created
+func (m *Manager) Wrap(st store.Store) store.Store {
+	return &recordedStore{Store: st, m: m}
+}
+
+// Get the retention record of a study
+func (m *Manager) Get(uid string) (*Study, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.studies[uid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return s.copy(), nil
+}
+
+// Hold a study so it is not expired until it is released. A study can be
+// held before it is ingested.
+func (m *Manager) Hold(uid, reason string) (*Study, error) {
+	return m.update(uid, func(s *Study) {
+		s.Hold = &Hold{Reason: reason, Created: time.Now().UTC()}
+	})
+}
+
+// Release the legal hold of a study
+func (m *Manager) Release(uid string) (*Study, error) {
+	return m.update(uid, func(s *Study) {
+		s.Hold = nil
+	})
+}
+
+// Label a study, replacing its labels
+func (m *Manager) Label(uid string, labels []string) (*Study, error) {
+	return m.update(uid, func(s *Study) {
+		s.Labels = append([]string{}, labels...)
+	})
+}
+
+// Evaluate the retention rules against the records of the stored studies.
+// Expired studies that are not held are deleted or archived unless dryRun is
+// set, in which case the report only shows what would be. The first
+// evaluation records the studies that were stored before they could be
+// recorded.
+func (m *Manager) Evaluate(dryRun bool) (*Report, error) {
+	err := m.backfill()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	studies := []*Study{}
+	for uid, s := range m.studies {
+		if m.stored[uid] {
+			studies = append(studies, s.copy())
+		}
+	}
+	m.mu.Unlock()
+
+	now := time.Now().UTC()
+	report := &Report{Evaluated: now, DryRun: dryRun, Studies: len(studies), Expired: []Expiry{}}
+	for _, s := range studies {
+		uid := s.StudyInstanceUID
+		rl, expired, ok := m.expiry(s)
+		if !ok || expired.After(now) {
+			continue
+		}
+		ids, err := m.instances(uid)
+		e := Expiry{
+			StudyInstanceUID: uid,
+			Rule:             rl.Name,
+			Action:           rl.Action,
+			Expired:          expired,
+			Instances:        len(ids),
+			Held:             s.Hold != nil,
+		}
+		if err == nil && !dryRun && !e.Held {
+			err = m.expire(uid, rl.Action, ids)
+			if errors.Is(err, ErrHeld) {
+				e.Held = true
+				err = nil
+			} else if err == nil {
+				e.Done = true
+				slog.Info("Expired study",
+					slog.String("study", uid),
+					slog.String("rule", rl.Name),
+					slog.String("action", rl.Action),
+					slog.Int("instances", len(ids)))
+			}
+		}
+		if err != nil {
+			e.Error = err.Error()
+			slog.Error("Failed to expire study",
+				slog.String("study", uid),
+				slog.String("rule", rl.Name),
+				slog.String("error", err.Error()))
+		}
+		report.Expired = append(report.Expired, e)
+	}
+	sort.Slice(report.Expired, func(i, j int) bool {
+		return report.Expired[i].StudyInstanceUID < report.Expired[j].StudyInstanceUID
+	})
+	return report, nil
+}
+
+// backfill records the DICOMs that were stored before the studies they
+// belong to could be recorded, treating their studies as ingested now. The
+// store is walked once, after which the journal is marked as backfilled, as
+// the DICOMs created since are recorded by the store of Wrap.
+func (m *Manager) backfill() error {
+	m.mu.Lock()
+	backfilled := m.backfilled
+	m.mu.Unlock()
+	if backfilled {
+		return nil
+	}
+	err := store.Walk(m.store, func(dcm *store.DICOM) error {
+		m.Record(dcm)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk dicoms: %w", err)
+	}
+	err = os.WriteFile(filepath.Join(m.dir, backfillFile), nil, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to mark studies backfilled: %w", err)
+	}
+	m.mu.Lock()
+	m.backfilled = true
+	m.mu.Unlock()
+	return nil
+}
+
+// expiry returns the first rule that matches a study and when the study
+// expires under it
+func (m *Manager) expiry(s *Study) (Rule, time.Time, bool) {
+	studyDate, _ := time.Parse(studyDateFormat, s.StudyDate)
+	for _, rl := range m.rules {
+		if rl.Match.Modality != "" && !slices.Contains(s.Modalities, rl.Match.Modality) {
+			continue
+		}
+		if rl.Match.Label != "" && !slices.Contains(s.Labels, rl.Match.Label) {
+			continue
+		}
+		since := s.Ingested
+		if rl.Since == SinceStudyDate {
+			if studyDate.IsZero() {
+				// a study without a study date can't expire by it
+				return rl, time.Time{}, false
+			}
+			since = studyDate
+		}
+		return rl, since.Add(time.Duration(rl.MaxAgeDays) * day), true
+	}
+	return Rule{}, time.Time{}, false
+}
+
+// instances returns the SOP Instance UIDs recorded for a study
+func (m *Manager) instances(uid string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, err := os.ReadFile(m.instancesPath(uid))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read instances: %w", err)
+	}
+	ids := []string{}
+	for _, id := range strings.Split(string(b), "\n") {
+		if id != "" && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// expire deletes the instances of a study from the store, copying them to
+// the archive first if the action is to archive. The hold of the study is
+// checked again before each instance is deleted, so a study that is held
+// while it is being expired keeps its remaining instances and its record, and
+// ErrHeld is returned.
+func (m *Manager) expire(uid, action string, ids []string) error {
+	for _, id := range ids {
+		if action == ActionArchive {
+			dcm, err := m.store.Read(id)
+			if errors.Is(err, store.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", id, err)
+			}
+			err = m.archive.Create(dcm)
+			if err != nil {
+				return fmt.Errorf("failed to archive %s: %w", id, err)
+			}
+		}
+		err := m.delete(uid, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	// forget the study so it starts again if it is ingested again
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.held(uid) {
+		return ErrHeld
+	}
+	delete(m.studies, uid)
+	delete(m.stored, uid)
+	err := os.Remove(m.instancesPath(uid))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove study instances: %w", err)
+	}
+	err = os.Remove(m.studyPath(uid))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove study record: %w", err)
+	}
+	return nil
+}
+
+// delete an instance of a study from the store unless the study is held. The
+// lock is held while the instance is deleted so the study can't be held in
+// the meantime.
+func (m *Manager) delete(uid, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.held(uid) {
+		return ErrHeld
+	}
+	err := m.store.Delete(id)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("failed to delete %s: %w", id, err)
+	}
+	return nil
+}
+
+// held returns whether a study has a legal hold. The caller must hold the
+// lock.
+func (m *Manager) held(uid string) bool {
+	s, ok := m.studies[uid]
+	return ok && s.Hold != nil
+}
+
+// update the record of a study, recording it if it is not recorded
+func (m *Manager) update(uid string, fn func(*Study)) (*Study, error) {
+	if !store.ValidUID(uid) {
+		return nil, ErrInvalidUID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.studies[uid]
+	if !ok {
+		s = m.newStudy(uid)
+	}
+	c := s.copy()
+	fn(c)
+	err := m.save(c)
+	if err != nil {
+		return nil, err
+	}
+	return c.copy(), nil
+}
+
+// newStudy returns a record of a study ingested now
+func (m *Manager) newStudy(uid string) *Study {
+	return &Study{StudyInstanceUID: uid, Ingested: time.Now().UTC(), Labels: []string{}}
+}
+
+// save a study record to the journal, replacing the previous entry
+// atomically. The caller must hold the lock.
+func (m *Manager) save(s *Study) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal study: %w", err)
+	}
+	tmp := m.studyPath(s.StudyInstanceUID) + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write study: %w", err)
+	}
+	err = os.Rename(tmp, m.studyPath(s.StudyInstanceUID))
+	if err != nil {
+		return fmt.Errorf("failed to write study: %w", err)
+	}
+	m.studies[s.StudyInstanceUID] = s
+	return nil
+}
+
+// load study records from the journal
+func (m *Manager) load() error {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read study directory: %w", err)
+	}
+	for _, e := range entries {
+		if e.Name() == backfillFile {
+			m.backfilled = true
+			continue
+		}
+		if strings.HasSuffix(e.Name(), instancesExt) {
+			m.stored[strings.TrimSuffix(e.Name(), instancesExt)] = true
+			continue
+		}
+		if !strings.HasSuffix(e.Name(), studyExt) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(m.dir, e.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read study: %w", err)
+		}
+		var s Study
+		err = json.Unmarshal(b, &s)
+		if err != nil {
+			slog.Error("Skipping unreadable study", slog.String("file", e.Name()))
+			continue
+		}
+		m.studies[s.StudyInstanceUID] = &s
+	}
+	return nil
+}
+
+func (m *Manager) studyPath(uid string) string {
+	return filepath.Join(m.dir, uid+studyExt)
+}
+
+func (m *Manager) instancesPath(uid string) string {
+	return filepath.Join(m.dir, uid+instancesExt)
+}
+
+func (s *Study) copy() *Study {
+	c := *s
+	c.Labels = append([]string{}, s.Labels...)
+	c.Modalities = slices.Clone(s.Modalities)
+	if s.Hold != nil {
+		h := *s.Hold
+		c.Hold = &h
+	}
+	return &c
+}
+
+// recordedStore records the DICOMs created in a store
+type recordedStore struct {
+	store.Store
+	m *Manager
+}
+
+// Create a DICOM in the store and record it
+func (s *recordedStore) Create(dcm *store.DICOM) error {
+	err := s.Store.Create(dcm)
+	if err != nil {
+		return err
+	}
+	s.m.Record(dcm)
+	return nil
+}
+
+// Walk calls fn with each DICOM of the store in turn
+func (s *recordedStore) Walk(fn func(dcm *store.DICOM) error) error {
+	return store.Walk(s.Store, fn)
+}
+
+// stringValue returns the first string value of an element of a DICOM
+func stringValue(dcm *store.DICOM, t tag.Tag) string {
+	element, err := dcm.Dataset().FindElementByTag(t)
+	if err != nil {
+		return ""
+	}
+	values, ok := element.Value.GetValue().([]string)
+	if !ok || len(values) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(values[0])
+}
@@ -0,0 +1,205 @@
+package retention_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/johnmarkli/dime/pkg/retention"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+)
+
+const (
+	testDataPath = "../../testdata/IM000001-mri"
+	testID       = "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000395"
+	testStudyUID = "1.2.840.114202.4.833393677.4209323108.691055951.3610221745"
+)
+
+// newDICOM parses the test DICOM and saves it to a store
+func newDICOM(t *testing.T, st store.Store) *store.DICOM {
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+	return dcm
+}
+
+func TestManager(t *testing.T) {
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	cfg := &retention.Config{
+		Rules: []retention.Rule{
+			{Name: "research", Match: retention.Match{Label: "research"}, Since: retention.SinceStudyDate, MaxAgeDays: 365},
+			{Name: "mr", Match: retention.Match{Modality: "MR"}, MaxAgeDays: 30},
+		},
+	}
+	dir := t.TempDir()
+	m, err := retention.New(dir, st, cfg)
+	assert.NoError(t, err)
+	newDICOM(t, m.Wrap(st))
+
+	// The study was stored now so hasn't expired
+	study, err := m.Get(testStudyUID)
+	assert.NoError(t, err)
+	assert.Empty(t, study.Labels)
+	report, err := m.Evaluate(true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Studies)
+	assert.Empty(t, report.Expired)
+
+	// Labelled as research, the study expired a year after its study date
+	_, err = m.Label(testStudyUID, []string{"research"})
+	assert.NoError(t, err)
+	report, err = m.Evaluate(true)
+	assert.NoError(t, err)
+	assert.Len(t, report.Expired, 1)
+	expiry := report.Expired[0]
+	assert.Equal(t, testStudyUID, expiry.StudyInstanceUID)
+	assert.Equal(t, "research", expiry.Rule)
+	assert.Equal(t, retention.ActionDelete, expiry.Action)
+	assert.Equal(t, "2014-12-17", expiry.Expired.Format("2006-01-02"))
+	assert.Equal(t, 1, expiry.Instances)
+	assert.False(t, expiry.Done)
+
+	// A dry run deletes nothing
+	_, err = st.Read(testID)
+	assert.NoError(t, err)
+
+	// A held study is not deleted
+	study, err = m.Hold(testStudyUID, "litigation")
+	assert.NoError(t, err)
+	assert.Equal(t, "litigation", study.Hold.Reason)
+	report, err = m.Evaluate(false)
+	assert.NoError(t, err)
+	assert.Len(t, report.Expired, 1)
+	assert.True(t, report.Expired[0].Held)
+	assert.False(t, report.Expired[0].Done)
+	_, err = st.Read(testID)
+	assert.NoError(t, err)
+
+	// Records survive a restart
+	m, err = retention.New(dir, st, cfg)
+	assert.NoError(t, err)
+	study, err = m.Get(testStudyUID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"research"}, study.Labels)
+	assert.NotNil(t, study.Hold)
+
+	// Once released the study is deleted and forgotten
+	study, err = m.Release(testStudyUID)
+	assert.NoError(t, err)
+	assert.Nil(t, study.Hold)
+	report, err = m.Evaluate(false)
+	assert.NoError(t, err)
+	assert.Len(t, report.Expired, 1)
+	assert.True(t, report.Expired[0].Done)
+	_, err = st.Read(testID)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	_, err = m.Get(testStudyUID)
+	assert.ErrorIs(t, err, retention.ErrNotFound)
+	assert.NoFileExists(t, filepath.Join(dir, testStudyUID+".json"))
+}
+
+func TestManagerArchive(t *testing.T) {
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	archive, err := store.NewMemStore()
+	assert.NoError(t, err)
+	cfg := &retention.Config{
+		Rules: []retention.Rule{
+			{Name: "old", Since: retention.SinceStudyDate, MaxAgeDays: 30, Action: retention.ActionArchive},
+		},
+	}
+	m, err := retention.New(t.TempDir(), st, cfg, retention.WithArchive(archive))
+	assert.NoError(t, err)
+	newDICOM(t, st)
+
+	// Studies stored before they were recorded are expired too
+	report, err := m.Evaluate(false)
+	assert.NoError(t, err)
+	assert.Len(t, report.Expired, 1)
+	assert.True(t, report.Expired[0].Done)
+	_, err = st.Read(testID)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	_, err = archive.Read(testID)
+	assert.NoError(t, err)
+}
+
+// holdingStore is a store that holds a study when a DICOM is created in it
+type holdingStore struct {
+	store.Store
+	hold func()
+}
+
+func (hs *holdingStore) Create(dcm *store.DICOM) error {
+	hs.hold()
+	return hs.Store.Create(dcm)
+}
+
+func TestManagerHeldWhileExpiring(t *testing.T) {
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	mem, err := store.NewMemStore()
+	assert.NoError(t, err)
+	cfg := &retention.Config{
+		Rules: []retention.Rule{
+			{Name: "old", Since: retention.SinceStudyDate, MaxAgeDays: 30, Action: retention.ActionArchive},
+		},
+	}
+	var m *retention.Manager
+	archive := &holdingStore{Store: mem, hold: func() {
+		_, err := m.Hold(testStudyUID, "litigation")
+		assert.NoError(t, err)
+	}}
+	m, err = retention.New(t.TempDir(), st, cfg, retention.WithArchive(archive))
+	assert.NoError(t, err)
+	m.Record(newDICOM(t, st))
+
+	// A study held after it was archived isn't deleted or forgotten
+	report, err := m.Evaluate(false)
+	assert.NoError(t, err)
+	assert.Len(t, report.Expired, 1)
+	assert.True(t, report.Expired[0].Held)
+	assert.False(t, report.Expired[0].Done)
+	assert.Empty(t, report.Expired[0].Error)
+	_, err = st.Read(testID)
+	assert.NoError(t, err)
+	study, err := m.Get(testStudyUID)
+	assert.NoError(t, err)
+	assert.NotNil(t, study.Hold)
+	assert.Equal(t, []string{"MR"}, study.Modalities)
+}
+
+func TestManagerInvalid(t *testing.T) {
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	for _, rl := range []retention.Rule{
+		{MaxAgeDays: 1},
+		{Name: "zero"},
+		{Name: "since", MaxAgeDays: 1, Since: "acquisition"},
+		{Name: "action", MaxAgeDays: 1, Action: "shred"},
+		{Name: "archive", MaxAgeDays: 1, Action: retention.ActionArchive},
+	} {
+		_, err = retention.New(t.TempDir(), st, &retention.Config{Rules: []retention.Rule{rl}})
+		assert.Error(t, err, rl.Name)
+	}
+
+	m, err := retention.New(t.TempDir(), st, &retention.Config{})
+	assert.NoError(t, err)
+	_, err = m.Hold("../../etc/passwd", "")
+	assert.ErrorIs(t, err, retention.ErrInvalidUID)
+	_, err = m.Get(testStudyUID)
+	assert.ErrorIs(t, err, retention.ErrNotFound)
+}
+
+func TestLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "retention.json")
+	assert.NoError(t, os.WriteFile(file, []byte(`{"rules": [{"name": "mr", "match": {"modality": "MR"}, "maxAgeDays": 30}]}`), 0600))
+	cfg, err := retention.Load(file)
+	assert.NoError(t, err)
+	assert.Len(t, cfg.Rules, 1)
+	assert.Equal(t, "MR", cfg.Rules[0].Match.Modality)
+}
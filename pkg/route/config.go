@@ -0,0 +1,184 @@
+package route
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+
+	"github.com/johnmarkli/dime/pkg/coerce"
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// Destination types
+const (
+	// TypeDIMSE sends DICOMs to a C-STORE SCP
+	TypeDIMSE = "dimse"
+	// TypeSTOW sends DICOMs to a DICOMweb STOW-RS endpoint
+	TypeSTOW = "stow"
+	// TypeDime sends DICOMs to the /dicoms endpoint of another dime server
+	TypeDime = "dime"
+)
+
+const (
+	defaultCallingAETitle = "DIME"
+)
+
+// Config is the destinations DICOMs can be forwarded to and the rules that
+// select them
+type Config struct {
+	Destinations []Destination `json:"destinations"`
+	Rules        []Rule        `json:"rules"`
+}
+
+// Destination is a downstream receiver of DICOMs. DIMSE destinations are
+// given by address and AE title, and associate over TLS if TLS is set;
+// STOW-RS and dime destinations by URL.
+type Destination struct {
+	Name           string            `json:"name" example:"pacs"`
+	Type           string            `json:"type" example:"dimse"`
+	Address        string            `json:"address,omitempty" example:"pacs.example.com:104"`
+	AETitle        string            `json:"aeTitle,omitempty" example:"PACS"`
+	CallingAETitle string            `json:"callingAETitle,omitempty" example:"DIME"`
+	TLS            bool              `json:"tls,omitempty"`
+	URL            string            `json:"url,omitempty" example:"https://dicomweb.example.com/studies"`
+	Headers        map[string]string `json:"headers,omitempty"`
+}
+
+// Rule forwards DICOMs that match it to destinations
+type Rule struct {
+	Name         string   `json:"name" example:"ct-to-pacs"`
+	Match        Match    `json:"match"`
+	Destinations []string `json:"destinations"`
+}
+
+// Match selects the DICOMs a rule forwards. Modality, SOP class UID and
+// station name must equal the DICOM's, the source must match the Source glob
+// pattern and each attribute must have a value matching its regular
+// expression. An empty Match matches every DICOM.
+type Match struct {
+	Modality    string            `json:"modality,omitempty" example:"CT"`
+	SOPClassUID string            `json:"sopClassUID,omitempty" example:"1.2.840.10008.5.1.4.1.1.2"`
+	StationName string            `json:"stationName,omitempty" example:"CT01"`
+	Source      string            `json:"source,omitempty" example:"10.0.1.*"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+}
+
+// rule is a compiled Rule
+type rule struct {
+	Rule
+	equals     map[tag.Tag]string
+	attributes map[tag.Tag]*regexp.Regexp
+}
+
+// Load a Config from a JSON file
+func Load(file string) (*Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routing rules: %w", err)
+	}
+	var cfg Config
+	err = json.Unmarshal(b, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse routing rules: %w", err)
+	}
+	return &cfg, nil
+}
+
+// compile validates the destinations and compiles the rules of a Config,
+// connecting to DIMSE destinations over TLS with a TLS configuration
+func compile(cfg *Config, tlsConfig *tls.Config) (map[string]sender, []rule, error) {
+	senders := map[string]sender{}
+	for i, d := range cfg.Destinations {
+		if d.Name == "" {
+			return nil, nil, fmt.Errorf("destination %d: name is required", i+1)
+		}
+		if _, ok := senders[d.Name]; ok {
+			return nil, nil, fmt.Errorf("%s: duplicate destination", d.Name)
+		}
+		s, err := newSender(d, tlsConfig)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", d.Name, err)
+		}
+		senders[d.Name] = s
+	}
+
+	rules := []rule{}
+	for i, r := range cfg.Rules {
+		compiled := rule{
+			Rule:       r,
+			equals:     map[tag.Tag]string{},
+			attributes: map[tag.Tag]*regexp.Regexp{},
+		}
+		if r.Name == "" {
+			compiled.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if len(r.Destinations) == 0 {
+			return nil, nil, fmt.Errorf("%s: no destinations", compiled.Name)
+		}
+		for _, d := range r.Destinations {
+			if _, ok := senders[d]; !ok {
+				return nil, nil, fmt.Errorf("%s: unknown destination %q", compiled.Name, d)
+			}
+		}
+		if _, err := path.Match(r.Match.Source, ""); err != nil {
+			return nil, nil, fmt.Errorf("%s: invalid source pattern: %w", compiled.Name, err)
+		}
+		for t, v := range map[tag.Tag]string{
+			tag.Modality:    r.Match.Modality,
+			tag.SOPClassUID: r.Match.SOPClassUID,
+			tag.StationName: r.Match.StationName,
+		} {
+			if v != "" {
+				compiled.equals[t] = v
+			}
+		}
+		for t, expr := range r.Match.Attributes {
+			parsed, err := coerce.ParseTag(t)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", compiled.Name, err)
+			}
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: invalid pattern for %s: %w", compiled.Name, t, err)
+			}
+			compiled.attributes[parsed] = re
+		}
+		rules = append(rules, compiled)
+	}
+	return senders, rules, nil
+}
+
+// matches returns whether the rule applies to a dataset from a source
+func (r *rule) matches(ds *dicom.Dataset, source string) bool {
+	if r.Match.Source != "" {
+		if ok, _ := path.Match(r.Match.Source, source); !ok {
+			return false
+		}
+	}
+	for t, v := range r.equals {
+		if !slices.Contains(stringValues(ds, t), v) {
+			return false
+		}
+	}
+	for t, re := range r.attributes {
+		if !slices.ContainsFunc(stringValues(ds, t), re.MatchString) {
+			return false
+		}
+	}
+	return true
+}
+
+// stringValues returns the string values of the attribute with the tag
+func stringValues(ds *dicom.Dataset, t tag.Tag) []string {
+	el, err := ds.FindElementByTag(t)
+	if err != nil {
+		return nil
+	}
+	values, _ := el.Value.GetValue().([]string)
+	return values
+}
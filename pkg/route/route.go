@@ -0,0 +1,480 @@
+// Package route forwards ingested DICOMs to downstream destinations
+package route
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/store"
+)
+
+const (
+	defaultMaxAttempts = 10
+	defaultBackoff     = 30 * time.Second
+	maxBackoff         = time.Hour
+	sendTimeout        = 2 * time.Minute
+	idleWait           = time.Hour
+	transferExt        = ".json"
+)
+
+var (
+	// ErrNotFound is an error for a transfer that is not found
+	ErrNotFound = errors.New("not found")
+)
+
+// State is the state of a transfer
+type State string
+
+const (
+	// StatePending is a transfer waiting to be sent or retried
+	StatePending State = "pending"
+	// StateFailed is a transfer that was not sent after the maximum number
+	// of attempts
+	StateFailed State = "failed"
+)
+
+// Transfer is a DICOM to be forwarded to a destination. Transfers are removed
+// once they are sent.
+type Transfer struct {
+	ID          string    `json:"id" example:"5f0c6b1e3a2d4c8e9b7a6f5e4d3c2b1a"`
+	DICOMID     string    `json:"dicomID" example:"1.3.12.2.1107.5.2.6.24119.30000013121716094326500000436"`
+	Destination string    `json:"destination" example:"pacs"`
+	Rule        string    `json:"rule" example:"ct-to-pacs"`
+	State       State     `json:"state" example:"pending"`
+	Attempts    int       `json:"attempts" example:"1"`
+	Error       string    `json:"error,omitempty"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+}
+
+// Router forwards DICOMs that match its rules to destinations. Transfers are
+// journaled to a directory so they survive a restart, and failed sends are
+// retried with exponential backoff.
+type Router struct {
+	dir         string
+	store       store.Store
+	rules       []rule
+	senders     map[string]sender
+	maxAttempts int
+	backoff     time.Duration
+	auditor     Auditor
+	tls         *tls.Config
+
+	mu        sync.Mutex
+	transfers map[string]*Transfer
+	wake      map[string]chan struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// Auditor records each DICOM sent to a destination along with the name and
+// network address or URL of the destination
+type Auditor interface {
+	Exported(dcm *store.DICOM, destination, address string)
+}
+
+// Option configures a Router
+type Option func(*Router)
+
+// WithMaxAttempts sets the number of attempts to send a DICOM before its
+// transfer fails
+func WithMaxAttempts(n int) Option {
+	return func(r *Router) {
+		r.maxAttempts = n
+	}
+}
+
+// WithBackoff sets the delay before the first retry, which doubles with each
+// attempt up to an hour
+func WithBackoff(d time.Duration) Option {
+	return func(r *Router) {
+		r.backoff = d
+	}
+}
+
+// WithAuditor sets the auditor that records each DICOM sent to a destination
+func WithAuditor(auditor Auditor) Option {
+	return func(r *Router) {
+		r.auditor = auditor
+	}
+}
+
+// WithTLS sets the TLS configuration that DIMSE destinations with TLS are
+// connected to with, such as one that presents dime's certificate. Without
+// it they are verified against the system roots and no certificate is
+// presented.
+func WithTLS(cfg *tls.Config) Option {
+	return func(r *Router) {
+		r.tls = cfg
+	}
+}
+
+// New creates a Router journaled in dir that reads DICOMs to forward from a
+// store, recovering any transfers from a previous run
+func New(dir string, st store.Store, cfg *Config, opts ...Option) (*Router, error) {
+	r := &Router{
+		dir:         dir,
+		store:       st,
+		maxAttempts: defaultMaxAttempts,
+		backoff:     defaultBackoff,
+		transfers:   map[string]*Transfer{},
+		wake:        map[string]chan struct{}{},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	senders, rules, err := compile(cfg, r.tls)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routing rules: %w", err)
+	}
+	r.senders = senders
+	r.rules = rules
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	for name := range senders {
+		r.wake[name] = make(chan struct{}, 1)
+	}
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	err = r.load()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Start a worker for each destination
+func (r *Router) Start() {
+	for name := range r.senders {
+		r.wg.Add(1)
+		go r.work(name)
+	}
+}
+
+// Stop the workers, cancelling any sends in progress. Pending transfers
+// remain in the journal.
+func (r *Router) Stop() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// Route queues transfers of a DICOM from a source to the destinations of the
+// rules it matches. It has the signature of an ingest.Hook.
+func (r *Router) Route(dcm *store.DICOM, source string) {
+	ds := dcm.Dataset()
+	queued := map[string]bool{}
+	for _, rl := range r.rules {
+		if !rl.matches(ds, source) {
+			continue
+		}
+		for _, dest := range rl.Destinations {
+			if queued[dest] {
+				continue
+			}
+			queued[dest] = true
+			err := r.queue(dcm.ID, dest, rl.Name)
+			if err != nil {
+				slog.Error("Failed to queue transfer",
+					slog.String("id", dcm.ID),
+					slog.String("destination", dest),
+					slog.String("error", err.Error()))
+			}
+		}
+	}
+}
+
+// List the pending and failed transfers in the order they were created,
+// optionally only those in a state
+func (r *Router) List(state State) []*Transfer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	transfers := []*Transfer{}
+	for _, t := range r.transfers {
+		if state == "" || t.State == state {
+			c := *t
+			transfers = append(transfers, &c)
+		}
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].Created.Before(transfers[j].Created)
+	})
+	return transfers
+}
+
+// Get a transfer by ID
+func (r *Router) Get(id string) (*Transfer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.transfers[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *t
+	return &c, nil
+}
+
+// Retry a transfer now. A failed transfer is given a fresh set of attempts.
+func (r *Router) Retry(id string) (*Transfer, error) {
+	t, err := r.update(id, func(t *Transfer) {
+		if t.State == StateFailed {
+			t.State = StatePending
+			t.Attempts = 0
+		}
+		t.NextAttempt = time.Now().UTC()
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.notify(t.Destination)
+	return t, nil
+}
+
+// queue a transfer of a DICOM to a destination
+func (r *Router) queue(dicomID, dest, ruleName string) error {
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	t := &Transfer{
+		ID:          id,
+		DICOMID:     dicomID,
+		Destination: dest,
+		Rule:        ruleName,
+		State:       StatePending,
+		NextAttempt: now,
+		Created:     now,
+		Updated:     now,
+	}
+	err = r.save(t)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.transfers[id] = t
+	r.mu.Unlock()
+	r.notify(dest)
+	return nil
+}
+
+// notify the worker of a destination that a transfer is due
+func (r *Router) notify(dest string) {
+	select {
+	case r.wake[dest] <- struct{}{}:
+	default:
+	}
+}
+
+// work sends the transfers to a destination as they become due
+func (r *Router) work(dest string) {
+	defer r.wg.Done()
+	for {
+		if r.ctx.Err() != nil {
+			return
+		}
+		t, wait := r.next(dest)
+		if t != nil {
+			r.send(t)
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-r.ctx.Done():
+		case <-r.wake[dest]:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// next returns the next due transfer to a destination, or how long to wait
+// until one is due
+func (r *Router) next(dest string) (*Transfer, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var next *Transfer
+	for _, t := range r.transfers {
+		if t.Destination != dest || t.State != StatePending {
+			continue
+		}
+		if next == nil || t.NextAttempt.Before(next.NextAttempt) ||
+			t.NextAttempt.Equal(next.NextAttempt) && t.Created.Before(next.Created) {
+			next = t
+		}
+	}
+	if next == nil {
+		return nil, idleWait
+	}
+	if wait := time.Until(next.NextAttempt); wait > 0 {
+		return nil, wait
+	}
+	c := *next
+	return &c, 0
+}
+
+// send a transfer, removing it once sent or scheduling a retry
+func (r *Router) send(t *Transfer) {
+	dcm, err := r.store.Read(t.DICOMID)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(r.ctx, sendTimeout)
+		err = r.senders[t.Destination].send(ctx, dcm.Dataset())
+		cancel()
+	}
+	if err != nil && r.ctx.Err() != nil {
+		// stopped while sending, retry on next start
+		return
+	}
+	if err == nil {
+		r.mu.Lock()
+		delete(r.transfers, t.ID)
+		r.mu.Unlock()
+		os.Remove(r.transferPath(t.ID))
+		if r.auditor != nil {
+			r.auditor.Exported(dcm, t.Destination, r.senders[t.Destination].address())
+		}
+		slog.Info("Forwarded dicom",
+			slog.String("id", t.DICOMID),
+			slog.String("destination", t.Destination))
+		return
+	}
+
+	permanent := errors.Is(err, store.ErrNotFound)
+	updated, _ := r.update(t.ID, func(t *Transfer) {
+		t.Attempts++
+		t.Error = err.Error()
+		if permanent || t.Attempts >= r.maxAttempts {
+			t.State = StateFailed
+			return
+		}
+		t.NextAttempt = time.Now().UTC().Add(r.delay(t.Attempts))
+	})
+	if updated == nil {
+		return
+	}
+	slog.Warn("Failed to forward dicom",
+		slog.String("id", t.DICOMID),
+		slog.String("destination", t.Destination),
+		slog.Int("attempts", updated.Attempts),
+		slog.String("state", string(updated.State)),
+		slog.String("error", err.Error()))
+}
+
+// delay returns the backoff before retrying after a number of attempts
+func (r *Router) delay(attempts int) time.Duration {
+	d := r.backoff
+	for range attempts - 1 {
+		d *= 2
+		if d >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return d
+}
+
+// update a transfer and journal it
+func (r *Router) update(id string, fn func(*Transfer)) (*Transfer, error) {
+	r.mu.Lock()
+	t, ok := r.transfers[id]
+	if !ok {
+		r.mu.Unlock()
+		return nil, ErrNotFound
+	}
+	fn(t)
+	t.Updated = time.Now().UTC()
+	c := *t
+	r.mu.Unlock()
+
+	err := r.save(&c)
+	if err != nil {
+		slog.Error(err.Error())
+	}
+	return &c, nil
+}
+
+// save a transfer to the journal, replacing the previous entry atomically
+func (r *Router) save(t *Transfer) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("failed to marshal transfer: %w", err)
+	}
+	tmp := r.transferPath(t.ID) + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write transfer: %w", err)
+	}
+	err = os.Rename(tmp, r.transferPath(t.ID))
+	if err != nil {
+		return fmt.Errorf("failed to write transfer: %w", err)
+	}
+	return nil
+}
+
+// load transfers from the journal. Transfers to destinations that are no
+// longer configured fail.
+func (r *Router) load() error {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read transfer directory: %w", err)
+	}
+	pending := 0
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), transferExt) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(r.dir, e.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read transfer: %w", err)
+		}
+		var t Transfer
+		err = json.Unmarshal(b, &t)
+		if err != nil {
+			slog.Error("Skipping unreadable transfer", slog.String("file", e.Name()))
+			continue
+		}
+		if _, ok := r.senders[t.Destination]; !ok && t.State == StatePending {
+			t.State = StateFailed
+			t.Error = fmt.Sprintf("destination %q is not configured", t.Destination)
+			t.Updated = time.Now().UTC()
+			err = r.save(&t)
+			if err != nil {
+				return err
+			}
+		}
+		if t.State == StatePending {
+			pending++
+		}
+		r.transfers[t.ID] = &t
+	}
+	if pending > 0 {
+		slog.Info("Recovered transfers", slog.Int("pending", pending))
+	}
+	return nil
+}
+
+func (r *Router) transferPath(id string) string {
+	return filepath.Join(r.dir, id+transferExt)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
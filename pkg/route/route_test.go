@@ -0,0 +1,331 @@
+package route_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/dimse"
+	"github.com/johnmarkli/dime/pkg/route"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+const (
+	testDataPath = "../../testdata/IM000001-mri"
+)
+
+// receiver is a stand-in destination that records the SOP instance UIDs it
+// receives
+type receiver struct {
+	mu       sync.Mutex
+	received []string
+}
+
+func (rc *receiver) add(ds *dicom.Dataset) {
+	el, _ := ds.FindElementByTag(tag.SOPInstanceUID)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.received = append(rc.received, el.Value.GetValue().([]string)[0])
+}
+
+func (rc *receiver) ids() []string {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]string{}, rc.received...)
+}
+
+// auditor records the destinations DICOMs are exported to
+type auditor struct {
+	mu       sync.Mutex
+	exported []string
+}
+
+func (a *auditor) Exported(dcm *store.DICOM, destination, address string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.exported = append(a.exported, destination)
+}
+
+func (a *auditor) destinations() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string{}, a.exported...)
+}
+
+// startSCP starts a C-STORE SCP stand-in, returning its address
+func startSCP(t *testing.T, rc *receiver) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := dimse.NewServer("PACS", func(_ string, ds *dicom.Dataset) error {
+		rc.add(ds)
+		return nil
+	})
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String()
+}
+
+// startTLSSCP starts a C-STORE SCP stand-in that accepts associations over
+// TLS, returning its address and the pool that verifies its certificate
+func startTLSSCP(t *testing.T, rc *receiver) (string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := dimse.NewServer("PACS", func(_ string, ds *dicom.Dataset) error {
+		rc.add(ds)
+		return nil
+	})
+	cfg := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	go s.Serve(tls.NewListener(ln, cfg))
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String(), pool
+}
+
+// startSTOW starts a STOW-RS stand-in that fails the first failures
+// requests, returning its URL
+func startSTOW(t *testing.T, rc *receiver, failures int) string {
+	var mu sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fail := failures > 0
+		failures--
+		mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/related" || params["type"] != "application/dicom" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if !assert.NoError(t, err) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			ds, err := dicom.ParseUntilEOF(part, nil)
+			if !assert.NoError(t, err) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			rc.add(&ds)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL + "/studies"
+}
+
+// newDICOM parses the test DICOM and saves it to a store
+func newDICOM(t *testing.T, st store.Store) *store.DICOM {
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+	return dcm
+}
+
+func TestRouter(t *testing.T) {
+	pacs, archive := &receiver{}, &receiver{}
+	cfg := &route.Config{
+		Destinations: []route.Destination{
+			{Name: "pacs", Type: route.TypeDIMSE, Address: startSCP(t, pacs), AETitle: "PACS"},
+			{Name: "archive", Type: route.TypeSTOW, URL: startSTOW(t, archive, 2)},
+		},
+		Rules: []route.Rule{
+			{Name: "mr", Match: route.Match{Modality: "MR", StationName: "MRC24119"}, Destinations: []string{"pacs"}},
+			{Name: "ct", Match: route.Match{Modality: "CT"}, Destinations: []string{"pacs"}},
+			{Name: "site", Match: route.Match{Source: "10.0.1.*"}, Destinations: []string{"archive", "pacs"}},
+		},
+	}
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	a := &auditor{}
+	r, err := route.New(t.TempDir(), st, cfg, route.WithBackoff(10*time.Millisecond), route.WithAuditor(a))
+	assert.NoError(t, err)
+	r.Start()
+	defer r.Stop()
+
+	dcm := newDICOM(t, st)
+	r.Route(dcm, "10.0.1.5")
+
+	// Each destination receives the DICOM once, the archive after retries,
+	// and each transfer is audited once it is sent
+	assert.Eventually(t, func() bool {
+		return len(r.List("")) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{dcm.ID}, pacs.ids())
+	assert.Equal(t, []string{dcm.ID}, archive.ids())
+	assert.ElementsMatch(t, []string{"pacs", "archive"}, a.destinations())
+
+	// DICOMs from other sources are only forwarded by the modality rule
+	r.Route(dcm, "192.168.0.1")
+	assert.Len(t, r.List(""), 1)
+	assert.Eventually(t, func() bool {
+		return len(r.List("")) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{dcm.ID, dcm.ID}, pacs.ids())
+	assert.Equal(t, []string{dcm.ID}, archive.ids())
+}
+
+func TestRouterTLS(t *testing.T) {
+	pacs := &receiver{}
+	addr, pool := startTLSSCP(t, pacs)
+	cfg := &route.Config{
+		Destinations: []route.Destination{
+			{Name: "pacs", Type: route.TypeDIMSE, Address: addr, AETitle: "PACS", TLS: true},
+		},
+		Rules: []route.Rule{{Name: "all", Destinations: []string{"pacs"}}},
+	}
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	r, err := route.New(t.TempDir(), st, cfg, route.WithTLS(&tls.Config{RootCAs: pool}))
+	assert.NoError(t, err)
+	r.Start()
+	defer r.Stop()
+
+	// The DICOM is sent over TLS to the SCP, verified by its address
+	dcm := newDICOM(t, st)
+	r.Route(dcm, "")
+	assert.Eventually(t, func() bool {
+		return len(r.List("")) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{dcm.ID}, pacs.ids())
+}
+
+func TestRouterFailed(t *testing.T) {
+	archive := &receiver{}
+	cfg := &route.Config{
+		Destinations: []route.Destination{
+			{Name: "archive", Type: route.TypeSTOW, URL: startSTOW(t, archive, 3)},
+		},
+		Rules: []route.Rule{{Destinations: []string{"archive"}}},
+	}
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	r, err := route.New(t.TempDir(), st, cfg,
+		route.WithMaxAttempts(2), route.WithBackoff(10*time.Millisecond))
+	assert.NoError(t, err)
+	r.Start()
+	defer r.Stop()
+
+	dcm := newDICOM(t, st)
+	r.Route(dcm, "")
+	assert.Eventually(t, func() bool {
+		return len(r.List(route.StateFailed)) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	failed := r.List(route.StateFailed)[0]
+	assert.Equal(t, dcm.ID, failed.DICOMID)
+	assert.Equal(t, "archive", failed.Destination)
+	assert.Equal(t, "rule 1", failed.Rule)
+	assert.Equal(t, 2, failed.Attempts)
+	assert.Contains(t, failed.Error, "503 Service Unavailable")
+
+	// Retrying gives the transfer a fresh set of attempts
+	retried, err := r.Retry(failed.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, route.StatePending, retried.State)
+	assert.Eventually(t, func() bool {
+		return len(r.List("")) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{dcm.ID}, archive.ids())
+
+	_, err = r.Get(failed.ID)
+	assert.ErrorIs(t, err, route.ErrNotFound)
+}
+
+func TestRouterRecover(t *testing.T) {
+	dir := t.TempDir()
+	pacs := &receiver{}
+	cfg := &route.Config{
+		Destinations: []route.Destination{
+			{Name: "pacs", Type: route.TypeDIMSE, Address: startSCP(t, pacs), AETitle: "PACS"},
+		},
+		Rules: []route.Rule{{Destinations: []string{"pacs"}}},
+	}
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	dcm := newDICOM(t, st)
+
+	// Queue a transfer without sending it
+	r, err := route.New(dir, st, cfg)
+	assert.NoError(t, err)
+	r.Route(dcm, "")
+	pending := r.List(route.StatePending)
+	assert.Len(t, pending, 1)
+
+	// The transfer is sent after a restart
+	r, err = route.New(dir, st, cfg)
+	assert.NoError(t, err)
+	recovered, err := r.Get(pending[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, pending[0].DICOMID, recovered.DICOMID)
+	r.Start()
+	defer r.Stop()
+	assert.Eventually(t, func() bool {
+		return len(r.List("")) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{dcm.ID}, pacs.ids())
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	for name, cfg := range map[string]*route.Config{
+		"unknown type": {Destinations: []route.Destination{{Name: "a", Type: "ftp"}}},
+		"missing url":  {Destinations: []route.Destination{{Name: "a", Type: route.TypeSTOW}}},
+		"missing ae":   {Destinations: []route.Destination{{Name: "a", Type: route.TypeDIMSE, Address: "pacs:104"}}},
+		"unknown destination": {
+			Destinations: []route.Destination{{Name: "a", Type: route.TypeDime, URL: "http://dime/dicoms"}},
+			Rules:        []route.Rule{{Destinations: []string{"b"}}},
+		},
+		"bad pattern": {
+			Destinations: []route.Destination{{Name: "a", Type: route.TypeDime, URL: "http://dime/dicoms"}},
+			Rules:        []route.Rule{{Match: route.Match{Attributes: map[string]string{"Modality": "("}}, Destinations: []string{"a"}}},
+		},
+	} {
+		st, err := store.NewMemStore()
+		assert.NoError(t, err)
+		_, err = route.New(t.TempDir(), st, cfg)
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,136 @@
+package route
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+
+	"github.com/johnmarkli/dime/pkg/dimse"
+	"github.com/suyashkumar/dicom"
+)
+
+// sender sends DICOMs to a destination
+type sender interface {
+	send(ctx context.Context, ds *dicom.Dataset) error
+	// address returns the network address or URL of the destination
+	address() string
+}
+
+// newSender returns the sender for a destination, which connects to DIMSE
+// destinations over TLS with a TLS configuration
+func newSender(d Destination, tlsConfig *tls.Config) (sender, error) {
+	switch d.Type {
+	case TypeDIMSE:
+		if d.Address == "" || d.AETitle == "" {
+			return nil, errors.New("address and aeTitle are required")
+		}
+		calling := d.CallingAETitle
+		if calling == "" {
+			calling = defaultCallingAETitle
+		}
+		var opts []dimse.ClientOption
+		if d.TLS {
+			host, _, err := net.SplitHostPort(d.Address)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address: %w", err)
+			}
+			cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+			if tlsConfig != nil {
+				cfg = tlsConfig.Clone()
+			}
+			cfg.ServerName = host
+			opts = append(opts, dimse.WithTLS(cfg))
+		}
+		return &dimseSender{dimse.NewClient(d.Address, calling, d.AETitle, opts...), d.Address}, nil
+	case TypeSTOW, TypeDime:
+		if d.URL == "" {
+			return nil, errors.New("url is required")
+		}
+		return &httpSender{url: d.URL, headers: d.Headers, stow: d.Type == TypeSTOW}, nil
+	default:
+		return nil, fmt.Errorf("unknown destination type %q", d.Type)
+	}
+}
+
+// dimseSender sends DICOMs with a C-STORE
+type dimseSender struct {
+	client *dimse.Client
+	addr   string
+}
+
+func (s *dimseSender) send(ctx context.Context, ds *dicom.Dataset) error {
+	return s.client.Store(ctx, ds)
+}
+
+func (s *dimseSender) address() string {
+	return s.addr
+}
+
+// httpSender posts DICOMs to a STOW-RS endpoint as multipart/related or to a
+// dime server as application/dicom
+type httpSender struct {
+	url     string
+	headers map[string]string
+	stow    bool
+}
+
+func (s *httpSender) address() string {
+	return s.url
+}
+
+func (s *httpSender) send(ctx context.Context, ds *dicom.Dataset) error {
+	var file bytes.Buffer
+	err := dicom.Write(&file, *ds)
+	if err != nil {
+		return fmt.Errorf("failed to write dicom: %w", err)
+	}
+
+	body := &file
+	contentType := "application/dicom"
+	if s.stow {
+		body = &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/dicom"}})
+		if err != nil {
+			return err
+		}
+		_, err = part.Write(file.Bytes())
+		if err != nil {
+			return err
+		}
+		err = mw.Close()
+		if err != nil {
+			return err
+		}
+		contentType = fmt.Sprintf(`multipart/related; type="application/dicom"; boundary=%s`, mw.Boundary())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.stow {
+		req.Header.Set("Accept", "application/dicom+json")
+	}
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send dicom: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("destination responded %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/johnmarkli/dime/pkg/quota"
+	"github.com/johnmarkli/dime/pkg/replica"
+	"github.com/johnmarkli/dime/pkg/store"
+)
+
+// AdminHandler handles requests to administer the server
+type AdminHandler struct {
+	scrubber   *store.Scrubber
+	quota      *quota.Manager
+	tiered     *store.TieredStore
+	recompress []*store.Recompressor
+	backup     *store.OnlineBackup
+	replicator *replica.Replicator
+}
+
+// NewAdminHandler returns a new AdminHandler
+func NewAdminHandler(scrubber *store.Scrubber, quota *quota.Manager, tiered *store.TieredStore,
+	recompress []*store.Recompressor, backup *store.OnlineBackup, replicator *replica.Replicator) *AdminHandler {
+	return &AdminHandler{scrubber, quota, tiered, recompress, backup, replicator}
+}
+
+// Scrub reports the integrity scrubbing of stored DICOMs
+//
+//	@Summary		Report integrity scrubbing
+//	@Description	Report the progress of the background scrubber and DICOMs whose checksum doesn't match the checksum recorded when they were stored
+//	@Tags			admin
+//	@Produce		json
+//	@Success		200	{object}	store.ScrubStatus
+//	@Failure		500	{object}	string
+//	@Router			/admin/scrub [get]
+func (ah *AdminHandler) Scrub(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Return scrub status
+	jsonBytes, err := json.Marshal(ah.scrubber.Status())
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
+// Usage reports the storage used by each tenant
+//
+//	@Summary		Report storage usage
+//	@Description	Report the storage used against the global quota and the quota of each tenant, the space of the disk of the data directory, and the bytes of images evicted to free it
+//	@Tags			admin
+//	@Produce		json
+//	@Success		200	{object}	quota.Report
+//	@Failure		500	{object}	string
+//	@Router			/admin/usage [get]
+func (ah *AdminHandler) Usage(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Return usage report
+	report, err := ah.quota.Report()
+	if err != nil {
+		panic(err)
+	}
+	jsonBytes, err := json.Marshal(report)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
+// Tiers reports the tiers of stored DICOMs
+//
+//	@Summary		Report storage tiers
+//	@Description	Report the number of DICOMs in the hot and cold tiers, how many were recalled, and the result of the last migration of idle studies to the cold tier
+//	@Tags			admin
+//	@Produce		json
+//	@Success		200	{object}	store.TierStatus
+//	@Failure		500	{object}	string
+//	@Router			/admin/tiers [get]
+func (ah *AdminHandler) Tiers(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Return tier status
+	jsonBytes, err := json.Marshal(ah.tiered.Status())
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
+// Compression reports the recompression of DICOMs stored uncompressed
+//
+//	@Summary		Report recompression
+//	@Description	Report the progress of compressing the DICOMs stored uncompressed in each compressed file store, such as those stored before compression was enabled, and the bytes saved
+//	@Tags			admin
+//	@Produce		json
+//	@Success		200	{array}		store.RecompressStatus
+//	@Failure		500	{object}	string
+//	@Router			/admin/compression [get]
+func (ah *AdminHandler) Compression(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Return recompression status
+	statuses := []store.RecompressStatus{}
+	for _, r := range ah.recompress {
+		statuses = append(statuses, r.Status())
+	}
+	jsonBytes, err := json.Marshal(statuses)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
+// Backup reports the online backup of the data directory
+//
+//	@Summary		Report backup
+//	@Description	Report whether a backup of the data directory is running, the latest snapshot in the backup directory and the error of the last backup if it failed
+//	@Tags			admin
+//	@Produce		json
+//	@Success		200	{object}	store.BackupStatus
+//	@Failure		500	{object}	string
+//	@Router			/admin/backup [get]
+func (ah *AdminHandler) Backup(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Return backup status
+	jsonBytes, err := json.Marshal(ah.backup.Status())
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
+// StartBackup starts an online backup of the data directory
+//
+//	@Summary		Start backup
+//	@Description	Start an incremental snapshot of the data directory in to the backup directory in the background without blocking ingest
+//	@Tags			admin
+//	@Produce		json
+//	@Success		202	{object}	store.BackupStatus
+//	@Failure		409	{object}	string
+//	@Failure		500	{object}	string
+//	@Router			/admin/backup [post]
+func (ah *AdminHandler) StartBackup(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Start backup
+	status, err := ah.backup.Start()
+	if err != nil {
+		panic(err)
+	}
+	jsonBytes, err := json.Marshal(status)
+	if err != nil {
+		panic(err)
+	}
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write(jsonBytes)
+}
+
+// Replication reports how far the server is behind the primary it replicates
+//
+//	@Summary		Report replication
+//	@Description	Report the sequence number of the last change of the primary applied, the number of changes not yet applied, and the error of the last pull if it failed
+//	@Tags			admin
+//	@Produce		json
+//	@Success		200	{object}	replica.Status
+//	@Failure		500	{object}	string
+//	@Router			/admin/replication [get]
+func (ah *AdminHandler) Replication(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Return replication status
+	jsonBytes, err := json.Marshal(ah.replicator.Status())
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
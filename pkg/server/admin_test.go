@@ -0,0 +1,154 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/quota"
+	"github.com/johnmarkli/dime/pkg/server"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+)
+
+func TestAdminHandlerScrub(t *testing.T) {
+	st, err := store.NewFileStore(t.TempDir())
+	assert.NoError(t, err)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+
+	scrubber := store.NewScrubber(st, 1000, time.Hour)
+	scrubber.Start()
+	defer scrubber.Stop()
+	assert.Eventually(t, func() bool {
+		return scrubber.Status().Passes == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// GET /admin/scrub
+	h := server.NewAdminHandler(scrubber, nil, nil, nil, nil, nil)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/admin/scrub", nil)
+	h.Scrub(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var status store.ScrubStatus
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&status))
+	assert.Equal(t, 1000, status.Rate)
+	assert.Equal(t, 1, status.Passes)
+	assert.Equal(t, 1, status.Checked)
+	assert.Empty(t, status.Mismatches)
+}
+
+func TestAdminHandlerUsage(t *testing.T) {
+	q, err := quota.New(t.TempDir(), quota.WithConfig(&quota.Config{Default: 1000}))
+	assert.NoError(t, err)
+	defer q.Close()
+	q.Add("research", testID, 100)
+
+	// GET /admin/usage
+	h := server.NewAdminHandler(nil, q, nil, nil, nil, nil)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/admin/usage", nil)
+	h.Usage(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var report quota.Report
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&report))
+	assert.Equal(t, quota.Usage{Used: 100, Count: 1}, report.Global)
+	assert.Equal(t, quota.Usage{Used: 100, Count: 1, Limit: 1000}, report.Tenants["research"])
+}
+
+func TestAdminHandlerTiers(t *testing.T) {
+	hot, err := store.NewMemStore()
+	assert.NoError(t, err)
+	cold, err := store.NewMemStore()
+	assert.NoError(t, err)
+	tiered, err := store.NewTieredStore(hot, cold, t.TempDir(), 0)
+	assert.NoError(t, err)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, tiered.Create(dcm))
+	tiered.Migrate()
+
+	// GET /admin/tiers
+	h := server.NewAdminHandler(nil, nil, tiered, nil, nil, nil)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/admin/tiers", nil)
+	h.Tiers(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var status store.TierStatus
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&status))
+	assert.Equal(t, 1, status.Cold)
+	assert.Equal(t, 1, status.LastMigration.Instances)
+}
+
+func TestAdminHandlerCompression(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.NewFileStore(dir)
+	assert.NoError(t, err)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+
+	st, err = store.NewFileStore(dir, store.WithCompression(store.CompressionDeflate))
+	assert.NoError(t, err)
+	recompressor := store.NewRecompressor(st, 1000)
+	recompressor.Start()
+	defer recompressor.Stop()
+	assert.Eventually(t, func() bool {
+		return recompressor.Status().Finished != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// GET /admin/compression
+	h := server.NewAdminHandler(nil, nil, nil, []*store.Recompressor{recompressor}, nil, nil)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/admin/compression", nil)
+	h.Compression(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var statuses []store.RecompressStatus
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&statuses))
+	if assert.Len(t, statuses, 1) {
+		assert.Equal(t, store.CompressionDeflate, statuses[0].Method)
+		assert.Equal(t, 1, statuses[0].Recompressed)
+	}
+}
+
+func TestAdminHandlerBackup(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.NewFileStore(dir)
+	assert.NoError(t, err)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+	backup := store.NewOnlineBackup(dir, t.TempDir())
+	h := server.NewAdminHandler(nil, nil, nil, nil, backup, nil)
+
+	// POST /admin/backup
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/admin/backup", nil)
+	h.StartBackup(w, r)
+	assert.Equal(t, http.StatusAccepted, w.Result().StatusCode)
+	backup.Wait()
+
+	// GET /admin/backup
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/admin/backup", nil)
+	h.Backup(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var status store.BackupStatus
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&status))
+	assert.False(t, status.Running)
+	if assert.NotNil(t, status.Last) {
+		assert.Equal(t, 3, status.Last.Count)
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/changes"
+)
+
+const (
+	maxChangesWait    = time.Minute
+	streamBatch       = 100
+	streamKeepAlive   = 15 * time.Second
+	lastEventIDHeader = "Last-Event-ID"
+)
+
+// ChangesHandler handles requests for the change feed of the store
+type ChangesHandler struct {
+	log *changes.Log
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// NewChangesHandler returns a new ChangesHandler
+func NewChangesHandler(log *changes.Log) *ChangesHandler {
+	return &ChangesHandler{log: log, stop: make(chan struct{})}
+}
+
+// Stop ends long-polls and streams so that the server can shut down
+func (ch *ChangesHandler) Stop() {
+	ch.stopOnce.Do(func() { close(ch.stop) })
+}
+
+// List the changes to the store
+//
+//	@Summary		List changes
+//	@Description	List the DICOMs created, updated and deleted after a sequence number in the order they changed, along with the sequence number of the last change. With wait, a request with no changes to list waits up to that long, at most 1m, for the next change.
+//	@Tags			changes
+//	@Produce		json
+//	@Param			since	query		int		false	"Sequence number to list changes after"
+//	@Param			limit	query		int		false	"Maximum number of changes, at most 1000"
+//	@Param			wait	query		string	false	"How long to wait for a change, such as 30s"
+//	@Success		200		{object}	changes.Page
+//	@Failure		400		{object}	string
+//	@Failure		500		{object}	string
+//	@Router			/changes [get]
+func (ch *ChangesHandler) List(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Parse query
+	since := parseSince(r.URL.Query().Get("since"))
+	var limit int
+	var wait time.Duration
+	var err error
+	if val := r.URL.Query().Get("limit"); val != "" {
+		limit, err = strconv.Atoi(val)
+		if err != nil || limit < 0 {
+			panic(fmt.Errorf("%w: limit %q", ErrInvalidQuery, val))
+		}
+	}
+	if val := r.URL.Query().Get("wait"); val != "" {
+		wait, err = time.ParseDuration(val)
+		if err != nil || wait < 0 {
+			panic(fmt.Errorf("%w: wait %q", ErrInvalidQuery, val))
+		}
+		wait = min(wait, maxChangesWait)
+	}
+
+	// Wait for a change
+	if wait > 0 {
+		ctx, cancel := ch.context(r.Context())
+		ctx, cancelWait := context.WithTimeout(ctx, wait)
+		ch.log.Wait(ctx, since)
+		cancelWait()
+		cancel()
+	}
+
+	// Return changes
+	jsonBytes, err := json.Marshal(ch.log.Since(since, limit))
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
+// Stream the changes to the store
+//
+//	@Summary		Stream changes
+//	@Description	Stream the DICOMs created, updated and deleted after a sequence number as Server-Sent Events as they change. Each event has the sequence number of the change as its id and the type of change as its event. A reconnecting client resumes after the change in its Last-Event-ID header.
+//	@Tags			changes
+//	@Produce		text/event-stream
+//	@Param			since			query		int		false	"Sequence number to stream changes after"
+//	@Param			Last-Event-ID	header		int		false	"Sequence number to resume streaming changes after"
+//	@Success		200				{object}	changes.Event
+//	@Failure		400				{object}	string
+//	@Failure		500				{object}	string
+//	@Router			/changes/stream [get]
+func (ch *ChangesHandler) Stream(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Parse query, resuming after the last event a client received
+	since := parseSince(r.URL.Query().Get("since"))
+	if val := r.Header.Get(lastEventIDHeader); val != "" {
+		since = parseSince(val)
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		panic(fmt.Errorf("streaming is not supported"))
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ctx, cancel := ch.context(r.Context())
+	defer cancel()
+	for {
+		// Send the changes after the last one sent
+		page := ch.log.Since(since, streamBatch)
+		for _, e := range page.Changes {
+			b, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, b)
+			if err != nil {
+				return
+			}
+			since = e.Seq
+		}
+		if len(page.Changes) > 0 {
+			flusher.Flush()
+			continue
+		}
+
+		// Wait for the next change, keeping the connection alive
+		waitCtx, cancelWait := context.WithTimeout(ctx, streamKeepAlive)
+		changed := ch.log.Wait(waitCtx, since)
+		cancelWait()
+		if ctx.Err() != nil {
+			return
+		}
+		if !changed {
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// context returns a context of a request that is also done when the handler
+// is stopped
+func (ch *ChangesHandler) context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-ch.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// parseSince parses a sequence number of the change feed
+func parseSince(val string) uint64 {
+	if val == "" {
+		return 0
+	}
+	since, err := strconv.ParseUint(val, 10, 64)
+	if err != nil {
+		panic(fmt.Errorf("%w: since %q", ErrInvalidQuery, val))
+	}
+	return since
+}
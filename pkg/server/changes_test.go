@@ -0,0 +1,143 @@
+package server_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/changes"
+	"github.com/johnmarkli/dime/pkg/server"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+)
+
+func TestChangesHandlerList(t *testing.T) {
+	l, err := changes.New(t.TempDir())
+	assert.NoError(t, err)
+	defer l.Close()
+	mem, err := store.NewMemStore()
+	assert.NoError(t, err)
+	st := l.Wrap(mem)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	h := server.NewChangesHandler(l)
+
+	// GET /changes?wait returns when a change is made
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, st.Create(dcm))
+	}()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/changes?since=0&wait=10s", nil)
+	h.List(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var page changes.Page
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&page))
+	if assert.Len(t, page.Changes, 1) {
+		assert.Equal(t, testID, page.Changes[0].ID)
+		assert.Equal(t, dcm.StudyInstanceUID, page.Changes[0].StudyInstanceUID)
+		assert.Equal(t, dcm.SeriesInstanceUID, page.Changes[0].SeriesInstanceUID)
+	}
+
+	// GET /changes?wait returns no changes after waiting
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/changes?since=1&wait=10ms", nil)
+	h.List(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&page))
+	assert.Empty(t, page.Changes)
+	assert.Equal(t, uint64(1), page.Last)
+
+	// GET /changes?wait returns when the handler is stopped
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		h.Stop()
+	}()
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/changes?since=1&wait=1m", nil)
+	h.List(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/changes?wait=soon", nil)
+	h.List(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
+
+func TestChangesHandlerStream(t *testing.T) {
+	l, err := changes.New(t.TempDir())
+	assert.NoError(t, err)
+	defer l.Close()
+	mem, err := store.NewMemStore()
+	assert.NoError(t, err)
+	st := l.Wrap(mem)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+	h := server.NewChangesHandler(l)
+	srv := httptest.NewServer(http.HandlerFunc(h.Stream))
+	defer srv.Close()
+	defer h.Stop()
+
+	// GET /changes/stream sends past changes and then those made while
+	// connected
+	resp, err := http.Get(srv.URL + "?since=0")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	scanner := bufio.NewScanner(resp.Body)
+	readEvent := func() (id, typ string, e changes.Event) {
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				return
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				typ = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e))
+			}
+		}
+		return
+	}
+	id, typ, e := readEvent()
+	assert.Equal(t, "1", id)
+	assert.Equal(t, changes.Created, typ)
+	assert.Equal(t, testID, e.ID)
+	assert.Equal(t, dcm.StudyInstanceUID, e.StudyInstanceUID)
+
+	assert.NoError(t, st.Delete(testID))
+	id, typ, e = readEvent()
+	assert.Equal(t, "2", id)
+	assert.Equal(t, changes.Deleted, typ)
+	assert.Equal(t, dcm.SeriesInstanceUID, e.SeriesInstanceUID)
+
+	// A reconnecting client resumes after its Last-Event-ID
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"?since=0", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "1")
+	resp2, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp2.Body.Close()
+	scanner = bufio.NewScanner(resp2.Body)
+	id, typ, _ = readEvent()
+	assert.Equal(t, "2", id)
+	assert.Equal(t, changes.Deleted, typ)
+
+	resp3, err := http.Get(srv.URL + "?since=x")
+	assert.NoError(t, err)
+	resp3.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp3.StatusCode)
+}
@@ -1,39 +1,209 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"net/netip"
+	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/johnmarkli/dime/pkg/audit"
+	"github.com/johnmarkli/dime/pkg/auth"
+	"github.com/johnmarkli/dime/pkg/coerce"
+	"github.com/johnmarkli/dime/pkg/ingest"
+	"github.com/johnmarkli/dime/pkg/jobs"
+	"github.com/johnmarkli/dime/pkg/quota"
+	"github.com/johnmarkli/dime/pkg/rbac"
+	"github.com/johnmarkli/dime/pkg/retention"
+	"github.com/johnmarkli/dime/pkg/route"
+	"github.com/johnmarkli/dime/pkg/stability"
 	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/johnmarkli/dime/pkg/validate"
+	"github.com/johnmarkli/dime/pkg/webhook"
 	"github.com/suyashkumar/dicom"
 	"github.com/suyashkumar/dicom/pkg/tag"
 )
 
+const (
+	defaultMaxUploadSize = 1 << 30 // 1GB
+)
+
+var (
+	// ErrImportDisabled is an error for an import when no import directory is
+	// configured
+	ErrImportDisabled = errors.New("import directory not configured")
+	// ErrInvalidQuery is an error for a query parameter that can't be parsed
+	ErrInvalidQuery = errors.New("invalid query parameter")
+	// ErrTooLarge is an error for an upload that exceeds the maximum size
+	ErrTooLarge = ingest.ErrTooLarge
+)
+
 // DICOMHandler handles requests for DICOM management
 type DICOMHandler struct {
-	store store.Store
+	store         store.Store
+	ingester      *ingest.Ingester
+	queue         *jobs.Queue
+	maxUploadSize int64
+	archive       ingest.ArchiveLimits
+	importDir     string
+	policy        validate.Policy
+	rules         *coerce.Engine
+	hooks         []ingest.Hook
+	quota         *quota.Manager
+	authorizer    *rbac.Authorizer
+	audit         *audit.Logger
+	proxies       []netip.Prefix
+}
+
+// DICOMHandlerOption configures a DICOMHandler
+type DICOMHandlerOption func(*DICOMHandler)
+
+// WithMaxUploadSize sets the maximum size in bytes of an uploaded DICOM
+func WithMaxUploadSize(size int64) DICOMHandlerOption {
+	return func(d *DICOMHandler) {
+		d.maxUploadSize = size
+	}
+}
+
+// WithArchiveLimits sets the limits of uploaded archives
+func WithArchiveLimits(limits ingest.ArchiveLimits) DICOMHandlerOption {
+	return func(d *DICOMHandler) {
+		d.archive = limits
+	}
+}
+
+// WithImportDir sets the directory that server-side imports are read from
+func WithImportDir(dir string) DICOMHandlerOption {
+	return func(d *DICOMHandler) {
+		d.importDir = dir
+	}
+}
+
+// WithValidation sets the policy for uploads that fail validation
+func WithValidation(policy validate.Policy) DICOMHandlerOption {
+	return func(d *DICOMHandler) {
+		d.policy = policy
+	}
+}
+
+// WithRules sets the rules that coerce the attributes of uploads
+func WithRules(rules *coerce.Engine) DICOMHandlerOption {
+	return func(d *DICOMHandler) {
+		d.rules = rules
+	}
+}
+
+// WithQueue sets the queue that uploads are ingested from asynchronously
+func WithQueue(queue *jobs.Queue) DICOMHandlerOption {
+	return func(d *DICOMHandler) {
+		d.queue = queue
+	}
+}
+
+// WithHook adds a hook that is called after each upload is saved to the store
+func WithHook(hook ingest.Hook) DICOMHandlerOption {
+	return func(d *DICOMHandler) {
+		d.hooks = append(d.hooks, hook)
+	}
+}
+
+// WithQuota sets the quota that uploads are admitted within
+func WithQuota(q *quota.Manager) DICOMHandlerOption {
+	return func(d *DICOMHandler) {
+		d.quota = q
+	}
+}
+
+// WithAuthorizer sets the authorizer of the actions of each request. Every
+// request is allowed without one.
+func WithAuthorizer(a *rbac.Authorizer) DICOMHandlerOption {
+	return func(d *DICOMHandler) {
+		d.authorizer = a
+	}
+}
+
+// WithAudit sets the log that the DICOMs each request creates and reads are
+// audited in
+func WithAudit(l *audit.Logger) DICOMHandlerOption {
+	return func(d *DICOMHandler) {
+		d.audit = l
+	}
+}
+
+// WithTrustedProxies sets the addresses of the proxies that are trusted to
+// set the X-Dime-Source and X-Dime-Tenant headers of the requests they forward
+func WithTrustedProxies(proxies []netip.Prefix) DICOMHandlerOption {
+	return func(d *DICOMHandler) {
+		d.proxies = proxies
+	}
 }
 
 // NewDICOMHandler returns a new DICOMHandler
-func NewDICOMHandler(store store.Store) *DICOMHandler {
-	return &DICOMHandler{store}
+func NewDICOMHandler(store store.Store, opts ...DICOMHandlerOption) *DICOMHandler {
+	d := &DICOMHandler{
+		store:         store,
+		maxUploadSize: defaultMaxUploadSize,
+		policy:        validate.PolicyAccept,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	ingestOpts := []ingest.Option{
+		ingest.WithMaxSize(d.maxUploadSize),
+		ingest.WithArchiveLimits(d.archive),
+		ingest.WithValidation(d.policy),
+		ingest.WithRules(d.rules),
+	}
+	for _, hook := range d.hooks {
+		ingestOpts = append(ingestOpts, ingest.WithHook(hook))
+	}
+	if d.audit != nil {
+		ingestOpts = append(ingestOpts, ingest.WithAuditor(d.audit))
+	}
+	d.ingester = ingest.New(store, ingestOpts...)
+	return d
+}
+
+// ImportRequest is a request to import a directory on the server
+type ImportRequest struct {
+	Path string `json:"path" example:"study1"`
 }
 
 // Upload a DICOM image
 //
 //	@Summary		Upload a DICOM image
-//	@Description	Uploads a DICOM image to the server
+//	@Description	Uploads a DICOM image to the server as multipart/form-data or as an application/dicom body.
+//	@Description	ZIP and tar(.gz) archives of DICOMs are ingested file by file and return a report for each file.
+//	@Description	If the server ingests asynchronously, the upload is queued and the ingest job is returned.
+//	@Description	Uploads are stored for the tenant of the identity's grants, and are rejected if they would exceed its quota or fill the disk.
+//	@Description	Only trusted proxies and admins may set the tenant in the X-Dime-Tenant header.
 //	@Tags			dicoms
 //	@Accept			mpfd
+//	@Accept			application/dicom
+//	@Accept			application/zip
+//	@Accept			application/x-tar
+//	@Accept			application/gzip
 //	@Produce		json
-//	@Success		201	{object}	store.DICOM
-//	@Failure		500	{object}	string
+//	@Param			X-Dime-Tenant	header		string	false	"Tenant that owns the upload, for trusted proxies and admins"
+//	@Success		201				{object}	store.DICOM
+//	@Success		200				{array}		ingest.Result
+//	@Success		202				{object}	jobs.Job
+//	@Failure		400				{object}	string
+//	@Failure		403				{object}	auth.Error
+//	@Failure		413				{object}	string
+//	@Failure		422				{object}	string
+//	@Failure		500				{object}	string
+//	@Failure		503				{object}	string
+//	@Failure		507				{object}	string
 //	@Router			/dicoms [post]
 func (d *DICOMHandler) Upload(w http.ResponseWriter, r *http.Request) {
 	defer func() {
@@ -42,37 +212,67 @@ func (d *DICOMHandler) Upload(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	// Get file upload
-	err := r.ParseMultipartForm(10 << 20) // limit of 10MB files
+	// Reject uploads that aren't allowed or won't fit before reading them
+	err := d.authorize(r, rbac.ActionCreate)
 	if err != nil {
-		panic(fmt.Errorf("failed to parse form: %w", err))
+		panic(err)
 	}
-	file, header, err := r.FormFile("file")
+	tenant, err := d.requestTenant(r)
 	if err != nil {
 		panic(err)
 	}
-	defer file.Close()
-	slog.Info("Uploaded file",
-		slog.String("filename", header.Filename),
-		slog.Int64("size", header.Size),
-		slog.String("header", fmt.Sprintf("%+v", header.Header)))
+	if d.quota != nil {
+		err = d.quota.Admit(tenant, max(r.ContentLength, 0))
+		if err != nil {
+			panic(err)
+		}
+	}
 
-	// Parse dicom file
-	dataset, err := dicom.Parse(file, header.Size, nil)
+	// Get file upload
+	file, filename, mediaType, err := uploadFile(r)
 	if err != nil {
 		panic(err)
 	}
 
-	// Create and store DICOM
-	dcm, err := store.NewDICOM(&dataset)
+	kind := jobs.KindOf(mediaType, filename)
+	source := d.requestSource(r)
+	if d.queue != nil {
+		d.enqueue(w, file, filename, kind, source, tenant, auth.FromContext(r.Context()))
+		return
+	}
+
+	// Ingest archive of DICOMs
+	var results []ingest.Result
+	ingester := d.requestIngester(r, source, tenant)
+	switch kind {
+	case jobs.KindZip:
+		results, err = ingester.IngestZip(file)
+	case jobs.KindTar:
+		results, err = ingester.IngestTar(file)
+	default:
+		d.upload(w, ingester, file, filename)
+		return
+	}
 	if err != nil {
 		panic(err)
 	}
-	err = d.store.Create(dcm)
+	slog.Info("Uploaded archive",
+		slog.String("filename", filename),
+		slog.Int("files", len(results)))
+	writeResults(w, results)
+}
+
+// upload a single DICOM image
+func (d *DICOMHandler) upload(w http.ResponseWriter, ingester *ingest.Ingester, file io.Reader, filename string) {
+
+	// Parse dicom file as it is streamed in and store it
+	dcm, err := ingester.Ingest(file)
 	if err != nil {
 		panic(err)
 	}
-	slog.Info("Saved DICOM", slog.String("id", dcm.ID))
+	slog.Info("Saved DICOM",
+		slog.String("id", dcm.ID),
+		slog.String("filename", filename))
 
 	// Return DICOM info
 	var jsonBytes []byte
@@ -84,6 +284,83 @@ func (d *DICOMHandler) Upload(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(jsonBytes)
 }
 
+// enqueue an upload to be ingested asynchronously
+func (d *DICOMHandler) enqueue(w http.ResponseWriter, file io.Reader, filename string, kind jobs.Kind, source, tenant string, id *auth.Identity) {
+	if kind == jobs.KindDICOM {
+		file = ingest.NewLimitReader(file, d.maxUploadSize)
+	} else {
+		file = ingest.NewLimitReader(file, d.ingester.ArchiveLimits().Size)
+	}
+	job, err := d.queue.Submit(file, kind, filename, source, tenant, id)
+	if err != nil {
+		panic(err)
+	}
+	slog.Info("Queued upload",
+		slog.String("job", job.ID),
+		slog.String("filename", filename))
+
+	// Return job info
+	var jsonBytes []byte
+	jsonBytes, err = json.Marshal(job)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Location", fmt.Sprintf("/jobs/%s", job.ID))
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write(jsonBytes)
+}
+
+// Import DICOMs from a directory on the server
+//
+//	@Summary		Import DICOMs from a directory on the server
+//	@Description	Import DICOMs from a directory under the server's import directory.
+//	@Description	If the directory contains a DICOMDIR, the files referenced by its directory records are imported.
+//	@Tags			dicoms
+//	@Accept			json
+//	@Produce		json
+//	@Param			request			body		ImportRequest	true	"Directory to import relative to the import directory"
+//	@Param			X-Dime-Tenant	header		string			false	"Tenant that owns the imported DICOMs, for trusted proxies and admins"
+//	@Success		200				{array}		ingest.Result
+//	@Failure		400				{object}	string
+//	@Failure		403				{object}	auth.Error
+//	@Failure		500				{object}	string
+//	@Router			/dicoms/import [post]
+func (d *DICOMHandler) Import(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	err := d.authorize(r, rbac.ActionCreate)
+	if err != nil {
+		panic(err)
+	}
+	if d.importDir == "" {
+		panic(ErrImportDisabled)
+	}
+	tenant, err := d.requestTenant(r)
+	if err != nil {
+		panic(err)
+	}
+	var req ImportRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		panic(fmt.Errorf("failed to decode import request: %w", err))
+	}
+
+	// Keep imports within the import directory
+	dir := filepath.Join(d.importDir, filepath.Clean("/"+req.Path))
+	results, err := d.requestIngester(r, d.requestSource(r), tenant).IngestDir(dir)
+	if err != nil {
+		panic(err)
+	}
+	slog.Info("Imported directory",
+		slog.String("path", dir),
+		slog.Int("files", len(results)))
+	writeResults(w, results)
+}
+
 // Read a DICOM image
 //
 //	@Summary		Read a DICOM image
@@ -91,7 +368,11 @@ func (d *DICOMHandler) Upload(w http.ResponseWriter, r *http.Request) {
 //	@Tags			dicoms
 //	@Produce		json
 //	@Param			id	path		string	true	"DICOM SOP Instance UID"
+//	@Param			If-None-Match	header	string	false	"ETag of a cached DICOM"
 //	@Success		200	{object}	store.DICOM
+//	@Success		304
+//	@Header			200	{string}	ETag	"SHA-256 checksum of the DICOM"
+//	@Failure		403	{object}	auth.Error
 //	@Failure		404	{object}	string
 //	@Failure		500	{object}	string
 //	@Router			/dicoms/{id} [get]
@@ -104,11 +385,21 @@ func (d *DICOMHandler) Read(w http.ResponseWriter, r *http.Request) {
 
 	// Get DICOM
 	id := mux.Vars(r)["id"]
-	dcm, err := d.store.Read(id)
+	dcm, err := d.read(r, id, audit.ActionRead)
 	if err != nil {
 		panic(err)
 	}
 
+	// Tag DICOM with its checksum
+	if dcm.SHA256 != "" {
+		etag := fmt.Sprintf("%q", dcm.SHA256)
+		w.Header().Set("ETag", etag)
+		if match := r.Header.Get("If-None-Match"); match == etag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
 	// Return DICOM info
 	var jsonBytes []byte
 	jsonBytes, err = json.Marshal(dcm)
@@ -126,6 +417,7 @@ func (d *DICOMHandler) Read(w http.ResponseWriter, r *http.Request) {
 //	@Produce		json
 //	@Param			id	path		string	true	"DICOM SOP Instance UID"
 //	@Success		200	{array}		dicom.Element
+//	@Failure		403	{object}	auth.Error
 //	@Failure		404	{object}	string
 //	@Failure		500	{object}	string
 //	@Router			/dicoms/{id}/attributes [get]
@@ -138,7 +430,7 @@ func (d *DICOMHandler) Attributes(w http.ResponseWriter, r *http.Request) {
 
 	// Get DICOM
 	id := mux.Vars(r)["id"]
-	dcm, err := d.store.Read(id)
+	dcm, err := d.read(r, id, audit.ActionQuery)
 	if err != nil {
 		panic(err)
 	}
@@ -186,6 +478,7 @@ func (d *DICOMHandler) Attributes(w http.ResponseWriter, r *http.Request) {
 //	@Tags			dicoms
 //	@Produce		png
 //	@Param			id	path		string	true	"DICOM SOP Instance UID"
+//	@Failure		403	{object}	auth.Error
 //	@Failure		404	{object}	string
 //	@Failure		500	{object}	string
 //	@Router			/dicoms/{id}/image [get]
@@ -196,8 +489,14 @@ func (d *DICOMHandler) Image(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	// Get DICOM Image
+	// Get DICOM Image, checking the DICOM may be read and auditing it
 	id := mux.Vars(r)["id"]
+	if d.authorizer != nil || d.audit != nil {
+		_, err := d.read(r, id, audit.ActionRender)
+		if err != nil {
+			panic(err)
+		}
+	}
 	b, err := d.store.GetImage(id)
 	if err != nil {
 		panic(err)
@@ -208,13 +507,129 @@ func (d *DICOMHandler) Image(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(b)
 }
 
+// File returns the DICOM file
+//
+//	@Summary		Get DICOM file
+//	@Description	Get a DICOM as a Part 10 file, decompressed and decrypted if it is stored compressed or encrypted
+//	@Tags			dicoms
+//	@Produce		application/dicom
+//	@Param			id	path		string	true	"DICOM SOP Instance UID"
+//	@Failure		403	{object}	auth.Error
+//	@Failure		404	{object}	string
+//	@Failure		500	{object}	string
+//	@Router			/dicoms/{id}/file [get]
+func (d *DICOMHandler) File(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Get DICOM
+	id := mux.Vars(r)["id"]
+	dcm, err := d.read(r, id, audit.ActionExport)
+	if err != nil {
+		panic(err)
+	}
+
+	// Return DICOM file
+	var b bytes.Buffer
+	err = dicom.Write(&b, *dcm.Dataset())
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/dicom")
+	_, _ = w.Write(b.Bytes())
+}
+
+// Validation report for a DICOM
+//
+//	@Summary		Validate a DICOM
+//	@Description	Validate a DICOM against the IOD of its SOP Class, checking required attributes, VR and VM conformance and UID syntax
+//	@Tags			dicoms
+//	@Produce		json
+//	@Param			id	path		string	true	"DICOM SOP Instance UID"
+//	@Success		200	{object}	validate.Report
+//	@Failure		403	{object}	auth.Error
+//	@Failure		404	{object}	string
+//	@Failure		500	{object}	string
+//	@Router			/dicoms/{id}/validation [get]
+func (d *DICOMHandler) Validation(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Get DICOM
+	id := mux.Vars(r)["id"]
+	dcm, err := d.read(r, id, audit.ActionRead)
+	if err != nil {
+		panic(err)
+	}
+
+	// Return validation report
+	var jsonBytes []byte
+	jsonBytes, err = json.Marshal(validate.Validate(dcm.Dataset()))
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
+// Coercion dry run for a DICOM
+//
+//	@Summary		Dry run coercion rules on a DICOM
+//	@Description	Show the changes the coercion rules would make to a DICOM if it was ingested from a source
+//	@Tags			dicoms
+//	@Produce		json
+//	@Param			id		path		string	true	"DICOM SOP Instance UID"
+//	@Param			source	query		string	false	"Source the DICOM is ingested from"
+//	@Success		200		{array}		coerce.Change
+//	@Failure		403		{object}	auth.Error
+//	@Failure		404		{object}	string
+//	@Failure		500		{object}	string
+//	@Router			/dicoms/{id}/coercion [get]
+func (d *DICOMHandler) Coercion(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Get DICOM
+	id := mux.Vars(r)["id"]
+	dcm, err := d.read(r, id, audit.ActionRead)
+	if err != nil {
+		panic(err)
+	}
+
+	// Evaluate rules without changing the DICOM
+	changes := []coerce.Change{}
+	if d.rules != nil {
+		changes, err = d.rules.DryRun(dcm.Dataset(), r.URL.Query().Get("source"))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// Return changes
+	var jsonBytes []byte
+	jsonBytes, err = json.Marshal(changes)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
 // List DICOMS
 //
 //	@Summary		List DICOMs
-//	@Description	List DICOMs on the server
+//	@Description	List DICOMs on the server that the request may read
 //	@Tags			dicoms
 //	@Produce		json
 //	@Success		200	{array}		store.DICOM
+//	@Failure		403	{object}	auth.Error
 //	@Failure		500	{object}	string
 //	@Router			/dicoms [get]
 func (d *DICOMHandler) List(w http.ResponseWriter, r *http.Request) {
@@ -224,11 +639,20 @@ func (d *DICOMHandler) List(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	// Get DICOMS
+	// Get DICOMS the request may read
+	err := d.authorize(r, rbac.ActionRead)
+	if err != nil {
+		d.record(r, audit.ActionQuery, nil, audit.OutcomeMinorFailure)
+		panic(err)
+	}
 	dicoms, err := d.store.List()
 	if err != nil {
 		panic(err)
 	}
+	if d.authorizer != nil {
+		dicoms = d.authorizer.Filter(auth.FromContext(r.Context()), rbac.ActionRead, dicoms)
+	}
+	d.record(r, audit.ActionQuery, nil, audit.OutcomeSuccess)
 
 	// Return DICOMS
 	var jsonBytes []byte
@@ -238,15 +662,218 @@ func (d *DICOMHandler) List(w http.ResponseWriter, r *http.Request) {
 	}
 	_, _ = w.Write(jsonBytes)
 }
+
+// requestUser returns the subject of the identity of a request, or an empty
+// string if it is unauthenticated
+func requestUser(r *http.Request) string {
+	if id := auth.FromContext(r.Context()); id != nil {
+		return id.Subject
+	}
+	return ""
+}
+
+// requestIngester returns the ingester of the DICOMs of a request from a
+// source for a tenant, which only stores the DICOMs its identity may create
+func (d *DICOMHandler) requestIngester(r *http.Request, source, tenant string) *ingest.Ingester {
+	ingester := d.ingester.WithSource(source).WithTenant(tenant).WithUser(requestUser(r))
+	if d.authorizer != nil {
+		ingester = ingester.WithAuthorize(authorizeCreate(d.authorizer, d.store)(auth.FromContext(r.Context())))
+	}
+	return ingester
+}
+
+// authorizeCreate returns the check of whether an identity may create a
+// DICOM in a store, which it may if the DICOM and the instance it would
+// replace are both within the scopes of its grants
+func authorizeCreate(authorizer *rbac.Authorizer, st store.Store) func(id *auth.Identity) func(*store.DICOM) error {
+	return func(id *auth.Identity) func(*store.DICOM) error {
+		return func(dcm *store.DICOM) error {
+			err := authorizer.AuthorizeDICOM(id, rbac.ActionCreate, dcm)
+			if err != nil {
+				return err
+			}
+			existing, err := st.Read(dcm.ID)
+			if errors.Is(err, store.ErrNotFound) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			return authorizer.AuthorizeDICOM(id, rbac.ActionCreate, existing)
+		}
+	}
+}
+
+// authorize the identity of a request to take an action
+func (d *DICOMHandler) authorize(r *http.Request, action rbac.Action) error {
+	if d.authorizer == nil {
+		return nil
+	}
+	return d.authorizer.Authorize(auth.FromContext(r.Context()), action)
+}
+
+// read a DICOM the identity of a request may read, auditing the action of
+// the request on it
+func (d *DICOMHandler) read(r *http.Request, id string, action audit.Action) (*store.DICOM, error) {
+	err := d.authorize(r, rbac.ActionRead)
+	if err != nil {
+		d.record(r, action, nil, audit.OutcomeMinorFailure)
+		return nil, err
+	}
+	dcm, err := d.store.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	if d.authorizer != nil {
+		err = d.authorizer.AuthorizeDICOM(auth.FromContext(r.Context()), rbac.ActionRead, dcm)
+		if err != nil {
+			d.record(r, action, dcm, audit.OutcomeMinorFailure)
+			return nil, err
+		}
+	}
+	d.record(r, action, dcm, audit.OutcomeSuccess)
+	return dcm, nil
+}
+
+// record the action of a request on a DICOM, if it was read, in the audit log
+func (d *DICOMHandler) record(r *http.Request, action audit.Action, dcm *store.DICOM, outcome audit.Outcome) {
+	if d.audit == nil {
+		return
+	}
+	ev := audit.Event{Action: action, User: requestUser(r), Source: remoteHost(r)}
+	if dcm != nil {
+		ev = audit.NewEvent(action, dcm, ev.User, ev.Source)
+	}
+	ev.Outcome = outcome
+	if action == audit.ActionQuery {
+		ev.Query = r.URL.RawQuery
+		if dcm == nil {
+			ev.Query = r.URL.RequestURI()
+		}
+	}
+	d.audit.Record(ev)
+}
+
+// uploadFile returns a reader for the uploaded file without buffering it
+// along with its name and media type. The file is either the "file" part of a
+// multipart form or the whole request body.
+func uploadFile(r *http.Request) (io.Reader, string, string, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to parse content type: %w", err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return r.Body, "", mediaType, nil
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to parse form: %w", err)
+	}
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, "", "", http.ErrMissingFile
+		}
+		if err != nil {
+			return nil, "", "", fmt.Errorf("failed to parse form: %w", err)
+		}
+		if part.FormName() == "file" {
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			return part, part.FileName(), partType, nil
+		}
+	}
+}
+
+// requestSource returns the source of a request for coercion and routing
+// rules, which is the client's address. Rules match on the source, so the
+// X-Dime-Source header only overrides it if the request is trusted.
+func (d *DICOMHandler) requestSource(r *http.Request) string {
+	if source := r.Header.Get("X-Dime-Source"); source != "" && d.trusted(r) {
+		return source
+	}
+	return remoteHost(r)
+}
+
+// requestTenant returns the tenant that owns the DICOMs of a request, which
+// is the tenant of its identity's grants. Quotas are charged to the tenant, so
+// the X-Dime-Tenant header may only set it if the request is trusted.
+func (d *DICOMHandler) requestTenant(r *http.Request) (string, error) {
+	if tenant := r.Header.Get("X-Dime-Tenant"); tenant != "" {
+		if !d.trusted(r) {
+			return "", fmt.Errorf("%w: only trusted proxies and admins may set the tenant", rbac.ErrForbidden)
+		}
+		return quota.ParseTenant(tenant)
+	}
+	if d.authorizer == nil {
+		return quota.ParseTenant("")
+	}
+	return quota.ParseTenant(d.authorizer.Tenant(auth.FromContext(r.Context())))
+}
+
+// trusted returns whether a request may speak for its client in headers such
+// as X-Dime-Source and X-Dime-Tenant, which it may if it is from a trusted
+// proxy or its identity is an admin
+func (d *DICOMHandler) trusted(r *http.Request) bool {
+	if addr, err := netip.ParseAddr(remoteHost(r)); err == nil {
+		for _, p := range d.proxies {
+			if p.Contains(addr.Unmap()) {
+				return true
+			}
+		}
+	}
+	return d.authorizer != nil && d.authorizer.Authorize(auth.FromContext(r.Context()), rbac.ActionAdmin) == nil
+}
+
+// remoteHost returns the address of the client of a request
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func writeResults(w http.ResponseWriter, results []ingest.Result) {
+	jsonBytes, err := json.Marshal(results)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
 func handleError(rec any, w http.ResponseWriter) {
 	errVal, ok := rec.(error)
 	if !ok {
 		errVal = fmt.Errorf("%v", rec)
 	}
 	slog.Error(errVal.Error())
-	if errors.Is(errVal, store.ErrNotFound) {
+	if errors.Is(errVal, store.ErrNotFound) || errors.Is(errVal, jobs.ErrNotFound) ||
+		errors.Is(errVal, route.ErrNotFound) || errors.Is(errVal, retention.ErrNotFound) ||
+		errors.Is(errVal, webhook.ErrNotFound) || errors.Is(errVal, stability.ErrNotFound) {
 		w.WriteHeader(http.StatusNotFound)
 		_, _ = w.Write([]byte("404 Not Found"))
+	} else if errors.Is(errVal, retention.ErrInvalidUID) || errors.Is(errVal, quota.ErrInvalidTenant) ||
+		errors.Is(errVal, ErrInvalidQuery) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(errVal.Error()))
+	} else if errors.Is(errVal, ErrTooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_, _ = w.Write([]byte("413 Request Entity Too Large"))
+	} else if errors.Is(errVal, validate.ErrInvalid) || errors.Is(errVal, store.ErrInvalidID) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = w.Write([]byte(errVal.Error()))
+	} else if errors.Is(errVal, ErrImportDisabled) || errors.Is(errVal, rbac.ErrForbidden) {
+		auth.WriteError(w, http.StatusForbidden, errVal.Error())
+	} else if errors.Is(errVal, quota.ErrQuotaExceeded) || errors.Is(errVal, quota.ErrInsufficientStorage) {
+		w.WriteHeader(http.StatusInsufficientStorage)
+		_, _ = w.Write([]byte(errVal.Error()))
+	} else if errors.Is(errVal, store.ErrBackupRunning) {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte(errVal.Error()))
+	} else if errors.Is(errVal, jobs.ErrQueueFull) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("503 Service Unavailable"))
 	} else {
 		w.WriteHeader(http.StatusInternalServerError)
 		_, _ = w.Write([]byte(errVal.Error()))
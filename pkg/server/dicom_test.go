@@ -1,19 +1,35 @@
 package server_test
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/gorilla/mux"
+	"github.com/johnmarkli/dime/pkg/audit"
+	"github.com/johnmarkli/dime/pkg/auth"
+	"github.com/johnmarkli/dime/pkg/coerce"
+	"github.com/johnmarkli/dime/pkg/ingest"
+	"github.com/johnmarkli/dime/pkg/quota"
+	"github.com/johnmarkli/dime/pkg/rbac"
 	"github.com/johnmarkli/dime/pkg/server"
 	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/johnmarkli/dime/pkg/validate"
 	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
 )
 
 const (
@@ -25,7 +41,8 @@ var (
 	testDICOMjson = `{
   "id":"1.3.12.2.1107.5.2.6.24119.30000013121716094326500000395",
   "seriesInstanceUID":"1.3.12.2.1107.5.2.6.24119.30000013121716094326500000394",
-  "studyInstanceUID":"1.2.840.114202.4.833393677.4209323108.691055951.3610221745"
+  "studyInstanceUID":"1.2.840.114202.4.833393677.4209323108.691055951.3610221745",
+  "sha256":"1a2cec607017bbd05e45dc5e1438372614320c414f3c50a462d35c7e3ff24ae4"
 }`
 )
 
@@ -34,6 +51,302 @@ func TestDICOMHandlerUpload(t *testing.T) {
 	assert.NotNil(t, st)
 }
 
+func TestDICOMHandlerUploadRaw(t *testing.T) {
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/dicoms", bytes.NewReader(b))
+	r.Header.Add("Content-Type", "application/dicom")
+
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	h := server.NewDICOMHandler(st)
+	h.Upload(w, r)
+	defer w.Result().Body.Close()
+	assert.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	body, err := io.ReadAll(w.Result().Body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, testDICOMjson, string(body))
+}
+
+func TestDICOMHandlerUploadTooLarge(t *testing.T) {
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/dicoms", bytes.NewReader(b))
+	r.Header.Add("Content-Type", "application/dicom")
+
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	h := server.NewDICOMHandler(st, server.WithMaxUploadSize(1<<10))
+	h.Upload(w, r)
+	defer w.Result().Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Result().StatusCode)
+
+	dcms, err := st.List()
+	assert.NoError(t, err)
+	assert.Empty(t, dcms)
+}
+
+func TestDICOMHandlerUploadQuota(t *testing.T) {
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+	q, err := quota.New(t.TempDir(), quota.WithConfig(&quota.Config{
+		Tenants: map[string]int64{"small": 1 << 10, "large": 1 << 30},
+	}))
+	assert.NoError(t, err)
+	defer q.Close()
+	authorizer, err := rbac.New(&rbac.Config{Grants: []rbac.Grant{
+		{Method: auth.MethodAPIKey, Subject: "small-gateway", Roles: []rbac.Role{rbac.RoleUploader}, Tenant: "small"},
+		{Method: auth.MethodAPIKey, Subject: "large-gateway", Roles: []rbac.Role{rbac.RoleUploader}, Tenant: "large"},
+	}})
+	assert.NoError(t, err)
+	mem, err := store.NewMemStore()
+	assert.NoError(t, err)
+	st := q.Wrap(mem)
+	h := server.NewDICOMHandler(st, server.WithQuota(q), server.WithAuthorizer(authorizer),
+		server.WithTrustedProxies([]netip.Prefix{netip.MustParsePrefix("198.51.100.1/32")}))
+	request := func(subject, tenant string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/dicoms", bytes.NewReader(b))
+		r.Header.Add("Content-Type", "application/dicom")
+		if tenant != "" {
+			r.Header.Add("X-Dime-Tenant", tenant)
+		}
+		return r.WithContext(auth.WithIdentity(r.Context(), &auth.Identity{Subject: subject, Method: auth.MethodAPIKey}))
+	}
+
+	// An upload over its tenant's quota is rejected before it is stored
+	w := httptest.NewRecorder()
+	h.Upload(w, request("small-gateway", ""))
+	assert.Equal(t, http.StatusInsufficientStorage, w.Result().StatusCode)
+	dcms, err := st.List()
+	assert.NoError(t, err)
+	assert.Empty(t, dcms)
+
+	// The tenant can't be set by a client that isn't trusted
+	w = httptest.NewRecorder()
+	h.Upload(w, request("small-gateway", "large"))
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+
+	// An upload within its tenant's quota is accounted to it
+	w = httptest.NewRecorder()
+	h.Upload(w, request("large-gateway", ""))
+	assert.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	report, err := q.Report()
+	assert.NoError(t, err)
+	assert.Equal(t, quota.Usage{Used: int64(len(b)), Count: 1, Limit: 1 << 30}, report.Tenants["large"])
+
+	// A trusted proxy sets the tenant, which must have a valid name
+	w = httptest.NewRecorder()
+	r := request("large-gateway", "small")
+	r.RemoteAddr = "198.51.100.1:1234"
+	h.Upload(w, r)
+	assert.Equal(t, http.StatusInsufficientStorage, w.Result().StatusCode)
+	w = httptest.NewRecorder()
+	r = request("large-gateway", "../large")
+	r.RemoteAddr = "198.51.100.1:1234"
+	h.Upload(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
+
+func TestDICOMHandlerUploadZip(t *testing.T) {
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, err := zw.Create("study/IM000001")
+	assert.NoError(t, err)
+	_, err = fw.Write(b)
+	assert.NoError(t, err)
+	fw, err = zw.Create("study/notes.txt")
+	assert.NoError(t, err)
+	_, err = fw.Write([]byte("not a dicom"))
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/dicoms", &buf)
+	r.Header.Add("Content-Type", "application/zip")
+
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	h := server.NewDICOMHandler(st)
+	h.Upload(w, r)
+	defer w.Result().Body.Close()
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var results []ingest.Result
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&results))
+	assert.Len(t, results, 2)
+	assert.Equal(t, ingest.Result{File: "study/IM000001", ID: testID}, results[0])
+	assert.Equal(t, "study/notes.txt", results[1].File)
+	assert.NotEmpty(t, results[1].Error)
+
+	_, err = st.Read(testID)
+	assert.NoError(t, err)
+}
+
+func TestDICOMHandlerUploadTarGz(t *testing.T) {
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "IM000001", Mode: 0600, Size: int64(len(b))}))
+	_, err = tw.Write(b)
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gw.Close())
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", "dicoms.tar.gz")
+	assert.NoError(t, err)
+	_, err = io.Copy(fw, &buf)
+	assert.NoError(t, err)
+	mw.Close()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/dicoms", &body)
+	r.Header.Add("Content-Type", mw.FormDataContentType())
+
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	h := server.NewDICOMHandler(st)
+	h.Upload(w, r)
+	defer w.Result().Body.Close()
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var results []ingest.Result
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&results))
+	assert.Equal(t, []ingest.Result{{File: "IM000001", ID: testID}}, results)
+}
+
+func TestDICOMHandlerUploadArchiveLimits(t *testing.T) {
+
+	// A ZIP archive with three entries
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	for _, name := range []string{"a", "b", "c"} {
+		fw, err := zw.Create(name)
+		assert.NoError(t, err)
+		_, err = fw.Write([]byte("not a dicom"))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, zw.Close())
+
+	// A tar.gz archive of a file that expands to 8MB
+	var tarBuf bytes.Buffer
+	gw := gzip.NewWriter(&tarBuf)
+	tw := tar.NewWriter(gw)
+	zeros := make([]byte, 8<<20)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "bomb", Mode: 0600, Size: int64(len(zeros))}))
+	_, err := tw.Write(zeros)
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gw.Close())
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		limits      ingest.ArchiveLimits
+		status      int
+	}{
+		{"zip within limits", "application/zip", zipBuf.Bytes(), ingest.ArchiveLimits{}, http.StatusOK},
+		{"zip too large", "application/zip", zipBuf.Bytes(), ingest.ArchiveLimits{Size: 100}, http.StatusRequestEntityTooLarge},
+		{"zip too many entries", "application/zip", zipBuf.Bytes(), ingest.ArchiveLimits{Entries: 2}, http.StatusRequestEntityTooLarge},
+		{"tar too large", "application/gzip", tarBuf.Bytes(), ingest.ArchiveLimits{Size: 100}, http.StatusRequestEntityTooLarge},
+		{"tar expands too large", "application/gzip", tarBuf.Bytes(), ingest.ArchiveLimits{UncompressedSize: 1 << 20}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := store.NewMemStore()
+			assert.NoError(t, err)
+			h := server.NewDICOMHandler(st, server.WithArchiveLimits(tt.limits))
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/dicoms", bytes.NewReader(tt.body))
+			r.Header.Add("Content-Type", tt.contentType)
+			h.Upload(w, r)
+			assert.Equal(t, tt.status, w.Result().StatusCode)
+		})
+	}
+}
+
+func TestDICOMHandlerImport(t *testing.T) {
+	importDir := t.TempDir()
+	mediaDir := filepath.Join(importDir, "cd1")
+	assert.NoError(t, os.MkdirAll(filepath.Join(mediaDir, "DICOM", "ST000001"), os.ModePerm))
+
+	// Copy test DICOM on to media and reference it from a DICOMDIR
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(mediaDir, "DICOM", "ST000001", "IM000001"), b, 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(mediaDir, "README.TXT"), []byte("not a dicom"), 0600))
+	writeDICOMDIR(t, mediaDir, []string{"DICOM", "ST000001", "IM000001"})
+
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	h := server.NewDICOMHandler(st, server.WithImportDir(importDir))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/dicoms/import", strings.NewReader(`{"path":"../cd1"}`))
+	h.Import(w, r)
+	defer w.Result().Body.Close()
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var results []ingest.Result
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&results))
+	assert.Equal(t, []ingest.Result{{File: filepath.Join("DICOM", "ST000001", "IM000001"), ID: testID}}, results)
+
+	// Imports are disabled without an import directory
+	h = server.NewDICOMHandler(st)
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/dicoms/import", strings.NewReader(`{"path":"cd1"}`))
+	h.Import(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+}
+
+func TestDICOMHandlerImportOutside(t *testing.T) {
+	importDir := filepath.Join(t.TempDir(), "import")
+	mediaDir := filepath.Join(importDir, "cd1")
+	assert.NoError(t, os.MkdirAll(mediaDir, os.ModePerm))
+
+	// Reference a DICOM outside of the media from its DICOMDIR
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(importDir, "outside.dcm"), b, 0600))
+	assert.NoError(t, os.Symlink(filepath.Join(importDir, "outside.dcm"), filepath.Join(mediaDir, "LINK")))
+	writeDICOMDIR(t, mediaDir, []string{"..", "outside.dcm"}, []string{"LINK"})
+
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	h := server.NewDICOMHandler(st, server.WithImportDir(importDir))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/dicoms/import", strings.NewReader(`{"path":"cd1"}`))
+	h.Import(w, r)
+	defer w.Result().Body.Close()
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var results []ingest.Result
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&results))
+	assert.Len(t, results, 2)
+	for _, res := range results {
+		assert.Empty(t, res.ID)
+		assert.Contains(t, res.Error, ingest.ErrInvalidFileID.Error())
+	}
+	dicoms, err := st.List()
+	assert.NoError(t, err)
+	assert.Empty(t, dicoms)
+}
+
 func TestDICOMHandlerRead(t *testing.T) {
 	st := uploadDICOM(t, testDataPath)
 	assert.NotNil(t, st)
@@ -46,10 +359,21 @@ func TestDICOMHandlerRead(t *testing.T) {
 	h.Read(w, r)
 	defer w.Result().Body.Close()
 	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	etag := w.Result().Header.Get("ETag")
+	assert.Equal(t, `"1a2cec607017bbd05e45dc5e1438372614320c414f3c50a462d35c7e3ff24ae4"`, etag)
 
 	body, err := io.ReadAll(w.Result().Body)
 	assert.NoError(t, err)
 	assert.JSONEq(t, testDICOMjson, string(body))
+
+	// A cached DICOM is not modified
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/dicoms", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": testID})
+	r.Header.Set("If-None-Match", etag)
+	h.Read(w, r)
+	defer w.Result().Body.Close()
+	assert.Equal(t, http.StatusNotModified, w.Result().StatusCode)
 }
 
 func TestDICOMHandlerAttributes(t *testing.T) {
@@ -93,6 +417,141 @@ func TestDICOMHandlerImage(t *testing.T) {
 	assert.Len(t, body, 127594) // byte length of test png
 }
 
+func TestDICOMHandlerFile(t *testing.T) {
+	st := uploadDICOM(t, testDataPath)
+	assert.NotNil(t, st)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/dicoms/%s/file", testID), nil)
+	r = mux.SetURLVars(r, map[string]string{"id": testID})
+
+	h := server.NewDICOMHandler(st)
+	h.File(w, r)
+	defer w.Result().Body.Close()
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "application/dicom", w.Result().Header.Get("Content-Type"))
+
+	ds, err := dicom.ParseUntilEOF(w.Result().Body, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.Equal(t, testID, dcm.ID)
+}
+
+func TestDICOMHandlerValidation(t *testing.T) {
+	st := uploadDICOM(t, testDataPath)
+	assert.NotNil(t, st)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/dicoms/%s/validation", testID), nil)
+	r = mux.SetURLVars(r, map[string]string{"id": testID})
+
+	h := server.NewDICOMHandler(st)
+	h.Validation(w, r)
+	defer w.Result().Body.Close()
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var report validate.Report
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&report))
+	assert.True(t, report.Valid)
+	assert.Equal(t, "MR Image", report.IOD)
+}
+
+func TestDICOMHandlerUploadInvalid(t *testing.T) {
+	ds := dicom.Dataset{Elements: []*dicom.Element{
+		mustNewElement(t, tag.MediaStorageSOPClassUID, []string{"1.2.840.10008.5.1.4.1.1.7"}),
+		mustNewElement(t, tag.MediaStorageSOPInstanceUID, []string{"1.2.3.4.5"}),
+		mustNewElement(t, tag.TransferSyntaxUID, []string{"1.2.840.10008.1.2.1"}),
+		mustNewElement(t, tag.SOPClassUID, []string{"1.2.840.10008.5.1.4.1.1.7"}),
+		mustNewElement(t, tag.SOPInstanceUID, []string{"1.2.3.4.5"}),
+		mustNewElement(t, tag.StudyInstanceUID, []string{"1.2.3"}),
+		mustNewElement(t, tag.SeriesInstanceUID, []string{"1.2.3.4"}),
+	}}
+	var b bytes.Buffer
+	assert.NoError(t, dicom.Write(&b, ds))
+
+	for policy, status := range map[validate.Policy]int{
+		validate.PolicyAccept: http.StatusCreated,
+		validate.PolicyWarn:   http.StatusCreated,
+		validate.PolicyReject: http.StatusUnprocessableEntity,
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/dicoms", bytes.NewReader(b.Bytes()))
+		r.Header.Add("Content-Type", "application/dicom")
+
+		st, err := store.NewMemStore()
+		assert.NoError(t, err)
+		h := server.NewDICOMHandler(st, server.WithValidation(policy))
+		h.Upload(w, r)
+		assert.Equal(t, status, w.Result().StatusCode, policy)
+		w.Result().Body.Close()
+	}
+}
+
+func TestDICOMHandlerCoercion(t *testing.T) {
+	rules, err := coerce.New([]coerce.Rule{{
+		Name:    "site-a",
+		Match:   coerce.Match{Source: "site-a"},
+		Actions: []coerce.Action{{Op: coerce.OpSet, Tag: "InstitutionName", Value: "Site A"}},
+	}})
+	assert.NoError(t, err)
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	h := server.NewDICOMHandler(st, server.WithRules(rules),
+		server.WithTrustedProxies([]netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}))
+
+	// Dry run before the rules are applied on ingest
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/dicoms", bytes.NewReader(b))
+	r.Header.Add("Content-Type", "application/dicom")
+	h.Upload(w, r)
+	assert.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/dicoms/%s/coercion?source=site-a", testID), nil)
+	r = mux.SetURLVars(r, map[string]string{"id": testID})
+	h.Coercion(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var changes []coerce.Change
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&changes))
+	assert.Len(t, changes, 1)
+	assert.Equal(t, []string{"Sunnyvale Imaging Center"}, changes[0].Old)
+	assert.Equal(t, []string{"Site A"}, changes[0].New)
+
+	// Apply the rules to an upload from the source
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/dicoms", bytes.NewReader(b))
+	r.Header.Add("Content-Type", "application/dicom")
+	r.Header.Add("X-Dime-Source", "site-a")
+	h.Upload(w, r)
+	assert.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	dcm, err := st.Read(testID)
+	assert.NoError(t, err)
+	el, err := dcm.Dataset().FindElementByTag(tag.InstitutionName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Site A"}, el.Value.GetValue())
+
+	// The source of a client that isn't a trusted proxy is its address
+	st, err = store.NewMemStore()
+	assert.NoError(t, err)
+	h = server.NewDICOMHandler(st, server.WithRules(rules))
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/dicoms", bytes.NewReader(b))
+	r.Header.Add("Content-Type", "application/dicom")
+	r.Header.Add("X-Dime-Source", "site-a")
+	h.Upload(w, r)
+	assert.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	dcm, err = st.Read(testID)
+	assert.NoError(t, err)
+	el, err = dcm.Dataset().FindElementByTag(tag.InstitutionName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Sunnyvale Imaging Center"}, el.Value.GetValue())
+}
+
 func TestDICOMHandlerList(t *testing.T) {
 	st := uploadDICOM(t, testDataPath)
 	assert.NotNil(t, st)
@@ -133,6 +592,34 @@ func TestDICOMHandlerNotFound(t *testing.T) {
 	}
 }
 
+// writeDICOMDIR writes a DICOMDIR to dir with an image record for each file ID
+func writeDICOMDIR(t *testing.T, dir string, fileIDs ...[]string) {
+	var records [][]*dicom.Element
+	for _, fileID := range fileIDs {
+		records = append(records, []*dicom.Element{
+			mustNewElement(t, tag.DirectoryRecordType, []string{"IMAGE"}),
+			mustNewElement(t, tag.ReferencedFileID, fileID),
+		})
+	}
+	ds := dicom.Dataset{Elements: []*dicom.Element{
+		mustNewElement(t, tag.MediaStorageSOPClassUID, []string{"1.2.840.10008.1.3.10"}),
+		mustNewElement(t, tag.MediaStorageSOPInstanceUID, []string{"1.2.3.4"}),
+		mustNewElement(t, tag.TransferSyntaxUID, []string{"1.2.840.10008.1.2.1"}),
+		mustNewElement(t, tag.FileSetID, []string{"TEST"}),
+		mustNewElement(t, tag.DirectoryRecordSequence, records),
+	}}
+	f, err := os.Create(filepath.Join(dir, "DICOMDIR"))
+	assert.NoError(t, err)
+	defer f.Close()
+	assert.NoError(t, dicom.Write(f, ds))
+}
+
+func mustNewElement(t *testing.T, tg tag.Tag, data any) *dicom.Element {
+	el, err := dicom.NewElement(tg, data)
+	assert.NoError(t, err)
+	return el
+}
+
 // uploadDICOM uploads a DICOM file
 func uploadDICOM(t *testing.T, filePath string) *store.MemStore {
 	file, err := os.Open(filePath)
@@ -170,3 +657,130 @@ func uploadDICOM(t *testing.T, filePath string) *store.MemStore {
 	assert.JSONEq(t, testDICOMjson, string(body))
 	return st
 }
+
+func TestDICOMHandlerAuthorization(t *testing.T) {
+	st := uploadDICOM(t, testDataPath)
+	authorizer, err := rbac.New(&rbac.Config{Grants: []rbac.Grant{
+		{Method: auth.MethodAPIKey, Subject: "gateway", Roles: []rbac.Role{rbac.RoleUploader}},
+		{Method: auth.MethodAPIKey, Subject: "reporting", Roles: []rbac.Role{rbac.RoleReader}, Scopes: []rbac.Scope{{Institution: "Sunnyvale Imaging Center"}}},
+		{Method: auth.MethodAPIKey, Subject: "other", Roles: []rbac.Role{rbac.RoleReader}, Scopes: []rbac.Scope{{Institution: "General Hospital"}}},
+		{Method: auth.MethodAPIKey, Subject: "researcher", Roles: []rbac.Role{rbac.RoleDeidentifiedReader}},
+		{Method: auth.MethodAPIKey, Subject: "clinic", Roles: []rbac.Role{rbac.RoleUploader}, Scopes: []rbac.Scope{{Institution: "General Hospital"}}},
+	}})
+	assert.NoError(t, err)
+	h := server.NewDICOMHandler(st, server.WithAuthorizer(authorizer))
+	request := func(method, target, subject string, body io.Reader) *http.Request {
+		r := httptest.NewRequest(method, target, body)
+		r = mux.SetURLVars(r, map[string]string{"id": testID})
+		return r.WithContext(auth.WithIdentity(r.Context(), &auth.Identity{Subject: subject, Method: auth.MethodAPIKey}))
+	}
+
+	// Readers in scope read the DICOM
+	for _, handle := range []http.HandlerFunc{h.Read, h.Attributes, h.Image, h.File, h.Validation, h.Coercion} {
+		w := httptest.NewRecorder()
+		handle(w, request(http.MethodGet, "/dicoms/"+testID, "reporting", nil))
+		assert.NotEqual(t, http.StatusForbidden, w.Result().StatusCode)
+
+		// Readers out of scope, uploaders and de-identified readers don't
+		for _, subject := range []string{"other", "gateway", "researcher"} {
+			w := httptest.NewRecorder()
+			handle(w, request(http.MethodGet, "/dicoms/"+testID, subject, nil))
+			assert.Equal(t, http.StatusForbidden, w.Result().StatusCode, subject)
+			assert.Equal(t, "application/json", w.Result().Header.Get("Content-Type"))
+		}
+	}
+
+	// GET /dicoms lists the DICOMs in scope
+	for subject, count := range map[string]int{"reporting": 1, "other": 0, "researcher": 0} {
+		w := httptest.NewRecorder()
+		h.List(w, request(http.MethodGet, "/dicoms", subject, nil))
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		var dicoms []*store.DICOM
+		assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&dicoms))
+		assert.Len(t, dicoms, count, subject)
+	}
+	w := httptest.NewRecorder()
+	h.List(w, request(http.MethodGet, "/dicoms", "gateway", nil))
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+
+	// Only uploaders upload and import
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+	w = httptest.NewRecorder()
+	r := request(http.MethodPost, "/dicoms", "reporting", bytes.NewReader(b))
+	r.Header.Set("Content-Type", "application/dicom")
+	h.Upload(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+	w = httptest.NewRecorder()
+	r = request(http.MethodPost, "/dicoms", "gateway", bytes.NewReader(b))
+	r.Header.Set("Content-Type", "application/dicom")
+	h.Upload(w, r)
+	assert.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	// Scoped uploaders only upload DICOMs in scope
+	w = httptest.NewRecorder()
+	r = request(http.MethodPost, "/dicoms", "clinic", bytes.NewReader(b))
+	r.Header.Set("Content-Type", "application/dicom")
+	h.Upload(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+	w = httptest.NewRecorder()
+	h.Import(w, request(http.MethodPost, "/dicoms/import", "reporting", strings.NewReader(`{"path":"cd1"}`)))
+	var authErr auth.Error
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&authErr))
+	assert.Equal(t, auth.Error{Status: http.StatusForbidden, Error: "Forbidden", Message: "forbidden: reporting may not create"}, authErr)
+}
+
+func TestDICOMHandlerAudit(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := audit.New(file)
+	assert.NoError(t, err)
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	authorizer, err := rbac.New(&rbac.Config{Grants: []rbac.Grant{
+		{Method: auth.MethodAPIKey, Subject: "reporting", Roles: []rbac.Role{rbac.RoleReader, rbac.RoleUploader}},
+	}})
+	assert.NoError(t, err)
+	h := server.NewDICOMHandler(st, server.WithAudit(auditLog), server.WithAuthorizer(authorizer))
+	request := func(method, target, subject string, body io.Reader) *http.Request {
+		r := httptest.NewRequest(method, target, body)
+		r = mux.SetURLVars(r, map[string]string{"id": testID})
+		return r.WithContext(auth.WithIdentity(r.Context(), &auth.Identity{Subject: subject, Method: auth.MethodAPIKey}))
+	}
+
+	// Uploads, reads, attribute queries, image renders, exports and listings
+	// are audited
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	r := request(http.MethodPost, "/dicoms", "reporting", bytes.NewReader(b))
+	r.Header.Set("Content-Type", "application/dicom")
+	h.Upload(w, r)
+	assert.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	for _, handle := range []http.HandlerFunc{h.Read, h.Attributes, h.Image, h.File} {
+		handle(httptest.NewRecorder(), request(http.MethodGet, "/dicoms/"+testID+"?tag=(0010,0020)", "reporting", nil))
+	}
+	h.List(httptest.NewRecorder(), request(http.MethodGet, "/dicoms", "reporting", nil))
+
+	// Forbidden reads are audited as failures
+	h.Read(httptest.NewRecorder(), request(http.MethodGet, "/dicoms/"+testID, "stranger", nil))
+	assert.NoError(t, auditLog.Close())
+
+	b, err = os.ReadFile(file)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if assert.Len(t, lines, 7) {
+		for i, action := range []string{"create", "read", "query", "render", "export", "query", "read"} {
+			assert.Contains(t, lines[i], fmt.Sprintf(`<EventTypeCode csd-code="%s"`, action))
+		}
+		for _, line := range lines[:5] {
+			assert.Contains(t, line, `UserID="reporting"`)
+			assert.Contains(t, line, `EventOutcomeIndicator="0"`)
+			assert.Contains(t, line, testID)
+		}
+		assert.Contains(t, lines[2], "<ParticipantObjectQuery>")
+		assert.Contains(t, lines[5], `UserID="reporting"`)
+		assert.Contains(t, lines[5], `ParticipantObjectID="/dicoms"`)
+		assert.Contains(t, lines[6], `UserID="stranger"`)
+		assert.Contains(t, lines[6], `EventOutcomeIndicator="4"`)
+	}
+}
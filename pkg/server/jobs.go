@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/johnmarkli/dime/pkg/jobs"
+)
+
+// JobsHandler handles requests for ingest jobs
+type JobsHandler struct {
+	queue *jobs.Queue
+}
+
+// NewJobsHandler returns a new JobsHandler
+func NewJobsHandler(queue *jobs.Queue) *JobsHandler {
+	return &JobsHandler{queue}
+}
+
+// Read an ingest job
+//
+//	@Summary		Read an ingest job
+//	@Description	Read the progress of an ingest job and the result of each file ingested
+//	@Tags			jobs
+//	@Produce		json
+//	@Param			id	path		string	true	"Job ID"
+//	@Success		200	{object}	jobs.Job
+//	@Failure		404	{object}	string
+//	@Failure		500	{object}	string
+//	@Router			/jobs/{id} [get]
+func (j *JobsHandler) Read(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Get job
+	id := mux.Vars(r)["id"]
+	job, err := j.queue.Get(id)
+	if err != nil {
+		panic(err)
+	}
+
+	// Return job info
+	var jsonBytes []byte
+	jsonBytes, err = json.Marshal(job)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
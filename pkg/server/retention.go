@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/johnmarkli/dime/pkg/retention"
+)
+
+// RetentionHandler handles requests for the retention of studies
+type RetentionHandler struct {
+	manager *retention.Manager
+}
+
+// HoldRequest is a request to place a legal hold on a study
+type HoldRequest struct {
+	Reason string `json:"reason" example:"litigation 2024-117"`
+}
+
+// NewRetentionHandler returns a new RetentionHandler
+func NewRetentionHandler(manager *retention.Manager) *RetentionHandler {
+	return &RetentionHandler{manager}
+}
+
+// Report expired studies
+//
+//	@Summary		Report expired studies
+//	@Description	Dry run the retention rules, reporting the studies that have expired and would be deleted or archived
+//	@Tags			retention
+//	@Produce		json
+//	@Success		200	{object}	retention.Report
+//	@Failure		500	{object}	string
+//	@Router			/retention/report [get]
+func (rh *RetentionHandler) Report(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Evaluate retention rules
+	report, err := rh.manager.Evaluate(true)
+	if err != nil {
+		panic(err)
+	}
+
+	// Return report
+	jsonBytes, err := json.Marshal(report)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
+// Read the retention record of a study
+//
+//	@Summary		Read the retention record of a study
+//	@Description	Read when a study was ingested, its labels and its legal hold
+//	@Tags			retention
+//	@Produce		json
+//	@Param			uid	path		string	true	"Study Instance UID"
+//	@Success		200	{object}	retention.Study
+//	@Failure		404	{object}	string
+//	@Failure		500	{object}	string
+//	@Router			/retention/studies/{uid} [get]
+func (rh *RetentionHandler) Read(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Get study
+	study, err := rh.manager.Get(mux.Vars(r)["uid"])
+	if err != nil {
+		panic(err)
+	}
+	writeStudy(w, study)
+}
+
+// Hold a study
+//
+//	@Summary		Hold a study
+//	@Description	Place a legal hold on a study that blocks it from being deleted or archived until it is released
+//	@Tags			retention
+//	@Accept			json
+//	@Produce		json
+//	@Param			uid		path		string		true	"Study Instance UID"
+//	@Param			request	body		HoldRequest	true	"Reason for the hold"
+//	@Success		200		{object}	retention.Study
+//	@Failure		400		{object}	string
+//	@Failure		500		{object}	string
+//	@Router			/retention/studies/{uid}/hold [put]
+func (rh *RetentionHandler) Hold(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	var req HoldRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		panic(fmt.Errorf("failed to decode hold request: %w", err))
+	}
+
+	// Hold study
+	study, err := rh.manager.Hold(mux.Vars(r)["uid"], req.Reason)
+	if err != nil {
+		panic(err)
+	}
+	writeStudy(w, study)
+}
+
+// Release a study
+//
+//	@Summary		Release a study
+//	@Description	Release the legal hold on a study
+//	@Tags			retention
+//	@Produce		json
+//	@Param			uid	path		string	true	"Study Instance UID"
+//	@Success		200	{object}	retention.Study
+//	@Failure		400	{object}	string
+//	@Failure		500	{object}	string
+//	@Router			/retention/studies/{uid}/hold [delete]
+func (rh *RetentionHandler) Release(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Release study
+	study, err := rh.manager.Release(mux.Vars(r)["uid"])
+	if err != nil {
+		panic(err)
+	}
+	writeStudy(w, study)
+}
+
+// Label a study
+//
+//	@Summary		Label a study
+//	@Description	Replace the labels of a study that retention rules match
+//	@Tags			retention
+//	@Accept			json
+//	@Produce		json
+//	@Param			uid		path		string		true	"Study Instance UID"
+//	@Param			labels	body		[]string	true	"Labels of the study"
+//	@Success		200		{object}	retention.Study
+//	@Failure		400		{object}	string
+//	@Failure		500		{object}	string
+//	@Router			/retention/studies/{uid}/labels [put]
+func (rh *RetentionHandler) Label(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	var labels []string
+	err := json.NewDecoder(r.Body).Decode(&labels)
+	if err != nil {
+		panic(fmt.Errorf("failed to decode labels: %w", err))
+	}
+
+	// Label study
+	study, err := rh.manager.Label(mux.Vars(r)["uid"], labels)
+	if err != nil {
+		panic(err)
+	}
+	writeStudy(w, study)
+}
+
+func writeStudy(w http.ResponseWriter, study *retention.Study) {
+	jsonBytes, err := json.Marshal(study)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
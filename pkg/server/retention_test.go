@@ -0,0 +1,108 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/johnmarkli/dime/pkg/retention"
+	"github.com/johnmarkli/dime/pkg/server"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testStudyUID = "1.2.840.114202.4.833393677.4209323108.691055951.3610221745"
+)
+
+func TestRetentionHandler(t *testing.T) {
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	cfg := &retention.Config{
+		Rules: []retention.Rule{
+			{Name: "old", Since: retention.SinceStudyDate, MaxAgeDays: 30},
+		},
+	}
+	manager, err := retention.New(t.TempDir(), st, cfg)
+	assert.NoError(t, err)
+
+	// Upload a DICOM that is recorded
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/dicoms", bytes.NewReader(b))
+	r.Header.Add("Content-Type", "application/dicom")
+	server.NewDICOMHandler(manager.Wrap(st)).Upload(w, r)
+	assert.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	// GET /retention/studies/{uid}
+	h := server.NewRetentionHandler(manager)
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/retention/studies/"+testStudyUID, nil)
+	r = mux.SetURLVars(r, map[string]string{"uid": testStudyUID})
+	h.Read(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var study retention.Study
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&study))
+	assert.Equal(t, testStudyUID, study.StudyInstanceUID)
+
+	// PUT /retention/studies/{uid}/labels
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPut, "/retention/studies/"+testStudyUID+"/labels", strings.NewReader(`["research"]`))
+	r = mux.SetURLVars(r, map[string]string{"uid": testStudyUID})
+	h.Label(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&study))
+	assert.Equal(t, []string{"research"}, study.Labels)
+
+	// PUT /retention/studies/{uid}/hold
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPut, "/retention/studies/"+testStudyUID+"/hold", strings.NewReader(`{"reason": "litigation"}`))
+	r = mux.SetURLVars(r, map[string]string{"uid": testStudyUID})
+	h.Hold(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&study))
+	assert.Equal(t, "litigation", study.Hold.Reason)
+
+	// GET /retention/report
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/retention/report", nil)
+	h.Report(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var report retention.Report
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&report))
+	assert.True(t, report.DryRun)
+	assert.Len(t, report.Expired, 1)
+	assert.True(t, report.Expired[0].Held)
+
+	// DELETE /retention/studies/{uid}/hold
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodDelete, "/retention/studies/"+testStudyUID+"/hold", nil)
+	r = mux.SetURLVars(r, map[string]string{"uid": testStudyUID})
+	h.Release(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var released retention.Study
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&released))
+	assert.Nil(t, released.Hold)
+
+	// The dry run deleted nothing
+	_, err = st.Read(testID)
+	assert.NoError(t, err)
+
+	// Unknown and invalid studies
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/retention/studies/1.2.3", nil)
+	r = mux.SetURLVars(r, map[string]string{"uid": "1.2.3"})
+	h.Read(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPut, "/retention/studies/x/hold", strings.NewReader(`{}`))
+	r = mux.SetURLVars(r, map[string]string{"uid": "x"})
+	h.Hold(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
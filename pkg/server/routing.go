@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/johnmarkli/dime/pkg/route"
+)
+
+// RoutingHandler handles requests for transfers of DICOMs to downstream
+// destinations
+type RoutingHandler struct {
+	router *route.Router
+}
+
+// NewRoutingHandler returns a new RoutingHandler
+func NewRoutingHandler(router *route.Router) *RoutingHandler {
+	return &RoutingHandler{router}
+}
+
+// List transfers
+//
+//	@Summary		List transfers
+//	@Description	List the transfers of DICOMs to downstream destinations that are pending or failed
+//	@Tags			routing
+//	@Produce		json
+//	@Param			state	query		string	false	"Only list transfers in a state"	Enums(pending, failed)
+//	@Success		200		{array}		route.Transfer
+//	@Failure		500		{object}	string
+//	@Router			/routing/transfers [get]
+func (rh *RoutingHandler) List(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Get transfers
+	transfers := rh.router.List(route.State(r.URL.Query().Get("state")))
+
+	// Return transfers
+	jsonBytes, err := json.Marshal(transfers)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
+// Read a transfer
+//
+//	@Summary		Read a transfer
+//	@Description	Read a pending or failed transfer of a DICOM to a downstream destination
+//	@Tags			routing
+//	@Produce		json
+//	@Param			id	path		string	true	"Transfer ID"
+//	@Success		200	{object}	route.Transfer
+//	@Failure		404	{object}	string
+//	@Failure		500	{object}	string
+//	@Router			/routing/transfers/{id} [get]
+func (rh *RoutingHandler) Read(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Get transfer
+	id := mux.Vars(r)["id"]
+	transfer, err := rh.router.Get(id)
+	if err != nil {
+		panic(err)
+	}
+
+	// Return transfer
+	var jsonBytes []byte
+	jsonBytes, err = json.Marshal(transfer)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
+// Retry a transfer
+//
+//	@Summary		Retry a transfer
+//	@Description	Retry a transfer now. A failed transfer is given a fresh set of attempts.
+//	@Tags			routing
+//	@Produce		json
+//	@Param			id	path		string	true	"Transfer ID"
+//	@Success		200	{object}	route.Transfer
+//	@Failure		404	{object}	string
+//	@Failure		500	{object}	string
+//	@Router			/routing/transfers/{id}/retry [post]
+func (rh *RoutingHandler) Retry(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Retry transfer
+	id := mux.Vars(r)["id"]
+	transfer, err := rh.router.Retry(id)
+	if err != nil {
+		panic(err)
+	}
+
+	// Return transfer
+	var jsonBytes []byte
+	jsonBytes, err = json.Marshal(transfer)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
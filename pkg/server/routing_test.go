@@ -0,0 +1,87 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/johnmarkli/dime/pkg/route"
+	"github.com/johnmarkli/dime/pkg/server"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutingHandler(t *testing.T) {
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	cfg := &route.Config{
+		Destinations: []route.Destination{
+			{Name: "pacs", Type: route.TypeDIMSE, Address: "127.0.0.1:104", AETitle: "PACS"},
+		},
+		Rules: []route.Rule{
+			{Name: "mr", Match: route.Match{Modality: "MR"}, Destinations: []string{"pacs"}},
+		},
+	}
+	// The router is not started so transfers remain pending
+	router, err := route.New(t.TempDir(), st, cfg)
+	assert.NoError(t, err)
+
+	// Upload a DICOM that is routed
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/dicoms", bytes.NewReader(b))
+	r.Header.Add("Content-Type", "application/dicom")
+	server.NewDICOMHandler(st, server.WithHook(router.Route)).Upload(w, r)
+	assert.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	// GET /routing/transfers
+	h := server.NewRoutingHandler(router)
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/routing/transfers?state=pending", nil)
+	h.List(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var transfers []route.Transfer
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&transfers))
+	assert.Len(t, transfers, 1)
+	assert.Equal(t, testID, transfers[0].DICOMID)
+	assert.Equal(t, "pacs", transfers[0].Destination)
+	assert.Equal(t, "mr", transfers[0].Rule)
+	assert.Equal(t, route.StatePending, transfers[0].State)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/routing/transfers?state=failed", nil)
+	h.List(w, r)
+	body, err := io.ReadAll(w.Result().Body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, "[]", string(body))
+
+	// GET /routing/transfers/:id
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/routing/transfers/"+transfers[0].ID, nil)
+	r = mux.SetURLVars(r, map[string]string{"id": transfers[0].ID})
+	h.Read(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var transfer route.Transfer
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&transfer))
+	assert.Equal(t, transfers[0].ID, transfer.ID)
+
+	// POST /routing/transfers/:id/retry
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/routing/transfers/"+transfers[0].ID+"/retry", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": transfers[0].ID})
+	h.Retry(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	// Unknown transfers are not found
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/routing/transfers/unknown", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": "unknown"})
+	h.Read(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
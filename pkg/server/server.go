@@ -6,23 +6,92 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	_ "github.com/johnmarkli/dime/docs" // docs generated by Swag CLI
+	"github.com/johnmarkli/dime/pkg/audit"
+	"github.com/johnmarkli/dime/pkg/auth"
+	"github.com/johnmarkli/dime/pkg/certs"
+	"github.com/johnmarkli/dime/pkg/changes"
+	"github.com/johnmarkli/dime/pkg/coerce"
+	"github.com/johnmarkli/dime/pkg/ingest"
+	"github.com/johnmarkli/dime/pkg/jobs"
+	"github.com/johnmarkli/dime/pkg/quota"
+	"github.com/johnmarkli/dime/pkg/rbac"
+	"github.com/johnmarkli/dime/pkg/replica"
+	"github.com/johnmarkli/dime/pkg/retention"
+	"github.com/johnmarkli/dime/pkg/route"
+	"github.com/johnmarkli/dime/pkg/stability"
 	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/johnmarkli/dime/pkg/validate"
+	"github.com/johnmarkli/dime/pkg/watch"
+	"github.com/johnmarkli/dime/pkg/webhook"
 	httpSwagger "github.com/swaggo/http-swagger/v2"
 )
 
 const (
-	defaultPort    = 8080
-	defaultDataDir = "data"
+	defaultPort             = 8080
+	defaultDataDir          = "data"
+	defaultIngestWorkers    = 4
+	defaultIngestQueueLen   = 100
+	defaultInboxInterval    = 5 * time.Second
+	defaultRouteAttempts    = 10
+	defaultRouteBackoff     = 30 * time.Second
+	defaultScrubRate        = 10
+	defaultScrubInterval    = 24 * time.Hour
+	defaultRetentionEvery   = time.Hour
+	defaultMinFree          = 1 << 28 // 256MB
+	defaultTierMaxIdle      = 90 * 24 * time.Hour
+	defaultTierInterval     = time.Hour
+	defaultRecompressRate   = 10
+	defaultReplicateEvery   = 5 * time.Second
+	defaultReplicateTimeout = 5 * time.Minute
+	defaultWebhookTries     = 10
+	defaultWebhookBackoff   = 30 * time.Second
+	defaultStableAfter      = 5 * time.Minute
+	defaultTLSInterval      = 30 * time.Second
+	defaultDeleteRetention  = 30 * 24 * time.Hour
+	storeFile               = "file"
+	storeS3                 = "s3"
+	jobsDir                 = "jobs"
+	routesDir               = "routes"
+	retentionDir            = "retention"
+	quotaDir                = "quota"
+	tiersDir                = "tiers"
+	changesDir              = "changes"
+	replicationDir          = "replication"
+	webhooksDir             = "webhooks"
+	stabilityDir            = "stability"
+	inboxArchiveDir         = "inbox/archive"
+	inboxErrorDir           = "inbox/error"
+	inboxSource             = "inbox"
 )
 
 // Server manages the lifecycle of the dime server
 type Server struct {
-	server *http.Server
+	server     *http.Server
+	queue      *jobs.Queue
+	watcher    *watch.Watcher
+	router     *route.Router
+	scrubber   *store.Scrubber
+	retention  *retention.Manager
+	quota      *quota.Manager
+	tiered     *store.TieredStore
+	recompress []*store.Recompressor
+	backup     *store.OnlineBackup
+	changes    *changes.Log
+	replicator *replica.Replicator
+	webhooks   *webhook.Dispatcher
+	stability  *stability.Tracker
+	audit      *audit.Logger
+	tls        *certs.Reloader
 }
 
 // New creates a new Server instance
@@ -33,9 +102,158 @@ type Server struct {
 //	    int - port for server to listen on
 //	DIME_DATA_DIR
 //	    string - directory to save data to the file system
+//	DIME_STORE
+//	    string - file or s3 storage of DICOMs and images
+//	DIME_S3_ENDPOINT
+//	    string - URL of the S3-compatible object storage service
+//	DIME_S3_REGION
+//	    string - region of the S3 bucket
+//	DIME_S3_BUCKET
+//	    string - S3 bucket to store DICOMs and images in
+//	DIME_S3_PREFIX
+//	    string - prefix of the S3 object keys
+//	DIME_S3_ACCESS_KEY_ID
+//	    string - S3 access key ID, defaults to AWS_ACCESS_KEY_ID
+//	DIME_S3_SECRET_ACCESS_KEY
+//	    string - S3 secret access key, defaults to AWS_SECRET_ACCESS_KEY
+//	DIME_S3_SESSION_TOKEN
+//	    string - S3 session token, defaults to AWS_SESSION_TOKEN
+//	DIME_S3_PATH_STYLE
+//	    bool - address the S3 bucket in the path instead of the host name
+//	DIME_S3_PART_SIZE
+//	    int - size in bytes of each part of a multipart upload to S3
+//	DIME_COMPRESSION
+//	    string - none or deflate to losslessly compress DICOM files in the data directory
+//	DIME_RECOMPRESS_RATE
+//	    int - DICOM files per second checked to compress those stored uncompressed, 0 to disable
+//	DIME_TIER_COLD_DIR
+//	    string - directory of the cold tier that idle studies are migrated to
+//	DIME_TIER_COLD_COMPRESSION
+//	    string - none or deflate to losslessly compress DICOM files in the cold tier, defaults to DIME_COMPRESSION
+//	DIME_TIER_MAX_IDLE
+//	    duration - how long a study is not accessed before it is migrated to the cold tier
+//	DIME_TIER_INTERVAL
+//	    duration - how often to migrate idle studies to the cold tier
+//	DIME_BACKUP_DIR
+//	    string - directory of snapshots of the data directory taken with POST /admin/backup
+//	DIME_CHANGES_DELETE_RETENTION
+//	    duration - how long deletes are kept in the change feed once compaction would drop them
+//	DIME_REPLICATE_FROM
+//	    string - URL of a primary dime server to replicate DICOMs from
+//	DIME_REPLICATION_INTERVAL
+//	    duration - how often to pull the change feed of the primary once caught up
+//	DIME_REPLICATION_TIMEOUT
+//	    duration - how long a request to the primary may take before it fails
+//	DIME_WEBHOOKS
+//	    string - JSON file of webhook subscriptions that events are delivered to
+//	DIME_WEBHOOK_MAX_ATTEMPTS
+//	    int - number of attempts to deliver an event before giving up
+//	DIME_WEBHOOK_BACKOFF
+//	    duration - delay before retrying a failed delivery, doubling each attempt
+//	DIME_STABLE_AFTER
+//	    duration - how long a series or study receives no instances before it is stable
+//	DIME_ENCRYPTION_KEY_FILE
+//	    string - JSON file of keys that DICOMs and images are encrypted at rest with
+//	DIME_MAX_UPLOAD_SIZE
+//	    int - maximum size in bytes of an uploaded DICOM
+//	DIME_MAX_ARCHIVE_SIZE
+//	    int - maximum size in bytes of an uploaded archive
+//	DIME_MAX_ARCHIVE_UNCOMPRESSED_SIZE
+//	    int - maximum total size in bytes of the files in an archive once decompressed
+//	DIME_MAX_ARCHIVE_ENTRIES
+//	    int - maximum number of entries in an archive
+//	DIME_IMPORT_DIR
+//	    string - directory that DICOMs can be imported from on the server
+//	DIME_VALIDATION_POLICY
+//	    string - accept, warn or reject DICOMs that fail IOD validation on ingest
+//	DIME_COERCION_RULES
+//	    string - JSON file of rules that coerce attributes on ingest
+//	DIME_TRUSTED_PROXIES
+//	    string - comma separated addresses or CIDRs of proxies trusted to set the X-Dime-Source and X-Dime-Tenant headers
+//	DIME_INGEST_WORKERS
+//	    int - number of workers ingesting queued uploads
+//	DIME_INGEST_QUEUE_SIZE
+//	    int - maximum number of queued uploads
+//	DIME_INBOX_DIR
+//	    string - directory to watch for DICOMs to ingest
+//	DIME_INBOX_ARCHIVE_DIR
+//	    string - directory to move ingested inbox files to
+//	DIME_INBOX_ERROR_DIR
+//	    string - directory to move inbox files that failed to ingest to
+//	DIME_INBOX_INTERVAL
+//	    duration - how often to poll the inbox directory
+//	DIME_ROUTING_RULES
+//	    string - JSON file of destinations and rules that forward DICOMs
+//	DIME_ROUTING_MAX_ATTEMPTS
+//	    int - number of attempts to forward a DICOM before giving up
+//	DIME_ROUTING_BACKOFF
+//	    duration - delay before retrying a failed forward, doubling each attempt
+//	DIME_SCRUB_RATE
+//	    int - DICOM files per second the scrubber verifies, 0 to disable scrubbing
+//	DIME_SCRUB_INTERVAL
+//	    duration - delay between scrubbing passes over the file store
+//	DIME_RETENTION_RULES
+//	    string - JSON file of rules that expire studies
+//	DIME_RETENTION_INTERVAL
+//	    duration - how often to evaluate the retention rules
+//	DIME_RETENTION_ARCHIVE_DIR
+//	    string - directory to archive expired studies to
+//	DIME_QUOTAS
+//	    string - JSON file of the global and per-tenant storage quotas in bytes
+//	DIME_MIN_FREE_BYTES
+//	    int - bytes to keep free on the disk of the data directory, 0 to disable the check
+//	DIME_EVICT_IMAGES
+//	    bool - evict the least recently used PNG images before rejecting uploads for lack of disk
+//	DIME_API_KEYS
+//	    string - JSON file of API keys that authenticate requests in the X-API-Key header
+//	DIME_JWKS_FILE
+//	    string - JWKS file of keys that verify JWT bearer tokens
+//	DIME_JWT_ISSUER
+//	    string - issuer that JWT bearer tokens must have
+//	DIME_JWT_AUDIENCE
+//	    string - audience that JWT bearer tokens must have
+//	DIME_AUTH_PUBLIC_HEALTH
+//	    bool - serve /health without authentication, defaults to true
+//	DIME_REPLICATE_API_KEY
+//	    string - API key of requests to the primary dime server
+//	DIME_RBAC
+//	    string - JSON file of the roles granted to subjects and groups within scopes of DICOMs
+//	DIME_AUDIT_LOG
+//	    string - file that audit messages of access to DICOMs are appended to
+//	DIME_AUDIT_SYSLOG
+//	    string - udp:// or tcp:// URL of a syslog collector that audit messages are sent to
+//	DIME_AUDIT_SOURCE_ID
+//	    string - audit source ID of audit messages, defaults to the host name
+//	DIME_TLS_CERT_FILE
+//	    string - PEM certificate chain that the server serves HTTPS with
+//	DIME_TLS_KEY_FILE
+//	    string - PEM private key of DIME_TLS_CERT_FILE
+//	DIME_TLS_CLIENT_CA_FILE
+//	    string - PEM CAs that verify client certificates, which then authenticate requests
+//	DIME_TLS_CLIENT_AUTH
+//	    string - none, request or require client certificates, defaults to request with DIME_TLS_CLIENT_CA_FILE
+//	DIME_TLS_RELOAD_INTERVAL
+//	    duration - how often to check the TLS files for changes and reload them
 func New() (*Server, error) {
 	router := mux.NewRouter()
 	router.Use(loggingMiddleware)
+	reloader, err := newTLS()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tls config: %w", err)
+	}
+	authenticators, err := newAuthenticators(reloader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create authenticators: %w", err)
+	}
+	public := map[string]bool{}
+	if getEnvBool("DIME_AUTH_PUBLIC_HEALTH", true) {
+		public["/health"] = true
+	}
+	if len(authenticators) > 0 {
+		router.Use(authMiddleware(authenticators, public))
+	} else if _, ok := os.LookupEnv("DIME_RBAC"); ok {
+		return nil, fmt.Errorf("DIME_RBAC requires DIME_API_KEYS, DIME_JWKS_FILE or DIME_TLS_CLIENT_CA_FILE")
+	}
 	router = router.StrictSlash(true)
 	port := getPort()
 
@@ -44,21 +262,336 @@ func New() (*Server, error) {
 	router.HandleFunc("/health", hh.Check).Methods("GET")
 
 	// /dicoms API
-	st, err := store.NewFileStore(getDataDir())
+	dataDir := getDataDir()
+	st, err := newStore(dataDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create store: %w", err)
 	}
-	dh := NewDICOMHandler(st)
+	base := st
+	if es, ok := st.(*store.EncryptedStore); ok {
+		base = es.Unwrap()
+	}
+	tiered, _ := base.(*store.TieredStore)
+	if tiered != nil {
+		base = tiered.Hot()
+	}
+	fileStore, _ := base.(*store.FileStore)
+
+	// Quotas and disk pressure
+	quotaOpts := []quota.Option{
+		quota.WithMinFree(int64(getEnvInt("DIME_MIN_FREE_BYTES", defaultMinFree))),
+	}
+	if file, ok := os.LookupEnv("DIME_QUOTAS"); ok {
+		cfg, err := quota.Load(file)
+		if err != nil {
+			return nil, err
+		}
+		quotaOpts = append(quotaOpts, quota.WithConfig(cfg))
+	}
+	if fileStore != nil && getEnvBool("DIME_EVICT_IMAGES", false) {
+		quotaOpts = append(quotaOpts, quota.WithEvictor(fileStore.EvictImages))
+	}
+	quotas, err := quota.New(filepath.Join(dataDir, quotaDir), quotaOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create quotas: %w", err)
+	}
+	if quotas.Empty() {
+		n, err := quotas.Backfill(st)
+		if err != nil {
+			return nil, fmt.Errorf("failed to backfill quota usage: %w", err)
+		}
+		if n > 0 {
+			slog.Info("Backfilled quota usage", slog.Int("dicoms", n))
+		}
+	}
+	st = quotas.Wrap(st)
+
+	// Change feed of the store
+	changeLog, err := changes.New(filepath.Join(dataDir, changesDir),
+		changes.WithDeleteRetention(getEnvDuration("DIME_CHANGES_DELETE_RETENTION", defaultDeleteRetention)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create change log: %w", err)
+	}
+	if changeLog.Last() == 0 {
+		n, err := changeLog.Backfill(st)
+		if err != nil {
+			return nil, fmt.Errorf("failed to backfill change log: %w", err)
+		}
+		if n > 0 {
+			slog.Info("Backfilled change log", slog.Int("dicoms", n))
+		}
+	}
+	st = changeLog.Wrap(st)
+
+	// Audit log of access to DICOMs
+	auditLog, err := newAuditLog()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create audit log: %w", err)
+	}
+
+	maxUploadSize := getMaxUploadSize()
+	proxies, err := getTrustedProxies()
+	if err != nil {
+		return nil, err
+	}
+	archiveLimits := ingest.ArchiveLimits{
+		Size:             getEnvInt64("DIME_MAX_ARCHIVE_SIZE", 0),
+		UncompressedSize: getEnvInt64("DIME_MAX_ARCHIVE_UNCOMPRESSED_SIZE", 0),
+		Entries:          getEnvInt("DIME_MAX_ARCHIVE_ENTRIES", 0),
+	}
+	policy, err := validate.ParsePolicy(getEnvString("DIME_VALIDATION_POLICY", string(validate.PolicyWarn)))
+	if err != nil {
+		return nil, err
+	}
+	var rules *coerce.Engine
+	if file, ok := os.LookupEnv("DIME_COERCION_RULES"); ok {
+		rules, err = coerce.Load(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Routing to downstream destinations
+	var routing *route.Router
+	var hooks []ingest.Hook
+	if file, ok := os.LookupEnv("DIME_ROUTING_RULES"); ok {
+		cfg, err := route.Load(file)
+		if err != nil {
+			return nil, err
+		}
+		routeOpts := []route.Option{
+			route.WithMaxAttempts(getEnvInt("DIME_ROUTING_MAX_ATTEMPTS", defaultRouteAttempts)),
+			route.WithBackoff(getEnvDuration("DIME_ROUTING_BACKOFF", defaultRouteBackoff)),
+		}
+		if auditLog != nil {
+			routeOpts = append(routeOpts, route.WithAuditor(auditLog))
+		}
+		if reloader != nil {
+			routeOpts = append(routeOpts, route.WithTLS(reloader.ClientConfig()))
+		}
+		routing, err = route.New(filepath.Join(dataDir, routesDir), st, cfg, routeOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create router: %w", err)
+		}
+		hooks = append(hooks, routing.Route)
+	}
+
+	// Webhooks of events in the store
+	var dispatcher *webhook.Dispatcher
+	stabilityOpts := []stability.Option{
+		stability.WithQuietPeriod(getEnvDuration("DIME_STABLE_AFTER", defaultStableAfter)),
+	}
+	if file, ok := os.LookupEnv("DIME_WEBHOOKS"); ok {
+		cfg, err := webhook.Load(file)
+		if err != nil {
+			return nil, err
+		}
+		dispatcher, err = webhook.New(filepath.Join(dataDir, webhooksDir), changeLog, cfg,
+			webhook.WithMaxAttempts(getEnvInt("DIME_WEBHOOK_MAX_ATTEMPTS", defaultWebhookTries)),
+			webhook.WithBackoff(getEnvDuration("DIME_WEBHOOK_BACKOFF", defaultWebhookBackoff)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create webhook dispatcher: %w", err)
+		}
+		stabilityOpts = append(stabilityOpts,
+			stability.WithHook(notifySeriesStable(dispatcher)),
+			stability.WithStudyHook(notifyStudyStable(dispatcher)))
+	}
+
+	// Stability of series and studies
+	tracker, err := stability.New(filepath.Join(dataDir, stabilityDir), changeLog, stabilityOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stability tracker: %w", err)
+	}
+
+	// Retention of studies
+	var manager *retention.Manager
+	if file, ok := os.LookupEnv("DIME_RETENTION_RULES"); ok {
+		cfg, err := retention.Load(file)
+		if err != nil {
+			return nil, err
+		}
+		opts := []retention.Option{
+			retention.WithInterval(getEnvDuration("DIME_RETENTION_INTERVAL", defaultRetentionEvery)),
+		}
+		if dir, ok := os.LookupEnv("DIME_RETENTION_ARCHIVE_DIR"); ok {
+			archive, err := store.NewFileStore(dir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create archive: %w", err)
+			}
+			opts = append(opts, retention.WithArchive(archive))
+		}
+		manager, err = retention.New(filepath.Join(dataDir, retentionDir), auditStore(auditLog, st, "retention", ""), cfg, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create retention manager: %w", err)
+		}
+		st = manager.Wrap(st)
+	}
+
+	// Authorization of requests by role
+	var authorizer *rbac.Authorizer
+	if file, ok := os.LookupEnv("DIME_RBAC"); ok {
+		authorizer, err = newAuthorizer(file, manager)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create authorizer: %w", err)
+		}
+		router.Use(rbacMiddleware(authorizer, public))
+	}
+
+	ingestOpts := []ingest.Option{
+		ingest.WithMaxSize(maxUploadSize),
+		ingest.WithArchiveLimits(archiveLimits),
+		ingest.WithValidation(policy),
+		ingest.WithRules(rules),
+	}
+	handlerOpts := []DICOMHandlerOption{
+		WithMaxUploadSize(maxUploadSize),
+		WithArchiveLimits(archiveLimits),
+		WithImportDir(os.Getenv("DIME_IMPORT_DIR")),
+		WithValidation(policy),
+		WithRules(rules),
+		WithQuota(quotas),
+		WithAuthorizer(authorizer),
+		WithTrustedProxies(proxies),
+	}
+	if auditLog != nil {
+		ingestOpts = append(ingestOpts, ingest.WithAuditor(auditLog))
+		handlerOpts = append(handlerOpts, WithAudit(auditLog))
+	}
+	for _, hook := range hooks {
+		ingestOpts = append(ingestOpts, ingest.WithHook(hook))
+		handlerOpts = append(handlerOpts, WithHook(hook))
+	}
+	ingester := ingest.New(st, ingestOpts...)
+	jobOpts := []jobs.Option{
+		jobs.WithWorkers(getEnvInt("DIME_INGEST_WORKERS", defaultIngestWorkers)),
+		jobs.WithSize(getEnvInt("DIME_INGEST_QUEUE_SIZE", defaultIngestQueueLen)),
+	}
+	if authorizer != nil {
+		jobOpts = append(jobOpts, jobs.WithAuthorize(authorizeCreate(authorizer, st)))
+	}
+	queue, err := jobs.New(filepath.Join(dataDir, jobsDir), ingester, jobOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ingest queue: %w", err)
+	}
+	dh := NewDICOMHandler(st, append(handlerOpts, WithQueue(queue))...)
 	dicomsRouter := router.PathPrefix("/dicoms").Subrouter()
 	dicomsRouter.HandleFunc("", dh.Upload).Methods("POST")
+	dicomsRouter.HandleFunc("/import", dh.Import).Methods("POST")
 	dicomsRouter.HandleFunc("", dh.List).Methods("GET")
 	dicomsRouter.HandleFunc("/{id}", dh.Read).Methods("GET")
 	dicomsRouter.HandleFunc("/{id}/attributes", dh.Attributes).Methods("GET")
 	dicomsRouter.HandleFunc("/{id}/image", dh.Image).Methods("GET")
+	dicomsRouter.HandleFunc("/{id}/file", dh.File).Methods("GET")
+	dicomsRouter.HandleFunc("/{id}/validation", dh.Validation).Methods("GET")
+	dicomsRouter.HandleFunc("/{id}/coercion", dh.Coercion).Methods("GET")
+
+	// /changes API
+	ch := NewChangesHandler(changeLog)
+	router.HandleFunc("/changes", ch.List).Methods("GET")
+	router.HandleFunc("/changes/stream", ch.Stream).Methods("GET")
+
+	// /jobs API
+	jh := NewJobsHandler(queue)
+	router.HandleFunc("/jobs/{id}", jh.Read).Methods("GET")
+
+	// /routing API
+	if routing != nil {
+		rh := NewRoutingHandler(routing)
+		router.HandleFunc("/routing/transfers", rh.List).Methods("GET")
+		router.HandleFunc("/routing/transfers/{id}", rh.Read).Methods("GET")
+		router.HandleFunc("/routing/transfers/{id}/retry", rh.Retry).Methods("POST")
+	}
+
+	// /webhooks API
+	if dispatcher != nil {
+		wh := NewWebhooksHandler(dispatcher)
+		router.HandleFunc("/webhooks/deliveries", wh.List).Methods("GET")
+		router.HandleFunc("/webhooks/deliveries/{id}", wh.Read).Methods("GET")
+		router.HandleFunc("/webhooks/deliveries/{id}/retry", wh.Retry).Methods("POST")
+	}
+
+	// /stability API
+	sh := NewStabilityHandler(tracker)
+	router.HandleFunc("/stability/studies", sh.ListStudies).Methods("GET")
+	router.HandleFunc("/stability/studies/{uid}", sh.ReadStudy).Methods("GET")
+	router.HandleFunc("/stability/studies/{uid}/series", sh.ListSeries).Methods("GET")
+	router.HandleFunc("/stability/series/{uid}", sh.ReadSeries).Methods("GET")
+
+	// /retention API
+	if manager != nil {
+		rh := NewRetentionHandler(manager)
+		router.HandleFunc("/retention/report", rh.Report).Methods("GET")
+		router.HandleFunc("/retention/studies/{uid}", rh.Read).Methods("GET")
+		router.HandleFunc("/retention/studies/{uid}/hold", rh.Hold).Methods("PUT")
+		router.HandleFunc("/retention/studies/{uid}/hold", rh.Release).Methods("DELETE")
+		router.HandleFunc("/retention/studies/{uid}/labels", rh.Label).Methods("PUT")
+	}
+
+	// /admin API
+	var scrubber *store.Scrubber
+	if fileStore != nil {
+		if rate := getEnvInt("DIME_SCRUB_RATE", defaultScrubRate); rate > 0 {
+			scrubber = store.NewScrubber(fileStore, rate, getEnvDuration("DIME_SCRUB_INTERVAL", defaultScrubInterval))
+		}
+	}
+	var recompress []*store.Recompressor
+	if rate := getEnvInt("DIME_RECOMPRESS_RATE", defaultRecompressRate); rate > 0 {
+		if fileStore != nil && getEnvString("DIME_COMPRESSION", store.CompressionNone) != store.CompressionNone {
+			recompress = append(recompress, store.NewRecompressor(fileStore, rate))
+		}
+		if tiered != nil {
+			if cold, ok := tiered.Cold().(*store.FileStore); ok && coldCompression() != store.CompressionNone {
+				recompress = append(recompress, store.NewRecompressor(cold, rate))
+			}
+		}
+	}
+	var backup *store.OnlineBackup
+	if dir, ok := os.LookupEnv("DIME_BACKUP_DIR"); ok && fileStore != nil {
+		backup = store.NewOnlineBackup(dataDir, dir)
+	}
+	var replicator *replica.Replicator
+	if primary, ok := os.LookupEnv("DIME_REPLICATE_FROM"); ok {
+		opts := []replica.Option{
+			replica.WithInterval(getEnvDuration("DIME_REPLICATION_INTERVAL", defaultReplicateEvery)),
+			replica.WithClient(&http.Client{Timeout: getEnvDuration("DIME_REPLICATION_TIMEOUT", defaultReplicateTimeout)}),
+		}
+		if key, ok := os.LookupEnv("DIME_REPLICATE_API_KEY"); ok {
+			opts = append(opts, replica.WithHeaders(map[string]string{auth.APIKeyHeader: key}))
+		}
+		host := primary
+		if u, err := url.Parse(primary); err == nil && u.Hostname() != "" {
+			host = u.Hostname()
+		}
+		replicator, err = replica.New(primary, auditStore(auditLog, st, "replication", host),
+			filepath.Join(dataDir, replicationDir), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create replicator: %w", err)
+		}
+	}
+	ah := NewAdminHandler(scrubber, quotas, tiered, recompress, backup, replicator)
+	if scrubber != nil {
+		router.HandleFunc("/admin/scrub", ah.Scrub).Methods("GET")
+	}
+	if tiered != nil {
+		router.HandleFunc("/admin/tiers", ah.Tiers).Methods("GET")
+	}
+	router.HandleFunc("/admin/usage", ah.Usage).Methods("GET")
+	router.HandleFunc("/admin/compression", ah.Compression).Methods("GET")
+	if replicator != nil {
+		router.HandleFunc("/admin/replication", ah.Replication).Methods("GET")
+	}
+	if backup != nil {
+		router.HandleFunc("/admin/backup", ah.Backup).Methods("GET")
+		router.HandleFunc("/admin/backup", ah.StartBackup).Methods("POST")
+	}
 
 	// /swagger docs
+	scheme := "http"
+	if reloader != nil {
+		scheme = "https"
+	}
 	router.PathPrefix("/swagger/").Handler(httpSwagger.Handler(
-		httpSwagger.URL(fmt.Sprintf("http://localhost:%d/swagger/doc.json", port)),
+		httpSwagger.URL(fmt.Sprintf("%s://localhost:%d/swagger/doc.json", scheme, port)),
 		httpSwagger.DeepLinking(true),
 		httpSwagger.DocExpansion("none"),
 		httpSwagger.DomID("swagger-ui"),
@@ -69,6 +602,39 @@ func New() (*Server, error) {
 			Addr:    fmt.Sprintf(":%d", port),
 			Handler: router,
 		},
+		queue:      queue,
+		router:     routing,
+		scrubber:   scrubber,
+		retention:  manager,
+		quota:      quotas,
+		tiered:     tiered,
+		recompress: recompress,
+		backup:     backup,
+		changes:    changeLog,
+		replicator: replicator,
+		webhooks:   dispatcher,
+		stability:  tracker,
+		audit:      auditLog,
+		tls:        reloader,
+	}
+	if reloader != nil {
+		s.server.TLSConfig = reloader.Config()
+	}
+
+	// Long-polls and streams of the change feed never go idle, so end them
+	// when shutting down
+	s.server.RegisterOnShutdown(ch.Stop)
+
+	// Inbox watcher
+	if inbox, ok := os.LookupEnv("DIME_INBOX_DIR"); ok {
+		s.watcher, err = watch.New(inbox,
+			getEnvString("DIME_INBOX_ARCHIVE_DIR", filepath.Join(dataDir, inboxArchiveDir)),
+			getEnvString("DIME_INBOX_ERROR_DIR", filepath.Join(dataDir, inboxErrorDir)),
+			ingester.WithSource(inboxSource),
+			watch.WithInterval(getEnvDuration("DIME_INBOX_INTERVAL", defaultInboxInterval)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create inbox watcher: %w", err)
+		}
 	}
 	return s, nil
 }
@@ -76,6 +642,37 @@ func New() (*Server, error) {
 // Run the dime server
 func (s *Server) Run() {
 	slog.Info("Starting dime server", slog.String("on", s.server.Addr))
+	s.queue.Start()
+	if s.router != nil {
+		s.router.Start()
+	}
+	if s.watcher != nil {
+		s.watcher.Start()
+	}
+	if s.scrubber != nil {
+		s.scrubber.Start()
+	}
+	if s.retention != nil {
+		s.retention.Start()
+	}
+	if s.tiered != nil {
+		s.tiered.Start(getEnvDuration("DIME_TIER_INTERVAL", defaultTierInterval))
+	}
+	for _, r := range s.recompress {
+		r.Start()
+	}
+	if s.replicator != nil {
+		s.replicator.Start()
+	}
+	if s.webhooks != nil {
+		s.webhooks.Start()
+	}
+	s.stability.Start()
+	if s.tls != nil {
+		s.tls.Start()
+		go func() { _ = s.server.ListenAndServeTLS("", "") }()
+		return
+	}
 	go func() { _ = s.server.ListenAndServe() }()
 }
 
@@ -83,6 +680,43 @@ func (s *Server) Run() {
 func (s *Server) Shutdown() {
 	slog.Info("Shutting down dime server")
 	_ = s.server.Shutdown(context.Background())
+	if s.tls != nil {
+		s.tls.Stop()
+	}
+	if s.watcher != nil {
+		s.watcher.Stop()
+	}
+	s.queue.Stop()
+	if s.router != nil {
+		s.router.Stop()
+	}
+	if s.scrubber != nil {
+		s.scrubber.Stop()
+	}
+	if s.retention != nil {
+		s.retention.Stop()
+	}
+	if s.tiered != nil {
+		s.tiered.Stop()
+	}
+	for _, r := range s.recompress {
+		r.Stop()
+	}
+	if s.backup != nil {
+		s.backup.Wait()
+	}
+	if s.replicator != nil {
+		s.replicator.Stop()
+	}
+	s.stability.Stop()
+	if s.webhooks != nil {
+		s.webhooks.Stop()
+	}
+	_ = s.quota.Close()
+	_ = s.changes.Close()
+	if s.audit != nil {
+		_ = s.audit.Close()
+	}
 }
 
 // Server returns the http server
@@ -99,6 +733,179 @@ func loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// authMiddleware authenticates requests to paths that are not public and
+// adds the identity to their context
+func authMiddleware(authenticators []auth.Authenticator, public map[string]bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if public[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			id, err := auth.Authenticate(r, authenticators)
+			if err != nil {
+				slog.Warn("Request unauthenticated",
+					slog.String("method", r.Method),
+					slog.String("request", r.RequestURI),
+					slog.String("error", err.Error()))
+				auth.WriteError(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), id)))
+		})
+	}
+}
+
+// rbacMiddleware authorizes requests to paths that are not public by the
+// roles of their identity. Requests to /dicoms are authorized by the
+// DICOMHandler, which knows the DICOMs they are for.
+func rbacMiddleware(authorizer *rbac.Authorizer, public map[string]bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			action := routeAction(r.URL.Path)
+			if public[r.URL.Path] || action == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			err := authorizer.Authorize(auth.FromContext(r.Context()), action)
+			if err != nil {
+				slog.Warn("Request forbidden",
+					slog.String("method", r.Method),
+					slog.String("request", r.RequestURI),
+					slog.String("error", err.Error()))
+				auth.WriteError(w, http.StatusForbidden, err.Error())
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// routeAction returns the action of a request to a path, or an empty action
+// for /dicoms whose handler authorizes requests. Uploaders poll their jobs,
+// readers read the docs and every other route manages the server.
+func routeAction(path string) rbac.Action {
+	switch {
+	case path == "/dicoms" || strings.HasPrefix(path, "/dicoms/"):
+		return ""
+	case strings.HasPrefix(path, "/jobs/"):
+		return rbac.ActionCreate
+	case strings.HasPrefix(path, "/swagger/"):
+		return rbac.ActionRead
+	default:
+		return rbac.ActionAdmin
+	}
+}
+
+// newAuthorizer creates the authorizer of the grants in a file, scoped by the
+// labels of studies if there is a retention manager. Grants scoped by study
+// label need the retention manager, since it keeps the labels.
+func newAuthorizer(file string, manager *retention.Manager) (*rbac.Authorizer, error) {
+	cfg, err := rbac.Load(file)
+	if err != nil {
+		return nil, err
+	}
+	if manager == nil && cfg.StudyLabels() {
+		return nil, fmt.Errorf("grants scoped by study label require DIME_RETENTION_RULES")
+	}
+	var opts []rbac.Option
+	if manager != nil {
+		opts = append(opts, rbac.WithLabels(func(uid string) []string {
+			study, err := manager.Get(uid)
+			if err != nil {
+				return nil
+			}
+			return study.Labels
+		}))
+	}
+	return rbac.New(cfg, opts...)
+}
+
+// newAuditLog creates the audit log in DIME_AUDIT_LOG, sent to the syslog
+// collector at the udp:// or tcp:// URL in DIME_AUDIT_SYSLOG if it is set.
+// Access is not audited if DIME_AUDIT_LOG is not set.
+func newAuditLog() (*audit.Logger, error) {
+	file, ok := os.LookupEnv("DIME_AUDIT_LOG")
+	if !ok {
+		return nil, nil
+	}
+	var opts []audit.Option
+	if id, ok := os.LookupEnv("DIME_AUDIT_SOURCE_ID"); ok {
+		opts = append(opts, audit.WithSourceID(id))
+	}
+	if val, ok := os.LookupEnv("DIME_AUDIT_SYSLOG"); ok {
+		u, err := url.Parse(val)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid syslog URL %q", val)
+		}
+		opts = append(opts, audit.WithSyslog(u.Scheme, u.Host))
+	}
+	return audit.New(file, opts...)
+}
+
+// auditStore wraps a store so the DICOMs created in and deleted from it are
+// audited as actions of a user from a source, if there is an audit log
+func auditStore(auditLog *audit.Logger, st store.Store, user, source string) store.Store {
+	if auditLog == nil {
+		return st
+	}
+	return auditLog.Wrap(st, user, source)
+}
+
+// newTLS creates the reloader of the certificate in DIME_TLS_CERT_FILE and
+// DIME_TLS_KEY_FILE and the client CAs in DIME_TLS_CLIENT_CA_FILE. The server
+// serves plain HTTP if none is set.
+func newTLS() (*certs.Reloader, error) {
+	cfg := certs.Config{
+		CertFile:     getEnvString("DIME_TLS_CERT_FILE", ""),
+		KeyFile:      getEnvString("DIME_TLS_KEY_FILE", ""),
+		ClientCAFile: getEnvString("DIME_TLS_CLIENT_CA_FILE", ""),
+		ClientAuth:   certs.ClientAuth(getEnvString("DIME_TLS_CLIENT_AUTH", "")),
+	}
+	if cfg == (certs.Config{}) {
+		return nil, nil
+	}
+	return certs.New(cfg, certs.WithInterval(getEnvDuration("DIME_TLS_RELOAD_INTERVAL", defaultTLSInterval)))
+}
+
+// newAuthenticators creates the authenticators of the API keys in
+// DIME_API_KEYS, the JWKS in DIME_JWKS_FILE and the client certificates
+// that the TLS reloader verifies. Requests are not authenticated if none is
+// set.
+func newAuthenticators(reloader *certs.Reloader) ([]auth.Authenticator, error) {
+	var authenticators []auth.Authenticator
+	if file, ok := os.LookupEnv("DIME_API_KEYS"); ok {
+		keys, err := auth.LoadAPIKeys(file)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, keys)
+	}
+	if file, ok := os.LookupEnv("DIME_JWKS_FILE"); ok {
+		var opts []auth.JWTOption
+		if iss, ok := os.LookupEnv("DIME_JWT_ISSUER"); ok {
+			opts = append(opts, auth.WithIssuer(iss))
+		}
+		if aud, ok := os.LookupEnv("DIME_JWT_AUDIENCE"); ok {
+			opts = append(opts, auth.WithAudience(aud))
+		}
+		jwt, err := auth.LoadJWKS(file, opts...)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, jwt)
+	}
+	if reloader != nil && reloader.ClientAuth() != certs.ClientAuthNone {
+		authenticators = append(authenticators, auth.NewClientCertificates())
+	}
+	return authenticators, nil
+}
+
+// DataDir returns the data directory set by DIME_DATA_DIR
+func DataDir() string {
+	return getDataDir()
+}
+
 func getPort() int {
 	port := defaultPort
 	if val, ok := os.LookupEnv("DIME_PORT"); ok {
@@ -116,3 +923,144 @@ func getDataDir() string {
 	}
 	return dir
 }
+
+// OpenStore opens the store configured by the environment, as the server does
+func OpenStore() (store.Store, error) {
+	return newStore(getDataDir())
+}
+
+// newStore creates the store selected by DIME_STORE, tiered with the cold
+// tier in DIME_TIER_COLD_DIR and encrypted with the keys in
+// DIME_ENCRYPTION_KEY_FILE if they are set
+func newStore(dataDir string) (store.Store, error) {
+	st, err := newBaseStore(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if dir, ok := os.LookupEnv("DIME_TIER_COLD_DIR"); ok {
+		cold, err := store.NewFileStore(dir, store.WithCompression(coldCompression()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cold tier: %w", err)
+		}
+		st, err = store.NewTieredStore(st, cold, filepath.Join(dataDir, tiersDir),
+			getEnvDuration("DIME_TIER_MAX_IDLE", defaultTierMaxIdle))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if file, ok := os.LookupEnv("DIME_ENCRYPTION_KEY_FILE"); ok {
+		keyring, err := store.LoadKeyring(file)
+		if err != nil {
+			return nil, err
+		}
+		return store.NewEncryptedStore(st, keyring), nil
+	}
+	return st, nil
+}
+
+// newBaseStore creates the store selected by DIME_STORE
+func newBaseStore(dataDir string) (store.Store, error) {
+	switch kind := getEnvString("DIME_STORE", storeFile); kind {
+	case storeFile:
+		return store.NewFileStore(dataDir, store.WithCompression(getEnvString("DIME_COMPRESSION", store.CompressionNone)))
+	case storeS3:
+		return store.NewS3Store(store.S3Config{
+			Endpoint:        os.Getenv("DIME_S3_ENDPOINT"),
+			Region:          os.Getenv("DIME_S3_REGION"),
+			Bucket:          os.Getenv("DIME_S3_BUCKET"),
+			Prefix:          os.Getenv("DIME_S3_PREFIX"),
+			AccessKeyID:     getEnvString("DIME_S3_ACCESS_KEY_ID", os.Getenv("AWS_ACCESS_KEY_ID")),
+			SecretAccessKey: getEnvString("DIME_S3_SECRET_ACCESS_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+			SessionToken:    getEnvString("DIME_S3_SESSION_TOKEN", os.Getenv("AWS_SESSION_TOKEN")),
+			PathStyle:       getEnvBool("DIME_S3_PATH_STYLE", false),
+			PartSize:        int64(getEnvInt("DIME_S3_PART_SIZE", 0)),
+		})
+	default:
+		return nil, fmt.Errorf("unknown store %q", kind)
+	}
+}
+
+// coldCompression returns the compression of the cold tier set by
+// DIME_TIER_COLD_COMPRESSION, which defaults to DIME_COMPRESSION
+func coldCompression() string {
+	return getEnvString("DIME_TIER_COLD_COMPRESSION", getEnvString("DIME_COMPRESSION", store.CompressionNone))
+}
+
+func getEnvString(key string, def string) string {
+	if val, ok := os.LookupEnv(key); ok {
+		return val
+	}
+	return def
+}
+
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	if val, ok := os.LookupEnv(key); ok {
+		if d, err := time.ParseDuration(val); err == nil {
+			return d
+		}
+	}
+	return def
+}
+
+func getEnvBool(key string, def bool) bool {
+	if val, ok := os.LookupEnv(key); ok {
+		if b, err := strconv.ParseBool(val); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+func getEnvInt(key string, def int) int {
+	if val, ok := os.LookupEnv(key); ok {
+		if i, err := strconv.Atoi(val); err == nil {
+			return i
+		}
+	}
+	return def
+}
+
+func getEnvInt64(key string, def int64) int64 {
+	if val, ok := os.LookupEnv(key); ok {
+		if i, err := strconv.ParseInt(val, 10, 64); err == nil {
+			return i
+		}
+	}
+	return def
+}
+
+// getTrustedProxies returns the comma separated addresses or CIDR prefixes of
+// the trusted proxies in DIME_TRUSTED_PROXIES
+func getTrustedProxies() ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, val := range strings.Split(os.Getenv("DIME_TRUSTED_PROXIES"), ",") {
+		val = strings.TrimSpace(val)
+		if val == "" {
+			continue
+		}
+		if !strings.Contains(val, "/") {
+			addr, err := netip.ParseAddr(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DIME_TRUSTED_PROXIES: %w", err)
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DIME_TRUSTED_PROXIES: %w", err)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+func getMaxUploadSize() int64 {
+	size := int64(defaultMaxUploadSize)
+	if val, ok := os.LookupEnv("DIME_MAX_UPLOAD_SIZE"); ok {
+		if s, err := strconv.ParseInt(val, 10, 64); err == nil {
+			size = s
+		}
+	}
+	return size
+}
@@ -2,14 +2,32 @@ package server_test
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/johnmarkli/dime/pkg/auth"
+	"github.com/johnmarkli/dime/pkg/changes"
+	"github.com/johnmarkli/dime/pkg/ingest"
+	"github.com/johnmarkli/dime/pkg/jobs"
+	"github.com/johnmarkli/dime/pkg/replica"
 	"github.com/johnmarkli/dime/pkg/server"
 	"github.com/stretchr/testify/assert"
 )
@@ -25,6 +43,7 @@ func TestServerRoutes(t *testing.T) {
 	s, err := server.New()
 	assert.NoError(t, err)
 	assert.NotNil(t, s)
+	s.Run()
 	defer s.Shutdown()
 
 	router := s.Server().Handler
@@ -63,11 +82,24 @@ func TestServerRoutes(t *testing.T) {
 
 	router.ServeHTTP(w, r)
 	res = w.Result()
-	body, err = io.ReadAll(res.Body)
-	assert.NoError(t, err)
-	assert.JSONEq(t, testDICOMjson, string(body))
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	var job jobs.Job
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&job))
+	assert.Equal(t, fmt.Sprintf("/jobs/%s", job.ID), res.Header.Get("Location"))
 	res.Body.Close()
 
+	// GET /jobs/:id
+	assert.Eventually(t, func() bool {
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/jobs/%s", job.ID), nil)
+		router.ServeHTTP(w, r)
+		res = w.Result()
+		defer res.Body.Close()
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&job))
+		return job.State == jobs.StateDone
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []ingest.Result{{File: "IM000001-mri", ID: testID}}, job.Results)
+
 	// GET /dicoms
 	w = httptest.NewRecorder()
 	r = httptest.NewRequest(http.MethodGet, "/dicoms", nil)
@@ -114,3 +146,319 @@ func TestServerRoutes(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
 	assert.Equal(t, "image/png", w.Result().Header.Get("Content-Type"))
 }
+
+// freePort returns a free local TCP port
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "localhost:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestServerReplication(t *testing.T) {
+	t.Setenv("DIME_MIN_FREE_BYTES", "0")
+
+	// Primary
+	port := freePort(t)
+	t.Setenv("DIME_PORT", strconv.Itoa(port))
+	t.Setenv("DIME_DATA_DIR", t.TempDir())
+	primary, err := server.New()
+	assert.NoError(t, err)
+	primary.Run()
+	defer primary.Shutdown()
+
+	// Secondary
+	dir := t.TempDir()
+	t.Setenv("DIME_PORT", strconv.Itoa(freePort(t)))
+	t.Setenv("DIME_DATA_DIR", dir)
+	t.Setenv("DIME_REPLICATE_FROM", fmt.Sprintf("http://localhost:%d", port))
+	t.Setenv("DIME_REPLICATION_INTERVAL", "10ms")
+	secondary, err := server.New()
+	assert.NoError(t, err)
+	secondary.Run()
+
+	// POST /dicoms to the primary
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/dicoms", bytes.NewReader(b))
+	r.Header.Set("Content-Type", "application/dicom")
+	primary.Server().Handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusAccepted, w.Result().StatusCode)
+
+	// The DICOM is replicated to the secondary
+	assert.Eventually(t, func() bool {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/dicoms/%s", testID), nil)
+		secondary.Server().Handler.ServeHTTP(w, r)
+		return w.Result().StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+	var status replica.Status
+	assert.Eventually(t, func() bool {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/admin/replication", nil)
+		secondary.Server().Handler.ServeHTTP(w, r)
+		return json.NewDecoder(w.Result().Body).Decode(&status) == nil && status.Checkpoint == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint64(0), status.Lag)
+	secondary.Shutdown()
+
+	// GET /changes of the secondary records the replicated DICOM
+	secondary, err = server.New()
+	assert.NoError(t, err)
+	defer secondary.Shutdown()
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/changes?since=0", nil)
+	secondary.Server().Handler.ServeHTTP(w, r)
+	var page changes.Page
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&page))
+	if assert.Len(t, page.Changes, 1) {
+		assert.Equal(t, testID, page.Changes[0].ID)
+		assert.Equal(t, changes.Created, page.Changes[0].Type)
+	}
+
+	// Replication resumes from its checkpoint after a restart
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/admin/replication", nil)
+	secondary.Server().Handler.ServeHTTP(w, r)
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&status))
+	assert.Equal(t, uint64(1), status.Checkpoint)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/changes?since=x", nil)
+	secondary.Server().Handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
+
+func TestServerAuth(t *testing.T) {
+	t.Setenv("DIME_MIN_FREE_BYTES", "0")
+	t.Setenv("DIME_PORT", strconv.Itoa(freePort(t)))
+	t.Setenv("DIME_DATA_DIR", t.TempDir())
+	keys := filepath.Join(t.TempDir(), "keys.json")
+	assert.NoError(t, os.WriteFile(keys, []byte(`{"keys":[{"name":"reporting","key":"s3cret"}]}`), 0600))
+	t.Setenv("DIME_API_KEYS", keys)
+	s, err := server.New()
+	assert.NoError(t, err)
+	defer s.Shutdown()
+	router := s.Server().Handler
+
+	// GET /health is public
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/health", nil)
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	// GET /dicoms without an API key is unauthorized
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/dicoms", nil)
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+	assert.Equal(t, "application/json", w.Result().Header.Get("Content-Type"))
+	assert.NotEmpty(t, w.Result().Header.Values("WWW-Authenticate"))
+	var authErr auth.Error
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&authErr))
+	assert.Equal(t, auth.Error{Status: http.StatusUnauthorized, Error: "Unauthorized", Message: "no credentials"}, authErr)
+
+	// GET /dicoms with an unknown API key is unauthorized
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/dicoms", nil)
+	r.Header.Set(auth.APIKeyHeader, "wrong")
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	// GET /dicoms with an API key
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/dicoms", nil)
+	r.Header.Set(auth.APIKeyHeader, "s3cret")
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	// GET /health requires an API key unless it is public
+	t.Setenv("DIME_PORT", strconv.Itoa(freePort(t)))
+	t.Setenv("DIME_DATA_DIR", t.TempDir())
+	t.Setenv("DIME_AUTH_PUBLIC_HEALTH", "false")
+	private, err := server.New()
+	assert.NoError(t, err)
+	defer private.Shutdown()
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/health", nil)
+	private.Server().Handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	// A missing API keys file fails
+	t.Setenv("DIME_API_KEYS", filepath.Join(t.TempDir(), "missing.json"))
+	_, err = server.New()
+	assert.Error(t, err)
+}
+
+// newCertificate issues a certificate for a name signed by a parent, or a
+// self-signed CA without one, and writes it and its key to files
+func newCertificate(t *testing.T, name string, parent *tls.Certificate, usage x509.ExtKeyUsage) (cert tls.Certificate, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name, OrganizationalUnit: []string{"radiology"}},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	assert.NoError(t, os.WriteFile(certFile, certPEM, 0600))
+	assert.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	assert.NoError(t, err)
+	cert.Leaf, err = x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert, certFile, keyFile
+}
+
+func TestServerTLS(t *testing.T) {
+	ca, caFile, _ := newCertificate(t, "dime test CA", nil, x509.ExtKeyUsageAny)
+	_, certFile, keyFile := newCertificate(t, "localhost", &ca, x509.ExtKeyUsageServerAuth)
+	client, _, _ := newCertificate(t, "modality", &ca, x509.ExtKeyUsageClientAuth)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	t.Setenv("DIME_MIN_FREE_BYTES", "0")
+	port := freePort(t)
+	t.Setenv("DIME_PORT", strconv.Itoa(port))
+	t.Setenv("DIME_DATA_DIR", t.TempDir())
+	t.Setenv("DIME_TLS_CERT_FILE", certFile)
+	t.Setenv("DIME_TLS_KEY_FILE", keyFile)
+	t.Setenv("DIME_TLS_CLIENT_CA_FILE", caFile)
+	rbac := filepath.Join(t.TempDir(), "rbac.json")
+	assert.NoError(t, os.WriteFile(rbac, []byte(`{"grants":[{"method":"certificate","group":"radiology","roles":["reader"]}]}`), 0600))
+	t.Setenv("DIME_RBAC", rbac)
+	s, err := server.New()
+	assert.NoError(t, err)
+	s.Run()
+	defer s.Shutdown()
+
+	get := func(path string, certs ...tls.Certificate) (*http.Response, error) {
+		c := &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				RootCAs:      roots,
+				Certificates: certs,
+			}},
+		}
+		rsp, err := c.Get(fmt.Sprintf("https://localhost:%d%s", port, path))
+		if err == nil {
+			rsp.Body.Close()
+		}
+		return rsp, err
+	}
+
+	// GET /health is served over HTTPS
+	assert.Eventually(t, func() bool {
+		rsp, err := get("/health")
+		return err == nil && rsp.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// GET /dicoms without a client certificate is unauthorized
+	rsp, err := get("/dicoms")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, rsp.StatusCode)
+
+	// GET /dicoms with a client certificate is authorized by its groups
+	rsp, err = get("/dicoms", client)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	rsp, err = get("/admin/usage", client)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, rsp.StatusCode)
+
+	// Plain HTTP is refused
+	rsp, err = http.Get(fmt.Sprintf("http://localhost:%d/health", port))
+	assert.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+
+	// A missing key file fails
+	t.Setenv("DIME_TLS_KEY_FILE", filepath.Join(t.TempDir(), "missing.pem"))
+	_, err = server.New()
+	assert.Error(t, err)
+}
+
+func TestServerRBAC(t *testing.T) {
+	t.Setenv("DIME_MIN_FREE_BYTES", "0")
+	t.Setenv("DIME_PORT", strconv.Itoa(freePort(t)))
+	t.Setenv("DIME_DATA_DIR", t.TempDir())
+	dir := t.TempDir()
+	grants := filepath.Join(dir, "rbac.json")
+	assert.NoError(t, os.WriteFile(grants, []byte(`{"grants":[
+		{"method":"apikey","subject":"reporting","roles":["reader"]},
+		{"method":"apikey","subject":"ops","roles":["admin"]}
+	]}`), 0600))
+	t.Setenv("DIME_RBAC", grants)
+
+	// DIME_RBAC requires authentication
+	_, err := server.New()
+	assert.Error(t, err)
+
+	keys := filepath.Join(dir, "keys.json")
+	assert.NoError(t, os.WriteFile(keys, []byte(`{"keys":[{"name":"reporting","key":"reader"},{"name":"ops","key":"admin"}]}`), 0600))
+	t.Setenv("DIME_API_KEYS", keys)
+	s, err := server.New()
+	assert.NoError(t, err)
+	defer s.Shutdown()
+	router := s.Server().Handler
+
+	for _, tc := range []struct {
+		path   string
+		key    string
+		status int
+	}{
+		{"/health", "", http.StatusOK},
+		{"/dicoms", "reader", http.StatusOK},
+		{"/dicoms", "admin", http.StatusOK},
+		{"/changes", "reader", http.StatusForbidden},
+		{"/changes", "admin", http.StatusOK},
+		{"/stability/studies", "reader", http.StatusForbidden},
+		{"/stability/studies", "admin", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.key != "" {
+			r.Header.Set(auth.APIKeyHeader, tc.key)
+		}
+		router.ServeHTTP(w, r)
+		assert.Equal(t, tc.status, w.Result().StatusCode, tc.path+" "+tc.key)
+	}
+
+	// POST /dicoms needs the uploader role
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/dicoms", bytes.NewReader(b))
+	r.Header.Set("Content-Type", "application/dicom")
+	r.Header.Set(auth.APIKeyHeader, "reader")
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+
+	// Grants scoped by study label need retention rules to label studies
+	assert.NoError(t, os.WriteFile(grants, []byte(`{"grants":[
+		{"method":"apikey","subject":"reporting","roles":["reader"],"scopes":[{"studyLabel":"research"}]}
+	]}`), 0600))
+	_, err = server.New()
+	assert.Error(t, err)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/johnmarkli/dime/pkg/stability"
+)
+
+// StabilityHandler handles requests for whether series and studies have
+// stopped receiving instances
+type StabilityHandler struct {
+	tracker *stability.Tracker
+}
+
+// NewStabilityHandler returns a new StabilityHandler
+func NewStabilityHandler(tracker *stability.Tracker) *StabilityHandler {
+	return &StabilityHandler{tracker}
+}
+
+// ListStudies lists the stability of studies
+//
+//	@Summary		List study stability
+//	@Description	List the studies in the order they last received an instance with whether each is stable, having received no instances for the quiet period or its expected Number of Study Related Instances
+//	@Tags			stability
+//	@Produce		json
+//	@Param			stable	query		bool	false	"Only list studies that are stable or not"
+//	@Success		200		{array}		stability.Study
+//	@Failure		400		{object}	string
+//	@Failure		500		{object}	string
+//	@Router			/stability/studies [get]
+func (sh *StabilityHandler) ListStudies(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Get studies
+	stable := parseStable(r.URL.Query().Get("stable"))
+	studies := []stability.Study{}
+	for _, s := range sh.tracker.ListStudies() {
+		if stable == nil || s.Stable == *stable {
+			studies = append(studies, s)
+		}
+	}
+
+	// Return studies
+	jsonBytes, err := json.Marshal(studies)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
+// ReadStudy reads the stability of a study
+//
+//	@Summary		Read study stability
+//	@Description	Read the instances received of a study and whether it is stable
+//	@Tags			stability
+//	@Produce		json
+//	@Param			uid	path		string	true	"Study Instance UID"
+//	@Success		200	{object}	stability.Study
+//	@Failure		404	{object}	string
+//	@Failure		500	{object}	string
+//	@Router			/stability/studies/{uid} [get]
+func (sh *StabilityHandler) ReadStudy(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Get study
+	study, err := sh.tracker.Study(mux.Vars(r)["uid"])
+	if err != nil {
+		panic(err)
+	}
+
+	// Return study
+	var jsonBytes []byte
+	jsonBytes, err = json.Marshal(study)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
+// ListSeries lists the stability of the series of a study
+//
+//	@Summary		List series stability
+//	@Description	List the series of a study in the order they last received an instance with whether each is stable, having received no instances for the quiet period or its expected Number of Series Related Instances
+//	@Tags			stability
+//	@Produce		json
+//	@Param			uid	path		string	true	"Study Instance UID"
+//	@Success		200	{array}		stability.Series
+//	@Failure		404	{object}	string
+//	@Failure		500	{object}	string
+//	@Router			/stability/studies/{uid}/series [get]
+func (sh *StabilityHandler) ListSeries(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Get series
+	uid := mux.Vars(r)["uid"]
+	_, err := sh.tracker.Study(uid)
+	if err != nil {
+		panic(err)
+	}
+	series := sh.tracker.ListSeries(uid)
+
+	// Return series
+	var jsonBytes []byte
+	jsonBytes, err = json.Marshal(series)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
+// ReadSeries reads the stability of a series
+//
+//	@Summary		Read series stability
+//	@Description	Read the instances received of a series and whether it is stable
+//	@Tags			stability
+//	@Produce		json
+//	@Param			uid	path		string	true	"Series Instance UID"
+//	@Success		200	{object}	stability.Series
+//	@Failure		404	{object}	string
+//	@Failure		500	{object}	string
+//	@Router			/stability/series/{uid} [get]
+func (sh *StabilityHandler) ReadSeries(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Get series
+	series, err := sh.tracker.Series(mux.Vars(r)["uid"])
+	if err != nil {
+		panic(err)
+	}
+
+	// Return series
+	var jsonBytes []byte
+	jsonBytes, err = json.Marshal(series)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
+// parseStable parses the stable query parameter, returning nil if it is
+// unset
+func parseStable(val string) *bool {
+	if val == "" {
+		return nil
+	}
+	stable, err := strconv.ParseBool(val)
+	if err != nil {
+		panic(fmt.Errorf("%w: stable %q", ErrInvalidQuery, val))
+	}
+	return &stable
+}
@@ -0,0 +1,97 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/johnmarkli/dime/pkg/changes"
+	"github.com/johnmarkli/dime/pkg/server"
+	"github.com/johnmarkli/dime/pkg/stability"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+)
+
+func TestStabilityHandler(t *testing.T) {
+	l, err := changes.New(t.TempDir())
+	assert.NoError(t, err)
+	defer l.Close()
+	mem, err := store.NewMemStore()
+	assert.NoError(t, err)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Wrap(mem).Create(dcm))
+	tracker, err := stability.New(t.TempDir(), l, stability.WithQuietPeriod(time.Hour))
+	assert.NoError(t, err)
+	h := server.NewStabilityHandler(tracker)
+
+	// GET /stability/studies
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/stability/studies?stable=false", nil)
+	h.ListStudies(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var studies []stability.Study
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&studies))
+	if assert.Len(t, studies, 1) {
+		assert.Equal(t, dcm.StudyInstanceUID, studies[0].StudyInstanceUID)
+		assert.Equal(t, 1, studies[0].Series)
+		assert.Equal(t, 1, studies[0].Instances)
+		assert.False(t, studies[0].Stable)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/stability/studies?stable=true", nil)
+	h.ListStudies(w, r)
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&studies))
+	assert.Empty(t, studies)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/stability/studies?stable=maybe", nil)
+	h.ListStudies(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+
+	// GET /stability/studies/:uid
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/stability/studies/"+dcm.StudyInstanceUID, nil)
+	r = mux.SetURLVars(r, map[string]string{"uid": dcm.StudyInstanceUID})
+	h.ReadStudy(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var study stability.Study
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&study))
+	assert.Equal(t, 1, study.Series)
+
+	// GET /stability/studies/:uid/series
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/stability/studies/"+dcm.StudyInstanceUID+"/series", nil)
+	r = mux.SetURLVars(r, map[string]string{"uid": dcm.StudyInstanceUID})
+	h.ListSeries(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var series []stability.Series
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&series))
+	if assert.Len(t, series, 1) {
+		assert.Equal(t, dcm.SeriesInstanceUID, series[0].SeriesInstanceUID)
+		assert.Equal(t, "MR", series[0].Modality)
+	}
+
+	// GET /stability/series/:uid
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/stability/series/"+dcm.SeriesInstanceUID, nil)
+	r = mux.SetURLVars(r, map[string]string{"uid": dcm.SeriesInstanceUID})
+	h.ReadSeries(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	// Unknown studies and series are not found
+	for _, fn := range []http.HandlerFunc{h.ReadStudy, h.ListSeries, h.ReadSeries} {
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodGet, "/stability/studies/unknown", nil)
+		r = mux.SetURLVars(r, map[string]string{"uid": "unknown"})
+		fn(w, r)
+		assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+	}
+}
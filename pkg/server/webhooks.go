@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/johnmarkli/dime/pkg/stability"
+	"github.com/johnmarkli/dime/pkg/webhook"
+)
+
+// WebhooksHandler handles requests for deliveries of events to webhook
+// subscriptions
+type WebhooksHandler struct {
+	dispatcher *webhook.Dispatcher
+}
+
+// NewWebhooksHandler returns a new WebhooksHandler
+func NewWebhooksHandler(dispatcher *webhook.Dispatcher) *WebhooksHandler {
+	return &WebhooksHandler{dispatcher}
+}
+
+// List deliveries
+//
+//	@Summary		List deliveries
+//	@Description	List the deliveries of events to webhook subscriptions that are pending, failed or among the last 1000 delivered
+//	@Tags			webhooks
+//	@Produce		json
+//	@Param			subscription	query		string	false	"Only list deliveries to a subscription"
+//	@Param			state			query		string	false	"Only list deliveries in a state"	Enums(pending, delivered, failed)
+//	@Success		200				{array}		webhook.Delivery
+//	@Failure		500				{object}	string
+//	@Router			/webhooks/deliveries [get]
+func (wh *WebhooksHandler) List(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Get deliveries
+	deliveries := wh.dispatcher.List(r.URL.Query().Get("subscription"), webhook.State(r.URL.Query().Get("state")))
+
+	// Return deliveries
+	jsonBytes, err := json.Marshal(deliveries)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
+// Read a delivery
+//
+//	@Summary		Read a delivery
+//	@Description	Read a delivery of an event to a webhook subscription
+//	@Tags			webhooks
+//	@Produce		json
+//	@Param			id	path		string	true	"Delivery ID"
+//	@Success		200	{object}	webhook.Delivery
+//	@Failure		404	{object}	string
+//	@Failure		500	{object}	string
+//	@Router			/webhooks/deliveries/{id} [get]
+func (wh *WebhooksHandler) Read(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Get delivery
+	id := mux.Vars(r)["id"]
+	delivery, err := wh.dispatcher.Get(id)
+	if err != nil {
+		panic(err)
+	}
+
+	// Return delivery
+	var jsonBytes []byte
+	jsonBytes, err = json.Marshal(delivery)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
+// Retry a delivery
+//
+//	@Summary		Retry a delivery
+//	@Description	Deliver an event to a webhook subscription again now. A failed or delivered delivery is given a fresh set of attempts.
+//	@Tags			webhooks
+//	@Produce		json
+//	@Param			id	path		string	true	"Delivery ID"
+//	@Success		200	{object}	webhook.Delivery
+//	@Failure		404	{object}	string
+//	@Failure		500	{object}	string
+//	@Router			/webhooks/deliveries/{id}/retry [post]
+func (wh *WebhooksHandler) Retry(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			handleError(rec, w)
+		}
+	}()
+
+	// Retry delivery
+	id := mux.Vars(r)["id"]
+	delivery, err := wh.dispatcher.Retry(id)
+	if err != nil {
+		panic(err)
+	}
+
+	// Return delivery
+	var jsonBytes []byte
+	jsonBytes, err = json.Marshal(delivery)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write(jsonBytes)
+}
+
+// notifyStudyStable returns a stability hook that delivers a study.stable
+// event for each study that becomes stable
+func notifyStudyStable(dispatcher *webhook.Dispatcher) stability.StudyHook {
+	return func(s stability.Study) {
+		dispatcher.Notify(webhook.Event{
+			ID:               fmt.Sprintf("%s-%s-%d", webhook.StudyStable, s.StudyInstanceUID, s.LastReceived.UnixNano()),
+			Type:             webhook.StudyStable,
+			Time:             *s.StableSince,
+			StudyInstanceUID: s.StudyInstanceUID,
+			Instances:        s.Instances,
+		})
+	}
+}
+
+// notifySeriesStable returns a stability hook that delivers a series.stable
+// event for each series that becomes stable
+func notifySeriesStable(dispatcher *webhook.Dispatcher) stability.Hook {
+	return func(s stability.Series) {
+		dispatcher.Notify(webhook.Event{
+			ID:                fmt.Sprintf("%s-%s-%d", webhook.SeriesStable, s.SeriesInstanceUID, s.LastReceived.UnixNano()),
+			Type:              webhook.SeriesStable,
+			Time:              *s.StableSince,
+			StudyInstanceUID:  s.StudyInstanceUID,
+			SeriesInstanceUID: s.SeriesInstanceUID,
+			Modality:          s.Modality,
+			Instances:         s.Instances,
+		})
+	}
+}
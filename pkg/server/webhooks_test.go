@@ -0,0 +1,89 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/johnmarkli/dime/pkg/changes"
+	"github.com/johnmarkli/dime/pkg/server"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/johnmarkli/dime/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhooksHandler(t *testing.T) {
+	l, err := changes.New(t.TempDir())
+	assert.NoError(t, err)
+	defer l.Close()
+	mem, err := store.NewMemStore()
+	assert.NoError(t, err)
+	st := l.Wrap(mem)
+
+	// A subscriber that is down leaves deliveries pending
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	cfg := &webhook.Config{Subscriptions: []webhook.Subscription{
+		{Name: "ai", URL: down.URL, Secret: "s3cret", Events: []string{webhook.InstanceStored}},
+	}}
+	dispatcher, err := webhook.New(t.TempDir(), l, cfg, webhook.WithBackoff(time.Hour))
+	assert.NoError(t, err)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	// Upload a DICOM
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/dicoms", bytes.NewReader(b))
+	r.Header.Add("Content-Type", "application/dicom")
+	server.NewDICOMHandler(st).Upload(w, r)
+	assert.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	assert.Eventually(t, func() bool {
+		d := dispatcher.List("", "")
+		return len(d) == 1 && d[0].Attempts == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// GET /webhooks/deliveries
+	h := server.NewWebhooksHandler(dispatcher)
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/webhooks/deliveries?subscription=ai&state=pending", nil)
+	h.List(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var deliveries []webhook.Delivery
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&deliveries))
+	if assert.Len(t, deliveries, 1) {
+		assert.Equal(t, webhook.InstanceStored, deliveries[0].Event.Type)
+		assert.Equal(t, testID, deliveries[0].Event.SOPInstanceUID)
+		assert.NotEmpty(t, deliveries[0].Error)
+	}
+
+	// GET /webhooks/deliveries/:id
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/webhooks/deliveries/"+deliveries[0].ID, nil)
+	r = mux.SetURLVars(r, map[string]string{"id": deliveries[0].ID})
+	h.Read(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var delivery webhook.Delivery
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&delivery))
+	assert.Equal(t, deliveries[0].ID, delivery.ID)
+
+	// POST /webhooks/deliveries/:id/retry
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/webhooks/deliveries/"+deliveries[0].ID+"/retry", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": deliveries[0].ID})
+	h.Retry(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	// Unknown deliveries are not found
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/webhooks/deliveries/unknown", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": "unknown"})
+	h.Read(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
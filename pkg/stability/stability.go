@@ -0,0 +1,489 @@
+// Package stability detects series and studies that have stopped receiving
+// instances
+package stability
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/changes"
+)
+
+const (
+	defaultQuietPeriod = 5 * time.Minute
+	stateFile          = "series.json"
+	pageLimit          = 1000
+	idleWait           = time.Hour
+)
+
+var (
+	// ErrNotFound is an error for a series or study that is not found
+	ErrNotFound = errors.New("not found")
+)
+
+// Series is the instances received of a series. A series is stable once it
+// has received no instances for the quiet period or it has the expected
+// Number of Series Related Instances, and is unstable again if it receives
+// another.
+type Series struct {
+	SeriesInstanceUID string     `json:"seriesInstanceUID" example:"1.3.12.2.1107.5.2.6.24119.30000013121716094326500000394"`
+	StudyInstanceUID  string     `json:"studyInstanceUID" example:"1.2.840.114202.4.833393677.4209323108.691055951.3610221745"`
+	Modality          string     `json:"modality,omitempty" example:"MR"`
+	Instances         int        `json:"instances" example:"24"`
+	Expected          int        `json:"expected,omitempty" example:"24"`
+	LastReceived      time.Time  `json:"lastReceived"`
+	Stable            bool       `json:"stable" example:"true"`
+	StableSince       *time.Time `json:"stableSince,omitempty"`
+}
+
+// Study is the instances received of a study. A study is stable once it has
+// received no instances for the quiet period or it has the expected Number of
+// Study Related Instances, which makes each of its series stable, and is
+// unstable again if it receives another.
+type Study struct {
+	StudyInstanceUID string     `json:"studyInstanceUID" example:"1.2.840.114202.4.833393677.4209323108.691055951.3610221745"`
+	Series           int        `json:"series" example:"4"`
+	Instances        int        `json:"instances" example:"96"`
+	Expected         int        `json:"expected,omitempty" example:"96"`
+	LastReceived     time.Time  `json:"lastReceived"`
+	Stable           bool       `json:"stable" example:"true"`
+	StableSince      *time.Time `json:"stableSince,omitempty"`
+}
+
+// Hook is called when a series becomes stable
+type Hook func(Series)
+
+// StudyHook is called when a study becomes stable
+type StudyHook func(Study)
+
+// state is the series and studies of a Tracker and the sequence number of
+// the last change applied to them
+type state struct {
+	Seq     uint64    `json:"seq"`
+	Series  []*Series `json:"series"`
+	Studies []*Study  `json:"studies"`
+}
+
+// Tracker follows a change log to track the instances received of each
+// series and study, calling its hooks when they become stable. Its state is
+// saved to a directory so that series and studies received before a restart
+// become stable after it. Hooks may be called again after a crash.
+type Tracker struct {
+	dir        string
+	log        *changes.Log
+	quiet      time.Duration
+	hooks      []Hook
+	studyHooks []StudyHook
+
+	mu      sync.Mutex
+	seq     uint64
+	series  map[string]*Series
+	studies map[string]*Study
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// Option configures a Tracker
+type Option func(*Tracker)
+
+// WithQuietPeriod sets how long a series or study must receive no instances
+// to be stable
+func WithQuietPeriod(d time.Duration) Option {
+	return func(t *Tracker) {
+		t.quiet = d
+	}
+}
+
+// WithHook adds a hook called when a series becomes stable
+func WithHook(h Hook) Option {
+	return func(t *Tracker) {
+		t.hooks = append(t.hooks, h)
+	}
+}
+
+// WithStudyHook adds a hook called when a study becomes stable
+func WithStudyHook(h StudyHook) Option {
+	return func(t *Tracker) {
+		t.studyHooks = append(t.studyHooks, h)
+	}
+}
+
+// New creates a Tracker of the series and studies in a change log with its
+// state in dir, loading the state of a previous run. Without one, the log is
+// tracked without calling hooks for those that are already stable.
+func New(dir string, log *changes.Log, opts ...Option) (*Tracker, error) {
+	t := &Tracker{
+		dir:     dir,
+		log:     log,
+		quiet:   defaultQuietPeriod,
+		series:  map[string]*Series{},
+		studies: map[string]*Study{},
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, stateFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read series: %w", err)
+	}
+	if err == nil {
+		var st state
+		err = json.Unmarshal(b, &st)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse series: %w", err)
+		}
+		t.seq = st.Seq
+		for _, s := range st.Series {
+			t.series[s.SeriesInstanceUID] = s
+		}
+		for _, s := range st.Studies {
+			t.studies[s.StudyInstanceUID] = s
+		}
+		if st.Studies == nil {
+			t.rebuildStudies()
+		}
+		return t, nil
+	}
+
+	// Catch up with the log quietly
+	for t.apply() {
+	}
+	now := time.Now().UTC()
+	for _, s := range t.series {
+		if since := s.LastReceived.Add(t.quiet); !since.After(now) || complete(s.Instances, s.Expected) {
+			if since.After(now) {
+				since = now
+			}
+			s.Stable = true
+			s.StableSince = &since
+		}
+	}
+	for _, s := range t.studies {
+		if since := s.LastReceived.Add(t.quiet); !since.After(now) || complete(s.Instances, s.Expected) {
+			if since.After(now) {
+				since = now
+			}
+			s.Stable = true
+			s.StableSince = &since
+		}
+	}
+	return t, t.save()
+}
+
+// Start tracking series and studies in the background
+func (t *Tracker) Start() {
+	var ctx context.Context
+	ctx, t.cancel = context.WithCancel(context.Background())
+	t.done = make(chan struct{})
+	go func() {
+		defer close(t.done)
+		for {
+			for t.apply() {
+			}
+			t.settle()
+			err := t.save()
+			if err != nil {
+				slog.Error(err.Error())
+			}
+
+			// Wait for a change or the next series or study to become stable
+			wait, cancel := context.WithTimeout(ctx, t.next())
+			t.log.Wait(wait, t.Seq())
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+}
+
+// Stop tracking series and studies
+func (t *Tracker) Stop() {
+	if t.cancel == nil {
+		return
+	}
+	t.cancel()
+	<-t.done
+}
+
+// Seq returns the sequence number of the last change tracked
+func (t *Tracker) Seq() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.seq
+}
+
+// Series returns a series by Series Instance UID
+func (t *Tracker) Series(uid string) (Series, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.series[uid]
+	if !ok {
+		return Series{}, ErrNotFound
+	}
+	return *s, nil
+}
+
+// Study returns a study by Study Instance UID
+func (t *Tracker) Study(uid string) (Study, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.studies[uid]
+	if !ok {
+		return Study{}, ErrNotFound
+	}
+	study := *s
+	study.Series = t.countSeries(uid)
+	return study, nil
+}
+
+// ListSeries lists the series in the order they last received an instance,
+// optionally only those of a study
+func (t *Tracker) ListSeries(study string) []Series {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	series := []Series{}
+	for _, s := range t.series {
+		if study == "" || s.StudyInstanceUID == study {
+			series = append(series, *s)
+		}
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].LastReceived.Before(series[j].LastReceived)
+	})
+	return series
+}
+
+// ListStudies lists the studies in the order they last received an instance
+func (t *Tracker) ListStudies() []Study {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := map[string]int{}
+	for _, s := range t.series {
+		counts[s.StudyInstanceUID]++
+	}
+	studies := make([]Study, 0, len(t.studies))
+	for _, s := range t.studies {
+		study := *s
+		study.Series = counts[s.StudyInstanceUID]
+		studies = append(studies, study)
+	}
+	sort.Slice(studies, func(i, j int) bool {
+		return studies[i].LastReceived.Before(studies[j].LastReceived)
+	})
+	return studies
+}
+
+// apply a page of the changes after those tracked, returning whether there
+// may be more
+func (t *Tracker) apply() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	page := t.log.Since(t.seq, pageLimit)
+	for _, e := range page.Changes {
+		t.seq = e.Seq
+		if e.SeriesInstanceUID == "" || e.StudyInstanceUID == "" {
+			continue
+		}
+		s, ok := t.series[e.SeriesInstanceUID]
+		study := t.studies[e.StudyInstanceUID]
+		switch e.Type {
+		case changes.Created, changes.Updated:
+			if !ok {
+				s = &Series{SeriesInstanceUID: e.SeriesInstanceUID, StudyInstanceUID: e.StudyInstanceUID}
+				t.series[e.SeriesInstanceUID] = s
+			}
+			if study == nil {
+				study = &Study{StudyInstanceUID: e.StudyInstanceUID}
+				t.studies[e.StudyInstanceUID] = study
+			}
+			if e.Type == changes.Created {
+				s.Instances++
+				study.Instances++
+			}
+			if e.Modality != "" {
+				s.Modality = e.Modality
+			}
+			if e.SeriesInstances > 0 {
+				s.Expected = e.SeriesInstances
+			}
+			if e.StudyInstances > 0 {
+				study.Expected = e.StudyInstances
+			}
+			s.LastReceived, study.LastReceived = e.Time, e.Time
+			s.Stable, study.Stable = false, false
+			s.StableSince, study.StableSince = nil, nil
+		case changes.Deleted:
+			if ok {
+				s.Instances--
+				if s.Instances <= 0 {
+					delete(t.series, e.SeriesInstanceUID)
+				}
+			}
+			if study != nil {
+				study.Instances--
+				if study.Instances <= 0 {
+					delete(t.studies, e.StudyInstanceUID)
+				}
+			}
+		}
+	}
+	return len(page.Changes) == pageLimit
+}
+
+// settle marks the studies and series that have been quiet for the quiet
+// period or are complete stable, calling the hooks for each
+func (t *Tracker) settle() {
+	now := time.Now().UTC()
+	t.mu.Lock()
+	stableStudies := map[string]bool{}
+	for _, s := range t.studies {
+		if !s.Stable && (!s.LastReceived.Add(t.quiet).After(now) || complete(s.Instances, s.Expected)) {
+			stableStudies[s.StudyInstanceUID] = true
+		}
+	}
+	series := []Series{}
+	for _, s := range t.series {
+		if !s.Stable && (!s.LastReceived.Add(t.quiet).After(now) || complete(s.Instances, s.Expected) ||
+			stableStudies[s.StudyInstanceUID]) {
+			s.Stable = true
+			s.StableSince = &now
+			series = append(series, *s)
+		}
+	}
+	studies := []Study{}
+	for uid := range stableStudies {
+		s := t.studies[uid]
+		s.Stable = true
+		s.StableSince = &now
+		study := *s
+		study.Series = t.countSeries(uid)
+		studies = append(studies, study)
+	}
+	t.mu.Unlock()
+
+	for _, s := range series {
+		slog.Info("Series is stable",
+			slog.String("series", s.SeriesInstanceUID),
+			slog.Int("instances", s.Instances))
+		for _, h := range t.hooks {
+			h(s)
+		}
+	}
+	for _, s := range studies {
+		slog.Info("Study is stable",
+			slog.String("study", s.StudyInstanceUID),
+			slog.Int("instances", s.Instances))
+		for _, h := range t.studyHooks {
+			h(s)
+		}
+	}
+}
+
+// next returns how long until the next series or study becomes stable
+func (t *Tracker) next() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	wait := idleWait
+	for _, s := range t.series {
+		if !s.Stable {
+			wait = min(wait, time.Until(s.LastReceived.Add(t.quiet)))
+		}
+	}
+	for _, s := range t.studies {
+		if !s.Stable {
+			wait = min(wait, time.Until(s.LastReceived.Add(t.quiet)))
+		}
+	}
+	return max(wait, 0)
+}
+
+// countSeries returns the number of series of a study. The caller must hold
+// the lock.
+func (t *Tracker) countSeries(study string) int {
+	n := 0
+	for _, s := range t.series {
+		if s.StudyInstanceUID == study {
+			n++
+		}
+	}
+	return n
+}
+
+// rebuildStudies derives the studies from the series of state saved before
+// studies were tracked. The caller must hold the lock or own the Tracker.
+func (t *Tracker) rebuildStudies() {
+	for _, s := range t.series {
+		study, ok := t.studies[s.StudyInstanceUID]
+		if !ok {
+			study = &Study{StudyInstanceUID: s.StudyInstanceUID, Stable: true}
+			t.studies[s.StudyInstanceUID] = study
+		}
+		study.Instances += s.Instances
+		if s.LastReceived.After(study.LastReceived) {
+			study.LastReceived = s.LastReceived
+		}
+		study.Stable = study.Stable && s.Stable
+		if study.Stable && s.StableSince != nil &&
+			(study.StableSince == nil || s.StableSince.After(*study.StableSince)) {
+			study.StableSince = s.StableSince
+		}
+	}
+	for _, s := range t.studies {
+		if !s.Stable {
+			s.StableSince = nil
+		}
+	}
+}
+
+// save the state to a temp file and rename it in to place
+func (t *Tracker) save() error {
+	t.mu.Lock()
+	st := state{
+		Seq:     t.seq,
+		Series:  make([]*Series, 0, len(t.series)),
+		Studies: make([]*Study, 0, len(t.studies)),
+	}
+	for _, s := range t.series {
+		c := *s
+		st.Series = append(st.Series, &c)
+	}
+	for _, s := range t.studies {
+		c := *s
+		st.Studies = append(st.Studies, &c)
+	}
+	t.mu.Unlock()
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(t.dir, stateFile)
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write series: %w", err)
+	}
+	return nil
+}
+
+// complete returns whether the expected number of instances, if known, have
+// been received
+func complete(instances, expected int) bool {
+	return expected > 0 && instances >= expected
+}
@@ -0,0 +1,183 @@
+package stability_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/changes"
+	"github.com/johnmarkli/dime/pkg/stability"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+const (
+	testDataPath = "../../testdata/IM000001-mri"
+	testID       = "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000395"
+)
+
+func TestTracker(t *testing.T) {
+	l, err := changes.New(t.TempDir())
+	assert.NoError(t, err)
+	defer l.Close()
+	mem, err := store.NewMemStore()
+	assert.NoError(t, err)
+	st := l.Wrap(mem)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+
+	// A series is stable once it has received no instances for the quiet
+	// period
+	var mu sync.Mutex
+	stable := []stability.Series{}
+	dir := t.TempDir()
+	tracker, err := stability.New(dir, l,
+		stability.WithQuietPeriod(100*time.Millisecond),
+		stability.WithHook(func(s stability.Series) {
+			mu.Lock()
+			defer mu.Unlock()
+			stable = append(stable, s)
+		}))
+	assert.NoError(t, err)
+	tracker.Start()
+	assert.NoError(t, st.Create(dcm))
+	assert.Eventually(t, func() bool {
+		s, err := tracker.Series(dcm.SeriesInstanceUID)
+		return err == nil && !s.Stable
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(stable) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	s, err := tracker.Series(dcm.SeriesInstanceUID)
+	assert.NoError(t, err)
+	assert.True(t, s.Stable)
+	assert.NotNil(t, s.StableSince)
+	assert.Equal(t, 1, s.Instances)
+	assert.Equal(t, "MR", s.Modality)
+	assert.Equal(t, dcm.StudyInstanceUID, stable[0].StudyInstanceUID)
+	assert.Len(t, tracker.ListSeries(""), 1)
+	assert.Len(t, tracker.ListSeries(dcm.StudyInstanceUID), 1)
+	assert.Empty(t, tracker.ListSeries("1.2.3"))
+	tracker.Stop()
+
+	// A series receiving an instance while stopped is stable after a restart
+	assert.NoError(t, st.Create(dcm))
+	tracker, err = stability.New(dir, l,
+		stability.WithQuietPeriod(100*time.Millisecond),
+		stability.WithHook(func(s stability.Series) {
+			mu.Lock()
+			defer mu.Unlock()
+			stable = append(stable, s)
+		}))
+	assert.NoError(t, err)
+	tracker.Start()
+	defer tracker.Stop()
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(stable) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A series is gone once its instances are deleted
+	assert.NoError(t, st.Delete(testID))
+	assert.Eventually(t, func() bool {
+		_, err := tracker.Series(dcm.SeriesInstanceUID)
+		return errors.Is(err, stability.ErrNotFound)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestTrackerCatchUp(t *testing.T) {
+	l, err := changes.New(t.TempDir())
+	assert.NoError(t, err)
+	defer l.Close()
+	mem, err := store.NewMemStore()
+	assert.NoError(t, err)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Wrap(mem).Create(dcm))
+
+	// Series that are already stable when first tracked don't call hooks
+	called := false
+	tracker, err := stability.New(t.TempDir(), l,
+		stability.WithQuietPeriod(0),
+		stability.WithHook(func(stability.Series) { called = true }))
+	assert.NoError(t, err)
+	tracker.Start()
+	tracker.Stop()
+	assert.False(t, called)
+	s, err := tracker.Series(dcm.SeriesInstanceUID)
+	assert.NoError(t, err)
+	assert.True(t, s.Stable)
+	assert.Equal(t, uint64(1), tracker.Seq())
+}
+
+func TestTrackerStudies(t *testing.T) {
+	l, err := changes.New(t.TempDir())
+	assert.NoError(t, err)
+	defer l.Close()
+	mem, err := store.NewMemStore()
+	assert.NoError(t, err)
+	st := l.Wrap(mem)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	el, err := dicom.NewElement(tag.NumberOfStudyRelatedInstances, []string{"1"})
+	assert.NoError(t, err)
+	ds.Elements = append(ds.Elements, el)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+
+	// A study with the expected number of instances is stable without
+	// waiting for the quiet period, as are its series
+	var mu sync.Mutex
+	studies := []stability.Study{}
+	series := []stability.Series{}
+	tracker, err := stability.New(t.TempDir(), l,
+		stability.WithQuietPeriod(time.Hour),
+		stability.WithHook(func(s stability.Series) {
+			mu.Lock()
+			defer mu.Unlock()
+			series = append(series, s)
+		}),
+		stability.WithStudyHook(func(s stability.Study) {
+			mu.Lock()
+			defer mu.Unlock()
+			studies = append(studies, s)
+		}))
+	assert.NoError(t, err)
+	tracker.Start()
+	defer tracker.Stop()
+	assert.NoError(t, st.Create(dcm))
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(studies) == 1 && len(series) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, dcm.StudyInstanceUID, studies[0].StudyInstanceUID)
+	assert.Equal(t, 1, studies[0].Series)
+	assert.Equal(t, 1, studies[0].Expected)
+
+	study, err := tracker.Study(dcm.StudyInstanceUID)
+	assert.NoError(t, err)
+	assert.True(t, study.Stable)
+	assert.Equal(t, 1, study.Instances)
+	s, err := tracker.Series(dcm.SeriesInstanceUID)
+	assert.NoError(t, err)
+	assert.True(t, s.Stable)
+	assert.Len(t, tracker.ListStudies(), 1)
+
+	// A study is gone once its instances are deleted
+	assert.NoError(t, st.Delete(testID))
+	assert.Eventually(t, func() bool {
+		_, err := tracker.Study(dcm.StudyInstanceUID)
+		return errors.Is(err, stability.ErrNotFound)
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,557 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	backupObjectsDir   = "objects"
+	backupSnapshotsDir = "snapshots"
+	manifestExt        = ".json"
+	snapshotIDFormat   = "20060102T150405.000Z"
+	maxCaptureAttempts = 5
+)
+
+var (
+	// logExts are the extensions of the append-only logs in a data directory,
+	// such as the change log, quota ledger and audit log, whose records are
+	// each a line
+	logExts = []string{".jsonl", ".log", ".instances"}
+)
+
+// Kinds of problem found by VerifyBackup
+const (
+	// ProblemMissingObject is a file of a snapshot whose content is missing
+	// from the backup directory
+	ProblemMissingObject = "missing-object"
+	// ProblemCorruptObject is a file of a snapshot whose content doesn't
+	// match its checksum
+	ProblemCorruptObject = "corrupt-object"
+)
+
+var (
+	// ErrBackupRunning is an error for starting a backup while one is running
+	ErrBackupRunning = errors.New("backup is already running")
+	// ErrNotEmpty is an error for restoring a backup in to a directory with
+	// files in it
+	ErrNotEmpty = errors.New("directory is not empty")
+)
+
+// BackupFile is a file of a data directory in a snapshot
+type BackupFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	SHA256  string    `json:"sha256"`
+}
+
+// Snapshot is a backup of a data directory. Copied is the number of files
+// whose content wasn't already in the backup directory.
+type Snapshot struct {
+	ID         string    `json:"id" example:"20240601T020000.000Z"`
+	Source     string    `json:"source" example:"data"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	Count      int       `json:"count" example:"2400"`
+	Size       int64     `json:"size" example:"1073741824"`
+	Copied     int       `json:"copied" example:"12"`
+	CopiedSize int64     `json:"copiedSize" example:"5242880"`
+}
+
+// Manifest is a snapshot and the checksums of its files
+type Manifest struct {
+	Snapshot
+	Files []BackupFile `json:"files"`
+}
+
+// VerifyReport is the result of verifying a snapshot against its manifest
+type VerifyReport struct {
+	Snapshot string    `json:"snapshot"`
+	Checked  int       `json:"checked"`
+	Problems []Problem `json:"problems"`
+}
+
+// Backup snapshots the files of a FileStore directory, including its DICOMs,
+// images, checksums and the journals and indexes of the server, in to a
+// backup directory. The content of each file is stored once under objects by
+// its SHA-256 checksum and a manifest of the files of the snapshot is written
+// under snapshots once every file is stored, so snapshots are incremental and
+// an interrupted backup leaves the earlier snapshots as they were. Files that
+// haven't changed size or modification time since the last snapshot aren't
+// read again.
+//
+// Backup doesn't block writes to the directory. DICOMs, images, checksums and
+// journals are renamed in to place when they are written so each is captured
+// whole, and a DICOM and its checksum are captured again if the DICOM is
+// stored again while they are read, so they are from the same write. The
+// append-only logs are appended to in place instead, so each is captured up
+// to the end of the last whole record when it is opened and a record being
+// appended is left out. A DICOM stored while the backup runs may be in the
+// snapshot or not.
+func Backup(dir, dest string) (*Manifest, error) {
+	started := time.Now().UTC()
+	for _, d := range []string{filepath.Join(dest, backupObjectsDir), filepath.Join(dest, backupSnapshotsDir)} {
+		err := os.MkdirAll(d, os.ModePerm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+	b := &backup{
+		fs:   &FileStore{dir: dir},
+		dest: dest,
+		prev: map[string]BackupFile{},
+		m: &Manifest{Snapshot: Snapshot{
+			ID:      started.Format(snapshotIDFormat),
+			Source:  dir,
+			Started: started,
+		}},
+		captured: map[string]bool{},
+	}
+	last, err := ReadManifest(dest, "")
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if last != nil {
+		for _, f := range last.Files {
+			b.prev[f.Path] = f
+		}
+	}
+
+	// Capture DICOMs with their checksums first, then everything else
+	files, err := b.walk()
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range files {
+		if strings.HasPrefix(rel, dicomDir+"/") && strings.HasSuffix(rel, dicomExt) {
+			err = b.captureDICOM(rel)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, rel := range files {
+		if b.captured[rel] {
+			continue
+		}
+		err = b.capture(rel)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	// Write the manifest last so the snapshot only exists once it is whole
+	sort.Slice(b.m.Files, func(i, j int) bool {
+		return b.m.Files[i].Path < b.m.Files[j].Path
+	})
+	b.m.Finished = time.Now().UTC()
+	path := filepath.Join(dest, backupSnapshotsDir, b.m.ID+manifestExt)
+	tmp, err := writeTemp(path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(b.m)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write manifest: %w", err)
+	}
+	defer os.Remove(tmp)
+	err = commit(tmp, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return b.m, nil
+}
+
+// ReadManifest reads the manifest of a snapshot in a backup directory, or of
+// the latest snapshot if id is empty
+func ReadManifest(dest, id string) (*Manifest, error) {
+	if id == "" {
+		entries, err := os.ReadDir(filepath.Join(dest, backupSnapshotsDir))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read snapshots: %w", err)
+		}
+		for _, e := range entries {
+			name := e.Name()
+			if strings.HasSuffix(name, manifestExt) && !strings.HasPrefix(name, ".") {
+				id = max(id, strings.TrimSuffix(name, manifestExt))
+			}
+		}
+		if id == "" {
+			return nil, fmt.Errorf("no snapshots in %s: %w", dest, ErrNotFound)
+		}
+	}
+	if strings.ContainsAny(id, `/\`) {
+		return nil, ErrNotFound
+	}
+	b, err := os.ReadFile(filepath.Join(dest, backupSnapshotsDir, id+manifestExt))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("snapshot %s: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var m Manifest
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// Restore the files of a snapshot in a backup directory, or of the latest
+// snapshot if id is empty, in to a data directory that is empty or doesn't
+// exist. The content of each file is verified against its checksum as it is
+// restored. The server must not be running on the data directory.
+func Restore(dest, id, dir string) (*Manifest, error) {
+	m, err := ReadManifest(dest, id)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+	if len(entries) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotEmpty, dir)
+	}
+
+	for _, f := range m.Files {
+		if !filepath.IsLocal(filepath.FromSlash(f.Path)) {
+			return nil, fmt.Errorf("invalid path in manifest: %s", f.Path)
+		}
+		path := filepath.Join(dir, filepath.FromSlash(f.Path))
+		err := restoreFile(objectPath(dest, f.SHA256), path, f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %w", f.Path, err)
+		}
+	}
+	return m, nil
+}
+
+// VerifyBackup checks that the content of every file of a snapshot in a
+// backup directory, or of the latest snapshot if id is empty, is stored and
+// matches its checksum
+func VerifyBackup(dest, id string) (*VerifyReport, error) {
+	m, err := ReadManifest(dest, id)
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{Snapshot: m.ID, Problems: []Problem{}}
+	for _, f := range m.Files {
+		report.Checked++
+		sum, err := fileChecksum(objectPath(dest, f.SHA256))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			report.Problems = append(report.Problems, Problem{Path: f.Path, Kind: ProblemMissingObject})
+		case err != nil:
+			report.Problems = append(report.Problems, Problem{Path: f.Path, Kind: ProblemCorruptObject, Error: err.Error()})
+		case sum != f.SHA256:
+			report.Problems = append(report.Problems, Problem{Path: f.Path, Kind: ProblemCorruptObject,
+				Error: fmt.Sprintf("checksum is %s", sum)})
+		}
+	}
+	return report, nil
+}
+
+// backup is a snapshot in progress
+type backup struct {
+	fs       *FileStore
+	dest     string
+	prev     map[string]BackupFile
+	m        *Manifest
+	captured map[string]bool
+}
+
+// walk returns the slash separated paths of the files in the data directory
+// relative to it, skipping temp files, quarantined files and the backup
+// directory if it is in the data directory
+func (b *backup) walk() ([]string, error) {
+	dest, err := filepath.Abs(b.dest)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	err = filepath.WalkDir(b.fs.dir, func(file string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(b.fs.dir, file)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			abs, err := filepath.Abs(file)
+			if err != nil {
+				return err
+			}
+			if abs == dest || rel == quarantineDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(d.Name(), tmpExt) {
+			return nil
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk directory: %w", err)
+	}
+	return files, nil
+}
+
+// captureDICOM captures a DICOM file and its checksum, again if the DICOM is
+// stored again while they are read
+func (b *backup) captureDICOM(rel string) error {
+	id := strings.TrimSuffix(filepath.Base(rel), dicomExt)
+	sumRel, err := filepath.Rel(b.fs.dir, b.fs.path(checksumDir, id, checksumExt))
+	if err != nil {
+		return err
+	}
+	sumRel = filepath.ToSlash(sumRel)
+	for attempt := 1; ; attempt++ {
+		before := b.fs.checksum(id)
+		err := b.capture(rel)
+		if errors.Is(err, os.ErrNotExist) {
+			// deleted since the walk
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = b.capture(sumRel)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if b.fs.checksum(id) == before || attempt == maxCaptureAttempts {
+			return nil
+		}
+		slog.Info("Capturing dicom again as it was stored during backup", slog.String("id", id))
+	}
+}
+
+// capture the content of a file, reusing the content of the last snapshot if
+// the file hasn't changed since
+func (b *backup) capture(rel string) error {
+	f, err := os.Open(filepath.Join(b.fs.dir, filepath.FromSlash(rel)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if isLog(rel) {
+		size, err = recordsEnd(f, size)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", rel, err)
+		}
+	}
+	file := BackupFile{Path: rel, Size: size, ModTime: info.ModTime().UTC()}
+	if prev, ok := b.prev[rel]; ok && prev.Size == file.Size && prev.ModTime.Equal(file.ModTime) {
+		if _, err := os.Stat(objectPath(b.dest, prev.SHA256)); err == nil {
+			b.add(prev)
+			return nil
+		}
+	}
+
+	// Copy the file to a temp file while hashing it, then rename it in to
+	// place by its checksum unless its content is already stored
+	hash := sha256.New()
+	cr := &countingReader{r: io.LimitReader(f, size)}
+	tmp, err := writeTemp(filepath.Join(b.dest, backupObjectsDir, "object"), func(w io.Writer) error {
+		_, err := io.Copy(io.MultiWriter(w, hash), cr)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy %s: %w", rel, err)
+	}
+	defer os.Remove(tmp)
+	file.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	file.Size = cr.n
+	obj := objectPath(b.dest, file.SHA256)
+	if _, err := os.Stat(obj); errors.Is(err, os.ErrNotExist) {
+		err = os.MkdirAll(filepath.Dir(obj), os.ModePerm)
+		if err == nil {
+			err = commit(tmp, obj)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to copy %s: %w", rel, err)
+		}
+		b.m.Copied++
+		b.m.CopiedSize += file.Size
+	}
+	b.add(file)
+	return nil
+}
+
+// isLog returns whether a file is an append-only log
+func isLog(rel string) bool {
+	return slices.Contains(logExts, path.Ext(rel))
+}
+
+// recordsEnd returns the offset just past the last newline in the first size
+// bytes of a log, which is the end of its last whole record
+func recordsEnd(f *os.File, size int64) (int64, error) {
+	buf := make([]byte, 4096)
+	for end := size; end > 0; {
+		n := min(end, int64(len(buf)))
+		_, err := f.ReadAt(buf[:n], end-n)
+		if err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			return end - n + int64(i) + 1, nil
+		}
+		end -= n
+	}
+	return 0, nil
+}
+
+// add a file to the manifest, replacing an earlier capture of it
+func (b *backup) add(file BackupFile) {
+	if b.captured[file.Path] {
+		for i, f := range b.m.Files {
+			if f.Path == file.Path {
+				b.m.Size -= f.Size
+				b.m.Files[i] = file
+				b.m.Size += file.Size
+				return
+			}
+		}
+	}
+	b.captured[file.Path] = true
+	b.m.Files = append(b.m.Files, file)
+	b.m.Count++
+	b.m.Size += file.Size
+}
+
+// restoreFile copies the content of a file from its object, verifying its
+// checksum, and sets its modification time
+func restoreFile(obj, path string, file BackupFile) error {
+	src, err := os.Open(obj)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	hash := sha256.New()
+	tmp, err := writeTemp(path, func(w io.Writer) error {
+		_, err := io.Copy(io.MultiWriter(w, hash), src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != file.SHA256 {
+		return fmt.Errorf("checksum is %s instead of %s", sum, file.SHA256)
+	}
+	err = commit(tmp, path)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, file.ModTime, file.ModTime)
+}
+
+// objectPath returns the path of the content of a file in a backup directory
+func objectPath(dest, sum string) string {
+	if len(sum) < 2 {
+		return filepath.Join(dest, backupObjectsDir, sum)
+	}
+	return filepath.Join(dest, backupObjectsDir, sum[:2], sum)
+}
+
+// BackupStatus is the progress of an OnlineBackup and its last snapshot
+type BackupStatus struct {
+	Dir     string     `json:"dir" example:"/backups/dime"`
+	Running bool       `json:"running"`
+	Started *time.Time `json:"started,omitempty"`
+	Last    *Snapshot  `json:"last,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// OnlineBackup backs up the data directory of a running server in the
+// background, one backup at a time
+type OnlineBackup struct {
+	dir  string
+	dest string
+
+	mu     sync.Mutex
+	status BackupStatus
+	done   chan struct{}
+}
+
+// NewOnlineBackup returns an OnlineBackup of a data directory in to a backup
+// directory
+func NewOnlineBackup(dir, dest string) *OnlineBackup {
+	o := &OnlineBackup{dir: dir, dest: dest, status: BackupStatus{Dir: dest}}
+	if m, err := ReadManifest(dest, ""); err == nil {
+		o.status.Last = &m.Snapshot
+	}
+	return o
+}
+
+// Start a backup in the background, returning ErrBackupRunning if one is
+// already running
+func (o *OnlineBackup) Start() (BackupStatus, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.status.Running {
+		return BackupStatus{}, ErrBackupRunning
+	}
+	started := time.Now().UTC()
+	o.status.Running = true
+	o.status.Started = &started
+	o.status.Error = ""
+	o.done = make(chan struct{})
+	go func() {
+		defer close(o.done)
+		slog.Info("Starting backup", slog.String("dir", o.dir), slog.String("to", o.dest))
+		m, err := Backup(o.dir, o.dest)
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.status.Running = false
+		if err != nil {
+			o.status.Error = err.Error()
+			slog.Error("Failed to back up", slog.String("error", err.Error()))
+			return
+		}
+		o.status.Last = &m.Snapshot
+		slog.Info("Finished backup", slog.String("snapshot", m.ID), slog.Int("count", m.Count),
+			slog.Int("copied", m.Copied), slog.Duration("took", m.Finished.Sub(m.Started)))
+	}()
+	return o.status, nil
+}
+
+// Status returns the progress of the OnlineBackup
+func (o *OnlineBackup) Status() BackupStatus {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.status
+}
+
+// Wait for a backup in progress to finish
+func (o *OnlineBackup) Wait() {
+	o.mu.Lock()
+	done := o.done
+	o.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
@@ -0,0 +1,169 @@
+package store_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+)
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	dest := t.TempDir()
+	st, err := store.NewFileStore(dir)
+	assert.NoError(t, err)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "jobs"), os.ModePerm))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "jobs", "journal.json"), []byte("{}"), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "dicom", ".partial.dcm.123.tmp"), []byte("partial"), 0600))
+
+	// The DICOM, its image and checksum and the journal are backed up
+	m, err := store.Backup(dir, dest)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, m.Count)
+	assert.Equal(t, 4, m.Copied)
+	paths := []string{}
+	for _, f := range m.Files {
+		paths = append(paths, f.Path)
+	}
+	assert.Contains(t, paths, "jobs/journal.json")
+	assert.NotContains(t, paths, "dicom/.partial.dcm.123.tmp")
+
+	// Unchanged files aren't copied again
+	time.Sleep(time.Millisecond)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "jobs", "journal.json"), []byte(`{"jobs":[]}`), 0600))
+	m2, err := store.Backup(dir, dest)
+	assert.NoError(t, err)
+	assert.NotEqual(t, m.ID, m2.ID)
+	assert.Equal(t, 4, m2.Count)
+	assert.Equal(t, 1, m2.Copied)
+	latest, err := store.ReadManifest(dest, "")
+	assert.NoError(t, err)
+	assert.Equal(t, m2.ID, latest.ID)
+
+	report, err := store.VerifyBackup(dest, m.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, report.Checked)
+	assert.Empty(t, report.Problems)
+
+	// The first snapshot is restored with its journal
+	restored := filepath.Join(t.TempDir(), "data")
+	_, err = store.Restore(dest, m.ID, restored)
+	assert.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(restored, "jobs", "journal.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", string(b))
+	rst, err := store.NewFileStore(restored)
+	assert.NoError(t, err)
+	read, err := rst.Read(testID)
+	assert.NoError(t, err)
+	assert.Equal(t, dcm.SHA256, read.SHA256)
+	fsck, err := store.Fsck(restored, false)
+	assert.NoError(t, err)
+	assert.Empty(t, fsck.Problems)
+
+	// Restoring in to a directory with files fails
+	_, err = store.Restore(dest, "", restored)
+	assert.ErrorIs(t, err, store.ErrNotEmpty)
+	_, err = store.Restore(dest, "unknown", t.TempDir())
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	// Corrupt and missing objects are reported
+	for _, f := range m2.Files {
+		obj := filepath.Join(dest, "objects", f.SHA256[:2], f.SHA256)
+		switch {
+		case f.Path == "jobs/journal.json":
+			assert.NoError(t, os.Remove(obj))
+		case strings.HasSuffix(f.Path, ".dcm"):
+			assert.NoError(t, os.WriteFile(obj, []byte("rot"), 0600))
+		}
+	}
+	report, err = store.VerifyBackup(dest, "")
+	assert.NoError(t, err)
+	kinds := map[string]string{}
+	for _, p := range report.Problems {
+		kinds[p.Path] = p.Kind
+	}
+	assert.Len(t, kinds, 2)
+	assert.Equal(t, store.ProblemMissingObject, kinds["jobs/journal.json"])
+}
+
+func TestBackupLog(t *testing.T) {
+	dir := t.TempDir()
+	dest := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "changes"), os.ModePerm))
+	log := filepath.Join(dir, "changes", "changes.jsonl")
+	assert.NoError(t, os.WriteFile(log, []byte("{\"seq\":1}\n{\"seq\":2}\n{\"se"), 0600))
+
+	// A record being appended to a log isn't captured
+	m, err := store.Backup(dir, dest)
+	assert.NoError(t, err)
+	assert.Len(t, m.Files, 1)
+	assert.Equal(t, int64(len("{\"seq\":1}\n{\"seq\":2}\n")), m.Files[0].Size)
+	restored := filepath.Join(t.TempDir(), "data")
+	_, err = store.Restore(dest, "", restored)
+	assert.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(restored, "changes", "changes.jsonl"))
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"seq\":1}\n{\"seq\":2}\n", string(b))
+
+	// Once the record is whole it is captured
+	f, err := os.OpenFile(log, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err)
+	_, err = f.WriteString("q\":3}\n")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	m, err = store.Backup(dir, dest)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, m.Copied)
+}
+
+func TestOnlineBackup(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.NewFileStore(dir)
+	assert.NoError(t, err)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+
+	// The backup directory can be in the data directory
+	dest := filepath.Join(dir, "backup")
+	ob := store.NewOnlineBackup(dir, dest)
+	assert.Nil(t, ob.Status().Last)
+	status, err := ob.Start()
+	assert.NoError(t, err)
+	assert.True(t, status.Running)
+
+	// DICOMs are stored while the backup runs
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, st.Create(dcm))
+		}
+	}()
+	ob.Wait()
+	<-done
+
+	status = ob.Status()
+	assert.False(t, status.Running)
+	assert.Empty(t, status.Error)
+	if assert.NotNil(t, status.Last) {
+		assert.Equal(t, 3, status.Last.Count)
+	}
+	report, err := store.VerifyBackup(dest, "")
+	assert.NoError(t, err)
+	assert.Empty(t, report.Problems)
+	assert.Equal(t, status.Last.ID, store.NewOnlineBackup(dir, dest).Status().Last.ID)
+}
@@ -0,0 +1,285 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+	"github.com/suyashkumar/dicom/pkg/uid"
+)
+
+// Compression methods of the DICOM files of a FileStore
+const (
+	// CompressionNone stores DICOM files as they are
+	CompressionNone = "none"
+	// CompressionDeflate stores DICOM files with a native transfer syntax in
+	// Deflated Explicit VR Little Endian, which losslessly compresses
+	// everything after the file meta information, including pixel data
+	CompressionDeflate = "deflate"
+)
+
+const (
+	// headerLen is the length of the preamble, magic word and file meta
+	// information group length element of a DICOM file
+	headerLen = 144
+	magicWord = "DICM"
+)
+
+// Compression is how a stored DICOM file is compressed. Size is the length of
+// the DICOM uncompressed and StoredSize the length of the file.
+type Compression struct {
+	Method     string  `json:"method" example:"deflate"`
+	Size       int64   `json:"size" example:"586394"`
+	StoredSize int64   `json:"storedSize" example:"261537"`
+	Ratio      float64 `json:"ratio" example:"2.24"`
+}
+
+// ParseCompression parses a compression method
+func ParseCompression(method string) (string, error) {
+	switch method {
+	case CompressionNone, CompressionDeflate:
+		return method, nil
+	default:
+		return "", fmt.Errorf("unknown compression %q", method)
+	}
+}
+
+// encodeDICOM writes a DICOM with a compression method. DICOMs whose pixel
+// data is already encapsulated, such as JPEG, are written as they are.
+func encodeDICOM(w io.Writer, dcm *DICOM, method string) error {
+	if method != CompressionDeflate || !deflatable(dcm.dataset) {
+		return dicom.Write(w, *dcm.dataset)
+	}
+	ds, err := withTransferSyntax(dcm.dataset, uid.DeflatedExplicitVRLittleEndian)
+	if err != nil {
+		return err
+	}
+	dw := &deflateWriter{w: w, left: -1}
+	err = dicom.Write(dw, ds)
+	if err != nil {
+		return err
+	}
+	return dw.Close()
+}
+
+// readDICOM parses a DICOM file, inflating it if it is deflated. The
+// returned dataset is Explicit VR Little Endian, along with how the file was
+// compressed, or nil if it wasn't.
+func readDICOM(file string) (*dicom.Dataset, *Compression, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	header, meta, err := readMeta(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	if metaTransferSyntax(meta) != uid.DeflatedExplicitVRLittleEndian {
+		ds, err := dicom.ParseUntilEOF(io.MultiReader(bytes.NewReader(header), bytes.NewReader(meta), br), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &ds, nil, nil
+	}
+
+	fr := flate.NewReader(br)
+	defer fr.Close()
+	cr := &countingReader{r: io.MultiReader(bytes.NewReader(header), bytes.NewReader(meta), fr)}
+	ds, err := dicom.ParseUntilEOF(cr, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	inflated, err := withTransferSyntax(&ds, uid.ExplicitVRLittleEndian)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &Compression{Method: CompressionDeflate, Size: cr.n, StoredSize: info.Size()}
+	if c.StoredSize > 0 {
+		c.Ratio = float64(c.Size) / float64(c.StoredSize)
+	}
+	return &inflated, c, nil
+}
+
+// fileTransferSyntax returns the transfer syntax of a DICOM file without
+// parsing its dataset
+func fileTransferSyntax(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, meta, err := readMeta(bufio.NewReader(f))
+	if err != nil {
+		return "", err
+	}
+	return metaTransferSyntax(meta), nil
+}
+
+// readMeta reads the header and file meta information of a DICOM file. If
+// the file doesn't start with them nothing is read.
+func readMeta(br *bufio.Reader) (header, meta []byte, err error) {
+	header, err = br.Peek(headerLen)
+	if err != nil || string(header[128:132]) != magicWord || binary.LittleEndian.Uint16(header[132:]) != tag.MetadataGroup {
+		return nil, nil, nil
+	}
+	header = append([]byte(nil), header...)
+	_, _ = br.Discard(headerLen)
+	meta = make([]byte, binary.LittleEndian.Uint32(header[140:]))
+	_, err = io.ReadFull(br, meta)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read file meta information: %w", err)
+	}
+	return header, meta, nil
+}
+
+// deflatable returns whether a dataset has a native transfer syntax that can
+// be rewritten as Deflated Explicit VR Little Endian
+func deflatable(ds *dicom.Dataset) bool {
+	el, err := ds.FindElementByTag(tag.TransferSyntaxUID)
+	if err != nil {
+		return false
+	}
+	ts, ok := el.Value.GetValue().([]string)
+	if !ok || len(ts) == 0 {
+		return false
+	}
+	switch strings.TrimRight(ts[0], "\x00 ") {
+	case uid.ImplicitVRLittleEndian, uid.ExplicitVRLittleEndian:
+		return true
+	}
+	return false
+}
+
+// withTransferSyntax returns a copy of a dataset with a transfer syntax,
+// sharing its elements
+func withTransferSyntax(ds *dicom.Dataset, ts string) (dicom.Dataset, error) {
+	el, err := dicom.NewElement(tag.TransferSyntaxUID, []string{ts})
+	if err != nil {
+		return dicom.Dataset{}, err
+	}
+	c := dicom.Dataset{Elements: make([]*dicom.Element, 0, len(ds.Elements))}
+	for _, e := range ds.Elements {
+		if e.Tag == tag.TransferSyntaxUID {
+			e = el
+		}
+		c.Elements = append(c.Elements, e)
+	}
+	return c, nil
+}
+
+// metaTransferSyntax returns the transfer syntax in the file meta information
+// of a DICOM file, which is always Explicit VR Little Endian
+func metaTransferSyntax(meta []byte) string {
+	for len(meta) >= 8 {
+		group := binary.LittleEndian.Uint16(meta)
+		element := binary.LittleEndian.Uint16(meta[2:])
+		offset, length := 8, int(binary.LittleEndian.Uint16(meta[6:]))
+		switch string(meta[4:6]) {
+		case "OB", "OW", "OF", "SQ", "UT", "UN":
+			if len(meta) < 12 {
+				return ""
+			}
+			offset, length = 12, int(binary.LittleEndian.Uint32(meta[8:]))
+		}
+		if length < 0 || offset+length > len(meta) {
+			return ""
+		}
+		if group == tag.TransferSyntaxUID.Group && element == tag.TransferSyntaxUID.Element {
+			return strings.TrimRight(string(meta[offset:offset+length]), "\x00 ")
+		}
+		meta = meta[offset+length:]
+	}
+	return ""
+}
+
+// deflateWriter passes the preamble and file meta information of a DICOM
+// file through as they are written and deflates the rest
+type deflateWriter struct {
+	w      io.Writer
+	header []byte
+	left   int64
+	fw     *flate.Writer
+}
+
+func (d *deflateWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		switch {
+		case d.fw != nil:
+			_, err := d.fw.Write(p)
+			return n, err
+		case d.left < 0:
+			// Buffer the header until the length of the meta information is known
+			take := min(len(p), headerLen-len(d.header))
+			d.header = append(d.header, p[:take]...)
+			p = p[take:]
+			if len(d.header) < headerLen {
+				continue
+			}
+			if string(d.header[128:132]) != magicWord {
+				return 0, errors.New("failed to deflate dicom: missing magic word")
+			}
+			_, err := d.w.Write(d.header)
+			if err != nil {
+				return 0, err
+			}
+			d.left = int64(binary.LittleEndian.Uint32(d.header[140:]))
+		case d.left > 0:
+			take := min(int64(len(p)), d.left)
+			_, err := d.w.Write(p[:take])
+			if err != nil {
+				return 0, err
+			}
+			d.left -= take
+			p = p[take:]
+		default:
+			fw, err := flate.NewWriter(d.w, flate.DefaultCompression)
+			if err != nil {
+				return 0, err
+			}
+			d.fw = fw
+		}
+	}
+	return n, nil
+}
+
+// Close flushes the deflated data
+func (d *deflateWriter) Close() error {
+	if d.fw == nil {
+		if d.left != 0 {
+			return errors.New("failed to deflate dicom: truncated file meta information")
+		}
+		fw, err := flate.NewWriter(d.w, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		d.fw = fw
+	}
+	return d.fw.Close()
+}
+
+// countingReader counts the bytes read from a reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
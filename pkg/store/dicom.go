@@ -1,6 +1,7 @@
 package store
 
 import (
+	"errors"
 	"fmt"
 	"image"
 
@@ -8,12 +9,19 @@ import (
 	"github.com/suyashkumar/dicom/pkg/tag"
 )
 
-// DICOM is a model that represents a DICOM image
+// DICOM is a model that represents a DICOM image. SHA256 is the checksum of
+// the DICOM as stored, recorded when it was created, and Compression is how
+// it is compressed if it is stored compressed.
 type DICOM struct {
-	ID                string `json:"id" example:"1.3.12.2.1107.5.2.6.24119.30000013121716094326500000436"`
-	StudyInstanceUID  string `json:"studyInstanceUID" example:"1.2.840.114202.4.833393677.4209323108.691055951.3610221745"`
-	SeriesInstanceUID string `json:"seriesInstanceUID" example:"1.3.12.2.1107.5.2.6.24119.30000013121716094326500000394"`
-	dataset           *dicom.Dataset
+	ID                string       `json:"id" example:"1.3.12.2.1107.5.2.6.24119.30000013121716094326500000436"`
+	StudyInstanceUID  string       `json:"studyInstanceUID" example:"1.2.840.114202.4.833393677.4209323108.691055951.3610221745"`
+	SeriesInstanceUID string       `json:"seriesInstanceUID" example:"1.3.12.2.1107.5.2.6.24119.30000013121716094326500000394"`
+	SHA256            string       `json:"sha256,omitempty" example:"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"`
+	Compression       *Compression `json:"compression,omitempty"`
+	// Tenant is the tenant a DICOM is created for, whose quota it is
+	// accounted against. It isn't stored.
+	Tenant  string `json:"-"`
+	dataset *dicom.Dataset
 }
 
 // NewDICOM returns a new DICOM instance
@@ -61,9 +69,13 @@ func (d *DICOM) Dataset() *dicom.Dataset {
 	return d.dataset
 }
 
-// Image returns the DICOM as an image.Image
+// Image returns the DICOM as an image.Image, or nil if the DICOM has no
+// pixel data such as a structured report
 func (d *DICOM) Image() (*image.Image, error) {
 	pixelDataElement, err := d.dataset.FindElementByTag(tag.PixelData)
+	if errors.Is(err, dicom.ErrorElementNotFound) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to find pixel data: %w", err)
 	}
@@ -0,0 +1,445 @@
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"os"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+	"github.com/suyashkumar/dicom/pkg/uid"
+)
+
+const (
+	keySize          = 32 // AES-256
+	encryptionVendor = "DIME ENCRYPTION"
+)
+
+// Private elements of an envelope, reserved by the private creator in
+// (0009,0010)
+var (
+	tagEncryptionCreator = tag.Tag{Group: 0x0009, Element: 0x0010}
+	tagEncryptionKeyID   = tag.Tag{Group: 0x0009, Element: 0x1001}
+	tagEncryptionKey     = tag.Tag{Group: 0x0009, Element: 0x1002}
+	tagEncryptedDICOM    = tag.Tag{Group: 0x0009, Element: 0x1003}
+	tagEncryptedPNG      = tag.Tag{Group: 0x0009, Element: 0x1004}
+)
+
+var (
+	// ErrUnknownKey is an error for an object encrypted with a key that is not
+	// in the keyring
+	ErrUnknownKey = errors.New("unknown encryption key")
+)
+
+// Keyring is a set of key encryption keys by ID. New objects are encrypted
+// with the primary key and objects encrypted with any key can be read.
+type Keyring struct {
+	Primary string            `json:"primary"`
+	Keys    map[string]string `json:"keys"`
+	keys    map[string]cipher.AEAD
+}
+
+// LoadKeyring loads a Keyring from a JSON file of base64 encoded 256-bit keys
+// by ID, e.g.
+//
+//	{"primary": "2024-06", "keys": {"2024-06": "...", "2023-01": "..."}}
+func LoadKeyring(file string) (*Keyring, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	var keyring Keyring
+	err = json.Unmarshal(b, &keyring)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key file: %w", err)
+	}
+	err = keyring.init()
+	if err != nil {
+		return nil, err
+	}
+	return &keyring, nil
+}
+
+// init decodes the keys of a Keyring
+func (k *Keyring) init() error {
+	k.keys = map[string]cipher.AEAD{}
+	for id, encoded := range k.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", id, err)
+		}
+		if len(key) != keySize {
+			return fmt.Errorf("key %s: must be %d bytes", id, keySize)
+		}
+		k.keys[id], err = newAEAD(key)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", id, err)
+		}
+	}
+	if _, ok := k.keys[k.Primary]; !ok {
+		return fmt.Errorf("primary key %q is not in the key file", k.Primary)
+	}
+	return nil
+}
+
+// EncryptedStore wraps a Store to encrypt DICOMs and their PNGs at rest with
+// envelope encryption. Each DICOM is encrypted with its own data key, which is
+// wrapped by the primary key of a Keyring. The wrapped store is given an
+// envelope DICOM with the same SOP Instance, Study and Series UIDs and the key
+// ID, wrapped data key and encrypted DICOM and PNG in private elements, so
+// no pixel data or other attributes are stored in plaintext. DICOMs stored
+// before encryption was enabled are read as they are.
+type EncryptedStore struct {
+	store   Store
+	keyring *Keyring
+}
+
+// NewEncryptedStore returns an EncryptedStore that wraps a store
+func NewEncryptedStore(store Store, keyring *Keyring) *EncryptedStore {
+	return &EncryptedStore{store, keyring}
+}
+
+// Unwrap returns the wrapped store
+func (es *EncryptedStore) Unwrap() Store {
+	return es.store
+}
+
+// Create an encrypted DICOM image along with its PNG
+func (es *EncryptedStore) Create(dcm *DICOM) error {
+	var b bytes.Buffer
+	err := dicom.Write(&b, *dcm.dataset)
+	if err != nil {
+		return fmt.Errorf("failed to write dicom: %w", err)
+	}
+	var pngBytes []byte
+	pngImg, err := dcm.Image()
+	if err != nil {
+		return fmt.Errorf("failed to get dicom image: %w", err)
+	}
+	if pngImg != nil {
+		var p bytes.Buffer
+		err = png.Encode(&p, *pngImg)
+		if err != nil {
+			return fmt.Errorf("failed to encode png file: %w", err)
+		}
+		pngBytes = p.Bytes()
+	}
+
+	// encrypt with a new data key
+	dataKey := make([]byte, keySize)
+	_, err = rand.Read(dataKey)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+	env := &envelope{
+		keyID: es.keyring.Primary,
+		dicom: seal(aead, b.Bytes(), []byte(dcm.ID+dicomExt)),
+	}
+	if pngBytes != nil {
+		env.png = seal(aead, pngBytes, []byte(dcm.ID+pngExt))
+	}
+	env.key = seal(es.keyring.keys[env.keyID], dataKey, []byte(env.keyID+"/"+dcm.ID))
+
+	// store envelope
+	sealed, err := env.toDICOM(dcm)
+	if err != nil {
+		return fmt.Errorf("failed to create envelope: %w", err)
+	}
+	err = es.store.Create(sealed)
+	if err != nil {
+		return err
+	}
+	dcm.SHA256 = sealed.SHA256
+	return nil
+}
+
+// Read and decrypt a DICOM image by SOP Instance UID
+func (es *EncryptedStore) Read(id string) (*DICOM, error) {
+	sealed, err := es.store.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	return es.open(sealed)
+}
+
+// GetImage gets the decrypted DICOM image as a byte array
+func (es *EncryptedStore) GetImage(id string) ([]byte, error) {
+	sealed, err := es.store.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	env, err := readEnvelope(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if env == nil {
+		return es.store.GetImage(id)
+	}
+	if env.png == nil {
+		return nil, ErrNotFound
+	}
+	aead, err := es.dataKey(sealed.ID, env)
+	if err != nil {
+		return nil, err
+	}
+	b, err := open(aead, env.png, []byte(sealed.ID+pngExt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt png: %w", err)
+	}
+	return b, nil
+}
+
+// List decrypted DICOM images
+func (es *EncryptedStore) List() ([]*DICOM, error) {
+	dicoms := []*DICOM{}
+	err := es.Walk(func(dcm *DICOM) error {
+		dicoms = append(dicoms, dcm)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dicoms, nil
+}
+
+// Walk the decrypted DICOM images, decrypting one at a time
+func (es *EncryptedStore) Walk(fn func(dcm *DICOM) error) error {
+	return Walk(es.store, func(sealed *DICOM) error {
+		dcm, err := es.open(sealed)
+		if err != nil {
+			return err
+		}
+		return fn(dcm)
+	})
+}
+
+// Delete an encrypted DICOM image
+func (es *EncryptedStore) Delete(id string) error {
+	return es.store.Delete(id)
+}
+
+// Rewrap the data keys of DICOMs that are not wrapped by the primary key with
+// the primary key, returning the number of DICOMs rewrapped. The DICOMs
+// themselves are not encrypted again, so a key can be retired once its DICOMs
+// are rewrapped. DICOMs are walked and rewrapped one at a time so an archive
+// of any size can be rewrapped.
+func (es *EncryptedStore) Rewrap() (int, error) {
+	rewrapped := 0
+	err := Walk(es.store, func(s *DICOM) error {
+		env, err := readEnvelope(s)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.ID, err)
+		}
+		if env == nil || env.keyID == es.keyring.Primary {
+			return nil
+		}
+		kek, ok := es.keyring.keys[env.keyID]
+		if !ok {
+			return fmt.Errorf("%s: %w %s", s.ID, ErrUnknownKey, env.keyID)
+		}
+		dataKey, err := open(kek, env.key, []byte(env.keyID+"/"+s.ID))
+		if err != nil {
+			return fmt.Errorf("%s: failed to unwrap data key: %w", s.ID, err)
+		}
+		env.keyID = es.keyring.Primary
+		env.key = seal(es.keyring.keys[env.keyID], dataKey, []byte(env.keyID+"/"+s.ID))
+		resealed, err := env.toDICOM(s)
+		if err != nil {
+			return fmt.Errorf("%s: failed to create envelope: %w", s.ID, err)
+		}
+		err = es.store.Create(resealed)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.ID, err)
+		}
+		rewrapped++
+		return nil
+	})
+	return rewrapped, err
+}
+
+// open decrypts an envelope DICOM, returning DICOMs stored in plaintext as
+// they are
+func (es *EncryptedStore) open(sealed *DICOM) (*DICOM, error) {
+	env, err := readEnvelope(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if env == nil {
+		return sealed, nil
+	}
+	aead, err := es.dataKey(sealed.ID, env)
+	if err != nil {
+		return nil, err
+	}
+	b, err := open(aead, env.dicom, []byte(sealed.ID+dicomExt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt dicom: %w", err)
+	}
+	dataset, err := dicom.ParseUntilEOF(bytes.NewReader(b), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse dicom: %w", err)
+	}
+	dcm, err := NewDICOM(&dataset)
+	if err != nil {
+		return nil, err
+	}
+	dcm.SHA256 = sealed.SHA256
+	return dcm, nil
+}
+
+// dataKey unwraps the data key of an envelope
+func (es *EncryptedStore) dataKey(id string, env *envelope) (cipher.AEAD, error) {
+	kek, ok := es.keyring.keys[env.keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownKey, env.keyID)
+	}
+	dataKey, err := open(kek, env.key, []byte(env.keyID+"/"+id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return newAEAD(dataKey)
+}
+
+// envelope is the encrypted form of a DICOM
+type envelope struct {
+	keyID string
+	key   []byte
+	dicom []byte
+	png   []byte
+}
+
+// readEnvelope reads the envelope of a DICOM, or nil if it is not encrypted
+func readEnvelope(sealed *DICOM) (*envelope, error) {
+	creator, err := sealed.dataset.FindElementByTag(tagEncryptionCreator)
+	if err != nil {
+		return nil, nil
+	}
+	if values, ok := creator.Value.GetValue().([]string); !ok || len(values) == 0 || values[0] != encryptionVendor {
+		return nil, nil
+	}
+	env := &envelope{}
+	for _, e := range []struct {
+		tag   tag.Tag
+		value *[]byte
+	}{{tagEncryptionKey, &env.key}, {tagEncryptedDICOM, &env.dicom}, {tagEncryptedPNG, &env.png}} {
+		element, err := sealed.dataset.FindElementByTag(e.tag)
+		if errors.Is(err, dicom.ErrorElementNotFound) && e.tag == tagEncryptedPNG {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid envelope: %w", err)
+		}
+		b, ok := element.Value.GetValue().([]byte)
+		if !ok {
+			return nil, errors.New("invalid envelope")
+		}
+		*e.value = b
+	}
+	element, err := sealed.dataset.FindElementByTag(tagEncryptionKeyID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid envelope: %w", err)
+	}
+	if values, ok := element.Value.GetValue().([]string); ok && len(values) > 0 {
+		env.keyID = values[0]
+	}
+	return env, nil
+}
+
+// toDICOM returns the envelope DICOM of an envelope with the UIDs of a DICOM
+func (env *envelope) toDICOM(dcm *DICOM) (*DICOM, error) {
+	sopClassUID := ""
+	if element, err := dcm.dataset.FindElementByTag(tag.SOPClassUID); err == nil {
+		if values, ok := element.Value.GetValue().([]string); ok && len(values) > 0 {
+			sopClassUID = values[0]
+		}
+	}
+	elements := []*dicom.Element{}
+	for _, e := range []struct {
+		tag   tag.Tag
+		value string
+	}{
+		{tag.MediaStorageSOPClassUID, sopClassUID},
+		{tag.MediaStorageSOPInstanceUID, dcm.ID},
+		{tag.TransferSyntaxUID, uid.ExplicitVRLittleEndian},
+		{tag.SOPClassUID, sopClassUID},
+		{tag.SOPInstanceUID, dcm.ID},
+		{tag.StudyInstanceUID, dcm.StudyInstanceUID},
+		{tag.SeriesInstanceUID, dcm.SeriesInstanceUID},
+	} {
+		element, err := dicom.NewElement(e.tag, []string{e.value})
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+	}
+	elements = append(elements,
+		privateElement(tagEncryptionCreator, "LO", []string{encryptionVendor}),
+		privateElement(tagEncryptionKeyID, "LO", []string{env.keyID}),
+		privateElement(tagEncryptionKey, "OB", env.key),
+		privateElement(tagEncryptedDICOM, "OB", env.dicom))
+	if env.png != nil {
+		elements = append(elements, privateElement(tagEncryptedPNG, "OB", env.png))
+	}
+	return NewDICOM(&dicom.Dataset{Elements: elements})
+}
+
+// privateElement returns a private element with a string list or bytes value
+func privateElement(t tag.Tag, vr string, data any) *dicom.Element {
+	value, _ := dicom.NewValue(data)
+	kind := tag.VRStringList
+	if _, ok := data.([]byte); ok {
+		kind = tag.VRBytes
+	}
+	return &dicom.Element{
+		Tag:                    t,
+		ValueRepresentation:    kind,
+		RawValueRepresentation: vr,
+		Value:                  value,
+	}
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce. DICOM pads odd length values,
+// so the sealed bytes start with a flag that is set when a padding byte was
+// added and are always of even length.
+func seal(aead cipher.AEAD, plaintext, data []byte) []byte {
+	sealed := make([]byte, 1+aead.NonceSize(), 2+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, _ = io.ReadFull(rand.Reader, sealed[1:])
+	sealed = aead.Seal(sealed, sealed[1:], plaintext, data)
+	if len(sealed)%2 == 1 {
+		sealed[0] = 1
+		sealed = append(sealed, 0)
+	}
+	return sealed
+}
+
+// open decrypts bytes sealed by seal
+func open(aead cipher.AEAD, sealed, data []byte) ([]byte, error) {
+	if len(sealed) > 0 && sealed[0] == 1 {
+		sealed = sealed[:len(sealed)-1]
+	}
+	if len(sealed) < 1+aead.NonceSize() {
+		return nil, errors.New("sealed value is too short")
+	}
+	nonce := sealed[1 : 1+aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[1+aead.NonceSize():], data)
+}
@@ -0,0 +1,140 @@
+package store_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// writeKeyring writes a key file with keys by ID
+func writeKeyring(t *testing.T, primary string, ids ...string) *store.Keyring {
+	keys := []string{}
+	for _, id := range ids {
+		key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte(id[:1]), 32))
+		keys = append(keys, `"`+id+`": "`+key+`"`)
+	}
+	file := filepath.Join(t.TempDir(), "keys.json")
+	content := `{"primary": "` + primary + `", "keys": {` + strings.Join(keys, ", ") + `}}`
+	assert.NoError(t, os.WriteFile(file, []byte(content), 0600))
+	keyring, err := store.LoadKeyring(file)
+	assert.NoError(t, err)
+	return keyring
+}
+
+func TestEncryptedStore(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := store.NewFileStore(dir)
+	assert.NoError(t, err)
+	st := store.NewEncryptedStore(fs, writeKeyring(t, "a", "a"))
+
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+
+	// Neither attributes nor images are stored in plaintext
+	dicoms := shardedFiles(t, dir, "dicom")
+	assert.Len(t, dicoms, 1)
+	b, err := os.ReadFile(dicoms[0])
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "NAYYAR^HARSH")
+	assert.Empty(t, shardedFiles(t, dir, "png"))
+	_, err = fs.GetImage(testID)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	// The wrapped store reads the envelope
+	sealed, err := fs.Read(testID)
+	assert.NoError(t, err)
+	assert.Equal(t, dcm.StudyInstanceUID, sealed.StudyInstanceUID)
+	assert.Equal(t, dcm.SHA256, sealed.SHA256)
+
+	read, err := st.Read(testID)
+	assert.NoError(t, err)
+	assert.Equal(t, dcm.ID, read.ID)
+	assert.Equal(t, dcm.SeriesInstanceUID, read.SeriesInstanceUID)
+	element, err := read.Dataset().FindElementByTag(tag.PatientName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"NAYYAR^HARSH"}, element.Value.GetValue())
+	img, err := st.GetImage(testID)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("\x89PNG"), img[:4])
+	list, err := st.List()
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	_, err = st.Read("unknown")
+	assert.ErrorIs(t, err, store.ErrNotFound)
+}
+
+func TestEncryptedStorePlaintext(t *testing.T) {
+	fs, err := store.NewFileStore(t.TempDir())
+	assert.NoError(t, err)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, fs.Create(dcm))
+
+	// DICOMs stored before encryption was enabled are read as they are
+	st := store.NewEncryptedStore(fs, writeKeyring(t, "a", "a"))
+	read, err := st.Read(testID)
+	assert.NoError(t, err)
+	assert.Equal(t, dcm.ID, read.ID)
+	img, err := st.GetImage(testID)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, img)
+	n, err := st.Rewrap()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestEncryptedStoreRewrap(t *testing.T) {
+	fs, err := store.NewFileStore(t.TempDir())
+	assert.NoError(t, err)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, store.NewEncryptedStore(fs, writeKeyring(t, "a", "a")).Create(dcm))
+
+	// Rotate to a new primary key
+	st := store.NewEncryptedStore(fs, writeKeyring(t, "b", "a", "b"))
+	_, err = st.Read(testID)
+	assert.NoError(t, err)
+	n, err := st.Rewrap()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = st.Rewrap()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// The old key can be retired
+	st = store.NewEncryptedStore(fs, writeKeyring(t, "b", "b"))
+	read, err := st.Read(testID)
+	assert.NoError(t, err)
+	assert.Equal(t, dcm.ID, read.ID)
+	img, err := st.GetImage(testID)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, img)
+	_, err = store.NewEncryptedStore(fs, writeKeyring(t, "a", "a")).Read(testID)
+	assert.ErrorIs(t, err, store.ErrUnknownKey)
+}
+
+func TestLoadKeyring(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.json")
+	assert.NoError(t, os.WriteFile(file, []byte(`{"primary": "a", "keys": {"a": "c2hvcnQ="}}`), 0600))
+	_, err := store.LoadKeyring(file)
+	assert.Error(t, err)
+	assert.NoError(t, os.WriteFile(file, []byte(`{"primary": "b", "keys": {}}`), 0600))
+	_, err = store.LoadKeyring(file)
+	assert.Error(t, err)
+}
@@ -0,0 +1,53 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EvictImages removes the least recently used PNG files until at least need
+// bytes are freed or no PNG files are left, returning the number of bytes
+// freed. PNGs are a cache of the images of DICOMs, so an evicted PNG is
+// rendered again the next time its image is read.
+func (fs *FileStore) EvictImages(need int64) (int64, error) {
+	type image struct {
+		path string
+		size int64
+		used time.Time
+	}
+	var images []image
+	err := walkFiles(filepath.Join(fs.dir, pngDir), func(file string) {
+		if !strings.HasSuffix(file, pngExt) {
+			return
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return
+		}
+		images = append(images, image{file, info.Size(), info.ModTime()})
+	})
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].used.Before(images[j].used)
+	})
+
+	var freed int64
+	for _, img := range images {
+		if freed >= need {
+			break
+		}
+		err := os.Remove(img.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return freed, fmt.Errorf("failed to remove png file: %w", err)
+		}
+		freed += img.size
+	}
+	return freed, nil
+}
@@ -1,118 +1,414 @@
 package store
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"image/png"
+	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
-
-	"github.com/suyashkumar/dicom"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
-	dicomDir = "dicom"
-	pngDir   = "png"
+	dicomDir    = "dicom"
+	pngDir      = "png"
+	checksumDir = "sha256"
+	dicomExt    = ".dcm"
+	pngExt      = ".png"
+	checksumExt = ".sha256"
+	tmpExt      = ".tmp"
 )
 
-// FileStore stores DICOM images on a file system
+// FileStore stores DICOM images on a file system. Files are sharded in to
+// two levels of directories by a hash of their SOP Instance UID, e.g.
+// dicom/3f/a2/{id}.dcm, so that no directory grows too large. Files in the
+// flat layout of earlier versions, e.g. dicom/{id}.dcm, are read until they
+// are migrated with Migrate. The SHA-256 checksum of each DICOM file is
+// recorded in the same layout under sha256, e.g. sha256/3f/a2/{id}.sha256.
+// DICOM files can be stored compressed, and are decompressed when they are
+// read whatever the compression of the FileStore.
 type FileStore struct {
-	dir string
+	dir         string
+	compression string
+}
+
+// FileStoreOption configures a FileStore
+type FileStoreOption func(*FileStore)
+
+// WithCompression sets the compression method that DICOM files are written
+// with
+func WithCompression(method string) FileStoreOption {
+	return func(fs *FileStore) {
+		fs.compression = method
+	}
 }
 
 // NewFileStore creates a FileStore
-func NewFileStore(dir string) (*FileStore, error) {
+func NewFileStore(dir string, opts ...FileStoreOption) (*FileStore, error) {
+	fs := &FileStore{dir: dir, compression: CompressionNone}
+	for _, opt := range opts {
+		opt(fs)
+	}
+	_, err := ParseCompression(fs.compression)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create directories if they don't exist
-	dirs := []string{dir, filepath.Join(dir, dicomDir), filepath.Join(dir, pngDir)}
+	dirs := []string{dir, filepath.Join(dir, dicomDir), filepath.Join(dir, pngDir), filepath.Join(dir, checksumDir)}
 	for _, dir := range dirs {
 		err := createDirIfNotExist(dir)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create directory: %w", err)
 		}
 	}
-	return &FileStore{dir}, nil
+	return fs, nil
 }
 
-// Create a DICOM image in the file system along with PNG file
+// Create a DICOM image in the file system along with PNG file. The PNG is
+// rendered before anything is written and each file is written to a synced
+// temp file that is renamed in to place, so a crash or failure never leaves a
+// partial file. The DICOM is renamed last so that it is only stored once its
+// PNG is, and the PNG is removed if the DICOM can't be. The checksum of the
+// DICOM file is recorded once it is in place. A DICOM whose ID is not a valid
+// UID fails with ErrInvalidID, since the ID names its files.
 func (fs *FileStore) Create(dcm *DICOM) error {
+	if !ValidUID(dcm.ID) {
+		return ErrInvalidID
+	}
 
-	// save DICOM to file system
-	dcmFile, err := os.Create(filepath.Join(fs.dir, dicomDir, fmt.Sprintf("%s.dcm", dcm.ID)))
+	// render PNG
+	var pngBytes []byte
+	pngImg, err := dcm.Image()
 	if err != nil {
-		return fmt.Errorf("failed to create dicom file: %w", err)
+		return fmt.Errorf("failed to get dicom image: %w", err)
 	}
-	defer dcmFile.Close()
-	err = dicom.Write(dcmFile, *dcm.dataset)
+	if pngImg != nil {
+		var b bytes.Buffer
+		err = png.Encode(&b, *pngImg)
+		if err != nil {
+			return fmt.Errorf("failed to encode png file: %w", err)
+		}
+		pngBytes = b.Bytes()
+	}
+
+	// write DICOM to a temp file
+	dcmPath := fs.path(dicomDir, dcm.ID, dicomExt)
+	hash := sha256.New()
+	dcmTmp, err := writeTemp(dcmPath, func(w io.Writer) error {
+		return encodeDICOM(io.MultiWriter(w, hash), dcm, fs.compression)
+	})
 	if err != nil {
 		return fmt.Errorf("failed to write dicom file: %w", err)
 	}
+	defer os.Remove(dcmTmp)
 
 	// save PNG to file system
-	pngFile, err := os.Create(filepath.Join(fs.dir, pngDir, fmt.Sprintf("%s.png", dcm.ID)))
-	if err != nil {
-		return fmt.Errorf("failed to create png file: %w", err)
+	pngPath := fs.path(pngDir, dcm.ID, pngExt)
+	if pngBytes != nil {
+		pngTmp, err := writeTemp(pngPath, func(w io.Writer) error {
+			_, err := w.Write(pngBytes)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write png file: %w", err)
+		}
+		defer os.Remove(pngTmp)
+		err = commit(pngTmp, pngPath)
+		if err != nil {
+			return fmt.Errorf("failed to write png file: %w", err)
+		}
 	}
-	defer pngFile.Close()
-	pngImg, err := dcm.Image()
-	if err != nil {
-		return fmt.Errorf("failed to get dicom image: %w", err)
+
+	// save DICOM to file system, removing the checksum of any earlier DICOM
+	// first so it is never compared with this one
+	sumPath := fs.path(checksumDir, dcm.ID, checksumExt)
+	err = os.Remove(sumPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove checksum file: %w", err)
 	}
-	if pngImg != nil {
-		err = png.Encode(pngFile, *pngImg)
-		if err != nil {
-			return fmt.Errorf("failed to encode png file: %w", err)
+	err = commit(dcmTmp, dcmPath)
+	if err != nil {
+		if pngBytes != nil {
+			os.Remove(pngPath)
 		}
+		return fmt.Errorf("failed to write dicom file: %w", err)
+	}
+	if pngBytes == nil {
+		os.Remove(pngPath)
+	}
+
+	// record checksum of DICOM
+	sum := hex.EncodeToString(hash.Sum(nil))
+	err = fs.writeChecksum(dcm.ID, sum)
+	if err != nil {
+		return fmt.Errorf("failed to write checksum file: %w", err)
 	}
+	dcm.SHA256 = sum
+
+	// remove files of the same DICOM in the flat layout
+	os.Remove(fs.flatPath(dicomDir, dcm.ID, dicomExt))
+	os.Remove(fs.flatPath(pngDir, dcm.ID, pngExt))
 	return nil
 }
 
 // Read a DICOM image from the file system by SOP Instance UID
 func (fs *FileStore) Read(id string) (*DICOM, error) {
-	fi, err := os.Stat(filepath.Join(fs.dir, dicomDir, fmt.Sprintf("%s.dcm", id)))
+	file, err := fs.find(dicomDir, id, dicomExt)
 	if err != nil {
-		return nil, ErrNotFound
+		return nil, err
 	}
-	dataset, err := dicom.ParseFile(filepath.Join(fs.dir, dicomDir, fi.Name()), nil)
+	dataset, compression, err := readDICOM(file)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse dicom file: %w", err)
 	}
-	dcm, err := NewDICOM(&dataset)
+	dcm, err := NewDICOM(dataset)
 	if err != nil {
 		return nil, err
 	}
+	dcm.SHA256 = fs.checksum(id)
+	dcm.Compression = compression
 	return dcm, nil
 }
 
-// GetImage gets DICOM image as a byte array
+// GetImage gets DICOM image as a byte array. A PNG that was evicted is
+// rendered again from its DICOM.
 func (fs *FileStore) GetImage(id string) ([]byte, error) {
-	_, err := os.Stat(filepath.Join(fs.dir, pngDir, fmt.Sprintf("%s.png", id)))
+	file, err := fs.find(pngDir, id, pngExt)
+	if errors.Is(err, ErrNotFound) {
+		file, err = fs.rerender(id)
+	}
 	if err != nil {
-		return nil, ErrNotFound
+		return nil, err
 	}
-	b, err := os.ReadFile(filepath.Join(fs.dir, pngDir, fmt.Sprintf("%s.png", id)))
+	b, err := os.ReadFile(file)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read png file: %w", err)
 	}
+
+	// Mark the PNG as recently used so that it is evicted last
+	now := time.Now()
+	_ = os.Chtimes(file, now, now)
 	return b, nil
 }
 
+// rerender the PNG of a DICOM whose PNG was evicted, returning its path
+func (fs *FileStore) rerender(id string) (string, error) {
+	dcm, err := fs.Read(id)
+	if err != nil {
+		return "", err
+	}
+	err = fs.render(dcm)
+	if errors.Is(err, errNoImage) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to render png file: %w", err)
+	}
+	return fs.path(pngDir, id, pngExt), nil
+}
+
 // List DICOM images from the file system by SOP Instance UID
 func (fs *FileStore) List() ([]*DICOM, error) {
 	dicoms := []*DICOM{}
-	files, _ := os.ReadDir(filepath.Join(fs.dir, dicomDir))
-	for _, file := range files {
-		dataset, err := dicom.ParseFile(filepath.Join(fs.dir, dicomDir, file.Name()), nil)
+	err := fs.Walk(func(dcm *DICOM) error {
+		dicoms = append(dicoms, dcm)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dicoms, nil
+}
+
+// Walk the DICOM images in the file system, reading one at a time
+func (fs *FileStore) Walk(fn func(dcm *DICOM) error) error {
+	return filepath.WalkDir(filepath.Join(fs.dir, dicomDir), func(file string, d os.DirEntry, err error) error {
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse dicom file: %w", err)
+			return err
 		}
-		dcm, err := NewDICOM(&dataset)
+		if d.IsDir() || !strings.HasSuffix(d.Name(), dicomExt) {
+			return nil
+		}
+		dataset, compression, err := readDICOM(file)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("failed to parse dicom file: %w", err)
 		}
-		dicoms = append(dicoms, dcm)
+		dcm, err := NewDICOM(dataset)
+		if err != nil {
+			return err
+		}
+		dcm.SHA256 = fs.checksum(dcm.ID)
+		dcm.Compression = compression
+		return fn(dcm)
+	})
+}
+
+// Delete a DICOM image from the file system along with its PNG and checksum
+// files. The DICOM is removed first so a failure never leaves a DICOM without
+// its PNG.
+func (fs *FileStore) Delete(id string) error {
+	if _, err := fs.find(dicomDir, id, dicomExt); err != nil {
+		return err
 	}
-	return dicoms, nil
+	for _, kind := range []struct{ dir, ext string }{{dicomDir, dicomExt}, {pngDir, pngExt}, {checksumDir, checksumExt}} {
+		for _, file := range []string{fs.path(kind.dir, id, kind.ext), fs.flatPath(kind.dir, id, kind.ext)} {
+			err := os.Remove(file)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to remove file: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Migrate moves the files of a FileStore directory in the flat layout of
+// earlier versions in to the sharded layout, returning the number of files
+// moved. Files are renamed in place, so a migration that is interrupted can
+// be run again.
+func Migrate(dir string) (int, error) {
+	fs := &FileStore{dir: dir}
+	moved := 0
+	for _, kind := range []struct{ dir, ext string }{{dicomDir, dicomExt}, {pngDir, pngExt}} {
+		entries, err := os.ReadDir(filepath.Join(dir, kind.dir))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return moved, fmt.Errorf("failed to read directory: %w", err)
+		}
+		for _, e := range entries {
+			if e.IsDir() || !strings.HasSuffix(e.Name(), kind.ext) {
+				continue
+			}
+			id := strings.TrimSuffix(e.Name(), kind.ext)
+			to := fs.path(kind.dir, id, kind.ext)
+			err = os.MkdirAll(filepath.Dir(to), os.ModePerm)
+			if err != nil {
+				return moved, fmt.Errorf("failed to create directory: %w", err)
+			}
+			err = os.Rename(filepath.Join(dir, kind.dir, e.Name()), to)
+			if err != nil {
+				return moved, fmt.Errorf("failed to move file: %w", err)
+			}
+			moved++
+			if moved%10000 == 0 {
+				slog.Info("Migrating files", slog.Int("moved", moved))
+			}
+		}
+	}
+	return moved, nil
+}
+
+// path returns the path of a file in the sharded layout
+func (fs *FileStore) path(kind, id, ext string) string {
+	sum := sha256.Sum256([]byte(id))
+	hash := hex.EncodeToString(sum[:2])
+	return filepath.Join(fs.dir, kind, hash[:2], hash[2:], id+ext)
+}
+
+// flatPath returns the path of a file in the flat layout
+func (fs *FileStore) flatPath(kind, id, ext string) string {
+	return filepath.Join(fs.dir, kind, id+ext)
+}
+
+// find returns the path of a file in either layout
+func (fs *FileStore) find(kind, id, ext string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) {
+		return "", ErrNotFound
+	}
+	for _, file := range []string{fs.path(kind, id, ext), fs.flatPath(kind, id, ext)} {
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+// checksum returns the recorded checksum of a DICOM, or an empty string if
+// none was recorded
+func (fs *FileStore) checksum(id string) string {
+	b, err := os.ReadFile(fs.path(checksumDir, id, checksumExt))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// writeChecksum records the checksum of a DICOM
+func (fs *FileStore) writeChecksum(id, sum string) error {
+	sumPath := fs.path(checksumDir, id, checksumExt)
+	tmp, err := writeTemp(sumPath, func(w io.Writer) error {
+		_, err := io.WriteString(w, sum+"\n")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return commit(tmp, sumPath)
+}
+
+// writeTemp writes a temp file in the directory of path and syncs it,
+// returning the name of the temp file
+func writeTemp(path string, write func(w io.Writer) error) (string, error) {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*"+tmpExt)
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(f)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// commit renames a temp file in to place and syncs its directory so the
+// rename is durable
+func commit(tmp, path string) error {
+	err := os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs a directory, ignoring file systems that don't support it
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	err = d.Sync()
+	if err != nil && !errors.Is(err, os.ErrInvalid) && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+	return nil
 }
 
 func createDirIfNotExist(dir string) error {
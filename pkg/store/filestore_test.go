@@ -0,0 +1,387 @@
+package store_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+)
+
+// shardedFiles returns the sharded files of a kind in a data directory
+func shardedFiles(t *testing.T, dir, kind string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, kind, "*", "*", "*"))
+	assert.NoError(t, err)
+	return files
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.NewFileStore(dir)
+	assert.NoError(t, err)
+
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+
+	// Files are sharded by a hash of their ID
+	dicoms := shardedFiles(t, dir, "dicom")
+	assert.Len(t, dicoms, 1)
+	assert.Equal(t, testID+".dcm", filepath.Base(dicoms[0]))
+	assert.Len(t, shardedFiles(t, dir, "png"), 1)
+
+	read, err := st.Read(testID)
+	assert.NoError(t, err)
+	assert.Equal(t, dcm.StudyInstanceUID, read.StudyInstanceUID)
+	img, err := st.GetImage(testID)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, img)
+	list, err := st.List()
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	_, err = st.Read("unknown")
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	_, err = st.Read("../dicom")
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	// A DICOM whose ID is not a UID can't name a file outside the store
+	assert.ErrorIs(t, st.Create(&store.DICOM{ID: "../../escaped"}), store.ErrInvalidID)
+	_, err = os.Stat(filepath.Join(dir, "..", "escaped.dcm"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Deleting a DICOM deletes its PNG and checksum
+	assert.NoError(t, st.Delete(testID))
+	assert.Empty(t, shardedFiles(t, dir, "dicom"))
+	assert.Empty(t, shardedFiles(t, dir, "png"))
+	assert.Empty(t, shardedFiles(t, dir, "sha256"))
+	_, err = st.Read(testID)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	assert.ErrorIs(t, st.Delete(testID), store.ErrNotFound)
+}
+
+func TestFileStoreMigrate(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.NewFileStore(dir)
+	assert.NoError(t, err)
+
+	// Write a DICOM in the flat layout
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+	flatDICOM := filepath.Join(dir, "dicom", testID+".dcm")
+	flatPNG := filepath.Join(dir, "png", testID+".png")
+	assert.NoError(t, os.WriteFile(flatDICOM, b, 0600))
+	assert.NoError(t, os.WriteFile(flatPNG, []byte("png"), 0600))
+
+	// The flat layout is read before migrating
+	read, err := st.Read(testID)
+	assert.NoError(t, err)
+	assert.Equal(t, testID, read.ID)
+	img, err := st.GetImage(testID)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("png"), img)
+	list, err := st.List()
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	moved, err := store.Migrate(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, moved)
+	assert.NoFileExists(t, flatDICOM)
+	assert.NoFileExists(t, flatPNG)
+	assert.Len(t, shardedFiles(t, dir, "dicom"), 1)
+	assert.Len(t, shardedFiles(t, dir, "png"), 1)
+
+	// The sharded layout is read after migrating
+	read, err = st.Read(testID)
+	assert.NoError(t, err)
+	assert.Equal(t, testID, read.ID)
+	img, err = st.GetImage(testID)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("png"), img)
+	list, err = st.List()
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	// Migrating again does nothing
+	moved, err = store.Migrate(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, moved)
+}
+
+func TestFileStoreCreateAtomic(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.NewFileStore(dir)
+	assert.NoError(t, err)
+
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+	assert.NoError(t, st.Create(dcm))
+
+	// No temp files are left behind
+	for _, kind := range []string{"dicom", "png"} {
+		files := shardedFiles(t, dir, kind)
+		assert.Len(t, files, 1)
+		for _, file := range files {
+			assert.NotContains(t, filepath.Base(file), ".tmp")
+		}
+	}
+}
+
+func TestFileStoreEvictImages(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.NewFileStore(dir)
+	assert.NoError(t, err)
+
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+	img, err := st.GetImage(testID)
+	assert.NoError(t, err)
+
+	// Nothing is evicted if nothing needs to be freed
+	freed, err := st.EvictImages(0)
+	assert.NoError(t, err)
+	assert.Zero(t, freed)
+	assert.Len(t, shardedFiles(t, dir, "png"), 1)
+
+	// An evicted PNG is rendered again when its image is read
+	freed, err = st.EvictImages(1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(img)), freed)
+	assert.Empty(t, shardedFiles(t, dir, "png"))
+	rendered, err := st.GetImage(testID)
+	assert.NoError(t, err)
+	assert.Equal(t, img, rendered)
+	assert.Len(t, shardedFiles(t, dir, "png"), 1)
+}
+
+func TestFsck(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.NewFileStore(dir)
+	assert.NoError(t, err)
+
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+
+	// A clean data directory has no problems
+	report, err := store.Fsck(dir, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Checked)
+	assert.Empty(t, report.Problems)
+
+	// Break the data directory
+	dicoms := shardedFiles(t, dir, "dicom")
+	assert.Len(t, dicoms, 1)
+	tmp := filepath.Join(filepath.Dir(dicoms[0]), "."+testID+".dcm.123.tmp")
+	assert.NoError(t, os.WriteFile(tmp, []byte("partial"), 0600))
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+	truncated := filepath.Join(dir, "dicom", "truncated.dcm")
+	assert.NoError(t, os.WriteFile(truncated, b[:len(b)/2], 0600))
+	orphan := filepath.Join(dir, "png", "orphan.png")
+	assert.NoError(t, os.WriteFile(orphan, []byte("png"), 0600))
+	pngs := shardedFiles(t, dir, "png")
+	assert.Len(t, pngs, 1)
+	assert.NoError(t, os.WriteFile(pngs[0], nil, 0600))
+
+	kinds := func(report *store.FsckReport) []string {
+		kinds := []string{}
+		for _, p := range report.Problems {
+			kinds = append(kinds, p.Kind)
+		}
+		return kinds
+	}
+	report, err = store.Fsck(dir, false)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{store.ProblemTemp, store.ProblemUnparsable,
+		store.ProblemInvalidImage, store.ProblemOrphan}, kinds(report))
+	assert.Equal(t, 4, report.Unrepaired())
+	assert.FileExists(t, tmp)
+
+	// Repair the data directory
+	report, err = store.Fsck(dir, true)
+	assert.NoError(t, err)
+	assert.Len(t, report.Problems, 4)
+	assert.Equal(t, 0, report.Unrepaired())
+	assert.NoFileExists(t, tmp)
+	assert.NoFileExists(t, truncated)
+	assert.NoFileExists(t, orphan)
+	assert.FileExists(t, filepath.Join(dir, "quarantine", "dicom", "truncated.dcm"))
+	assert.FileExists(t, filepath.Join(dir, "quarantine", "png", "orphan.png"))
+	img, err := st.GetImage(testID)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, img)
+
+	report, err = store.Fsck(dir, false)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Problems)
+}
+
+func TestScrubber(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.NewFileStore(dir)
+	assert.NoError(t, err)
+
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+
+	// The checksum of the DICOM file is recorded
+	dicoms := shardedFiles(t, dir, "dicom")
+	assert.Len(t, dicoms, 1)
+	b, err := os.ReadFile(dicoms[0])
+	assert.NoError(t, err)
+	sum := sha256.Sum256(b)
+	assert.Equal(t, hex.EncodeToString(sum[:]), dcm.SHA256)
+	read, err := st.Read(testID)
+	assert.NoError(t, err)
+	assert.Equal(t, dcm.SHA256, read.SHA256)
+
+	// A DICOM from an earlier version without a checksum
+	legacy := filepath.Join(dir, "dicom", "legacy.dcm")
+	assert.NoError(t, os.WriteFile(legacy, b, 0600))
+
+	// Flip a bit of the DICOM file
+	b[len(b)-1] ^= 1
+	assert.NoError(t, os.WriteFile(dicoms[0], b, 0600))
+
+	scrubber := store.NewScrubber(st, 1000, time.Hour)
+	scrubber.Start()
+	assert.Eventually(t, func() bool {
+		return scrubber.Status().Passes == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	scrubber.Stop()
+
+	status := scrubber.Status()
+	assert.Equal(t, 2, status.Checked)
+	assert.Equal(t, 1, status.Recorded)
+	assert.Len(t, status.Mismatches, 1)
+	assert.Equal(t, testID, status.Mismatches[0].ID)
+	assert.Equal(t, dcm.SHA256, status.Mismatches[0].Expected)
+	assert.NotEqual(t, dcm.SHA256, status.Mismatches[0].Actual)
+
+	// The mismatch is cleared once the DICOM is stored again
+	assert.NoError(t, st.Create(dcm))
+	scrubber.Start()
+	assert.Eventually(t, func() bool {
+		return scrubber.Status().Passes == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	scrubber.Stop()
+	status = scrubber.Status()
+	assert.Equal(t, 0, status.Recorded)
+	assert.Empty(t, status.Mismatches)
+}
+
+func TestFileStoreCompression(t *testing.T) {
+	_, err := store.NewFileStore(t.TempDir(), store.WithCompression("zip"))
+	assert.Error(t, err)
+
+	dir := t.TempDir()
+	st, err := store.NewFileStore(dir, store.WithCompression(store.CompressionDeflate))
+	assert.NoError(t, err)
+
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+
+	// The DICOM file is smaller than the original
+	info, err := os.Stat(testDataPath)
+	assert.NoError(t, err)
+	dicoms := shardedFiles(t, dir, "dicom")
+	assert.Len(t, dicoms, 1)
+	stored, err := os.Stat(dicoms[0])
+	assert.NoError(t, err)
+	assert.Less(t, stored.Size(), info.Size())
+
+	// The DICOM is decompressed when it is read
+	read, err := st.Read(testID)
+	assert.NoError(t, err)
+	assert.Equal(t, dcm.StudyInstanceUID, read.StudyInstanceUID)
+	assert.Equal(t, dcm.SHA256, read.SHA256)
+	if assert.NotNil(t, read.Compression) {
+		assert.Equal(t, store.CompressionDeflate, read.Compression.Method)
+		assert.Equal(t, stored.Size(), read.Compression.StoredSize)
+		assert.Greater(t, read.Compression.Ratio, 1.0)
+	}
+	img, err := read.Image()
+	assert.NoError(t, err)
+	assert.NotNil(t, img)
+
+	// A FileStore without compression reads compressed files
+	plain, err := store.NewFileStore(dir)
+	assert.NoError(t, err)
+	list, err := plain.List()
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+	assert.NotNil(t, list[0].Compression)
+	report, err := store.Fsck(dir, false)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Problems)
+}
+
+func TestRecompressor(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.NewFileStore(dir)
+	assert.NoError(t, err)
+
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+	read, err := st.Read(testID)
+	assert.NoError(t, err)
+	assert.Nil(t, read.Compression)
+
+	// DICOMs stored before compression was enabled are compressed
+	st, err = store.NewFileStore(dir, store.WithCompression(store.CompressionDeflate))
+	assert.NoError(t, err)
+	recompressor := store.NewRecompressor(st, 1000)
+	recompressor.Start()
+	assert.Eventually(t, func() bool {
+		return recompressor.Status().Finished != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	recompressor.Stop()
+	status := recompressor.Status()
+	assert.Equal(t, 1, status.Checked)
+	assert.Equal(t, 1, status.Recompressed)
+	assert.Less(t, status.BytesAfter, status.BytesBefore)
+	assert.Empty(t, status.Errors)
+
+	read, err = st.Read(testID)
+	assert.NoError(t, err)
+	assert.NotNil(t, read.Compression)
+	assert.NotEqual(t, dcm.SHA256, read.SHA256)
+	report, err := store.Fsck(dir, false)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Problems)
+
+	// Compressed DICOMs are left as they are
+	recompressor = store.NewRecompressor(st, 1000)
+	recompressor.Start()
+	assert.Eventually(t, func() bool {
+		return recompressor.Status().Finished != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	recompressor.Stop()
+	assert.Equal(t, 0, recompressor.Status().Recompressed)
+}
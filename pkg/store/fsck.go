@@ -0,0 +1,245 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+const (
+	quarantineDir = "quarantine"
+)
+
+// errNoImage is an error for rendering a DICOM without pixel data
+var errNoImage = errors.New("dicom has no image")
+
+// Kinds of problem found by Fsck
+const (
+	// ProblemTemp is a temp file left by an interrupted write
+	ProblemTemp = "temp"
+	// ProblemUnparsable is a DICOM file that is truncated or can't be parsed
+	ProblemUnparsable = "unparsable"
+	// ProblemMismatched is a DICOM file named for a different SOP Instance UID
+	ProblemMismatched = "mismatched"
+	// ProblemOrphan is a PNG file without a DICOM file
+	ProblemOrphan = "orphan"
+	// ProblemMissingImage is a DICOM file with pixel data but no PNG file
+	ProblemMissingImage = "missing-image"
+	// ProblemInvalidImage is a PNG file that can't be decoded
+	ProblemInvalidImage = "invalid-image"
+)
+
+// Actions taken by Fsck to repair a problem
+const (
+	// ActionRemoved is a file that was removed
+	ActionRemoved = "removed"
+	// ActionQuarantined is a file that was moved to the quarantine directory
+	ActionQuarantined = "quarantined"
+	// ActionRendered is a PNG file that was rendered from its DICOM file
+	ActionRendered = "rendered"
+)
+
+// Problem is a problem with a file in a FileStore directory or a backup
+type Problem struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Error  string `json:"error,omitempty"`
+	Action string `json:"action,omitempty"`
+}
+
+// FsckReport is the result of checking a FileStore directory
+type FsckReport struct {
+	Checked  int       `json:"checked"`
+	Problems []Problem `json:"problems"`
+}
+
+// Unrepaired returns the number of problems that were not repaired
+func (r *FsckReport) Unrepaired() int {
+	n := 0
+	for _, p := range r.Problems {
+		if p.Action == "" {
+			n++
+		}
+	}
+	return n
+}
+
+// Fsck checks the files of a FileStore directory for temp files left by
+// interrupted writes, truncated or unparsable DICOMs and missing, invalid or
+// orphaned PNGs. With repair, temp files are removed, PNGs are rendered again
+// and files that can't be repaired are moved to the quarantine directory
+// under the same relative path.
+func Fsck(dir string, repair bool) (*FsckReport, error) {
+	fs := &FileStore{dir: dir}
+	report := &FsckReport{Problems: []Problem{}}
+	fix := func(p Problem, action func() (string, error)) {
+		if repair {
+			done, err := action()
+			if err != nil {
+				p.Error = fmt.Sprintf("%s; failed to repair: %s", p.Error, err)
+			} else {
+				p.Action = done
+			}
+		}
+		report.Problems = append(report.Problems, p)
+	}
+	quarantine := func(file string) func() (string, error) {
+		return func() (string, error) {
+			return ActionQuarantined, fs.quarantine(file)
+		}
+	}
+
+	// DICOM files
+	err := walkFiles(filepath.Join(dir, dicomDir), func(file string) {
+		report.Checked++
+		if strings.HasSuffix(file, tmpExt) {
+			fix(Problem{Path: file, Kind: ProblemTemp}, func() (string, error) {
+				return ActionRemoved, os.Remove(file)
+			})
+			return
+		}
+		if !strings.HasSuffix(file, dicomExt) {
+			return
+		}
+		dataset, _, err := readDICOM(file)
+		if err != nil {
+			fix(Problem{Path: file, Kind: ProblemUnparsable, Error: err.Error()}, quarantine(file))
+			return
+		}
+		dcm, err := NewDICOM(dataset)
+		if err != nil {
+			fix(Problem{Path: file, Kind: ProblemUnparsable, Error: err.Error()}, quarantine(file))
+			return
+		}
+		id := strings.TrimSuffix(filepath.Base(file), dicomExt)
+		if dcm.ID != id {
+			fix(Problem{Path: file, Kind: ProblemMismatched,
+				Error: fmt.Sprintf("sop instance uid is %s", dcm.ID)}, quarantine(file))
+			return
+		}
+
+		// PNG of the DICOM
+		if _, err := dataset.FindElementByTag(tag.PixelData); err != nil {
+			return
+		}
+		pngFile, err := fs.find(pngDir, id, pngExt)
+		if err != nil {
+			fix(Problem{Path: file, Kind: ProblemMissingImage}, func() (string, error) {
+				return ActionRendered, fs.render(dcm)
+			})
+			return
+		}
+		b, err := os.ReadFile(pngFile)
+		if err == nil {
+			_, err = png.DecodeConfig(bytes.NewReader(b))
+		}
+		if err != nil {
+			fix(Problem{Path: pngFile, Kind: ProblemInvalidImage, Error: err.Error()}, func() (string, error) {
+				return ActionRendered, fs.render(dcm)
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// PNG files
+	err = walkFiles(filepath.Join(dir, pngDir), func(file string) {
+		report.Checked++
+		if strings.HasSuffix(file, tmpExt) {
+			fix(Problem{Path: file, Kind: ProblemTemp}, func() (string, error) {
+				return ActionRemoved, os.Remove(file)
+			})
+			return
+		}
+		if !strings.HasSuffix(file, pngExt) {
+			return
+		}
+		id := strings.TrimSuffix(filepath.Base(file), pngExt)
+		if _, err := fs.find(dicomDir, id, dicomExt); err != nil {
+			fix(Problem{Path: file, Kind: ProblemOrphan}, quarantine(file))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Checksum files
+	err = walkFiles(filepath.Join(dir, checksumDir), func(file string) {
+		if strings.HasSuffix(file, tmpExt) {
+			fix(Problem{Path: file, Kind: ProblemTemp}, func() (string, error) {
+				return ActionRemoved, os.Remove(file)
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// render the PNG of a DICOM again
+func (fs *FileStore) render(dcm *DICOM) error {
+	img, err := dcm.Image()
+	if err != nil {
+		return err
+	}
+	if img == nil {
+		return errNoImage
+	}
+	pngPath := fs.path(pngDir, dcm.ID, pngExt)
+	tmp, err := writeTemp(pngPath, func(w io.Writer) error {
+		return png.Encode(w, *img)
+	})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	err = commit(tmp, pngPath)
+	if err != nil {
+		return err
+	}
+	os.Remove(fs.flatPath(pngDir, dcm.ID, pngExt))
+	return nil
+}
+
+// quarantine moves a file to the quarantine directory
+func (fs *FileStore) quarantine(file string) error {
+	rel, err := filepath.Rel(fs.dir, file)
+	if err != nil {
+		return err
+	}
+	to := filepath.Join(fs.dir, quarantineDir, rel)
+	err = os.MkdirAll(filepath.Dir(to), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return os.Rename(file, to)
+}
+
+// walkFiles calls fn with each file under dir
+func walkFiles(dir string, fn func(file string)) error {
+	err := filepath.WalkDir(dir, func(file string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			fn(file)
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+	return nil
+}
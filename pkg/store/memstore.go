@@ -2,8 +2,12 @@ package store
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"image/png"
+
+	"github.com/suyashkumar/dicom"
 )
 
 // MemStore stores DICOM images in memory
@@ -22,6 +26,12 @@ func NewMemStore() (*MemStore, error) {
 
 // Create DICOM image in memory store
 func (ms *MemStore) Create(dcm *DICOM) error {
+	hash := sha256.New()
+	err := dicom.Write(hash, *dcm.dataset)
+	if err != nil {
+		return fmt.Errorf("failed to write dicom: %w", err)
+	}
+	dcm.SHA256 = hex.EncodeToString(hash.Sum(nil))
 	ms.dicoms[dcm.ID] = dcm
 
 	pngImg, err := dcm.Image()
@@ -55,6 +65,16 @@ func (ms *MemStore) GetImage(id string) ([]byte, error) {
 	return []byte{}, ErrNotFound
 }
 
+// Delete a DICOM image from memory by SOP Instance UID
+func (ms *MemStore) Delete(id string) error {
+	if _, ok := ms.dicoms[id]; !ok {
+		return ErrNotFound
+	}
+	delete(ms.dicoms, id)
+	delete(ms.pngs, id)
+	return nil
+}
+
 // List DICOM images from the file system
 func (ms *MemStore) List() ([]*DICOM, error) {
 	dcms := []*DICOM{}
@@ -0,0 +1,221 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/suyashkumar/dicom/pkg/uid"
+)
+
+var errRecompressStopped = errors.New("recompress stopped")
+
+// RecompressStatus is the progress of a Recompressor
+type RecompressStatus struct {
+	Dir          string     `json:"dir" example:"data"`
+	Method       string     `json:"method" example:"deflate"`
+	Rate         int        `json:"rate" example:"10"`
+	Running      bool       `json:"running"`
+	Checked      int        `json:"checked" example:"1200"`
+	Recompressed int        `json:"recompressed" example:"800"`
+	BytesBefore  int64      `json:"bytesBefore" example:"469115200"`
+	BytesAfter   int64      `json:"bytesAfter" example:"209229600"`
+	Started      *time.Time `json:"started,omitempty"`
+	Finished     *time.Time `json:"finished,omitempty"`
+	Errors       []string   `json:"errors,omitempty"`
+}
+
+// Recompressor compresses the DICOM files of a FileStore that were stored
+// uncompressed, such as those stored before compression was enabled, with the
+// compression method of the FileStore. It makes a single pass in the
+// background, reading files at a limited rate so it doesn't starve
+// requests of disk bandwidth. Each file is rewritten atomically and its
+// checksum recorded again, and a file created again or deleted while it is
+// rewritten is left as it is.
+type Recompressor struct {
+	fs   *FileStore
+	rate int
+
+	mu     sync.Mutex
+	status RecompressStatus
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewRecompressor returns a Recompressor that checks rate files per second
+func NewRecompressor(fs *FileStore, rate int) *Recompressor {
+	if rate <= 0 {
+		rate = 1
+	}
+	return &Recompressor{
+		fs:   fs,
+		rate: rate,
+		status: RecompressStatus{
+			Dir:    fs.dir,
+			Method: fs.compression,
+			Rate:   rate,
+		},
+	}
+}
+
+// Start recompressing in the background
+func (r *Recompressor) Start() {
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go func() {
+		defer close(r.done)
+		_ = r.pass()
+	}()
+}
+
+// Stop recompressing, waiting for a pass in progress to stop
+func (r *Recompressor) Stop() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+}
+
+// Status returns the progress of the Recompressor
+func (r *Recompressor) Status() RecompressStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := r.status
+	status.Errors = append([]string(nil), r.status.Errors...)
+	return status
+}
+
+// pass compresses every DICOM file that was stored uncompressed
+func (r *Recompressor) pass() error {
+	started := time.Now().UTC()
+	r.mu.Lock()
+	r.status.Running = true
+	r.status.Started = &started
+	r.mu.Unlock()
+	slog.Info("Starting recompression", slog.String("method", r.fs.compression), slog.Int("rate", r.rate))
+
+	ticker := time.NewTicker(time.Second / time.Duration(r.rate))
+	defer ticker.Stop()
+	err := filepath.WalkDir(filepath.Join(r.fs.dir, dicomDir), func(file string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), dicomExt) {
+			return nil
+		}
+		select {
+		case <-r.stop:
+			return errRecompressStopped
+		case <-ticker.C:
+		}
+
+		id := strings.TrimSuffix(d.Name(), dicomExt)
+		before, after, err := r.fs.recompress(id, file)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if err != nil {
+			r.status.Errors = append(r.status.Errors, err.Error())
+			slog.Error("Failed to recompress dicom file", slog.String("path", file), slog.String("error", err.Error()))
+			return nil
+		}
+		r.status.Checked++
+		if after > 0 {
+			r.status.Recompressed++
+			r.status.BytesBefore += before
+			r.status.BytesAfter += after
+		}
+		return nil
+	})
+
+	finished := time.Now().UTC()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.Running = false
+	if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, errRecompressStopped) {
+		r.status.Errors = append(r.status.Errors, err.Error())
+	}
+	if errors.Is(err, errRecompressStopped) {
+		return err
+	}
+	r.status.Finished = &finished
+	slog.Info("Finished recompression", slog.Int("checked", r.status.Checked),
+		slog.Int("recompressed", r.status.Recompressed), slog.Int64("bytesBefore", r.status.BytesBefore),
+		slog.Int64("bytesAfter", r.status.BytesAfter), slog.Duration("took", finished.Sub(started)))
+	return nil
+}
+
+// recompress rewrites a DICOM file with the compression method of the
+// FileStore if it was stored uncompressed and can be compressed, returning the
+// size of the file before and after, or zeros if it was left as it is
+func (fs *FileStore) recompress(id, file string) (int64, int64, error) {
+	ts, err := fileTransferSyntax(file)
+	if errors.Is(err, os.ErrNotExist) {
+		// removed or migrated since the walk
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read dicom file: %w", err)
+	}
+	if fs.compression == CompressionNone || (ts != uid.ImplicitVRLittleEndian && ts != uid.ExplicitVRLittleEndian) {
+		return 0, 0, nil
+	}
+
+	sum := fs.checksum(id)
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0, 0, nil
+	}
+	dataset, _, err := readDICOM(file)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse dicom file: %w", err)
+	}
+	dcm, err := NewDICOM(dataset)
+	if err != nil {
+		return 0, 0, err
+	}
+	hash := sha256.New()
+	tmp, err := writeTemp(file, func(w io.Writer) error {
+		return encodeDICOM(io.MultiWriter(w, hash), dcm, fs.compression)
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to write dicom file: %w", err)
+	}
+	defer os.Remove(tmp)
+	tmpInfo, err := os.Stat(tmp)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to write dicom file: %w", err)
+	}
+
+	// the DICOM may have been created again or deleted since it was read
+	if fs.checksum(id) != sum {
+		return 0, 0, nil
+	}
+	if _, err := os.Stat(file); err != nil {
+		return 0, 0, nil
+	}
+
+	// replace the DICOM file, removing its checksum first so it is never
+	// compared with the new file
+	err = os.Remove(fs.path(checksumDir, id, checksumExt))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, 0, fmt.Errorf("failed to remove checksum file: %w", err)
+	}
+	err = commit(tmp, file)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to write dicom file: %w", err)
+	}
+	err = fs.writeChecksum(id, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to write checksum file: %w", err)
+	}
+	return info.Size(), tmpInfo.Size(), nil
+}
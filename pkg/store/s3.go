@@ -0,0 +1,382 @@
+package store
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Service       = "s3"
+	s3Algorithm     = "AWS4-HMAC-SHA256"
+	s3TimeFormat    = "20060102T150405Z"
+	s3DateFormat    = "20060102"
+	s3ListMaxKeys   = 1000
+	s3ErrorBodySize = 4096
+)
+
+// s3Client is a minimal client for S3-compatible object storage that signs
+// requests with AWS Signature Version 4
+type s3Client struct {
+	endpoint     *url.URL
+	region       string
+	bucket       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	pathStyle    bool
+	client       *http.Client
+}
+
+// s3Error is an error response from S3
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3 responded %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// put uploads an object in a single request
+func (c *s3Client) put(key string, body []byte, contentType string) error {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	resp, err := c.do(http.MethodPut, key, nil, header, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// get downloads an object. The caller must close the body.
+func (c *s3Client) get(key string) (io.ReadCloser, error) {
+	resp, err := c.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// head checks that an object exists
+func (c *s3Client) head(key string) error {
+	resp, err := c.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// delete an object. Deleting an object that doesn't exist succeeds.
+func (c *s3Client) delete(key string) error {
+	resp, err := c.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// list returns the keys of the objects with a prefix
+func (c *s3Client) list(prefix string) ([]string, error) {
+	keys := []string{}
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		query.Set("max-keys", strconv.Itoa(s3ListMaxKeys))
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err := c.doXML(http.MethodGet, "", query, nil, &result)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range result.Contents {
+			keys = append(keys, obj.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// createMultipartUpload starts a multipart upload, returning its ID
+func (c *s3Client) createMultipartUpload(key, contentType string) (string, error) {
+	query := url.Values{}
+	query.Set("uploads", "")
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	resp, err := c.do(http.MethodPost, key, query, header, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode s3 response: %w", err)
+	}
+	return result.UploadID, nil
+}
+
+// uploadPart uploads a part of a multipart upload, returning its ETag
+func (c *s3Client) uploadPart(key, uploadID string, part int, body []byte) (string, error) {
+	query := url.Values{}
+	query.Set("partNumber", strconv.Itoa(part))
+	query.Set("uploadId", uploadID)
+	resp, err := c.do(http.MethodPut, key, query, nil, body)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// completeMultipartUpload assembles the uploaded parts into the object
+func (c *s3Client) completeMultipartUpload(key, uploadID string, etags []string) error {
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	for i, etag := range etags {
+		complete.Parts = append(complete.Parts, part{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	query.Set("uploadId", uploadID)
+	header := http.Header{}
+	header.Set("Content-Type", "application/xml")
+	resp, err := c.do(http.MethodPost, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// S3 can report an error with a 200 response once the upload has started
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read s3 response: %w", err)
+	}
+	if bytes.Contains(b, []byte("<Error>")) {
+		return decodeS3Error(resp.StatusCode, b)
+	}
+	return nil
+}
+
+// abortMultipartUpload discards the parts of a multipart upload
+func (c *s3Client) abortMultipartUpload(key, uploadID string) error {
+	query := url.Values{}
+	query.Set("uploadId", uploadID)
+	resp, err := c.do(http.MethodDelete, key, query, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// doXML sends a request and decodes the XML response into v
+func (c *s3Client) doXML(method, key string, query url.Values, body []byte, v any) error {
+	resp, err := c.do(method, key, query, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	err = xml.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("failed to decode s3 response: %w", err)
+	}
+	return nil
+}
+
+// do sends a signed request for a key, returning an *s3Error for
+// unsuccessful responses
+func (c *s3Client) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := c.objectURL(key)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 request: %w", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	c.sign(req, body, time.Now().UTC())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send s3 request: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, s3ErrorBodySize))
+		return nil, decodeS3Error(resp.StatusCode, b)
+	}
+	return resp, nil
+}
+
+// objectURL returns the URL of an object, or of the bucket for an empty key
+func (c *s3Client) objectURL(key string) *url.URL {
+	u := *c.endpoint
+	base := strings.TrimSuffix(u.Path, "/")
+	if c.pathStyle {
+		u.Path = base + "/" + c.bucket + "/" + key
+	} else {
+		u.Host = c.bucket + "." + u.Host
+		u.Path = base + "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	return &u
+}
+
+// sign a request with AWS Signature Version 4
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	// Canonical headers
+	names := []string{}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "host" || lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	date := now.Format(s3DateFormat)
+	scope := strings.Join([]string{date, c.region, s3Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		now.Format(s3TimeFormat),
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, c.accessKey, scope, signedHeaders, signature))
+	req.Header.Del("Host")
+}
+
+// decodeS3Error decodes an S3 error response
+func decodeS3Error(status int, b []byte) error {
+	e := &s3Error{Status: status}
+	if err := xml.Unmarshal(b, e); err != nil || e.Code == "" {
+		// responses to HEAD requests and some services have no body
+		if status == http.StatusNotFound {
+			e.Code = "NoSuchKey"
+		} else {
+			e.Code = http.StatusText(status)
+		}
+	}
+	if e.Code == "NoSuchKey" {
+		return fmt.Errorf("%w: %w", ErrNotFound, e)
+	}
+	return e
+}
+
+// canonicalQuery encodes a query string sorted by key as SigV4 requires
+func canonicalQuery(query url.Values) string {
+	keys := []string{}
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes every byte except unreserved characters, and
+// slashes unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && !encodeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// isNotFound returns whether an error is a missing object
+func isNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
@@ -0,0 +1,320 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/suyashkumar/dicom"
+)
+
+const (
+	defaultS3Region   = "us-east-1"
+	defaultS3PartSize = 16 << 20 // 16MB
+	dicomContentType  = "application/dicom"
+	pngContentType    = "image/png"
+	textContentType   = "text/plain"
+)
+
+// S3Config configures an S3Store
+type S3Config struct {
+	// Endpoint is the URL of the S3 service, e.g. https://s3.us-east-1.amazonaws.com
+	Endpoint string
+	// Region the bucket is in
+	Region string
+	// Bucket to store objects in
+	Bucket string
+	// Prefix of the keys of objects, e.g. dime/
+	Prefix string
+	// AccessKeyID, SecretAccessKey and SessionToken are the credentials
+	// requests are signed with
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// PathStyle addresses the bucket in the path rather than the host name,
+	// as most S3-compatible services require
+	PathStyle bool
+	// PartSize is the size in bytes of each part of a multipart upload.
+	// Objects up to this size are uploaded in a single request. S3 requires
+	// parts of at least 5MB.
+	PartSize int64
+}
+
+// S3Store stores DICOM images in S3-compatible object storage, with the same
+// layout of DICOM and PNG objects under a prefix as a FileStore directory
+type S3Store struct {
+	client   *s3Client
+	prefix   string
+	partSize int64
+}
+
+// NewS3Store creates an S3Store
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3 endpoint and bucket are required")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+	if cfg.Region == "" {
+		cfg.Region = defaultS3Region
+	}
+	if cfg.PartSize <= 0 {
+		cfg.PartSize = defaultS3PartSize
+	}
+	return &S3Store{
+		client: &s3Client{
+			endpoint:     endpoint,
+			region:       cfg.Region,
+			bucket:       cfg.Bucket,
+			accessKey:    cfg.AccessKeyID,
+			secretKey:    cfg.SecretAccessKey,
+			sessionToken: cfg.SessionToken,
+			pathStyle:    cfg.PathStyle,
+			client:       &http.Client{},
+		},
+		prefix:   cfg.Prefix,
+		partSize: cfg.PartSize,
+	}, nil
+}
+
+// Create a DICOM image in object storage along with PNG object and the
+// checksum of the DICOM object. A DICOM whose ID is not a valid UID fails
+// with ErrInvalidID, since the ID names its objects.
+func (s *S3Store) Create(dcm *DICOM) error {
+	if !ValidUID(dcm.ID) {
+		return ErrInvalidID
+	}
+
+	// save DICOM to object storage, streaming it in parts
+	pr, pw := io.Pipe()
+	hash := sha256.New()
+	go func() {
+		pw.CloseWithError(dicom.Write(io.MultiWriter(pw, hash), *dcm.dataset))
+	}()
+	err := s.upload(s.dicomKey(dcm.ID), pr, dicomContentType)
+	pr.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("failed to write dicom object: %w", err)
+	}
+
+	// save PNG to object storage
+	pngImg, err := dcm.Image()
+	if err != nil {
+		return fmt.Errorf("failed to get dicom image: %w", err)
+	}
+	if pngImg != nil {
+		var b bytes.Buffer
+		err = png.Encode(&b, *pngImg)
+		if err != nil {
+			return fmt.Errorf("failed to encode png file: %w", err)
+		}
+		err = s.upload(s.pngKey(dcm.ID), &b, pngContentType)
+		if err != nil {
+			return fmt.Errorf("failed to write png object: %w", err)
+		}
+	}
+
+	// record checksum of DICOM
+	sum := hex.EncodeToString(hash.Sum(nil))
+	err = s.client.put(s.checksumKey(dcm.ID), []byte(sum+"\n"), textContentType)
+	if err != nil {
+		return fmt.Errorf("failed to write checksum object: %w", err)
+	}
+	dcm.SHA256 = sum
+	return nil
+}
+
+// Read a DICOM image from object storage by SOP Instance UID
+func (s *S3Store) Read(id string) (*DICOM, error) {
+	if !validKey(id) {
+		return nil, ErrNotFound
+	}
+	return s.read(s.dicomKey(id), id)
+}
+
+// GetImage gets DICOM image as a byte array
+func (s *S3Store) GetImage(id string) ([]byte, error) {
+	if !validKey(id) {
+		return nil, ErrNotFound
+	}
+	body, err := s.client.get(s.pngKey(id))
+	if isNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read png object: %w", err)
+	}
+	defer body.Close()
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read png object: %w", err)
+	}
+	return b, nil
+}
+
+// List DICOM images from object storage
+func (s *S3Store) List() ([]*DICOM, error) {
+	dicoms := []*DICOM{}
+	err := s.Walk(func(dcm *DICOM) error {
+		dicoms = append(dicoms, dcm)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dicoms, nil
+}
+
+// Walk the DICOM images in object storage, reading one at a time
+func (s *S3Store) Walk(fn func(dcm *DICOM) error) error {
+	keys, err := s.client.list(path.Join(s.prefix, dicomDir) + "/")
+	if err != nil {
+		return fmt.Errorf("failed to list dicom objects: %w", err)
+	}
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".dcm") {
+			continue
+		}
+		dcm, err := s.read(key, strings.TrimSuffix(path.Base(key), ".dcm"))
+		if err != nil {
+			return err
+		}
+		err = fn(dcm)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete a DICOM image from object storage along with its PNG and checksum
+// objects
+func (s *S3Store) Delete(id string) error {
+	if !validKey(id) {
+		return ErrNotFound
+	}
+	err := s.client.head(s.dicomKey(id))
+	if isNotFound(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read dicom object: %w", err)
+	}
+	for _, key := range []string{s.dicomKey(id), s.pngKey(id), s.checksumKey(id)} {
+		err = s.client.delete(key)
+		if err != nil {
+			return fmt.Errorf("failed to delete object: %w", err)
+		}
+	}
+	return nil
+}
+
+// read and parse the DICOM object with a key along with its checksum
+func (s *S3Store) read(key, id string) (*DICOM, error) {
+	body, err := s.client.get(key)
+	if isNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dicom object: %w", err)
+	}
+	defer body.Close()
+	dataset, err := dicom.ParseUntilEOF(body, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse dicom object: %w", err)
+	}
+	dcm, err := NewDICOM(&dataset)
+	if err != nil {
+		return nil, err
+	}
+	dcm.SHA256, err = s.checksum(id)
+	if err != nil {
+		return nil, err
+	}
+	return dcm, nil
+}
+
+// checksum returns the recorded checksum of a DICOM, or an empty string if
+// none was recorded
+func (s *S3Store) checksum(id string) (string, error) {
+	body, err := s.client.get(s.checksumKey(id))
+	if isNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read checksum object: %w", err)
+	}
+	defer body.Close()
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read checksum object: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// upload an object read from r. Objects larger than the part size are
+// uploaded in parts so only one part is held in memory at a time.
+func (s *S3Store) upload(key string, r io.Reader, contentType string) error {
+	var part bytes.Buffer
+	_, err := io.CopyN(&part, r, s.partSize)
+	if errors.Is(err, io.EOF) {
+		return s.client.put(key, part.Bytes(), contentType)
+	}
+	if err != nil {
+		return err
+	}
+
+	uploadID, err := s.client.createMultipartUpload(key, contentType)
+	if err != nil {
+		return err
+	}
+	etags := []string{}
+	for part.Len() > 0 {
+		etag, err := s.client.uploadPart(key, uploadID, len(etags)+1, part.Bytes())
+		if err != nil {
+			s.client.abortMultipartUpload(key, uploadID)
+			return err
+		}
+		etags = append(etags, etag)
+		part.Reset()
+		_, err = io.CopyN(&part, r, s.partSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			s.client.abortMultipartUpload(key, uploadID)
+			return err
+		}
+	}
+	err = s.client.completeMultipartUpload(key, uploadID, etags)
+	if err != nil {
+		s.client.abortMultipartUpload(key, uploadID)
+		return err
+	}
+	return nil
+}
+
+// validKey returns whether an ID names an object under the prefix of the
+// store rather than one elsewhere in the bucket
+func validKey(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\`)
+}
+
+func (s *S3Store) dicomKey(id string) string {
+	return path.Join(s.prefix, dicomDir, id+".dcm")
+}
+
+func (s *S3Store) pngKey(id string) string {
+	return path.Join(s.prefix, pngDir, id+".png")
+}
+
+func (s *S3Store) checksumKey(id string) string {
+	return path.Join(s.prefix, checksumDir, id+checksumExt)
+}
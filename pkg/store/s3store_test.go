@@ -0,0 +1,244 @@
+package store_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+)
+
+const (
+	testDataPath = "../../testdata/IM000001-mri"
+	testID       = "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000395"
+	testBucket   = "dime"
+)
+
+// fakeS3 is an in-process stand-in for an S3 service with path-style
+// addressing. It lists one key per page to exercise pagination.
+type fakeS3 struct {
+	t          *testing.T
+	mu         sync.Mutex
+	objects    map[string][]byte
+	uploads    map[string]map[int][]byte
+	multiparts int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, string) {
+	f := &fakeS3{
+		t:       t,
+		objects: map[string][]byte{},
+		uploads: map[string]map[int][]byte{},
+	}
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+	return f, ts.URL
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Requests are signed and their payload hash matches the body
+	body, _ := io.ReadAll(r.Body)
+	hash := sha256.Sum256(body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") ||
+		r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(hash[:]) {
+		f.error(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != testBucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, query.Get("prefix"), query.Get("continuation-token"))
+	case r.Method == http.MethodGet:
+		b, ok := f.objects[key]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		_, _ = w.Write(b)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		part, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[query.Get("uploadId")][part] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, part))
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		assert.NoError(f.t, xml.Unmarshal(body, &complete))
+		parts := f.uploads[query.Get("uploadId")]
+		object := []byte{}
+		for i, p := range complete.Parts {
+			assert.Equal(f.t, i+1, p.PartNumber)
+			assert.Equal(f.t, fmt.Sprintf(`"%d"`, p.PartNumber), p.ETag)
+			object = append(object, parts[p.PartNumber]...)
+		}
+		f.objects[key] = object
+		f.multiparts++
+		delete(f.uploads, query.Get("uploadId"))
+		_, _ = w.Write([]byte("<CompleteMultipartUploadResult></CompleteMultipartUploadResult>"))
+	case r.Method == http.MethodHead:
+		if _, ok := f.objects[key]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix, token string) {
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > token {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	fmt.Fprint(w, "<ListBucketResult>")
+	if len(keys) > 0 {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", keys[0])
+	}
+	if len(keys) > 1 {
+		fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>", keys[0])
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func TestS3Store(t *testing.T) {
+	fake, endpoint := newFakeS3(t)
+	st, err := store.NewS3Store(store.S3Config{
+		Endpoint:        endpoint,
+		Bucket:          testBucket,
+		Prefix:          "prefix",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+		PartSize:        256 << 10,
+	})
+	assert.NoError(t, err)
+
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, st.Create(dcm))
+
+	// The DICOM is larger than a part and the PNG smaller
+	fake.mu.Lock()
+	assert.Equal(t, 1, fake.multiparts)
+	assert.Empty(t, fake.uploads)
+	assert.Contains(t, fake.objects, "prefix/dicom/"+testID+".dcm")
+	assert.Contains(t, fake.objects, "prefix/png/"+testID+".png")
+
+	// The checksum of the DICOM object is recorded
+	sum := sha256.Sum256(fake.objects["prefix/dicom/"+testID+".dcm"])
+	assert.Equal(t, hex.EncodeToString(sum[:]), dcm.SHA256)
+	assert.Equal(t, dcm.SHA256+"\n", string(fake.objects["prefix/sha256/"+testID+".sha256"]))
+	fake.mu.Unlock()
+
+	read, err := st.Read(testID)
+	assert.NoError(t, err)
+	assert.Equal(t, dcm.ID, read.ID)
+	assert.Equal(t, dcm.StudyInstanceUID, read.StudyInstanceUID)
+	assert.Equal(t, dcm.SeriesInstanceUID, read.SeriesInstanceUID)
+	assert.Equal(t, dcm.SHA256, read.SHA256)
+
+	img, err := st.GetImage(testID)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("\x89PNG"), img[:4])
+
+	// Objects outside the DICOM prefix are not listed
+	fake.mu.Lock()
+	fake.objects["prefix/dicom/other.dcm"] = fake.objects["prefix/dicom/"+testID+".dcm"]
+	fake.objects["other/dicom/other.dcm"] = []byte{}
+	fake.mu.Unlock()
+	dicoms, err := st.List()
+	assert.NoError(t, err)
+	assert.Len(t, dicoms, 2)
+
+	_, err = st.Read("unknown")
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	_, err = st.GetImage("unknown")
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	// A DICOM whose ID is not a UID can't name an object outside the prefix
+	assert.ErrorIs(t, st.Create(&store.DICOM{ID: "../other/dicom/escaped"}), store.ErrInvalidID)
+	assert.ErrorIs(t, st.Delete("../../other/dicom/other"), store.ErrNotFound)
+	fake.mu.Lock()
+	assert.Contains(t, fake.objects, "other/dicom/other.dcm")
+	fake.mu.Unlock()
+
+	// Deleting a DICOM deletes its PNG and checksum
+	assert.NoError(t, st.Delete(testID))
+	fake.mu.Lock()
+	assert.NotContains(t, fake.objects, "prefix/dicom/"+testID+".dcm")
+	assert.NotContains(t, fake.objects, "prefix/png/"+testID+".png")
+	assert.NotContains(t, fake.objects, "prefix/sha256/"+testID+".sha256")
+	fake.mu.Unlock()
+	_, err = st.Read(testID)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	assert.ErrorIs(t, st.Delete(testID), store.ErrNotFound)
+}
+
+func TestS3StoreError(t *testing.T) {
+	_, endpoint := newFakeS3(t)
+	st, err := store.NewS3Store(store.S3Config{
+		Endpoint:        endpoint,
+		Bucket:          "missing",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+	})
+	assert.NoError(t, err)
+
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	err = st.Create(dcm)
+	assert.ErrorContains(t, err, "NoSuchBucket")
+	_, err = st.Read(testID)
+	assert.ErrorContains(t, err, "NoSuchBucket")
+	assert.NotErrorIs(t, err, store.ErrNotFound)
+
+	_, err = store.NewS3Store(store.S3Config{Endpoint: endpoint})
+	assert.Error(t, err)
+}
@@ -0,0 +1,238 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errScrubStopped = errors.New("scrub stopped")
+
+// Mismatch is a DICOM file whose checksum doesn't match the checksum recorded
+// when it was created
+type Mismatch struct {
+	ID       string    `json:"id"`
+	Path     string    `json:"path"`
+	Expected string    `json:"expected"`
+	Actual   string    `json:"actual"`
+	Detected time.Time `json:"detected"`
+}
+
+// ScrubStatus is the progress of a Scrubber and the mismatches it has found
+type ScrubStatus struct {
+	Rate           int        `json:"rate"`
+	Interval       string     `json:"interval"`
+	Running        bool       `json:"running"`
+	Passes         int        `json:"passes"`
+	Checked        int        `json:"checked"`
+	Recorded       int        `json:"recorded"`
+	LastStarted    *time.Time `json:"lastStarted,omitempty"`
+	LastFinished   *time.Time `json:"lastFinished,omitempty"`
+	LastPassErrors []string   `json:"lastPassErrors,omitempty"`
+	Mismatches     []Mismatch `json:"mismatches"`
+}
+
+// Scrubber periodically verifies the DICOM files of a FileStore against
+// their recorded checksums to detect bit rot. Files are read at a limited
+// rate so scrubbing doesn't starve requests of disk bandwidth. DICOM files
+// without a recorded checksum, such as those stored by earlier versions, have
+// one recorded when they are first scrubbed.
+type Scrubber struct {
+	fs       *FileStore
+	rate     int
+	interval time.Duration
+
+	mu         sync.Mutex
+	status     ScrubStatus
+	mismatches map[string]Mismatch
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// NewScrubber returns a Scrubber that verifies rate files per second, starting
+// a pass every interval
+func NewScrubber(fs *FileStore, rate int, interval time.Duration) *Scrubber {
+	if rate <= 0 {
+		rate = 1
+	}
+	return &Scrubber{
+		fs:         fs,
+		rate:       rate,
+		interval:   interval,
+		mismatches: map[string]Mismatch{},
+		status: ScrubStatus{
+			Rate:     rate,
+			Interval: interval.String(),
+		},
+	}
+}
+
+// Start scrubbing in the background, starting with a pass
+func (s *Scrubber) Start() {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		for {
+			err := s.pass()
+			if errors.Is(err, errScrubStopped) {
+				return
+			}
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(s.interval):
+			}
+		}
+	}()
+}
+
+// Stop scrubbing, waiting for a pass in progress to stop
+func (s *Scrubber) Stop() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+}
+
+// Status returns the progress of the Scrubber and the mismatches it has found
+func (s *Scrubber) Status() ScrubStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	status.LastPassErrors = append([]string(nil), s.status.LastPassErrors...)
+	status.Mismatches = []Mismatch{}
+	for _, m := range s.mismatches {
+		status.Mismatches = append(status.Mismatches, m)
+	}
+	sort.Slice(status.Mismatches, func(i, j int) bool {
+		return status.Mismatches[i].ID < status.Mismatches[j].ID
+	})
+	return status
+}
+
+// pass verifies every DICOM file once
+func (s *Scrubber) pass() error {
+	started := time.Now().UTC()
+	s.mu.Lock()
+	s.status.Running = true
+	s.status.LastStarted = &started
+	s.mu.Unlock()
+	slog.Info("Starting scrub", slog.Int("rate", s.rate))
+
+	ticker := time.NewTicker(time.Second / time.Duration(s.rate))
+	defer ticker.Stop()
+	checked, recorded := 0, 0
+	errs := []string{}
+	err := filepath.WalkDir(filepath.Join(s.fs.dir, dicomDir), func(file string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), dicomExt) {
+			return nil
+		}
+		select {
+		case <-s.stop:
+			return errScrubStopped
+		case <-ticker.C:
+		}
+
+		id := strings.TrimSuffix(d.Name(), dicomExt)
+		rec, err := s.verify(id, file)
+		if err != nil {
+			errs = append(errs, err.Error())
+			slog.Error("Failed to scrub dicom file", slog.String("path", file), slog.String("error", err.Error()))
+			return nil
+		}
+		checked++
+		if rec {
+			recorded++
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		errs = append(errs, err.Error())
+	}
+
+	finished := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Running = false
+	s.status.Checked = checked
+	s.status.Recorded = recorded
+	s.status.LastPassErrors = errs
+	if errors.Is(err, errScrubStopped) {
+		return err
+	}
+	s.status.Passes++
+	s.status.LastFinished = &finished
+	slog.Info("Finished scrub", slog.Int("checked", checked), slog.Int("recorded", recorded),
+		slog.Int("mismatches", len(s.mismatches)), slog.Duration("took", finished.Sub(started)))
+	return nil
+}
+
+// verify the checksum of a DICOM file, recording it if there is none and
+// returning whether it was recorded
+func (s *Scrubber) verify(id, file string) (bool, error) {
+	expected := s.fs.checksum(id)
+	actual, err := fileChecksum(file)
+	if errors.Is(err, os.ErrNotExist) {
+		// removed or migrated since the walk
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if expected == "" {
+		return true, s.fs.writeChecksum(id, actual)
+	}
+
+	// the DICOM may have been created again since its checksum was read
+	if expected != actual && s.fs.checksum(id) != expected {
+		return false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expected == actual {
+		delete(s.mismatches, id)
+		return false, nil
+	}
+	if _, ok := s.mismatches[id]; !ok {
+		slog.Error("Checksum mismatch", slog.String("id", id), slog.String("path", file),
+			slog.String("expected", expected), slog.String("actual", actual))
+	}
+	s.mismatches[id] = Mismatch{
+		ID:       id,
+		Path:     file,
+		Expected: expected,
+		Actual:   actual,
+		Detected: time.Now().UTC(),
+	}
+	return false, nil
+}
+
+// fileChecksum returns the hex SHA-256 checksum of a file
+func fileChecksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", fmt.Errorf("failed to read dicom file: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
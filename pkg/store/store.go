@@ -1,11 +1,17 @@
 // Package store provides a way to store DICOM images
 package store
 
-import "errors"
+import (
+	"errors"
+	"strings"
+)
 
 var (
 	// ErrNotFound is an error for a DICOM that is not found
 	ErrNotFound = errors.New("not found")
+	// ErrInvalidID is an error for a DICOM whose SOP Instance UID is not a
+	// valid UID, and so can't be used to name its files
+	ErrInvalidID = errors.New("invalid sop instance uid")
 )
 
 // Store is an interface for working with storage of DICOM images
@@ -22,4 +28,49 @@ type Store interface {
 
 	// List DICOM images
 	List() ([]*DICOM, error)
+
+	// Delete a DICOM image and its PNG by SOP Instance UID
+	Delete(id string) error
+}
+
+// Walker is a Store that can walk its DICOM images one at a time, so that
+// a pass over every DICOM doesn't hold them all in memory as List does
+type Walker interface {
+
+	// Walk calls fn with each DICOM image in turn, stopping at the first
+	// error fn returns
+	Walk(fn func(dcm *DICOM) error) error
+}
+
+// Walk calls fn with each DICOM image of a store in turn, one at a time if
+// the store is a Walker or from List if it isn't
+func Walk(st Store, fn func(dcm *DICOM) error) error {
+	if w, ok := st.(Walker); ok {
+		return w.Walk(fn)
+	}
+	dicoms, err := st.List()
+	if err != nil {
+		return err
+	}
+	for _, dcm := range dicoms {
+		err = fn(dcm)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidUID returns whether a UID is made of digits and dots as DICOM
+// requires, which also keeps it safe to use in a path
+func ValidUID(uid string) bool {
+	if uid == "" || len(uid) > 64 || strings.Trim(uid, ".") != uid {
+		return false
+	}
+	for _, c := range uid {
+		if (c < '0' || c > '9') && c != '.' {
+			return false
+		}
+	}
+	return true
 }
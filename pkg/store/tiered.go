@@ -0,0 +1,576 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tiers of a TieredStore
+const (
+	// TierHot is the tier that DICOMs are stored in and recalled to
+	TierHot = "hot"
+	// TierCold is the tier that idle studies are migrated to
+	TierCold = "cold"
+)
+
+const (
+	tierRecordExt     = ".json"
+	tierFlushInterval = time.Minute
+	tierLocks         = 64
+)
+
+// TierStatus is the number of DICOMs in each tier of a TieredStore and the
+// result of its last migration
+type TierStatus struct {
+	MaxIdle       string         `json:"maxIdle" example:"2160h0m0s"`
+	Studies       int            `json:"studies" example:"40"`
+	Hot           int            `json:"hot" example:"120"`
+	Cold          int            `json:"cold" example:"3600"`
+	Recalled      int            `json:"recalled" example:"12"`
+	LastMigration *TierMigration `json:"lastMigration,omitempty"`
+}
+
+// TierMigration is the result of a pass that migrates idle studies to the
+// cold tier
+type TierMigration struct {
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Studies   int       `json:"studies" example:"2"`
+	Instances int       `json:"instances" example:"60"`
+	Errors    []string  `json:"errors,omitempty"`
+}
+
+// tierRecord is the tier of each instance of a study and when the study was
+// last accessed
+type tierRecord struct {
+	StudyInstanceUID string            `json:"studyInstanceUID"`
+	Accessed         time.Time         `json:"accessed"`
+	Instances        map[string]string `json:"instances"`
+}
+
+// TieredStore composes a hot store, such as fast local disk, with a cold
+// store, such as an archive. DICOMs are created in the hot tier, and studies
+// that haven't been read for maxIdle are migrated to the cold tier by Migrate.
+// Reading a DICOM in the cold tier transparently recalls it to the hot tier.
+// The tier of each instance and when its study was last accessed are
+// journaled to a directory, one file per study, which is flushed every minute
+// and when the store is stopped.
+type TieredStore struct {
+	hot     Store
+	cold    Store
+	dir     string
+	maxIdle time.Duration
+
+	locks    [tierLocks]sync.Mutex
+	flushMu  sync.Mutex
+	mu       sync.Mutex
+	studies  map[string]*tierRecord
+	ids      map[string]string
+	dirty    map[string]bool
+	last     *TierMigration
+	recalled int
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewTieredStore returns a TieredStore journaled in dir that migrates studies
+// from hot to cold once they haven't been accessed for maxIdle. If the journal
+// is empty, such as when tiering is first enabled, the DICOMs already in each
+// tier are recorded as accessed now.
+func NewTieredStore(hot, cold Store, dir string, maxIdle time.Duration) (*TieredStore, error) {
+	ts := &TieredStore{
+		hot:     hot,
+		cold:    cold,
+		dir:     dir,
+		maxIdle: maxIdle,
+		studies: map[string]*tierRecord{},
+		ids:     map[string]string{},
+		dirty:   map[string]bool{},
+	}
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	err = ts.load()
+	if err != nil {
+		return nil, err
+	}
+	if len(ts.studies) == 0 {
+		err = ts.backfill()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ts, nil
+}
+
+// Hot returns the hot tier
+func (ts *TieredStore) Hot() Store {
+	return ts.hot
+}
+
+// Cold returns the cold tier
+func (ts *TieredStore) Cold() Store {
+	return ts.cold
+}
+
+// Start migrating idle studies in the background every interval
+func (ts *TieredStore) Start(interval time.Duration) {
+	ts.stop = make(chan struct{})
+	ts.done = make(chan struct{})
+	go func() {
+		defer close(ts.done)
+		migrate := time.NewTicker(interval)
+		defer migrate.Stop()
+		flush := time.NewTicker(tierFlushInterval)
+		defer flush.Stop()
+		for {
+			select {
+			case <-ts.stop:
+				return
+			case <-migrate.C:
+				ts.Migrate()
+			case <-flush.C:
+				ts.flush()
+			}
+		}
+	}()
+}
+
+// Stop migrating, waiting for a migration in progress to finish, and flush
+// the journal
+func (ts *TieredStore) Stop() {
+	if ts.stop != nil {
+		close(ts.stop)
+		<-ts.done
+	}
+	ts.flush()
+}
+
+// Status returns the number of DICOMs in each tier and the result of the last
+// migration
+func (ts *TieredStore) Status() TierStatus {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	status := TierStatus{
+		MaxIdle:  ts.maxIdle.String(),
+		Studies:  len(ts.studies),
+		Recalled: ts.recalled,
+	}
+	for _, rec := range ts.studies {
+		for _, tier := range rec.Instances {
+			if tier == TierCold {
+				status.Cold++
+			} else {
+				status.Hot++
+			}
+		}
+	}
+	if ts.last != nil {
+		last := *ts.last
+		status.LastMigration = &last
+	}
+	return status
+}
+
+// Create a DICOM in the hot tier, or replace it in the cold tier if it is
+// stored there so that rewriting a DICOM doesn't recall it
+func (ts *TieredStore) Create(dcm *DICOM) error {
+	unlock := ts.lock(dcm.ID)
+	defer unlock()
+	if ts.tier(dcm.ID) == TierCold {
+		return ts.cold.Create(dcm)
+	}
+	err := ts.hot.Create(dcm)
+	if err != nil {
+		return err
+	}
+	ts.record(dcm.ID, dcm.StudyInstanceUID, TierHot, true)
+	return nil
+}
+
+// Read a DICOM from the hot tier, recalling it from the cold tier if it was
+// migrated
+func (ts *TieredStore) Read(id string) (*DICOM, error) {
+	dcm, err := ts.hot.Read(id)
+	if errors.Is(err, ErrNotFound) {
+		return ts.recall(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ts.record(id, dcm.StudyInstanceUID, TierHot, true)
+	return dcm, nil
+}
+
+// GetImage gets the image of a DICOM from the hot tier, recalling the DICOM
+// from the cold tier if it was migrated
+func (ts *TieredStore) GetImage(id string) ([]byte, error) {
+	b, err := ts.hot.GetImage(id)
+	if errors.Is(err, ErrNotFound) && ts.tier(id) != TierHot {
+		_, err = ts.recall(id)
+		if err != nil {
+			return nil, err
+		}
+		b, err = ts.hot.GetImage(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ts.touch(id)
+	return b, nil
+}
+
+// List the DICOMs in both tiers
+func (ts *TieredStore) List() ([]*DICOM, error) {
+	dicoms := []*DICOM{}
+	err := ts.Walk(func(dcm *DICOM) error {
+		dicoms = append(dicoms, dcm)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dicoms, nil
+}
+
+// Walk the DICOMs in both tiers without recalling them, walking a DICOM in
+// both tiers only once from the hot tier
+func (ts *TieredStore) Walk(fn func(dcm *DICOM) error) error {
+	seen := map[string]bool{}
+	err := Walk(ts.hot, func(dcm *DICOM) error {
+		seen[dcm.ID] = true
+		return fn(dcm)
+	})
+	if err != nil {
+		return err
+	}
+	return Walk(ts.cold, func(dcm *DICOM) error {
+		if seen[dcm.ID] {
+			return nil
+		}
+		return fn(dcm)
+	})
+}
+
+// Delete a DICOM from both tiers
+func (ts *TieredStore) Delete(id string) error {
+	unlock := ts.lock(id)
+	defer unlock()
+	hotErr := ts.hot.Delete(id)
+	if hotErr != nil && !errors.Is(hotErr, ErrNotFound) {
+		return hotErr
+	}
+	coldErr := ts.cold.Delete(id)
+	if coldErr != nil && !errors.Is(coldErr, ErrNotFound) {
+		return coldErr
+	}
+	ts.forget(id)
+	if hotErr != nil && coldErr != nil {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Migrate the hot instances of studies that haven't been accessed for maxIdle
+// to the cold tier
+func (ts *TieredStore) Migrate() *TierMigration {
+	m := &TierMigration{Started: time.Now().UTC()}
+	cutoff := m.Started.Add(-ts.maxIdle)
+	ts.mu.Lock()
+	idle := map[string][]string{}
+	for uid, rec := range ts.studies {
+		if !rec.Accessed.Before(cutoff) {
+			continue
+		}
+		for id, tier := range rec.Instances {
+			if tier == TierHot {
+				idle[uid] = append(idle[uid], id)
+			}
+		}
+	}
+	ts.mu.Unlock()
+
+	for uid, ids := range idle {
+		migrated := 0
+		for _, id := range ids {
+			err := ts.demote(id, uid, cutoff)
+			if err != nil {
+				m.Errors = append(m.Errors, fmt.Sprintf("%s: %s", id, err))
+				continue
+			}
+			migrated++
+		}
+		if migrated > 0 {
+			m.Studies++
+			m.Instances += migrated
+		}
+	}
+	m.Finished = time.Now().UTC()
+	slog.Info("Migrated idle studies",
+		slog.Int("studies", m.Studies),
+		slog.Int("instances", m.Instances),
+		slog.Int("errors", len(m.Errors)))
+
+	ts.mu.Lock()
+	ts.last = m
+	ts.mu.Unlock()
+	ts.flush()
+	return m
+}
+
+// demote copies an instance of an idle study to the cold tier and deletes it
+// from the hot tier, unless the study was accessed since it became idle
+func (ts *TieredStore) demote(id, uid string, cutoff time.Time) error {
+	unlock := ts.lock(id)
+	defer unlock()
+	ts.mu.Lock()
+	rec, ok := ts.studies[uid]
+	idle := ok && rec.Accessed.Before(cutoff) && rec.Instances[id] == TierHot
+	ts.mu.Unlock()
+	if !idle {
+		return nil
+	}
+
+	dcm, err := ts.hot.Read(id)
+	if errors.Is(err, ErrNotFound) {
+		ts.forget(id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = ts.cold.Create(dcm)
+	if err != nil {
+		return err
+	}
+	err = ts.hot.Delete(id)
+	if err != nil {
+		return err
+	}
+	ts.record(id, uid, TierCold, false)
+	return nil
+}
+
+// recall a DICOM from the cold tier to the hot tier
+func (ts *TieredStore) recall(id string) (*DICOM, error) {
+	unlock := ts.lock(id)
+	defer unlock()
+
+	// Another request may have recalled it
+	dcm, err := ts.hot.Read(id)
+	if err == nil {
+		ts.record(id, dcm.StudyInstanceUID, TierHot, true)
+		return dcm, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	dcm, err = ts.cold.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	err = ts.hot.Create(dcm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recall dicom: %w", err)
+	}
+	err = ts.cold.Delete(id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		slog.Warn("Failed to delete recalled DICOM from cold tier",
+			slog.String("id", id),
+			slog.String("error", err.Error()))
+	}
+	ts.record(id, dcm.StudyInstanceUID, TierHot, true)
+	ts.mu.Lock()
+	ts.recalled++
+	ts.mu.Unlock()
+	slog.Info("Recalled DICOM", slog.String("id", id))
+	return dcm, nil
+}
+
+// lock the operations that move a DICOM between tiers, returning the function
+// that unlocks them
+func (ts *TieredStore) lock(id string) func() {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	mu := &ts.locks[h.Sum32()%tierLocks]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// tier returns the tier of a DICOM, or "" if it isn't recorded
+func (ts *TieredStore) tier(id string) string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	uid, ok := ts.ids[id]
+	if !ok {
+		return ""
+	}
+	return ts.studies[uid].Instances[id]
+}
+
+// record the tier of a DICOM, and that its study was accessed now if access
+// is set
+func (ts *TieredStore) record(id, uid, tier string, access bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if old, ok := ts.ids[id]; ok && old != uid {
+		ts.remove(id)
+	}
+	rec, ok := ts.studies[uid]
+	if !ok {
+		rec = &tierRecord{StudyInstanceUID: uid, Accessed: time.Now().UTC(), Instances: map[string]string{}}
+		ts.studies[uid] = rec
+	}
+	rec.Instances[id] = tier
+	if access {
+		rec.Accessed = time.Now().UTC()
+	}
+	ts.ids[id] = uid
+	ts.dirty[uid] = true
+}
+
+// touch records that the study of a DICOM was accessed now
+func (ts *TieredStore) touch(id string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	uid, ok := ts.ids[id]
+	if !ok {
+		return
+	}
+	ts.studies[uid].Accessed = time.Now().UTC()
+	ts.dirty[uid] = true
+}
+
+// forget a DICOM that is no longer stored
+func (ts *TieredStore) forget(id string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.remove(id)
+}
+
+// remove a DICOM from the record of its study. The caller must hold the lock.
+func (ts *TieredStore) remove(id string) {
+	uid, ok := ts.ids[id]
+	if !ok {
+		return
+	}
+	rec := ts.studies[uid]
+	delete(rec.Instances, id)
+	if len(rec.Instances) == 0 {
+		delete(ts.studies, uid)
+	}
+	delete(ts.ids, id)
+	ts.dirty[uid] = true
+}
+
+// flush the records of studies that changed to the journal
+func (ts *TieredStore) flush() {
+	ts.flushMu.Lock()
+	defer ts.flushMu.Unlock()
+	ts.mu.Lock()
+	records := map[string][]byte{}
+	for uid := range ts.dirty {
+		var b []byte
+		if rec, ok := ts.studies[uid]; ok {
+			b, _ = json.Marshal(rec)
+		}
+		records[uid] = b
+	}
+	ts.dirty = map[string]bool{}
+	ts.mu.Unlock()
+
+	for uid, b := range records {
+		err := ts.save(uid, b)
+		if err != nil {
+			slog.Error("Failed to write tier record",
+				slog.String("study", uid),
+				slog.String("error", err.Error()))
+			ts.mu.Lock()
+			ts.dirty[uid] = true
+			ts.mu.Unlock()
+		}
+	}
+}
+
+// save the record of a study atomically, removing it if b is nil
+func (ts *TieredStore) save(uid string, b []byte) error {
+	path := ts.recordPath(uid)
+	if b == nil {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	tmp := path + tmpExt
+	err := os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// load the records of studies from the journal
+func (ts *TieredStore) load() error {
+	entries, err := os.ReadDir(ts.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read tier directory: %w", err)
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), tierRecordExt) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(ts.dir, e.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read tier record: %w", err)
+		}
+		var rec tierRecord
+		err = json.Unmarshal(b, &rec)
+		if err != nil || rec.Instances == nil {
+			slog.Error("Skipping unreadable tier record", slog.String("file", e.Name()))
+			continue
+		}
+		ts.studies[rec.StudyInstanceUID] = &rec
+		for id := range rec.Instances {
+			ts.ids[id] = rec.StudyInstanceUID
+		}
+	}
+	return nil
+}
+
+// backfill records the DICOMs already in each tier as accessed now
+func (ts *TieredStore) backfill() error {
+	for _, tier := range []struct {
+		name string
+		st   Store
+	}{{TierCold, ts.cold}, {TierHot, ts.hot}} {
+		err := Walk(tier.st, func(dcm *DICOM) error {
+			ts.record(dcm.ID, dcm.StudyInstanceUID, tier.name, true)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to walk %s tier: %w", tier.name, err)
+		}
+	}
+	ts.flush()
+	return nil
+}
+
+// recordPath returns the path of the record of a study, named by a hash of
+// its Study Instance UID so that any UID is a valid file name
+func (ts *TieredStore) recordPath(uid string) string {
+	sum := sha256.Sum256([]byte(uid))
+	return filepath.Join(ts.dir, hex.EncodeToString(sum[:16])+tierRecordExt)
+}
@@ -0,0 +1,128 @@
+package store_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+)
+
+func TestTieredStore(t *testing.T) {
+	dir := t.TempDir()
+	hot, err := store.NewMemStore()
+	assert.NoError(t, err)
+	cold, err := store.NewMemStore()
+	assert.NoError(t, err)
+	ts, err := store.NewTieredStore(hot, cold, dir, time.Hour)
+	assert.NoError(t, err)
+
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, ts.Create(dcm))
+
+	// A study that was just stored isn't migrated
+	m := ts.Migrate()
+	assert.Zero(t, m.Instances)
+	_, err = hot.Read(testID)
+	assert.NoError(t, err)
+	ts.Stop()
+
+	// Once idle, the study is migrated to the cold tier
+	ts, err = store.NewTieredStore(hot, cold, dir, 0)
+	assert.NoError(t, err)
+	m = ts.Migrate()
+	assert.Equal(t, 1, m.Studies)
+	assert.Equal(t, 1, m.Instances)
+	assert.Empty(t, m.Errors)
+	_, err = hot.Read(testID)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	_, err = cold.Read(testID)
+	assert.NoError(t, err)
+	list, err := ts.List()
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+
+	// Walking the tiers doesn't recall a cold DICOM
+	walked := 0
+	assert.NoError(t, store.Walk(ts, func(dcm *store.DICOM) error {
+		walked++
+		return nil
+	}))
+	assert.Equal(t, 1, walked)
+	_, err = hot.Read(testID)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	// Rewriting a cold DICOM doesn't recall it
+	assert.NoError(t, ts.Create(dcm))
+	_, err = hot.Read(testID)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	status := ts.Status()
+	assert.Equal(t, 1, status.Cold)
+	assert.Equal(t, 1, status.LastMigration.Instances)
+
+	// Reading its image recalls it to the hot tier
+	img, err := ts.GetImage(testID)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, img)
+	_, err = hot.Read(testID)
+	assert.NoError(t, err)
+	_, err = cold.Read(testID)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	status = ts.Status()
+	assert.Equal(t, 1, status.Hot)
+	assert.Zero(t, status.Cold)
+	assert.Equal(t, 1, status.Recalled)
+
+	// Deleting a DICOM deletes it from both tiers
+	assert.NoError(t, ts.Delete(testID))
+	_, err = ts.Read(testID)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	assert.ErrorIs(t, ts.Delete(testID), store.ErrNotFound)
+	assert.Zero(t, ts.Status().Studies)
+	ts.Stop()
+}
+
+// walkOnly is a store that is walked one DICOM at a time and fails to list
+type walkOnly struct {
+	store.Store
+}
+
+func (walkOnly) List() ([]*store.DICOM, error) {
+	return nil, errors.New("listed")
+}
+
+func (w walkOnly) Walk(fn func(dcm *store.DICOM) error) error {
+	return store.Walk(w.Store, fn)
+}
+
+func TestTieredStoreBackfill(t *testing.T) {
+	hot, err := store.NewMemStore()
+	assert.NoError(t, err)
+	cold, err := store.NewMemStore()
+	assert.NoError(t, err)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+	assert.NoError(t, cold.Create(dcm))
+
+	// DICOMs stored before tiering are recorded in their tier, walking each
+	// tier rather than listing it
+	ts, err := store.NewTieredStore(walkOnly{hot}, walkOnly{cold}, t.TempDir(), time.Hour)
+	assert.NoError(t, err)
+	status := ts.Status()
+	assert.Equal(t, 1, status.Studies)
+	assert.Equal(t, 1, status.Cold)
+
+	// Reading a cold DICOM recalls it
+	read, err := ts.Read(testID)
+	assert.NoError(t, err)
+	assert.Equal(t, testID, read.ID)
+	_, err = hot.Read(testID)
+	assert.NoError(t, err)
+}
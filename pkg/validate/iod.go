@@ -0,0 +1,231 @@
+package validate
+
+import (
+	"slices"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// Attribute types from PS3.5 section 7.4
+const (
+	// Type1 attributes must be present with a value
+	Type1 = "1"
+	// Type1C attributes must be present with a value when their condition is
+	// met
+	Type1C = "1C"
+	// Type2 attributes must be present but may be empty
+	Type2 = "2"
+	// Type2C attributes must be present but may be empty when their
+	// condition is met
+	Type2C = "2C"
+)
+
+// attribute is a requirement of a module on an attribute
+type attribute struct {
+	tag  tag.Tag
+	typ  string
+	cond func(*dicom.Dataset) bool
+}
+
+// module is a set of related attributes from PS3.3 section C
+type module struct {
+	name       string
+	attributes []attribute
+}
+
+// iod is an Information Object Definition from PS3.3 section A, which is
+// made up of modules
+type iod struct {
+	name    string
+	modules []module
+}
+
+var (
+	patientModule = module{"Patient", []attribute{
+		{tag: tag.PatientName, typ: Type2},
+		{tag: tag.PatientID, typ: Type2},
+		{tag: tag.PatientBirthDate, typ: Type2},
+		{tag: tag.PatientSex, typ: Type2},
+	}}
+	generalStudyModule = module{"General Study", []attribute{
+		{tag: tag.StudyInstanceUID, typ: Type1},
+		{tag: tag.StudyDate, typ: Type2},
+		{tag: tag.StudyTime, typ: Type2},
+		{tag: tag.ReferringPhysicianName, typ: Type2},
+		{tag: tag.StudyID, typ: Type2},
+		{tag: tag.AccessionNumber, typ: Type2},
+	}}
+	generalSeriesModule = module{"General Series", []attribute{
+		{tag: tag.Modality, typ: Type1},
+		{tag: tag.SeriesInstanceUID, typ: Type1},
+		{tag: tag.SeriesNumber, typ: Type2},
+	}}
+	generalEquipmentModule = module{"General Equipment", []attribute{
+		{tag: tag.Manufacturer, typ: Type2},
+	}}
+	generalImageModule = module{"General Image", []attribute{
+		{tag: tag.InstanceNumber, typ: Type2},
+		{tag: tag.PatientOrientation, typ: Type2C, cond: missing(tag.ImageOrientationPatient)},
+	}}
+	imagePixelModule = module{"Image Pixel", []attribute{
+		{tag: tag.SamplesPerPixel, typ: Type1},
+		{tag: tag.PhotometricInterpretation, typ: Type1},
+		{tag: tag.Rows, typ: Type1},
+		{tag: tag.Columns, typ: Type1},
+		{tag: tag.BitsAllocated, typ: Type1},
+		{tag: tag.BitsStored, typ: Type1},
+		{tag: tag.HighBit, typ: Type1},
+		{tag: tag.PixelRepresentation, typ: Type1},
+		{tag: tag.PixelData, typ: Type1C, cond: missing(tag.PixelDataProviderURL)},
+		{tag: tag.PlanarConfiguration, typ: Type1C, cond: intGreaterThan(tag.SamplesPerPixel, 1)},
+	}}
+	imagePlaneModule = module{"Image Plane", []attribute{
+		{tag: tag.PixelSpacing, typ: Type1},
+		{tag: tag.ImageOrientationPatient, typ: Type1},
+		{tag: tag.ImagePositionPatient, typ: Type1},
+		{tag: tag.SliceThickness, typ: Type2},
+	}}
+	sopCommonModule = module{"SOP Common", []attribute{
+		{tag: tag.SOPClassUID, typ: Type1},
+		{tag: tag.SOPInstanceUID, typ: Type1},
+	}}
+
+	ctImageModule = module{"CT Image", []attribute{
+		{tag: tag.ImageType, typ: Type1},
+		{tag: tag.RescaleIntercept, typ: Type1},
+		{tag: tag.RescaleSlope, typ: Type1},
+		{tag: tag.KVP, typ: Type2},
+		{tag: tag.AcquisitionNumber, typ: Type2},
+	}}
+	mrImageModule = module{"MR Image", []attribute{
+		{tag: tag.ImageType, typ: Type1},
+		{tag: tag.ScanningSequence, typ: Type1},
+		{tag: tag.SequenceVariant, typ: Type1},
+		{tag: tag.ScanOptions, typ: Type2},
+		{tag: tag.MRAcquisitionType, typ: Type2},
+		{tag: tag.EchoTime, typ: Type2},
+		{tag: tag.EchoTrainLength, typ: Type2},
+	}}
+	crSeriesModule = module{"CR Series", []attribute{
+		{tag: tag.BodyPartExamined, typ: Type2},
+		{tag: tag.ViewPosition, typ: Type2},
+	}}
+	dxImageModule = module{"DX Image", []attribute{
+		{tag: tag.ImageType, typ: Type1},
+		{tag: tag.PixelIntensityRelationship, typ: Type1},
+		{tag: tag.PixelIntensityRelationshipSign, typ: Type1},
+		{tag: tag.RescaleIntercept, typ: Type1},
+		{tag: tag.RescaleSlope, typ: Type1},
+		{tag: tag.RescaleType, typ: Type1},
+		{tag: tag.PresentationLUTShape, typ: Type1},
+		{tag: tag.LossyImageCompression, typ: Type1},
+		{tag: tag.BurnedInAnnotation, typ: Type1},
+	}}
+	dxDetectorModule = module{"DX Detector", []attribute{
+		{tag: tag.DetectorType, typ: Type2},
+		{tag: tag.ImagerPixelSpacing, typ: Type1},
+	}}
+	usImageModule = module{"US Image", []attribute{
+		{tag: tag.ImageType, typ: Type2},
+		{tag: tag.LossyImageCompression, typ: Type1C, cond: present(tag.LossyImageCompressionRatio)},
+	}}
+	scEquipmentModule = module{"SC Equipment", []attribute{
+		{tag: tag.ConversionType, typ: Type1},
+	}}
+	srDocumentSeriesModule = module{"SR Document Series", []attribute{
+		{tag: tag.Modality, typ: Type1},
+		{tag: tag.SeriesInstanceUID, typ: Type1},
+		{tag: tag.SeriesNumber, typ: Type1},
+		{tag: tag.ReferencedPerformedProcedureStepSequence, typ: Type2},
+	}}
+	srDocumentGeneralModule = module{"SR Document General", []attribute{
+		{tag: tag.InstanceNumber, typ: Type1},
+		{tag: tag.CompletionFlag, typ: Type1},
+		{tag: tag.VerificationFlag, typ: Type1},
+		{tag: tag.ContentDate, typ: Type1},
+		{tag: tag.ContentTime, typ: Type1},
+		{tag: tag.PerformedProcedureCodeSequence, typ: Type2},
+	}}
+	srDocumentContentModule = module{"SR Document Content", []attribute{
+		{tag: tag.ValueType, typ: Type1},
+		{tag: tag.ConceptNameCodeSequence, typ: Type1},
+		{tag: tag.ContinuityOfContent, typ: Type1C, cond: stringEquals(tag.ValueType, "CONTAINER")},
+	}}
+
+	imageModules = []module{
+		patientModule, generalStudyModule, generalSeriesModule, generalEquipmentModule,
+		generalImageModule, imagePixelModule, sopCommonModule,
+	}
+	srModules = []module{
+		patientModule, generalStudyModule, srDocumentSeriesModule, generalEquipmentModule,
+		srDocumentGeneralModule, srDocumentContentModule, sopCommonModule,
+	}
+
+	ctIOD = iod{"CT Image", slices.Concat(imageModules, []module{imagePlaneModule, ctImageModule})}
+	mrIOD = iod{"MR Image", slices.Concat(imageModules, []module{imagePlaneModule, mrImageModule})}
+	crIOD = iod{"Computed Radiography Image", slices.Concat(imageModules, []module{crSeriesModule})}
+	dxIOD = iod{"Digital X-Ray Image", slices.Concat(imageModules, []module{dxImageModule, dxDetectorModule})}
+	usIOD = iod{"Ultrasound Image", slices.Concat(imageModules, []module{usImageModule})}
+	scIOD = iod{"Secondary Capture Image", slices.Concat(imageModules, []module{scEquipmentModule})}
+	srIOD = iod{"Structured Report Document", srModules}
+
+	// iods maps SOP Class UIDs to their IOD
+	iods = map[string]iod{
+		"1.2.840.10008.5.1.4.1.1.2":     ctIOD, // CT Image Storage
+		"1.2.840.10008.5.1.4.1.1.4":     mrIOD, // MR Image Storage
+		"1.2.840.10008.5.1.4.1.1.1":     crIOD, // Computed Radiography Image Storage
+		"1.2.840.10008.5.1.4.1.1.1.1":   dxIOD, // Digital X-Ray Image Storage - For Presentation
+		"1.2.840.10008.5.1.4.1.1.1.1.1": dxIOD, // Digital X-Ray Image Storage - For Processing
+		"1.2.840.10008.5.1.4.1.1.6.1":   usIOD, // Ultrasound Image Storage
+		"1.2.840.10008.5.1.4.1.1.3.1":   usIOD, // Ultrasound Multi-frame Image Storage
+		"1.2.840.10008.5.1.4.1.1.7":     scIOD, // Secondary Capture Image Storage
+		"1.2.840.10008.5.1.4.1.1.88.11": srIOD, // Basic Text SR Storage
+		"1.2.840.10008.5.1.4.1.1.88.22": srIOD, // Enhanced SR Storage
+		"1.2.840.10008.5.1.4.1.1.88.33": srIOD, // Comprehensive SR Storage
+		"1.2.840.10008.5.1.4.1.1.88.34": srIOD, // Comprehensive 3D SR Storage
+		"1.2.840.10008.5.1.4.1.1.88.35": srIOD, // Extensible SR Storage
+	}
+)
+
+// missing returns a condition that is met when the tag is not present
+func missing(t tag.Tag) func(*dicom.Dataset) bool {
+	return func(ds *dicom.Dataset) bool {
+		_, err := ds.FindElementByTag(t)
+		return err != nil
+	}
+}
+
+// present returns a condition that is met when the tag is present
+func present(t tag.Tag) func(*dicom.Dataset) bool {
+	return func(ds *dicom.Dataset) bool {
+		_, err := ds.FindElementByTag(t)
+		return err == nil
+	}
+}
+
+// intGreaterThan returns a condition that is met when the first value of the
+// tag is greater than n
+func intGreaterThan(t tag.Tag, n int) func(*dicom.Dataset) bool {
+	return func(ds *dicom.Dataset) bool {
+		el, err := ds.FindElementByTag(t)
+		if err != nil {
+			return false
+		}
+		ints, ok := el.Value.GetValue().([]int)
+		return ok && len(ints) > 0 && ints[0] > n
+	}
+}
+
+// stringEquals returns a condition that is met when the first value of the
+// tag is s
+func stringEquals(t tag.Tag, s string) func(*dicom.Dataset) bool {
+	return func(ds *dicom.Dataset) bool {
+		el, err := ds.FindElementByTag(t)
+		if err != nil {
+			return false
+		}
+		strs, ok := el.Value.GetValue().([]string)
+		return ok && len(strs) > 0 && strs[0] == s
+	}
+}
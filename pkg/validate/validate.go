@@ -0,0 +1,259 @@
+// Package validate validates DICOMs against the Information Object Definitions
+// of their SOP Class
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// Policy is what to do with a DICOM that fails validation on ingest
+type Policy string
+
+const (
+	// PolicyAccept accepts DICOMs without validating them
+	PolicyAccept Policy = "accept"
+	// PolicyWarn accepts DICOMs and logs any validation errors
+	PolicyWarn Policy = "warn"
+	// PolicyReject rejects DICOMs with validation errors
+	PolicyReject Policy = "reject"
+)
+
+const (
+	maxUIDLength = 64
+)
+
+var (
+	// ErrInvalid is an error for a DICOM that fails validation
+	ErrInvalid = errors.New("invalid dicom")
+
+	uidPattern = regexp.MustCompile(`^(0|[1-9][0-9]*)(\.(0|[1-9][0-9]*))*$`)
+
+	// vrs whose values may contain backslashes, so always have one value
+	singleValueVRs = map[string]bool{"LT": true, "ST": true, "UT": true, "UR": true}
+)
+
+// ParsePolicy parses a validation policy
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(s)); p {
+	case PolicyAccept, PolicyWarn, PolicyReject:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown validation policy %q", s)
+}
+
+// Finding is a problem found with an attribute
+type Finding struct {
+	Tag     string `json:"tag" example:"(0010,0010)"`
+	Name    string `json:"name" example:"PatientName"`
+	Module  string `json:"module,omitempty" example:"Patient"`
+	Type    string `json:"type,omitempty" example:"2"`
+	Message string `json:"message" example:"missing type 2 attribute"`
+}
+
+// Report is the result of validating a DICOM
+type Report struct {
+	SOPClassUID string    `json:"sopClassUID" example:"1.2.840.10008.5.1.4.1.1.4"`
+	IOD         string    `json:"iod,omitempty" example:"MR Image"`
+	Valid       bool      `json:"valid"`
+	Errors      []Finding `json:"errors"`
+	Warnings    []Finding `json:"warnings"`
+}
+
+// Err returns an error wrapping ErrInvalid that summarizes the report's
+// errors, or nil if the DICOM is valid
+func (r *Report) Err() error {
+	if r.Valid {
+		return nil
+	}
+	msgs := []string{}
+	for _, f := range r.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s %s: %s", f.Tag, f.Name, f.Message))
+	}
+	return fmt.Errorf("%w: %s", ErrInvalid, strings.Join(msgs, "; "))
+}
+
+// Validate a dataset against the IOD of its SOP Class, checking that the
+// attributes required by each module are present, that values conform to
+// the VR and VM of their attribute and that UIDs are well formed
+func Validate(ds *dicom.Dataset) *Report {
+	r := &Report{
+		Errors:   []Finding{},
+		Warnings: []Finding{},
+	}
+	if el, err := ds.FindElementByTag(tag.SOPClassUID); err == nil {
+		if strs, ok := el.Value.GetValue().([]string); ok && len(strs) > 0 {
+			r.SOPClassUID = strings.TrimRight(strs[0], " \x00")
+		}
+	}
+
+	// Check module attributes
+	if def, ok := iods[r.SOPClassUID]; ok {
+		r.IOD = def.name
+		checkIOD(r, ds, def)
+	} else {
+		r.Warnings = append(r.Warnings, newFinding(tag.SOPClassUID, "", "",
+			"no IOD definition for SOP Class, only checking values"))
+	}
+
+	// Check values of every element
+	for el := range ds.FlatIterator() {
+		checkValue(r, el)
+	}
+
+	r.Valid = len(r.Errors) == 0
+	return r
+}
+
+// checkIOD checks the attributes required by the modules of an IOD
+func checkIOD(r *Report, ds *dicom.Dataset, def iod) {
+	checked := map[tag.Tag]bool{}
+	for _, m := range def.modules {
+		for _, attr := range m.attributes {
+			if checked[attr.tag] {
+				continue
+			}
+			if attr.cond != nil && !attr.cond(ds) {
+				continue
+			}
+			checked[attr.tag] = true
+
+			el, err := ds.FindElementByTag(attr.tag)
+			if err != nil {
+				r.Errors = append(r.Errors, newFinding(attr.tag, m.name, attr.typ,
+					fmt.Sprintf("missing type %s attribute", attr.typ)))
+				continue
+			}
+			if (attr.typ == Type1 || attr.typ == Type1C) && isEmpty(el) {
+				r.Errors = append(r.Errors, newFinding(attr.tag, m.name, attr.typ,
+					fmt.Sprintf("empty type %s attribute", attr.typ)))
+			}
+		}
+	}
+}
+
+// checkValue checks an element's value conforms to its VR and VM, and that
+// UIDs are well formed
+func checkValue(r *Report, el *dicom.Element) {
+	info, err := tag.Find(el.Tag)
+	if err != nil || el.Tag.Element == 0x0000 {
+		return // private and group length tags
+	}
+
+	// VR
+	vr := el.RawValueRepresentation
+	if vr != "" && vr != "UN" && !strings.Contains(info.VR, vr) {
+		r.Errors = append(r.Errors, newFinding(el.Tag, "", "",
+			fmt.Sprintf("VR %s does not match %s", vr, info.VR)))
+		return
+	}
+
+	// VM
+	if n, ok := valueCount(el); ok && n > 0 && !singleValueVRs[vr] {
+		if !matchVM(info.VM, n) {
+			r.Errors = append(r.Errors, newFinding(el.Tag, "", "",
+				fmt.Sprintf("%d values does not match VM %s", n, info.VM)))
+		}
+	}
+
+	// UIDs
+	if vr == "UI" {
+		strs, _ := el.Value.GetValue().([]string)
+		for _, uid := range strs {
+			uid = strings.TrimRight(uid, " \x00")
+			if uid == "" {
+				continue
+			}
+			if len(uid) > maxUIDLength || !uidPattern.MatchString(uid) {
+				r.Errors = append(r.Errors, newFinding(el.Tag, "", "",
+					fmt.Sprintf("invalid UID %q", uid)))
+			}
+		}
+	}
+}
+
+// valueCount returns the number of values in an element, if it has a value
+// multiplicity
+func valueCount(el *dicom.Element) (int, bool) {
+	switch v := el.Value.GetValue().(type) {
+	case []string:
+		if len(v) == 1 && v[0] == "" {
+			return 0, true
+		}
+		return len(v), true
+	case []int:
+		if el.RawValueRepresentation == "AT" {
+			return len(v) / 2, true
+		}
+		return len(v), true
+	case []float64:
+		return len(v), true
+	}
+	return 0, false
+}
+
+// matchVM returns whether n values matches a value multiplicity such as 1,
+// 1-3, 1-n or 2-2n
+func matchVM(vm string, n int) bool {
+	lo, hi, found := strings.Cut(vm, "-")
+	lower, err := strconv.Atoi(lo)
+	if err != nil {
+		return true
+	}
+	if !found {
+		return n == lower
+	}
+	if n < lower {
+		return false
+	}
+	switch {
+	case hi == "n":
+		return true
+	case strings.HasSuffix(hi, "n"):
+		step, err := strconv.Atoi(strings.TrimSuffix(hi, "n"))
+		return err != nil || n%step == 0
+	}
+	upper, err := strconv.Atoi(hi)
+	return err != nil || n <= upper
+}
+
+// isEmpty returns whether an element has no value
+func isEmpty(el *dicom.Element) bool {
+	switch v := el.Value.GetValue().(type) {
+	case []string:
+		for _, s := range v {
+			if strings.TrimSpace(s) != "" {
+				return false
+			}
+		}
+		return true
+	case []int:
+		return len(v) == 0
+	case []float64:
+		return len(v) == 0
+	case []byte:
+		return len(v) == 0
+	case []*dicom.SequenceItemValue:
+		return len(v) == 0
+	}
+	return false
+}
+
+func newFinding(t tag.Tag, module, typ, msg string) Finding {
+	f := Finding{
+		Tag:     fmt.Sprintf("(%04X,%04X)", t.Group, t.Element),
+		Module:  module,
+		Type:    typ,
+		Message: msg,
+	}
+	if info, err := tag.Find(t); err == nil {
+		f.Name = info.Name
+	}
+	return f
+}
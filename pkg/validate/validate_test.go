@@ -0,0 +1,79 @@
+package validate_test
+
+import (
+	"testing"
+
+	"github.com/johnmarkli/dime/pkg/validate"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+const (
+	testDataPath = "../../testdata/IM000001-mri"
+)
+
+func TestValidate(t *testing.T) {
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+
+	report := validate.Validate(&ds)
+	assert.True(t, report.Valid)
+	assert.Equal(t, "1.2.840.10008.5.1.4.1.1.4", report.SOPClassUID)
+	assert.Equal(t, "MR Image", report.IOD)
+	assert.Empty(t, report.Errors)
+	assert.NoError(t, report.Err())
+}
+
+func TestValidateInvalid(t *testing.T) {
+	ds := dicom.Dataset{Elements: []*dicom.Element{
+		mustNewElement(t, tag.SOPClassUID, []string{"1.2.840.10008.5.1.4.1.1.7"}),
+		mustNewElement(t, tag.SOPInstanceUID, []string{"1.2.03"}),
+		mustNewElement(t, tag.StudyInstanceUID, []string{"1.2.3"}),
+		mustNewElement(t, tag.SeriesInstanceUID, []string{"1.2.3.4"}),
+		mustNewElement(t, tag.Modality, []string{""}),
+		mustNewElement(t, tag.PatientSex, []string{"F", "M"}),
+	}}
+
+	report := validate.Validate(&ds)
+	assert.False(t, report.Valid)
+	assert.Equal(t, "Secondary Capture Image", report.IOD)
+	assert.ErrorIs(t, report.Err(), validate.ErrInvalid)
+
+	messages := map[string]string{}
+	for _, f := range report.Errors {
+		messages[f.Name] = f.Message
+	}
+	assert.Equal(t, "missing type 2 attribute", messages["PatientName"])
+	assert.Equal(t, "missing type 1 attribute", messages["ConversionType"])
+	assert.Equal(t, "empty type 1 attribute", messages["Modality"])
+	assert.Equal(t, `invalid UID "1.2.03"`, messages["SOPInstanceUID"])
+	assert.Equal(t, "2 values does not match VM 1", messages["PatientSex"])
+	assert.NotContains(t, messages, "PlanarConfiguration") // condition not met
+}
+
+func TestValidateUnknownSOPClass(t *testing.T) {
+	ds := dicom.Dataset{Elements: []*dicom.Element{
+		mustNewElement(t, tag.SOPClassUID, []string{"1.2.3"}),
+	}}
+
+	report := validate.Validate(&ds)
+	assert.True(t, report.Valid)
+	assert.Empty(t, report.IOD)
+	assert.Len(t, report.Warnings, 1)
+}
+
+func TestParsePolicy(t *testing.T) {
+	p, err := validate.ParsePolicy("Reject")
+	assert.NoError(t, err)
+	assert.Equal(t, validate.PolicyReject, p)
+
+	_, err = validate.ParsePolicy("ignore")
+	assert.Error(t, err)
+}
+
+func mustNewElement(t *testing.T, tg tag.Tag, data any) *dicom.Element {
+	el, err := dicom.NewElement(tg, data)
+	assert.NoError(t, err)
+	return el
+}
@@ -0,0 +1,253 @@
+// Package watch provides a watched folder that ingests DICOMs dropped in to it
+package watch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/ingest"
+	"github.com/johnmarkli/dime/pkg/jobs"
+)
+
+const (
+	defaultInterval = 5 * time.Second
+	reasonExt       = ".error.txt"
+	tmpExt          = ".tmp"
+)
+
+// Watcher polls an inbox directory for new files and ingests them once they
+// are stable, i.e. their size and modification time are unchanged between
+// two polls. Ingested files are moved to an archive directory and files that
+// fail to ingest are moved to an error directory along with a sidecar file
+// containing the reason. A file that can't be moved out of the inbox is left
+// there and skipped until it changes, so it isn't ingested again.
+type Watcher struct {
+	inbox      string
+	archiveDir string
+	errorDir   string
+	ingester   *ingest.Ingester
+	interval   time.Duration
+
+	seen  map[string]fileState
+	stuck map[string]fileState
+	quit  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// fileState is the state of a file when it was last polled
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// Option configures a Watcher
+type Option func(*Watcher)
+
+// WithInterval sets how often the inbox is polled
+func WithInterval(d time.Duration) Option {
+	return func(w *Watcher) {
+		w.interval = d
+	}
+}
+
+// New creates a Watcher, creating its directories if they don't exist
+func New(inbox, archiveDir, errorDir string, ingester *ingest.Ingester, opts ...Option) (*Watcher, error) {
+	w := &Watcher{
+		inbox:      inbox,
+		archiveDir: archiveDir,
+		errorDir:   errorDir,
+		ingester:   ingester,
+		interval:   defaultInterval,
+		seen:       map[string]fileState{},
+		stuck:      map[string]fileState{},
+		quit:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	for _, dir := range []string{inbox, archiveDir, errorDir} {
+		err := os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+	return w, nil
+}
+
+// Start polling the inbox
+func (w *Watcher) Start() {
+	slog.Info("Watching inbox", slog.String("dir", w.inbox))
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.quit:
+				return
+			case <-ticker.C:
+				w.poll()
+			}
+		}
+	}()
+}
+
+// Stop polling the inbox, waiting for the file being ingested to finish
+func (w *Watcher) Stop() {
+	close(w.quit)
+	w.wg.Wait()
+}
+
+// poll the inbox and ingest the files that are stable
+func (w *Watcher) poll() {
+	entries, err := os.ReadDir(w.inbox)
+	if err != nil {
+		slog.Error("Failed to read inbox", slog.String("error", err.Error()))
+		return
+	}
+	seen := map[string]fileState{}
+	stuck := map[string]fileState{}
+	for _, e := range entries {
+		// Skip directories and hidden files, which are often partial copies
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		state := fileState{size: fi.Size(), modTime: fi.ModTime()}
+		if prev, ok := w.stuck[e.Name()]; ok && prev == state {
+			stuck[e.Name()] = state
+			continue
+		}
+		if prev, ok := w.seen[e.Name()]; !ok || prev != state {
+			seen[e.Name()] = state
+			continue
+		}
+		if !w.ingest(e.Name()) {
+			stuck[e.Name()] = state
+		}
+	}
+	w.seen = seen
+	w.stuck = stuck
+}
+
+// ingest a file from the inbox and move it out of the inbox, returning
+// whether it was moved
+func (w *Watcher) ingest(name string) bool {
+	path := filepath.Join(w.inbox, name)
+	ingestErr := w.ingestFile(path)
+	if ingestErr != nil {
+		slog.Error("Failed to ingest inbox file",
+			slog.String("file", name),
+			slog.String("error", ingestErr.Error()))
+		dest, err := move(path, w.errorDir)
+		if err != nil {
+			slog.Error("Failed to move inbox file", slog.String("file", name), slog.String("error", err.Error()))
+			return false
+		}
+		err = os.WriteFile(dest+reasonExt, []byte(ingestErr.Error()+"\n"), 0600)
+		if err != nil {
+			slog.Error(err.Error())
+		}
+		return true
+	}
+	slog.Info("Ingested inbox file", slog.String("file", name))
+	_, err := move(path, w.archiveDir)
+	if err != nil {
+		slog.Error("Failed to move inbox file", slog.String("file", name), slog.String("error", err.Error()))
+		return false
+	}
+	return true
+}
+
+// ingestFile ingests a DICOM or archive of DICOMs, failing if any DICOM fails
+// to ingest
+func (w *Watcher) ingestFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	var results []ingest.Result
+	switch jobs.KindOf("", path) {
+	case jobs.KindZip:
+		results, err = w.ingester.IngestZip(f)
+	case jobs.KindTar:
+		results, err = w.ingester.IngestTar(f)
+	default:
+		_, err = w.ingester.Ingest(f)
+	}
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	for _, res := range results {
+		if res.Error != "" {
+			errs = append(errs, fmt.Errorf("%s: %s", res.File, res.Error))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// move a file in to a directory, adding a timestamp to its name if a file
+// with the same name already exists there. A file can't be renamed to another
+// file system, as when the inbox is a share, so it is copied and removed
+// instead.
+func move(path, dir string) (string, error) {
+	dest := filepath.Join(dir, filepath.Base(path))
+	if _, err := os.Stat(dest); err == nil {
+		dest = fmt.Sprintf("%s.%d", dest, time.Now().UnixNano())
+	}
+	err := os.Rename(path, dest)
+	if errors.Is(err, syscall.EXDEV) {
+		err = copyFile(path, dest)
+		if err == nil {
+			err = os.Remove(path)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to move file: %w", err)
+	}
+	return dest, nil
+}
+
+// copyFile copies a file to a synced temp file that is renamed to dest, so
+// dest is never a partial copy
+func copyFile(path, dest string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := dest + tmpExt
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, src)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package watch_test
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/ingest"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/johnmarkli/dime/pkg/watch"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testID       = "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000395"
+	testDataPath = "../../testdata/IM000001-mri"
+)
+
+func TestWatcher(t *testing.T) {
+	dir := t.TempDir()
+	inbox := filepath.Join(dir, "inbox")
+	archiveDir := filepath.Join(dir, "archive")
+	errorDir := filepath.Join(dir, "error")
+
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	w, err := watch.New(inbox, archiveDir, errorDir, ingest.New(st),
+		watch.WithInterval(10*time.Millisecond))
+	assert.NoError(t, err)
+	w.Start()
+	defer w.Stop()
+
+	// Drop a DICOM and a file that isn't a DICOM in to the inbox
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(inbox, "IM000001"), b, 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(inbox, "notes.txt"), []byte("not a dicom"), 0600))
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(archiveDir, "IM000001"))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = st.Read(testID)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(errorDir, "notes.txt.error.txt"))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = os.Stat(filepath.Join(errorDir, "notes.txt"))
+	assert.NoError(t, err)
+
+	entries, err := os.ReadDir(inbox)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestWatcherMoveFailed(t *testing.T) {
+	dir := t.TempDir()
+	inbox := filepath.Join(dir, "inbox")
+	archiveDir := filepath.Join(dir, "archive")
+	errorDir := filepath.Join(dir, "error")
+
+	var ingested atomic.Int32
+	st, err := store.NewMemStore()
+	assert.NoError(t, err)
+	w, err := watch.New(inbox, archiveDir, errorDir,
+		ingest.New(st, ingest.WithHook(func(*store.DICOM, string) { ingested.Add(1) })),
+		watch.WithInterval(10*time.Millisecond))
+	assert.NoError(t, err)
+
+	// Replace the archive directory with a file so ingested files can't be
+	// moved in to it
+	assert.NoError(t, os.Remove(archiveDir))
+	assert.NoError(t, os.WriteFile(archiveDir, nil, 0600))
+	w.Start()
+	defer w.Stop()
+
+	b, err := os.ReadFile(testDataPath)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(inbox, "IM000001"), b, 0600))
+
+	// The file is ingested once and left in the inbox
+	assert.Eventually(t, func() bool {
+		return ingested.Load() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), ingested.Load())
+	_, err = os.Stat(filepath.Join(inbox, "IM000001"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,96 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+)
+
+// Config is the webhook subscriptions events are delivered to
+type Config struct {
+	Subscriptions []Subscription `json:"subscriptions"`
+}
+
+// Subscription delivers the events of its types that match its filter to a
+// URL, signed with its secret. A subscription with no events receives every
+// type.
+type Subscription struct {
+	Name    string            `json:"name" example:"ai"`
+	URL     string            `json:"url" example:"https://ai.example.com/dime"`
+	Secret  string            `json:"secret,omitempty"`
+	Events  []string          `json:"events,omitempty" example:"instance.stored,series.stable"`
+	Filter  Filter            `json:"filter"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Filter selects the events a subscription receives. Each field that is set
+// must equal the event's, so a study.deleted event, which has only a study,
+// never matches a filter on modality, SOP class or series. An empty Filter
+// matches every event.
+type Filter struct {
+	Modality          string `json:"modality,omitempty" example:"CT"`
+	SOPClassUID       string `json:"sopClassUID,omitempty" example:"1.2.840.10008.5.1.4.1.1.2"`
+	StudyInstanceUID  string `json:"studyInstanceUID,omitempty"`
+	SeriesInstanceUID string `json:"seriesInstanceUID,omitempty"`
+}
+
+// Load a Config from a JSON file
+func Load(file string) (*Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook subscriptions: %w", err)
+	}
+	var cfg Config
+	err = json.Unmarshal(b, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse webhook subscriptions: %w", err)
+	}
+	return &cfg, nil
+}
+
+// compile validates the subscriptions of a Config
+func compile(cfg *Config) (map[string]Subscription, error) {
+	subs := map[string]Subscription{}
+	for i, s := range cfg.Subscriptions {
+		if s.Name == "" {
+			return nil, fmt.Errorf("subscription %d: name is required", i+1)
+		}
+		if _, ok := subs[s.Name]; ok {
+			return nil, fmt.Errorf("%s: duplicate subscription", s.Name)
+		}
+		u, err := url.Parse(s.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s: invalid url %q", s.Name, s.URL)
+		}
+		if s.Secret == "" {
+			return nil, fmt.Errorf("%s: secret is required", s.Name)
+		}
+		for _, e := range s.Events {
+			if !slices.Contains(eventTypes, e) {
+				return nil, fmt.Errorf("%s: unknown event %q", s.Name, e)
+			}
+		}
+		subs[s.Name] = s
+	}
+	return subs, nil
+}
+
+// matches returns whether a subscription receives an event
+func (s *Subscription) matches(e *Event) bool {
+	if len(s.Events) > 0 && !slices.Contains(s.Events, e.Type) {
+		return false
+	}
+	for _, f := range [][2]string{
+		{s.Filter.Modality, e.Modality},
+		{s.Filter.SOPClassUID, e.SOPClassUID},
+		{s.Filter.StudyInstanceUID, e.StudyInstanceUID},
+		{s.Filter.SeriesInstanceUID, e.SeriesInstanceUID},
+	} {
+		if f[0] != "" && f[0] != f[1] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,707 @@
+// Package webhook delivers events of the store to subscribed URLs
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/changes"
+)
+
+// Types of event
+const (
+	// InstanceStored is a DICOM stored or stored again
+	InstanceStored = "instance.stored"
+	// SeriesStable is a series that has stopped receiving instances
+	SeriesStable = "series.stable"
+	// StudyStable is a study that has stopped receiving instances
+	StudyStable = "study.stable"
+	// StudyDeleted is a study whose last instance was deleted
+	StudyDeleted = "study.deleted"
+)
+
+// Headers of a delivery
+const (
+	// EventHeader is the type of the event delivered
+	EventHeader = "X-Dime-Event"
+	// DeliveryHeader is the ID of the delivery, which is the same for each
+	// attempt
+	DeliveryHeader = "X-Dime-Delivery"
+	// TimestampHeader is the Unix time the delivery was signed
+	TimestampHeader = "X-Dime-Timestamp"
+	// SignatureHeader is the signature of the delivery, see Sign
+	SignatureHeader = "X-Dime-Signature"
+)
+
+const (
+	defaultMaxAttempts = 10
+	defaultBackoff     = 30 * time.Second
+	maxBackoff         = time.Hour
+	sendTimeout        = 30 * time.Second
+	idleWait           = time.Hour
+	maxDelivered       = 1000
+	pageLimit          = 1000
+	maxErrorBody       = 512
+	deliveriesDir      = "deliveries"
+	checkpointFile     = "checkpoint.json"
+	deliveryExt        = ".json"
+)
+
+var (
+	// ErrNotFound is an error for a delivery that is not found
+	ErrNotFound = errors.New("not found")
+
+	eventTypes = []string{InstanceStored, SeriesStable, StudyStable, StudyDeleted}
+)
+
+// State is the state of a delivery
+type State string
+
+const (
+	// StatePending is a delivery waiting to be sent or retried
+	StatePending State = "pending"
+	// StateDelivered is a delivery the subscriber accepted
+	StateDelivered State = "delivered"
+	// StateFailed is a delivery that was not accepted after the maximum
+	// number of attempts
+	StateFailed State = "failed"
+)
+
+// Event is something that happened in the store. The ID of an event is the
+// same if it is delivered again after a restart, so subscribers can ignore
+// duplicates.
+type Event struct {
+	ID                string    `json:"id" example:"instance.stored-42"`
+	Type              string    `json:"type" example:"instance.stored"`
+	Time              time.Time `json:"time"`
+	SOPInstanceUID    string    `json:"sopInstanceUID,omitempty" example:"1.3.12.2.1107.5.2.6.24119.30000013121716094326500000436"`
+	StudyInstanceUID  string    `json:"studyInstanceUID" example:"1.2.840.114202.4.833393677.4209323108.691055951.3610221745"`
+	SeriesInstanceUID string    `json:"seriesInstanceUID,omitempty" example:"1.3.12.2.1107.5.2.6.24119.30000013121716094326500000394"`
+	Modality          string    `json:"modality,omitempty" example:"MR"`
+	SOPClassUID       string    `json:"sopClassUID,omitempty" example:"1.2.840.10008.5.1.4.1.1.4"`
+	SHA256            string    `json:"sha256,omitempty" example:"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"`
+	Instances         int       `json:"instances,omitempty" example:"24"`
+}
+
+// Delivery is an event to be delivered to a subscription. Pending and failed
+// deliveries are kept until they are delivered, and the last 1000 delivered
+// are kept as a log.
+type Delivery struct {
+	ID           string     `json:"id" example:"5f0c6b1e3a2d4c8e9b7a6f5e4d3c2b1a"`
+	Subscription string     `json:"subscription" example:"ai"`
+	Event        Event      `json:"event"`
+	State        State      `json:"state" example:"pending"`
+	Attempts     int        `json:"attempts" example:"1"`
+	StatusCode   int        `json:"statusCode,omitempty" example:"503"`
+	Error        string     `json:"error,omitempty"`
+	NextAttempt  time.Time  `json:"nextAttempt"`
+	Created      time.Time  `json:"created"`
+	Updated      time.Time  `json:"updated"`
+	Delivered    *time.Time `json:"delivered,omitempty"`
+}
+
+// checkpoint is the sequence number of the last change turned in to events
+type checkpoint struct {
+	Seq uint64 `json:"seq"`
+}
+
+// Dispatcher delivers events to the subscriptions that match them. It
+// follows a change log for instances stored and studies deleted, and is
+// notified of other events. Deliveries are journaled to a directory so they
+// survive a restart, and failed deliveries are retried with exponential
+// backoff.
+type Dispatcher struct {
+	dir         string
+	log         *changes.Log
+	subs        map[string]Subscription
+	maxAttempts int
+	backoff     time.Duration
+	client      *http.Client
+
+	mu         sync.Mutex
+	deliveries map[string]*Delivery
+	wake       map[string]chan struct{}
+	seq        uint64
+	instances  map[string]string
+	studies    map[string]int
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+// Option configures a Dispatcher
+type Option func(*Dispatcher)
+
+// WithMaxAttempts sets the number of attempts to deliver an event before its
+// delivery fails
+func WithMaxAttempts(n int) Option {
+	return func(d *Dispatcher) {
+		d.maxAttempts = n
+	}
+}
+
+// WithBackoff sets the delay before the first retry, which doubles with each
+// attempt up to an hour
+func WithBackoff(b time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.backoff = b
+	}
+}
+
+// WithClient sets the HTTP client of deliveries
+func WithClient(c *http.Client) Option {
+	return func(d *Dispatcher) {
+		d.client = c
+	}
+}
+
+// New creates a Dispatcher journaled in dir of the events of a change log,
+// recovering any deliveries from a previous run. Without a previous run,
+// events are delivered from the end of the log.
+func New(dir string, log *changes.Log, cfg *Config, opts ...Option) (*Dispatcher, error) {
+	subs, err := compile(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook subscriptions: %w", err)
+	}
+	d := &Dispatcher{
+		dir:         dir,
+		log:         log,
+		subs:        subs,
+		maxAttempts: defaultMaxAttempts,
+		backoff:     defaultBackoff,
+		client:      http.DefaultClient,
+		deliveries:  map[string]*Delivery{},
+		wake:        map[string]chan struct{}{},
+		instances:   map[string]string{},
+		studies:     map[string]int{},
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for name := range subs {
+		d.wake[name] = make(chan struct{}, 1)
+	}
+	err = os.MkdirAll(filepath.Join(dir, deliveriesDir), os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	err = d.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// Count the instances of each study up to the checkpoint
+	b, err := os.ReadFile(filepath.Join(dir, checkpointFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	end := log.Last()
+	if err == nil {
+		var cp checkpoint
+		err = json.Unmarshal(b, &cp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse checkpoint: %w", err)
+		}
+		end = cp.Seq
+	}
+	for d.seq < end {
+		page := log.Since(d.seq, pageLimit)
+		for _, e := range page.Changes {
+			if e.Seq > end {
+				break
+			}
+			d.count(e)
+			d.seq = e.Seq
+		}
+		if len(page.Changes) == 0 {
+			break
+		}
+	}
+	d.seq = end
+	return d, d.writeCheckpoint()
+}
+
+// Start following the change log and a worker for each subscription
+func (d *Dispatcher) Start() {
+	d.wg.Add(1)
+	go d.follow()
+	for name := range d.subs {
+		d.wg.Add(1)
+		go d.work(name)
+	}
+}
+
+// Stop following the change log and the workers, cancelling any deliveries
+// in progress. Pending deliveries remain in the journal.
+func (d *Dispatcher) Stop() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+// Notify queues deliveries of an event to the subscriptions that match it
+func (d *Dispatcher) Notify(e Event) {
+	for name, s := range d.subs {
+		if !s.matches(&e) {
+			continue
+		}
+		err := d.queue(name, e)
+		if err != nil {
+			slog.Error("Failed to queue delivery",
+				slog.String("event", e.ID),
+				slog.String("subscription", name),
+				slog.String("error", err.Error()))
+		}
+	}
+}
+
+// List the deliveries in the order they were created, optionally only those
+// to a subscription or in a state
+func (d *Dispatcher) List(subscription string, state State) []*Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	deliveries := []*Delivery{}
+	for _, dl := range d.deliveries {
+		if (subscription == "" || dl.Subscription == subscription) && (state == "" || dl.State == state) {
+			c := *dl
+			deliveries = append(deliveries, &c)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Created.Before(deliveries[j].Created)
+	})
+	return deliveries
+}
+
+// Get a delivery by ID
+func (d *Dispatcher) Get(id string) (*Delivery, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dl, ok := d.deliveries[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *dl
+	return &c, nil
+}
+
+// Retry a delivery now. A failed or delivered delivery is given a fresh set
+// of attempts.
+func (d *Dispatcher) Retry(id string) (*Delivery, error) {
+	dl, err := d.update(id, func(dl *Delivery) {
+		if dl.State != StatePending {
+			dl.State = StatePending
+			dl.Attempts = 0
+		}
+		dl.NextAttempt = time.Now().UTC()
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.notify(dl.Subscription)
+	return dl, nil
+}
+
+// Sign returns the signature of a delivery body at a Unix timestamp with a
+// secret, the hex HMAC-SHA256 of the timestamp, a period and the body
+// prefixed with "sha256="
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%d.", timestamp)
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// follow the change log, queueing deliveries of its events
+func (d *Dispatcher) follow() {
+	defer d.wg.Done()
+	for {
+		page := d.log.Since(d.seq, pageLimit)
+		for _, e := range page.Changes {
+			for _, event := range d.count(e) {
+				d.Notify(event)
+			}
+			d.seq = e.Seq
+		}
+		if len(page.Changes) > 0 {
+			err := d.writeCheckpoint()
+			if err != nil {
+				slog.Error(err.Error())
+			}
+			continue
+		}
+		if !d.log.Wait(d.ctx, d.seq) {
+			return
+		}
+	}
+}
+
+// count the instances of the study of a change, returning its events
+func (d *Dispatcher) count(e changes.Event) []Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch e.Type {
+	case changes.Created, changes.Updated:
+		if _, ok := d.instances[e.ID]; !ok {
+			d.instances[e.ID] = e.StudyInstanceUID
+			d.studies[e.StudyInstanceUID]++
+		}
+		return []Event{{
+			ID:                fmt.Sprintf("%s-%d", InstanceStored, e.Seq),
+			Type:              InstanceStored,
+			Time:              e.Time,
+			SOPInstanceUID:    e.ID,
+			StudyInstanceUID:  e.StudyInstanceUID,
+			SeriesInstanceUID: e.SeriesInstanceUID,
+			Modality:          e.Modality,
+			SOPClassUID:       e.SOPClassUID,
+			SHA256:            e.SHA256,
+		}}
+	case changes.Deleted:
+		study, ok := d.instances[e.ID]
+		if !ok {
+			return nil
+		}
+		delete(d.instances, e.ID)
+		d.studies[study]--
+		if d.studies[study] > 0 {
+			return nil
+		}
+		delete(d.studies, study)
+		return []Event{{
+			ID:               fmt.Sprintf("%s-%d", StudyDeleted, e.Seq),
+			Type:             StudyDeleted,
+			Time:             e.Time,
+			StudyInstanceUID: study,
+		}}
+	}
+	return nil
+}
+
+// queue a delivery of an event to a subscription
+func (d *Dispatcher) queue(subscription string, e Event) error {
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	dl := &Delivery{
+		ID:           id,
+		Subscription: subscription,
+		Event:        e,
+		State:        StatePending,
+		NextAttempt:  now,
+		Created:      now,
+		Updated:      now,
+	}
+	err = d.save(dl)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.deliveries[id] = dl
+	d.mu.Unlock()
+	d.notify(subscription)
+	return nil
+}
+
+// notify the worker of a subscription that a delivery is due
+func (d *Dispatcher) notify(subscription string) {
+	select {
+	case d.wake[subscription] <- struct{}{}:
+	default:
+	}
+}
+
+// work sends the deliveries to a subscription as they become due
+func (d *Dispatcher) work(subscription string) {
+	defer d.wg.Done()
+	for {
+		if d.ctx.Err() != nil {
+			return
+		}
+		dl, wait := d.next(subscription)
+		if dl != nil {
+			d.send(dl)
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-d.ctx.Done():
+		case <-d.wake[subscription]:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// next returns the next due delivery to a subscription, or how long to wait
+// until one is due
+func (d *Dispatcher) next(subscription string) (*Delivery, time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var next *Delivery
+	for _, dl := range d.deliveries {
+		if dl.Subscription != subscription || dl.State != StatePending {
+			continue
+		}
+		if next == nil || dl.NextAttempt.Before(next.NextAttempt) ||
+			dl.NextAttempt.Equal(next.NextAttempt) && dl.Created.Before(next.Created) {
+			next = dl
+		}
+	}
+	if next == nil {
+		return nil, idleWait
+	}
+	if wait := time.Until(next.NextAttempt); wait > 0 {
+		return nil, wait
+	}
+	c := *next
+	return &c, 0
+}
+
+// send a delivery, logging it once delivered or scheduling a retry
+func (d *Dispatcher) send(dl *Delivery) {
+	status, err := d.post(dl)
+	if err != nil && d.ctx.Err() != nil {
+		// stopped while sending, retry on next start
+		return
+	}
+	updated, _ := d.update(dl.ID, func(dl *Delivery) {
+		dl.Attempts++
+		dl.StatusCode = status
+		if err == nil {
+			now := time.Now().UTC()
+			dl.State = StateDelivered
+			dl.Error = ""
+			dl.Delivered = &now
+			return
+		}
+		dl.Error = err.Error()
+		if dl.Attempts >= d.maxAttempts {
+			dl.State = StateFailed
+			return
+		}
+		dl.NextAttempt = time.Now().UTC().Add(d.delay(dl.Attempts))
+	})
+	if updated == nil {
+		return
+	}
+	if err == nil {
+		slog.Info("Delivered event",
+			slog.String("event", dl.Event.ID),
+			slog.String("subscription", dl.Subscription))
+		d.prune()
+		return
+	}
+	slog.Warn("Failed to deliver event",
+		slog.String("event", dl.Event.ID),
+		slog.String("subscription", dl.Subscription),
+		slog.Int("attempts", updated.Attempts),
+		slog.String("state", string(updated.State)),
+		slog.String("error", err.Error()))
+}
+
+// post the event of a delivery to its subscription, returning the status code
+// of the response
+func (d *Dispatcher) post(dl *Delivery) (int, error) {
+	s := d.subs[dl.Subscription]
+	body, err := json.Marshal(dl.Event)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal event: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(d.ctx, sendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, dl.Event.Type)
+	req.Header.Set(DeliveryHeader, dl.ID)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(s.Secret, timestamp, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to deliver event: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return resp.StatusCode, fmt.Errorf("subscriber responded %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp.StatusCode, nil
+}
+
+// delay returns the backoff before retrying after a number of attempts
+func (d *Dispatcher) delay(attempts int) time.Duration {
+	b := d.backoff
+	for range attempts - 1 {
+		b *= 2
+		if b >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return b
+}
+
+// prune the oldest delivered deliveries beyond the last 1000
+func (d *Dispatcher) prune() {
+	d.mu.Lock()
+	delivered := []*Delivery{}
+	for _, dl := range d.deliveries {
+		if dl.State == StateDelivered {
+			delivered = append(delivered, dl)
+		}
+	}
+	if len(delivered) <= maxDelivered {
+		d.mu.Unlock()
+		return
+	}
+	sort.Slice(delivered, func(i, j int) bool {
+		return delivered[i].Updated.Before(delivered[j].Updated)
+	})
+	pruned := delivered[:len(delivered)-maxDelivered]
+	for _, dl := range pruned {
+		delete(d.deliveries, dl.ID)
+	}
+	d.mu.Unlock()
+	for _, dl := range pruned {
+		os.Remove(d.deliveryPath(dl.ID))
+	}
+}
+
+// update a delivery and journal it
+func (d *Dispatcher) update(id string, fn func(*Delivery)) (*Delivery, error) {
+	d.mu.Lock()
+	dl, ok := d.deliveries[id]
+	if !ok {
+		d.mu.Unlock()
+		return nil, ErrNotFound
+	}
+	fn(dl)
+	dl.Updated = time.Now().UTC()
+	c := *dl
+	d.mu.Unlock()
+
+	err := d.save(&c)
+	if err != nil {
+		slog.Error(err.Error())
+	}
+	return &c, nil
+}
+
+// save a delivery to the journal, replacing the previous entry atomically
+func (d *Dispatcher) save(dl *Delivery) error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery: %w", err)
+	}
+	tmp := d.deliveryPath(dl.ID) + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write delivery: %w", err)
+	}
+	err = os.Rename(tmp, d.deliveryPath(dl.ID))
+	if err != nil {
+		return fmt.Errorf("failed to write delivery: %w", err)
+	}
+	return nil
+}
+
+// load deliveries from the journal. Pending deliveries to subscriptions that
+// are no longer configured fail.
+func (d *Dispatcher) load() error {
+	dir := filepath.Join(d.dir, deliveriesDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read delivery directory: %w", err)
+	}
+	pending := 0
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), deliveryExt) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read delivery: %w", err)
+		}
+		var dl Delivery
+		err = json.Unmarshal(b, &dl)
+		if err != nil {
+			slog.Error("Skipping unreadable delivery", slog.String("file", e.Name()))
+			continue
+		}
+		if _, ok := d.subs[dl.Subscription]; !ok && dl.State == StatePending {
+			dl.State = StateFailed
+			dl.Error = fmt.Sprintf("subscription %q is not configured", dl.Subscription)
+			dl.Updated = time.Now().UTC()
+			err = d.save(&dl)
+			if err != nil {
+				return err
+			}
+		}
+		if dl.State == StatePending {
+			pending++
+		}
+		d.deliveries[dl.ID] = &dl
+	}
+	if pending > 0 {
+		slog.Info("Recovered deliveries", slog.Int("pending", pending))
+	}
+	return nil
+}
+
+// writeCheckpoint writes the checkpoint to a temp file and renames it in to
+// place
+func (d *Dispatcher) writeCheckpoint() error {
+	b, err := json.Marshal(checkpoint{Seq: d.seq})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(d.dir, checkpointFile)
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return nil
+}
+
+func (d *Dispatcher) deliveryPath(id string) string {
+	return filepath.Join(d.dir, deliveriesDir, id+deliveryExt)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,163 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/johnmarkli/dime/pkg/changes"
+	"github.com/johnmarkli/dime/pkg/store"
+	"github.com/johnmarkli/dime/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+	"github.com/suyashkumar/dicom"
+)
+
+const (
+	testDataPath = "../../testdata/IM000001-mri"
+	testID       = "1.3.12.2.1107.5.2.6.24119.30000013121716094326500000395"
+	testSecret   = "s3cret"
+)
+
+// subscriber is a stand-in subscriber that fails the first failures
+// deliveries and records the events of those it accepts
+type subscriber struct {
+	t        *testing.T
+	mu       sync.Mutex
+	failures int
+	events   []webhook.Event
+}
+
+func (s *subscriber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	assert.NoError(s.t, err)
+	timestamp, err := strconv.ParseInt(r.Header.Get(webhook.TimestampHeader), 10, 64)
+	assert.NoError(s.t, err)
+	assert.Equal(s.t, webhook.Sign(testSecret, timestamp, body), r.Header.Get(webhook.SignatureHeader))
+	assert.NotEmpty(s.t, r.Header.Get(webhook.DeliveryHeader))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var e webhook.Event
+	assert.NoError(s.t, json.Unmarshal(body, &e))
+	assert.Equal(s.t, e.Type, r.Header.Get(webhook.EventHeader))
+	s.events = append(s.events, e)
+}
+
+func (s *subscriber) received() []webhook.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]webhook.Event{}, s.events...)
+}
+
+func TestDispatcher(t *testing.T) {
+	l, err := changes.New(t.TempDir())
+	assert.NoError(t, err)
+	defer l.Close()
+	mem, err := store.NewMemStore()
+	assert.NoError(t, err)
+	st := l.Wrap(mem)
+	ds, err := dicom.ParseFile(testDataPath, nil)
+	assert.NoError(t, err)
+	dcm, err := store.NewDICOM(&ds)
+	assert.NoError(t, err)
+
+	// DICOMs stored before the first run aren't delivered
+	assert.NoError(t, st.Create(dcm))
+
+	all := &subscriber{t: t, failures: 1}
+	allSrv := httptest.NewServer(all)
+	defer allSrv.Close()
+	ct := &subscriber{t: t}
+	ctSrv := httptest.NewServer(ct)
+	defer ctSrv.Close()
+	cfg := &webhook.Config{Subscriptions: []webhook.Subscription{
+		{Name: "all", URL: allSrv.URL, Secret: testSecret},
+		{Name: "ct", URL: ctSrv.URL, Secret: testSecret, Events: []string{webhook.InstanceStored}, Filter: webhook.Filter{Modality: "CT"}},
+	}}
+
+	_, err = webhook.New(t.TempDir(), l, &webhook.Config{Subscriptions: []webhook.Subscription{{Name: "x", URL: "ftp://x", Secret: testSecret}}})
+	assert.Error(t, err)
+	_, err = webhook.New(t.TempDir(), l, &webhook.Config{Subscriptions: []webhook.Subscription{{Name: "x", URL: allSrv.URL}}})
+	assert.Error(t, err)
+	_, err = webhook.New(t.TempDir(), l, &webhook.Config{Subscriptions: []webhook.Subscription{{Name: "x", URL: allSrv.URL, Secret: testSecret, Events: []string{"x"}}}})
+	assert.Error(t, err)
+
+	// Events are delivered to the subscriptions they match, retrying
+	// failures
+	dir := t.TempDir()
+	d, err := webhook.New(dir, l, cfg, webhook.WithBackoff(10*time.Millisecond))
+	assert.NoError(t, err)
+	d.Start()
+	assert.NoError(t, st.Create(dcm))
+	assert.NoError(t, st.Delete(testID))
+	d.Notify(webhook.Event{ID: "series.stable-1", Type: webhook.SeriesStable, StudyInstanceUID: dcm.StudyInstanceUID, SeriesInstanceUID: dcm.SeriesInstanceUID})
+	assert.Eventually(t, func() bool {
+		return len(all.received()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	types := map[string]webhook.Event{}
+	for _, e := range all.received() {
+		types[e.Type] = e
+	}
+	assert.Equal(t, testID, types[webhook.InstanceStored].SOPInstanceUID)
+	assert.Equal(t, "MR", types[webhook.InstanceStored].Modality)
+	assert.Equal(t, dcm.StudyInstanceUID, types[webhook.StudyDeleted].StudyInstanceUID)
+	assert.Contains(t, types, webhook.SeriesStable)
+	assert.Empty(t, ct.received())
+
+	// Deliveries are logged
+	assert.Eventually(t, func() bool {
+		return len(d.List("all", webhook.StateDelivered)) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	deliveries := d.List("", "")
+	assert.Len(t, deliveries, 3)
+	retried := 0
+	for _, dl := range deliveries {
+		retried += dl.Attempts - 1
+		assert.NotNil(t, dl.Delivered)
+	}
+	assert.Equal(t, 1, retried)
+	d.Stop()
+
+	// Pending deliveries are retried after a restart
+	allSrv.Close()
+	d, err = webhook.New(dir, l, cfg, webhook.WithBackoff(time.Hour))
+	assert.NoError(t, err)
+	d.Start()
+	assert.NoError(t, st.Create(dcm))
+	assert.Eventually(t, func() bool {
+		p := d.List("all", webhook.StatePending)
+		return len(p) == 1 && p[0].Attempts == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	pending := d.List("all", webhook.StatePending)[0]
+	assert.NotEmpty(t, pending.Error)
+	d.Stop()
+
+	restarted := &subscriber{t: t}
+	restartedSrv := httptest.NewServer(restarted)
+	defer restartedSrv.Close()
+	cfg.Subscriptions[0].URL = restartedSrv.URL
+	d, err = webhook.New(dir, l, cfg)
+	assert.NoError(t, err)
+	d.Start()
+	defer d.Stop()
+	_, err = d.Retry(pending.ID)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return len(restarted.received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, webhook.InstanceStored, restarted.received()[0].Type)
+	delivered, err := d.Get(pending.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, webhook.StateDelivered, delivered.State)
+	_, err = d.Get("missing")
+	assert.ErrorIs(t, err, webhook.ErrNotFound)
+}